@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -69,6 +70,15 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+const (
+	// metricsFlushPeriod is the period at which the cache reports the metrics
+	// of the ClusterQueues that it batches.
+	metricsFlushPeriod = 5 * time.Second
+	// usageSamplePeriod is the period at which the cache samples the usage of
+	// the ClusterQueues for their usage trend.
+	usageSamplePeriod = time.Minute
+)
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(schedulingv1.AddToScheme(scheme))
@@ -97,6 +107,18 @@ func main() {
 	var featureGates string
 	flag.StringVar(&featureGates, "feature-gates", "", "A set of key=value pairs that describe feature gates for alpha/experimental features.")
 
+	var clusterQueueMetricLabels string
+	flag.StringVar(&clusterQueueMetricLabels, "cluster-queue-metric-labels", "",
+		"A comma separated list of ClusterQueue label keys to add as labels to the ClusterQueue metrics.")
+
+	var conservativeWarmup bool
+	flag.BoolVar(&conservativeWarmup, "conservative-warmup", false,
+		"Refuse the workloads that need to borrow from the cohort until the cache accounts all the admitted workloads that exist at startup.")
+
+	var batchClusterQueueMetrics bool
+	flag.BoolVar(&batchClusterQueueMetrics, "batch-cluster-queue-metrics", false,
+		"Report the ClusterQueue metrics that change on every admission periodically instead of on every change.")
+
 	opts := zap.Options{
 		TimeEncoder: zapcore.RFC3339NanoTimeEncoder,
 		ZapOpts:     []zaplog.Option{zaplog.AddCaller()},
@@ -118,6 +140,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	var cqLabelKeys []string
+	if clusterQueueMetricLabels != "" {
+		cqLabelKeys = strings.Split(clusterQueueMetricLabels, ",")
+	}
+	if err := metrics.SetClusterQueueLabelKeys(cqLabelKeys...); err != nil {
+		setupLog.Error(err, "Unable to set the ClusterQueue metric labels")
+		os.Exit(1)
+	}
 	metrics.Register()
 
 	kubeConfig := ctrl.GetConfigOrDie()
@@ -144,7 +174,13 @@ func main() {
 		close(certsReady)
 	}
 
-	cCache := cache.New(mgr.GetClient(), cache.WithPodsReadyTracking(blockForPodsReady(&cfg)))
+	cCache := cache.New(mgr.GetClient(),
+		cache.WithPodsReadyTracking(blockForPodsReady(&cfg)),
+		cache.WithEventRecorder(mgr.GetEventRecorderFor(constants.KueueName+"-cache")),
+		cache.WithConservativeWarmup(conservativeWarmup),
+		cache.WithBatchedMetrics(batchClusterQueueMetrics),
+		cache.WithRetainedLabels(cqLabelKeys...),
+	)
 	queues := queue.NewManager(mgr.GetClient(), cCache)
 
 	ctx := ctrl.SetupSignalHandler()
@@ -162,6 +198,14 @@ func main() {
 	go func() {
 		cCache.CleanUpOnContext(ctx)
 	}()
+	if batchClusterQueueMetrics {
+		go func() {
+			cCache.RunMetricsFlusher(ctx, metricsFlushPeriod)
+		}()
+	}
+	go func() {
+		cCache.RunUsageSampler(ctx, usageSamplePeriod)
+	}()
 
 	setupScheduler(mgr, cCache, queues, &cfg)
 
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"math"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	"sigs.k8s.io/kueue/pkg/workload"
+)
+
+// FlavorAssigner chooses a flavor of a resource group for the requests of a
+// workload. The flavor assigner of the scheduler evaluates the chosen flavor
+// first; see PreferredFlavor.
+type FlavorAssigner interface {
+	// Assign returns the quantities to take from the chosen flavor for the
+	// requests, which are all covered by the resource group, or nil if no
+	// flavor fits them.
+	Assign(rg *ResourceGroup, requests workload.Requests, usage FlavorResourceQuantities) FlavorResourceQuantities
+}
+
+// FlavorFits returns whether the requests fit in the nominal quota of the
+// flavor that isn't used yet.
+func FlavorFits(flvQuotas *FlavorQuotas, requests workload.Requests, usage FlavorResourceQuantities) bool {
+	for rName, v := range requests {
+		rQuota, defined := flvQuotas.Resources[rName]
+		if !defined || usage[flvQuotas.Name][rName]+v > rQuota.Nominal {
+			return false
+		}
+	}
+	return true
+}
+
+// AssignedQuantities returns the requests as quantities of the flavor.
+func AssignedQuantities(flvQuotas *FlavorQuotas, requests workload.Requests) FlavorResourceQuantities {
+	quantities := make(map[corev1.ResourceName]int64, len(requests))
+	for rName, v := range requests {
+		quantities[rName] = v
+	}
+	return FlavorResourceQuantities{flvQuotas.Name: quantities}
+}
+
+// PreferredFlavor returns the flavor that the FlavorAssigner of the
+// ClusterQueue chooses in the resource group for the requests, and whether it
+// chose one. The requests and the usage are counted like in the usage of the
+// ClusterQueue, and extraUsage, the usage of the flavors already assigned to
+// other pod sets of the workload, is added to the usage.
+func (c *ClusterQueue) PreferredFlavor(rg *ResourceGroup, requests workload.Requests, extraUsage FlavorResourceQuantities) (kueue.ResourceFlavorReference, bool) {
+	if c.FlavorAssigner == nil {
+		return "", false
+	}
+	accounted := make(workload.Requests, len(requests))
+	for rName, v := range requests {
+		accounted[rName] = c.AccountedRequest(v)
+	}
+	usage := c.Usage.clone()
+	for fName, rUsage := range extraUsage {
+		for rName, v := range rUsage {
+			if _, found := usage[fName][rName]; found {
+				usage[fName][rName] += v
+			}
+		}
+	}
+	for fName := range c.FlavorAssigner.Assign(rg, accounted, usage) {
+		return fName, true
+	}
+	return "", false
+}
+
+// AssignFlavorsSpread distributes the replicas of a workload across the
+// flavors of perReplica, which holds the requests of one replica for each
+// flavor that it can use. A flavor gets at most maxPerFlavorFraction of the
+// replicas and only as many as fit in its unused nominal quota. The replicas
+// are spread as evenly as possible, in the order of the flavor names.
+// It returns false if the replicas can't be distributed within those limits.
+func (c *ClusterQueue) AssignFlavorsSpread(perReplica FlavorResourceQuantities, replicas int, maxPerFlavorFraction float64) (map[kueue.ResourceFlavorReference]int, bool) {
+	perFlavorCap := int(math.Floor(maxPerFlavorFraction * float64(replicas)))
+	flavors := make([]kueue.ResourceFlavorReference, 0, len(perReplica))
+	capacity := make(map[kueue.ResourceFlavorReference]int, len(perReplica))
+	for fName, requests := range perReplica {
+		fit := perFlavorCap
+		for rName, v := range requests {
+			if v <= 0 {
+				continue
+			}
+			var free int64
+			if rQuota := c.quotaFor(fName, rName); rQuota != nil {
+				free = rQuota.Nominal - c.Usage[fName][rName]
+			}
+			if free < 0 {
+				free = 0
+			}
+			if n := int(free / v); n < fit {
+				fit = n
+			}
+		}
+		if fit > 0 {
+			flavors = append(flavors, fName)
+			capacity[fName] = fit
+		}
+	}
+	sort.Slice(flavors, func(i, j int) bool {
+		return flavors[i] < flavors[j]
+	})
+
+	assigned := make(map[kueue.ResourceFlavorReference]int, len(flavors))
+	for remaining := replicas; remaining > 0; {
+		progress := false
+		for _, fName := range flavors {
+			if remaining == 0 {
+				break
+			}
+			if assigned[fName] < capacity[fName] {
+				assigned[fName]++
+				remaining--
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, false
+		}
+	}
+	return assigned, true
+}
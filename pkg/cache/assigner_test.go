@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+
+	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	utiltesting "sigs.k8s.io/kueue/pkg/util/testing"
+	"sigs.k8s.io/kueue/pkg/workload"
+)
+
+// tightestFitAssigner chooses the flavor that fits the requests with the least
+// remaining nominal quota.
+type tightestFitAssigner struct{}
+
+func (tightestFitAssigner) Assign(rg *ResourceGroup, requests workload.Requests, usage FlavorResourceQuantities) FlavorResourceQuantities {
+	var best *FlavorQuotas
+	var bestRemaining int64
+	for i := range rg.Flavors {
+		flvQuotas := &rg.Flavors[i]
+		if !FlavorFits(flvQuotas, requests, usage) {
+			continue
+		}
+		var remaining int64
+		for rName, v := range requests {
+			remaining += flvQuotas.Resources[rName].Nominal - usage[flvQuotas.Name][rName] - v
+		}
+		if best == nil || remaining < bestRemaining {
+			best, bestRemaining = flvQuotas, remaining
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return AssignedQuantities(best, requests)
+}
+
+func TestClusterQueuePreferredFlavor(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("big").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("small").Resource(corev1.ResourceCPU, "3").Obj(),
+		).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	cases := map[string]struct {
+		assigner   FlavorAssigner
+		extraUsage FlavorResourceQuantities
+		wantFlavor kueue.ResourceFlavorReference
+		wantChosen bool
+	}{
+		"no assigner": {},
+		"tightest fit": {
+			assigner:   tightestFitAssigner{},
+			wantFlavor: "small",
+			wantChosen: true,
+		},
+		"tightest fit with the usage of previous pod sets": {
+			assigner:   tightestFitAssigner{},
+			extraUsage: FlavorResourceQuantities{"small": {corev1.ResourceCPU: 2_000}},
+			wantFlavor: "big",
+			wantChosen: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cq.FlavorAssigner = tc.assigner
+			gotFlavor, gotChosen := cq.PreferredFlavor(&cq.ResourceGroups[0], workload.Requests{corev1.ResourceCPU: 2_000}, tc.extraUsage)
+			if gotFlavor != tc.wantFlavor || gotChosen != tc.wantChosen {
+				t.Errorf("PreferredFlavor() = (%q, %t), want (%q, %t)", gotFlavor, gotChosen, tc.wantFlavor, tc.wantChosen)
+			}
+		})
+	}
+}
+
+func TestClusterQueueAssignFlavorsSpread(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "8").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "3").Obj(),
+		).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	perReplica := FlavorResourceQuantities{
+		"on-demand": {corev1.ResourceCPU: 1_000},
+		"spot":      {corev1.ResourceCPU: 1_000},
+	}
+
+	cases := map[string]struct {
+		replicas    int
+		maxFraction float64
+		want        map[kueue.ResourceFlavorReference]int
+		wantOK      bool
+	}{
+		"even spread": {
+			replicas:    4,
+			maxFraction: 0.5,
+			want:        map[kueue.ResourceFlavorReference]int{"on-demand": 2, "spot": 2},
+			wantOK:      true,
+		},
+		"spread limited by quota": {
+			replicas:    8,
+			maxFraction: 0.75,
+			want:        map[kueue.ResourceFlavorReference]int{"on-demand": 5, "spot": 3},
+			wantOK:      true,
+		},
+		"fraction too low": {
+			replicas:    4,
+			maxFraction: 0.25,
+		},
+		"not enough quota": {
+			replicas:    12,
+			maxFraction: 1,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := cq.AssignFlavorsSpread(perReplica, tc.replicas, tc.maxFraction)
+			if ok != tc.wantOK {
+				t.Fatalf("AssignFlavorsSpread() returned %t, want %t", ok, tc.wantOK)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected replicas per flavor (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
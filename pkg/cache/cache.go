@@ -22,10 +22,13 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -49,7 +52,18 @@ const (
 )
 
 type options struct {
-	podsReadyTracking bool
+	podsReadyTracking          bool
+	preemptionProtectionWindow time.Duration
+	usageRounding              UsageRoundingPolicy
+	safetyMargin               float64
+	usageDecayHalfLife         time.Duration
+	flavorUnavailablePolicy    FlavorUnavailablePolicy
+	terminatingLendingPolicy   TerminatingLendingPolicy
+	retainedLabelKeys          sets.Set[string]
+	recorder                   record.EventRecorder
+	batchedMetrics             bool
+	conservativeWarmup         bool
+	admissionGates             []AdmissionGate
 }
 
 // Option configures the reconciler.
@@ -64,6 +78,99 @@ func WithPodsReadyTracking(f bool) Option {
 	}
 }
 
+// WithPreemptionProtectionWindow sets the duration, since their admission,
+// during which workloads can't be selected as preemption candidates.
+func WithPreemptionProtectionWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.preemptionProtectionWindow = d
+	}
+}
+
+// WithUsageRounding sets the policy to round the usage of the ClusterQueues
+// when it's reported.
+func WithUsageRounding(p UsageRoundingPolicy) Option {
+	return func(o *options) {
+		o.usageRounding = p
+	}
+}
+
+// WithSafetyMargin sets the margin by which the requests of the admitted
+// workloads are inflated in the usage of the ClusterQueues.
+func WithSafetyMargin(margin float64) Option {
+	return func(o *options) {
+		o.safetyMargin = margin
+	}
+}
+
+// WithUsageDecayHalfLife sets the half-life of the decayed usage of the
+// ClusterQueues. See ClusterQueue.DecayedUsage.
+func WithUsageDecayHalfLife(d time.Duration) Option {
+	return func(o *options) {
+		o.usageDecayHalfLife = d
+	}
+}
+
+// WithFlavorUnavailablePolicy sets the behavior of the ClusterQueues when any
+// of their flavors doesn't exist.
+func WithFlavorUnavailablePolicy(p FlavorUnavailablePolicy) Option {
+	return func(o *options) {
+		o.flavorUnavailablePolicy = p
+	}
+}
+
+// WithTerminatingLendingPolicy sets whether the terminating ClusterQueues keep
+// lending their unused nominal quota to the cohort.
+func WithTerminatingLendingPolicy(p TerminatingLendingPolicy) Option {
+	return func(o *options) {
+		o.terminatingLendingPolicy = p
+	}
+}
+
+// WithRetainedLabels sets the keys of the ClusterQueue labels that are kept
+// in the cache. The remaining labels are dropped to bound the memory usage.
+// The keys of the labels added to the metrics, see
+// metrics.SetClusterQueueLabelKeys, are always kept.
+func WithRetainedLabels(keys ...string) Option {
+	return func(o *options) {
+		o.retainedLabelKeys = sets.New(keys...)
+	}
+}
+
+// WithEventRecorder sets the recorder for the events about the ClusterQueues
+// starting or stopping to borrow.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(o *options) {
+		o.recorder = recorder
+	}
+}
+
+// WithBatchedMetrics makes the ClusterQueues defer the report of the metrics
+// that change with every admitted or finished workload until FlushMetrics is
+// called, so that they are reported once per flush instead of on every change.
+func WithBatchedMetrics(f bool) Option {
+	return func(o *options) {
+		o.batchedMetrics = f
+	}
+}
+
+// WithConservativeWarmup makes the ClusterQueues refuse the workloads that
+// need to borrow from the cohort until MarkWarm is called, after the existing
+// workloads are added to the cache. This avoids admitting more than the cohort
+// can lend based on an incomplete usage.
+func WithConservativeWarmup(f bool) Option {
+	return func(o *options) {
+		o.conservativeWarmup = f
+	}
+}
+
+// WithAdmissionGates sets the AdmissionGates of the ClusterQueues, which the
+// scheduler runs before admitting a workload.
+func WithAdmissionGates(gates ...AdmissionGate) Option {
+	return func(o *options) {
+		o.admissionGates = gates
+	}
+}
+
 var defaultOptions = options{}
 
 // Cache keeps track of the Workloads that got admitted through ClusterQueues.
@@ -77,6 +184,24 @@ type Cache struct {
 	assumedWorkloads  map[string]string
 	resourceFlavors   map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor
 	podsReadyTracking bool
+
+	preemptionProtectionWindow time.Duration
+	usageRounding              UsageRoundingPolicy
+	safetyMargin               float64
+	usageDecayHalfLife         time.Duration
+	flavorUnavailablePolicy    FlavorUnavailablePolicy
+	terminatingLendingPolicy   TerminatingLendingPolicy
+	retainedLabelKeys          sets.Set[string]
+	recorder                   record.EventRecorder
+	batchedMetrics             bool
+	admissionGates             []AdmissionGate
+	// capacityNotifications are the calls to the OnFull and OnFreed callbacks
+	// of the ClusterQueues waiting for the cache to be unlocked. See
+	// unlockAndNotify.
+	capacityNotifications []func()
+	// warm indicates that the usage of the ClusterQueues is complete. See
+	// MarkWarm.
+	warm bool
 }
 
 func New(client client.Client, opts ...Option) *Cache {
@@ -91,11 +216,34 @@ func New(client client.Client, opts ...Option) *Cache {
 		assumedWorkloads:  make(map[string]string),
 		resourceFlavors:   make(map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor),
 		podsReadyTracking: options.podsReadyTracking,
+
+		preemptionProtectionWindow: options.preemptionProtectionWindow,
+		usageRounding:              options.usageRounding,
+		safetyMargin:               options.safetyMargin,
+		usageDecayHalfLife:         options.usageDecayHalfLife,
+		flavorUnavailablePolicy:    options.flavorUnavailablePolicy,
+		terminatingLendingPolicy:   options.terminatingLendingPolicy,
+		retainedLabelKeys:          options.retainedLabelKeys.Union(sets.New(metrics.ClusterQueueLabelKeys()...)),
+		recorder:                   options.recorder,
+		batchedMetrics:             options.batchedMetrics,
+		admissionGates:             options.admissionGates,
+		warm:                       !options.conservativeWarmup,
 	}
 	c.podsReadyCond.L = &c.RWMutex
 	return c
 }
 
+// unlockAndNotify unlocks the cache and then makes the calls to the OnFull and
+// OnFreed callbacks that the ClusterQueues queued while it was locked.
+func (c *Cache) unlockAndNotify() {
+	notifications := c.capacityNotifications
+	c.capacityNotifications = nil
+	c.Unlock()
+	for _, notify := range notifications {
+		notify()
+	}
+}
+
 func (c *Cache) newClusterQueue(cq *kueue.ClusterQueue) (*ClusterQueue, error) {
 	cqImpl := &ClusterQueue{
 		Name:              cq.Name,
@@ -103,10 +251,25 @@ func (c *Cache) newClusterQueue(cq *kueue.ClusterQueue) (*ClusterQueue, error) {
 		WorkloadsNotReady: sets.New[string](),
 		localQueues:       make(map[string]*queue),
 		podsReadyTracking: c.podsReadyTracking,
-	}
-	if err := cqImpl.update(cq, c.resourceFlavors); err != nil {
+		retainedLabelKeys: c.retainedLabelKeys,
+		recorder:          c.recorder,
+		batchMetrics:      c.batchedMetrics,
+		warmingUp:         !c.warm,
+
+		capacityNotifications: &c.capacityNotifications,
+
+		PreemptionProtectionWindow: c.preemptionProtectionWindow,
+		UsageRounding:              c.usageRounding,
+		SafetyMargin:               c.safetyMargin,
+		UsageDecayHalfLife:         c.usageDecayHalfLife,
+		FlavorUnavailablePolicy:    c.flavorUnavailablePolicy,
+		TerminatingLendingPolicy:   c.terminatingLendingPolicy,
+		AdmissionGates:             c.admissionGates,
+	}
+	if err := cqImpl.update(cq, c.resourceFlavors, nil); err != nil {
 		return nil, err
 	}
+	cqImpl.updateIdleSince()
 
 	return cqImpl, nil
 }
@@ -237,7 +400,7 @@ func (c *Cache) TerminateClusterQueue(name string) {
 	defer c.Unlock()
 	if cq, exists := c.clusterQueues[name]; exists {
 		cq.Status = terminating
-		metrics.ReportClusterQueueStatus(cq.Name, cq.Status)
+		metrics.ReportClusterQueueStatus(cq.Name, cq.labels, cq.Status)
 	}
 }
 
@@ -281,6 +444,7 @@ func (c *Cache) AddClusterQueue(ctx context.Context, cq *kueue.ClusterQueue) err
 			key:               qKey,
 			admittedWorkloads: 0,
 			usage:             make(FlavorResourceQuantities),
+			weight:            localQueueWeight(&q),
 		}
 		if err = qImpl.resetFlavorsAndResources(cqImpl.Usage); err != nil {
 			return err
@@ -302,13 +466,20 @@ func (c *Cache) AddClusterQueue(ctx context.Context, cq *kueue.ClusterQueue) err
 }
 
 func (c *Cache) UpdateClusterQueue(cq *kueue.ClusterQueue) error {
+	return c.UpdateClusterQueueRenamingFlavors(cq, nil)
+}
+
+// UpdateClusterQueueRenamingFlavors updates the ClusterQueue carrying forward
+// the usage of the flavors in flavorRenames, keyed by their old name, to their
+// new name.
+func (c *Cache) UpdateClusterQueueRenamingFlavors(cq *kueue.ClusterQueue, flavorRenames map[kueue.ResourceFlavorReference]kueue.ResourceFlavorReference) error {
 	c.Lock()
 	defer c.Unlock()
 	cqImpl, ok := c.clusterQueues[cq.Name]
 	if !ok {
 		return errCqNotFound
 	}
-	if err := cqImpl.update(cq, c.resourceFlavors); err != nil {
+	if err := cqImpl.update(cq, c.resourceFlavors, flavorRenames); err != nil {
 		return err
 	}
 	for _, qImpl := range cqImpl.localQueues {
@@ -328,7 +499,10 @@ func (c *Cache) UpdateClusterQueue(cq *kueue.ClusterQueue) error {
 	if cqImpl.Cohort.Name != cq.Spec.Cohort {
 		c.deleteClusterQueueFromCohort(cqImpl)
 		c.addClusterQueueToCohort(cqImpl, cq.Spec.Cohort)
+		return nil
 	}
+	// The nominal quotas might have changed.
+	cqImpl.Cohort.resolveBorrowingLimits()
 	return nil
 }
 
@@ -365,11 +539,14 @@ func (c *Cache) DeleteLocalQueue(q *kueue.LocalQueue) {
 }
 
 func (c *Cache) UpdateLocalQueue(oldQ, newQ *kueue.LocalQueue) error {
+	c.Lock()
+	defer c.Unlock()
 	if oldQ.Spec.ClusterQueue == newQ.Spec.ClusterQueue {
+		if cq, ok := c.clusterQueues[string(newQ.Spec.ClusterQueue)]; ok {
+			cq.updateLocalQueue(newQ)
+		}
 		return nil
 	}
-	c.Lock()
-	defer c.Unlock()
 	cq, ok := c.clusterQueues[string(oldQ.Spec.ClusterQueue)]
 	if ok {
 		cq.deleteLocalQueue(oldQ)
@@ -383,7 +560,7 @@ func (c *Cache) UpdateLocalQueue(oldQ, newQ *kueue.LocalQueue) error {
 
 func (c *Cache) AddOrUpdateWorkload(w *kueue.Workload) bool {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlockAndNotify()
 	return c.addOrUpdateWorkload(w)
 }
 
@@ -399,30 +576,50 @@ func (c *Cache) addOrUpdateWorkload(w *kueue.Workload) bool {
 
 	c.cleanupAssumedState(w)
 
-	if _, exist := clusterQueue.Workloads[workload.Key(w)]; exist {
+	exist := clusterQueue.hasWorkload(workload.Key(w))
+	if exist {
 		clusterQueue.deleteWorkload(w)
 	}
 
 	if c.podsReadyTracking {
 		c.podsReadyCond.Broadcast()
 	}
-	return clusterQueue.addWorkload(w) == nil
+	// A frozen ClusterQueue accounts the workload on Thaw.
+	if err := clusterQueue.addWorkload(w); err != nil && !errors.Is(err, ErrClusterQueueFrozen) {
+		ctrl.Log.WithName("cache").Error(err, "Failed to account an admitted workload", "workload", klog.KObj(w), "clusterQueue", klog.KRef("", clusterQueue.Name))
+		return false
+	}
+	if !exist {
+		clusterQueue.recordChurn()
+	}
+	return true
 }
 
 func (c *Cache) UpdateWorkload(oldWl, newWl *kueue.Workload) error {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlockAndNotify()
+	// Only the changes of the admission, and not the updates of an admitted
+	// workload, count as churn.
+	sameClusterQueue := workload.IsAdmitted(oldWl) && workload.IsAdmitted(newWl) &&
+		oldWl.Status.Admission.ClusterQueue == newWl.Status.Admission.ClusterQueue
+	// The changes deferred by a frozen ClusterQueue are reported with
+	// ErrClusterQueueFrozen.
+	var deleteErr error
 	if workload.IsAdmitted(oldWl) {
 		cq, ok := c.clusterQueues[string(oldWl.Status.Admission.ClusterQueue)]
 		if !ok {
 			return fmt.Errorf("old ClusterQueue doesn't exist")
 		}
-		cq.deleteWorkload(oldWl)
+		admitted := cq.hasWorkload(workload.Key(oldWl))
+		deleteErr = cq.deleteWorkload(oldWl)
+		if admitted && !sameClusterQueue {
+			cq.recordChurn()
+		}
 	}
 	c.cleanupAssumedState(oldWl)
 
 	if !workload.IsAdmitted(newWl) {
-		return nil
+		return deleteErr
 	}
 	cq, ok := c.clusterQueues[string(newWl.Status.Admission.ClusterQueue)]
 	if !ok {
@@ -431,12 +628,19 @@ func (c *Cache) UpdateWorkload(oldWl, newWl *kueue.Workload) error {
 	if c.podsReadyTracking {
 		c.podsReadyCond.Broadcast()
 	}
-	return cq.addWorkload(newWl)
+	addErr := cq.addWorkload(newWl)
+	if addErr != nil && !errors.Is(addErr, ErrClusterQueueFrozen) {
+		return addErr
+	}
+	if !sameClusterQueue {
+		cq.recordChurn()
+	}
+	return errors.Join(deleteErr, addErr)
 }
 
 func (c *Cache) DeleteWorkload(w *kueue.Workload) error {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlockAndNotify()
 
 	cq := c.clusterQueueForWorkload(w)
 	if cq == nil {
@@ -445,11 +649,15 @@ func (c *Cache) DeleteWorkload(w *kueue.Workload) error {
 
 	c.cleanupAssumedState(w)
 
-	cq.deleteWorkload(w)
+	admitted := cq.hasWorkload(workload.Key(w))
+	err := cq.deleteWorkload(w)
+	if admitted {
+		cq.recordChurn()
+	}
 	if c.podsReadyTracking {
 		c.podsReadyCond.Broadcast()
 	}
-	return nil
+	return err
 }
 
 func (c *Cache) IsAssumedOrAdmittedWorkload(w workload.Info) bool {
@@ -470,7 +678,7 @@ func (c *Cache) IsAssumedOrAdmittedWorkload(w workload.Info) bool {
 
 func (c *Cache) AssumeWorkload(w *kueue.Workload) error {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlockAndNotify()
 
 	if !workload.IsAdmitted(w) {
 		return errWorkloadNotAdmitted
@@ -487,16 +695,27 @@ func (c *Cache) AssumeWorkload(w *kueue.Workload) error {
 		return errCqNotFound
 	}
 
+	// The workload isn't admitted in the API yet, so reject it as a whole if
+	// the ClusterQueue can't account for all of its usage.
+	if err := cq.checkRequestsCovered(workload.NewInfo(w)); err != nil {
+		return err
+	}
+	// Unlike the changes of the admitted workloads, the addition isn't
+	// deferred while the ClusterQueue is frozen.
+	if cq.IsFrozen() {
+		return ErrClusterQueueFrozen
+	}
 	if err := cq.addWorkload(w); err != nil {
 		return err
 	}
+	cq.recordChurn()
 	c.assumedWorkloads[k] = string(w.Status.Admission.ClusterQueue)
 	return nil
 }
 
 func (c *Cache) ForgetWorkload(w *kueue.Workload) error {
 	c.Lock()
-	defer c.Unlock()
+	defer c.unlockAndNotify()
 
 	if _, assumed := c.assumedWorkloads[workload.Key(w)]; !assumed {
 		return fmt.Errorf("the workload is not assumed")
@@ -511,11 +730,12 @@ func (c *Cache) ForgetWorkload(w *kueue.Workload) error {
 	if !ok {
 		return errCqNotFound
 	}
-	cq.deleteWorkload(w)
+	// The assumption is already counted as churn, undoing it isn't.
+	err := cq.deleteWorkload(w)
 	if c.podsReadyTracking {
 		c.podsReadyCond.Broadcast()
 	}
-	return nil
+	return err
 }
 
 // Usage reports the used resources and number of workloads admitted by the ClusterQueue.
@@ -540,13 +760,13 @@ func (c *Cache) Usage(cqObj *kueue.ClusterQueue) ([]kueue.FlavorUsage, int, erro
 				used := flvUsage[rName]
 				rUsage := kueue.ResourceUsage{
 					Name:  rName,
-					Total: workload.ResourceQuantity(rName, used),
+					Total: cq.reportedQuantity(rName, used),
 				}
 				// Enforce `borrowed=0` if the clusterQueue doesn't belong to a cohort.
 				if cq.Cohort != nil {
 					borrowed := used - rQuota.Nominal
 					if borrowed > 0 {
-						rUsage.Borrowed = workload.ResourceQuantity(rName, borrowed)
+						rUsage.Borrowed = cq.reportedQuantity(rName, borrowed)
 					}
 				}
 				outFlvUsage.Resources = append(outFlvUsage.Resources, rUsage)
@@ -585,7 +805,7 @@ func (c *Cache) LocalQueueUsage(qObj *kueue.LocalQueue) ([]kueue.LocalQueueFlavo
 			for rName := range flvQuotas.Resources {
 				outFlvUsage.Resources = append(outFlvUsage.Resources, kueue.LocalQueueResourceUsage{
 					Name:  rName,
-					Total: workload.ResourceQuantity(rName, flvUsage[rName]),
+					Total: cqImpl.reportedQuantity(rName, flvUsage[rName]),
 				})
 			}
 			// The resourceUsages should be in a stable order to avoid endless creation of update events.
@@ -635,19 +855,18 @@ func (c *Cache) addClusterQueueToCohort(cq *ClusterQueue, cohortName string) {
 		cohort = newCohort(cohortName, 1)
 		c.cohorts[cohortName] = cohort
 	}
-	cohort.Members.Insert(cq)
-	cq.Cohort = cohort
+	cq.MoveToCohort(cohort)
 }
 
 func (c *Cache) deleteClusterQueueFromCohort(cq *ClusterQueue) {
-	if cq.Cohort == nil {
+	cohort := cq.Cohort
+	if cohort == nil {
 		return
 	}
-	cq.Cohort.Members.Delete(cq)
-	if cq.Cohort.Members.Len() == 0 {
-		delete(c.cohorts, cq.Cohort.Name)
+	cq.MoveToCohort(nil)
+	if cohort.Members.Len() == 0 {
+		delete(c.cohorts, cohort.Name)
 	}
-	cq.Cohort = nil
 }
 
 func (c *Cache) ClusterQueuesUsingFlavor(flavor string) []string {
@@ -663,6 +882,124 @@ func (c *Cache) ClusterQueuesUsingFlavor(flavor string) []string {
 	return cqs
 }
 
+// FlushMetrics reports the metrics that the ClusterQueues deferred since the
+// last flush, when the metrics are batched.
+func (c *Cache) FlushMetrics() {
+	c.Lock()
+	defer c.Unlock()
+	for _, cq := range c.clusterQueues {
+		cq.flushMetrics()
+	}
+}
+
+// AccountsAdmittedWorkloads returns whether the ClusterQueues account all the
+// workloads of the list that are admitted in them. The workloads admitted in a
+// ClusterQueue that isn't in the cache are ignored, the ClusterQueue accounts
+// them when it's added.
+func (c *Cache) AccountsAdmittedWorkloads(wls []kueue.Workload) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for i := range wls {
+		w := &wls[i]
+		if !workload.IsAdmitted(w) {
+			continue
+		}
+		cq, ok := c.clusterQueues[string(w.Status.Admission.ClusterQueue)]
+		if ok && !cq.hasWorkload(workload.Key(w)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkWarm indicates that the usage of all the ClusterQueues is complete,
+// which the controller calls once the cache accounts the admitted workloads
+// that exist at startup. See WithConservativeWarmup and
+// AccountsAdmittedWorkloads.
+func (c *Cache) MarkWarm() {
+	c.Lock()
+	defer c.Unlock()
+	c.warm = true
+	for _, cq := range c.clusterQueues {
+		cq.MarkWarm()
+	}
+}
+
+// FreezeClusterQueue freezes the ClusterQueue with the name. See
+// ClusterQueue.Freeze.
+func (c *Cache) FreezeClusterQueue(name string) error {
+	c.Lock()
+	defer c.Unlock()
+	cq, ok := c.clusterQueues[name]
+	if !ok {
+		return errCqNotFound
+	}
+	cq.Freeze()
+	return nil
+}
+
+// ReserveForPending holds the requests of the pending workloads in the
+// ClusterQueue with the name. See ClusterQueue.ReserveForPending.
+func (c *Cache) ReserveForPending(name string, wis []*workload.Info) error {
+	c.Lock()
+	defer c.Unlock()
+	cq, ok := c.clusterQueues[name]
+	if !ok {
+		return errCqNotFound
+	}
+	cq.ReserveForPending(wis)
+	return nil
+}
+
+// ThawClusterQueue thaws the ClusterQueue with the name. See
+// ClusterQueue.Thaw.
+func (c *Cache) ThawClusterQueue(name string) error {
+	c.Lock()
+	defer c.unlockAndNotify()
+	cq, ok := c.clusterQueues[name]
+	if !ok {
+		return errCqNotFound
+	}
+	cq.Thaw()
+	return nil
+}
+
+// SamplePressure samples the pressure of every ClusterQueue with a
+// PressureProvider. See ClusterQueue.SamplePressure.
+func (c *Cache) SamplePressure() {
+	c.Lock()
+	defer c.Unlock()
+	for _, cq := range c.clusterQueues {
+		cq.SamplePressure()
+	}
+}
+
+// SampleUsage records the current usage of every ClusterQueue in its usage
+// history. See ClusterQueue.UsageTrend.
+func (c *Cache) SampleUsage() {
+	c.Lock()
+	defer c.Unlock()
+	for _, cq := range c.clusterQueues {
+		cq.SampleUsage()
+	}
+}
+
+// RunUsageSampler calls SampleUsage every period until the context is done,
+// so that the usage trend of the ClusterQueues covers the last samples taken
+// at that period.
+func (c *Cache) RunUsageSampler(ctx context.Context, period time.Duration) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		c.SampleUsage()
+	}, period)
+}
+
+// RunMetricsFlusher calls FlushMetrics every period until the context is done.
+func (c *Cache) RunMetricsFlusher(ctx context.Context, period time.Duration) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		c.FlushMetrics()
+	}, period)
+}
+
 func (c *Cache) MatchingClusterQueues(nsLabels map[string]string) sets.Set[string] {
 	c.RLock()
 	defer c.RUnlock()
@@ -20,19 +20,23 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	"sigs.k8s.io/kueue/pkg/metrics"
 	"sigs.k8s.io/kueue/pkg/util/pointer"
 	utiltesting "sigs.k8s.io/kueue/pkg/util/testing"
 	"sigs.k8s.io/kueue/pkg/workload"
@@ -100,8 +104,9 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal:        10_000,
-									BorrowingLimit: pointer.Int64(10_000),
+									Nominal:           10_000,
+									ConfiguredNominal: 10_000,
+									BorrowingLimit:    pointer.Int64(10_000),
 								},
 							},
 						}},
@@ -122,7 +127,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal: 15_000,
+									Nominal:           15_000,
+									ConfiguredNominal: 15_000,
 								},
 							},
 						}},
@@ -159,7 +165,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "nonexistent-flavor",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal: 15_000,
+									Nominal:           15_000,
+									ConfiguredNominal: 15_000,
 								},
 							},
 						}},
@@ -222,8 +229,9 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal:        10_000,
-									BorrowingLimit: pointer.Int64(10_000),
+									Nominal:           10_000,
+									ConfiguredNominal: 10_000,
+									BorrowingLimit:    pointer.Int64(10_000),
 								},
 							},
 						}},
@@ -244,7 +252,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal: 15_000,
+									Nominal:           15_000,
+									ConfiguredNominal: 15_000,
 								},
 							},
 						}},
@@ -282,7 +291,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 								Name: "nonexistent-flavor",
 								Resources: map[corev1.ResourceName]*ResourceQuota{
 									corev1.ResourceCPU: {
-										Nominal: 15_000,
+										Nominal:           15_000,
+										ConfiguredNominal: 15_000,
 									},
 								},
 							},
@@ -343,8 +353,9 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal:        5_000,
-									BorrowingLimit: pointer.Int64(5_000),
+									Nominal:           5_000,
+									ConfiguredNominal: 5_000,
+									BorrowingLimit:    pointer.Int64(5_000),
 								},
 							},
 						}},
@@ -389,8 +400,9 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal:        5_000,
-									BorrowingLimit: pointer.Int64(5_000),
+									Nominal:           5_000,
+									ConfiguredNominal: 5_000,
+									BorrowingLimit:    pointer.Int64(5_000),
 								},
 							}},
 						},
@@ -429,7 +441,7 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 						Flavors: []FlavorQuotas{{
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
-								corev1.ResourceCPU: {Nominal: 15_000},
+								corev1.ResourceCPU: {Nominal: 15_000, ConfiguredNominal: 15_000},
 							},
 						}},
 						LabelKeys: sets.New("cpuType"),
@@ -458,7 +470,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 								Name: "nonexistent-flavor",
 								Resources: map[corev1.ResourceName]*ResourceQuota{
 									corev1.ResourceCPU: {
-										Nominal: 15_000,
+										Nominal:           15_000,
+										ConfiguredNominal: 15_000,
 									},
 								},
 							},
@@ -494,8 +507,9 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal:        10_000,
-									BorrowingLimit: pointer.Int64(10_000),
+									Nominal:           10_000,
+									ConfiguredNominal: 10_000,
+									BorrowingLimit:    pointer.Int64(10_000),
 								},
 							},
 						}},
@@ -516,7 +530,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "default",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal: 15_000,
+									Nominal:           15_000,
+									ConfiguredNominal: 15_000,
 								},
 							},
 						}},
@@ -553,7 +568,8 @@ func TestCacheClusterQueueOperations(t *testing.T) {
 							Name: "nonexistent-flavor",
 							Resources: map[corev1.ResourceName]*ResourceQuota{
 								corev1.ResourceCPU: {
-									Nominal: 15_000,
+									Nominal:           15_000,
+									ConfiguredNominal: 15_000,
 								},
 							},
 						}},
@@ -1718,6 +1734,78 @@ func TestLocalQueueUsage(t *testing.T) {
 	}
 }
 
+func TestClusterQueueUsageRounding(t *testing.T) {
+	cq := utiltesting.MakeClusterQueue("foo").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		Obj()
+	admitted := utiltesting.MakeWorkload("admitted", "").
+		Admit(utiltesting.MakeAdmission("foo").
+			Assignment(corev1.ResourceCPU, "default", "1500m").
+			Assignment(corev1.ResourceMemory, "default", "1500Mi").Obj()).
+		Obj()
+	cases := map[string]struct {
+		policy    UsageRoundingPolicy
+		wantUsage []kueue.FlavorUsage
+	}{
+		"none": {
+			policy: UsageRoundingNone,
+			wantUsage: []kueue.FlavorUsage{{
+				Name: "default",
+				Resources: []kueue.ResourceUsage{
+					{Name: corev1.ResourceCPU, Total: resource.MustParse("1500m")},
+					{Name: corev1.ResourceMemory, Total: resource.MustParse("1500Mi")},
+				},
+			}},
+		},
+		"ceil to unit": {
+			policy: UsageRoundingCeilToUnit,
+			wantUsage: []kueue.FlavorUsage{{
+				Name: "default",
+				Resources: []kueue.ResourceUsage{
+					{Name: corev1.ResourceCPU, Total: resource.MustParse("2")},
+					{Name: corev1.ResourceMemory, Total: resource.MustParse("1500Mi")},
+				},
+			}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := New(utiltesting.NewFakeClient(), WithUsageRounding(tc.policy))
+			if err := cache.AddClusterQueue(ctx, cq); err != nil {
+				t.Fatalf("Adding ClusterQueue: %v", err)
+			}
+			if !cache.AddOrUpdateWorkload(admitted) {
+				t.Fatalf("Failed adding workload")
+			}
+			gotUsage, _, err := cache.Usage(cq)
+			if err != nil {
+				t.Fatalf("Couldn't get usage: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantUsage, gotUsage); diff != "" {
+				t.Errorf("Unexpected usage (-want,+got):\n%s", diff)
+			}
+
+			// Admission uses the exact usage.
+			cqImpl := cache.clusterQueues["foo"]
+			fits := utiltesting.MakeWorkload("fits", "").
+				Admit(utiltesting.MakeAdmission("foo").Assignment(corev1.ResourceCPU, "default", "8500m").Obj()).
+				Obj()
+			if !cqImpl.CanFit(workload.NewInfo(fits)) {
+				t.Errorf("Workload using the exact remaining quota doesn't fit")
+			}
+			exceeds := utiltesting.MakeWorkload("exceeds", "").
+				Admit(utiltesting.MakeAdmission("foo").Assignment(corev1.ResourceCPU, "default", "8501m").Obj()).
+				Obj()
+			if cqImpl.CanFit(workload.NewInfo(exceeds)) {
+				t.Errorf("Workload exceeding the remaining quota fits")
+			}
+		})
+	}
+}
+
 func TestCacheQueueOperations(t *testing.T) {
 	cqs := []*kueue.ClusterQueue{
 		utiltesting.MakeClusterQueue("foo").
@@ -1816,6 +1904,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns1/alpha": {
 			key:               "ns1/alpha",
 			admittedWorkloads: 1,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"spot": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("2")),
@@ -1829,6 +1918,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns2/beta": {
 			key:               "ns2/beta",
 			admittedWorkloads: 2,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"spot": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("0")),
@@ -1842,6 +1932,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns1/gamma": {
 			key:               "ns1/gamma",
 			admittedWorkloads: 1,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"ondemand": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("5")),
@@ -1857,6 +1948,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns1/alpha": {
 			key:               "ns1/alpha",
 			admittedWorkloads: 0,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"spot": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("0")),
@@ -1870,6 +1962,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns2/beta": {
 			key:               "ns2/beta",
 			admittedWorkloads: 0,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"spot": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("0")),
@@ -1883,6 +1976,7 @@ func TestCacheQueueOperations(t *testing.T) {
 		"ns1/gamma": {
 			key:               "ns1/gamma",
 			admittedWorkloads: 0,
+			weight:            1,
 			usage: FlavorResourceQuantities{
 				"ondemand": {
 					corev1.ResourceCPU:    workload.ResourceValue(corev1.ResourceCPU, resource.MustParse("0")),
@@ -2553,3 +2647,106 @@ func messageOrEmpty(err error) string {
 	}
 	return err.Error()
 }
+
+func TestCacheBatchedMetrics(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithBatchedMetrics(true))
+	cq := utiltesting.MakeClusterQueue("batched-metrics").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	activeWorkloads := func() float64 {
+		return testutil.ToFloat64(metrics.AdmittedActiveWorkloads.WithLabelValues(metrics.ClusterQueueLabelValues(nil, cq.Name)...))
+	}
+
+	var wls []*kueue.Workload
+	for i := 0; i < 3; i++ {
+		wl := utiltesting.MakeWorkload(fmt.Sprintf("wl-%d", i), "").
+			Admit(utiltesting.MakeAdmission(cq.Name).Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj()
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+		wls = append(wls, wl)
+	}
+	if got := activeWorkloads(); got != 0 {
+		t.Errorf("Got %v admitted active workloads before the flush, want 0", got)
+	}
+	cache.FlushMetrics()
+	if got := activeWorkloads(); got != 3 {
+		t.Errorf("Got %v admitted active workloads after the flush, want 3", got)
+	}
+
+	if err := cache.DeleteWorkload(wls[0]); err != nil {
+		t.Fatalf("Failed deleting workload: %v", err)
+	}
+	if got := activeWorkloads(); got != 3 {
+		t.Errorf("Got %v admitted active workloads before the second flush, want 3", got)
+	}
+	cache.FlushMetrics()
+	if got := activeWorkloads(); got != 2 {
+		t.Errorf("Got %v admitted active workloads after the second flush, want 2", got)
+	}
+}
+
+func BenchmarkClusterQueueWorkloadMetrics(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%t", batched), func(b *testing.B) {
+			cache := New(utiltesting.NewFakeClient(), WithBatchedMetrics(batched))
+			cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("benchmark").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+				Obj())
+			if err != nil {
+				b.Fatalf("Failed to create ClusterQueue: %v", err)
+			}
+			wl := utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("benchmark").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+				Obj()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := cq.addWorkload(wl); err != nil {
+					b.Fatalf("Failed adding workload: %v", err)
+				}
+				cq.deleteWorkload(wl)
+			}
+		})
+	}
+}
+
+func TestCacheRunUsageSampler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	samples := func() int {
+		cache.RLock()
+		defer cache.RUnlock()
+		return len(cache.clusterQueues["cq"].usageHistory)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cache.RunUsageSampler(ctx, time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(wait.ForeverTestTimeout)
+	for samples() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d usage samples, want at least 2", samples())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("The sampler didn't stop after the context was done")
+	}
+}
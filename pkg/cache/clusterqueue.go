@@ -1,25 +1,66 @@
 package cache
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
 
 	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
 	"sigs.k8s.io/kueue/pkg/metrics"
+	"sigs.k8s.io/kueue/pkg/util/maps"
+	"sigs.k8s.io/kueue/pkg/util/priority"
 	"sigs.k8s.io/kueue/pkg/workload"
 )
 
+// ErrClusterQueueFrozen is returned by the changes of a frozen ClusterQueue.
+// See ClusterQueue.Freeze.
+var ErrClusterQueueFrozen = errors.New("ClusterQueue is frozen")
+
 var (
-	errQueueAlreadyExists = errors.New("queue already exists")
+	errQueueAlreadyExists           = errors.New("queue already exists")
+	errMixedBorrowingLimits         = errors.New("borrowingLimit and borrowingLimitPercent are mutually exclusive")
+	errExclusiveFlavorInUse         = errors.New("exclusive flavor is already in use")
+	errFlavorResourceNotCovered     = errors.New("flavor and resource aren't covered by the ClusterQueue")
+	errResourceGroupDisabled        = errors.New("resource group is disabled because of a missing flavor")
+	errNamespaceNotInGroup          = errors.New("workload namespace doesn't match the resource group selector")
+	errVictimNotAdmitted            = errors.New("victim isn't admitted in the ClusterQueue")
+	errDoesNotFitAfterEviction      = errors.New("workload doesn't fit after evicting the victims")
+	errFlavorWorkloadsLimit         = errors.New("flavor reached its maximum number of workloads")
+	errAdmissionDeadlinePassed      = errors.New("workload admission deadline passed")
+	errFlavorAvoided                = errors.New("flavor is avoided by the workload")
+	errInvalidResourceGroupSettings = errors.New("invalid resource group settings")
 )
 
+// ClusterQueueView provides read-only access to a ClusterQueue, for consumers
+// that shouldn't be able to alter the state of the cache.
+type ClusterQueueView interface {
+	GetName() string
+	// GetUsage returns a copy of the resources used by the admitted workloads.
+	GetUsage() FlavorResourceQuantities
+	IsBorrowing() bool
+	Active() bool
+}
+
+var _ ClusterQueueView = (*ClusterQueue)(nil)
+
 // ClusterQueue is the internal implementation of kueue.ClusterQueue that
 // holds admitted workloads.
 type ClusterQueue struct {
@@ -34,23 +75,350 @@ type ClusterQueue struct {
 	Preemption        kueue.ClusterQueuePreemption
 	Status            metrics.ClusterQueueStatus
 
+	// PreemptionProtectionWindow is the duration, since their admission, during
+	// which the workloads of this ClusterQueue can't be preempted.
+	// Zero means that workloads can be preempted right after admission.
+	PreemptionProtectionWindow time.Duration
+
+	// UsageRounding is the policy to round the usage when it's reported.
+	// It doesn't affect the values used for admission.
+	UsageRounding UsageRoundingPolicy
+
+	// SafetyMargin inflates the requests of the admitted workloads in the
+	// usage to request*(1+SafetyMargin), to leave room for node-level packing
+	// inefficiencies. The requests are inflated the same way when checking
+	// if they fit. It must not change while workloads are admitted.
+	SafetyMargin float64
+
+	// UsageDecayHalfLife is the half-life of the difference between the
+	// DecayedUsage and the usage. Zero means that the decayed usage is the
+	// usage.
+	UsageDecayHalfLife time.Duration
+
+	// DefaultRequests are the requests, per pod, accounted for the resources
+	// that the pod sets of a workload don't request, per flavor.
+	// A default only applies to a pod set that is assigned the flavor for another
+	// resource of the same resource group.
+	DefaultRequests FlavorResourceQuantities
+
+	// FlavorAssigner, when set, chooses the flavor of a resource group that
+	// the flavor assignment evaluates first. When nil, the flavors are
+	// evaluated in the order of the resource group.
+	FlavorAssigner FlavorAssigner
+
+	// FlavorOverride, when set, can force the flavor of a resource group for
+	// a workload during flavor assignment in the scheduler.
+	FlavorOverride FlavorOverride
+
+	// AdmissionGates can veto the admission of a workload. The scheduler runs
+	// them before assigning flavors, and so does CanFit. They run in order and
+	// the first error rejects the workload.
+	AdmissionGates []AdmissionGate
+
+	// ResourceAliases maps resource names to the canonical resource name whose
+	// quota they use. The requests of the aliases are accounted for as requests
+	// of the canonical resource.
+	ResourceAliases map[corev1.ResourceName]corev1.ResourceName
+
+	// AdmissionCostWeights are the weights for AdmissionCost. When nil,
+	// DefaultAdmissionCostWeights are used.
+	AdmissionCostWeights *AdmissionCostWeights
+
+	// BorrowingPolicy defines which unused quota of the cohort can be borrowed.
+	BorrowingPolicy BorrowingPolicy
+
+	// BorrowVsPreemptPolicy defines whether a workload that fits by borrowing,
+	// but that could also fit in the nominal quota by preempting, borrows or
+	// preempts.
+	BorrowVsPreemptPolicy BorrowVsPreemptPolicy
+
+	// FlavorUnavailablePolicy defines what is disabled when a flavor of the
+	// ClusterQueue doesn't exist.
+	FlavorUnavailablePolicy FlavorUnavailablePolicy
+
+	// TerminatingLendingPolicy defines whether the ClusterQueue keeps lending
+	// its unused nominal quota to the cohort while it's terminating.
+	TerminatingLendingPolicy TerminatingLendingPolicy
+
+	// PressureProvider, when set, reports the resource pressure of the cluster,
+	// from 0 to 1, to scale down the nominal quota. It's only called by
+	// SamplePressure. See EffectiveNominal.
+	PressureProvider func() float64
+	// PressureCurve maps the pressure to the fraction of the nominal quota
+	// that stays available. When nil, DefaultPressureCurve is used.
+	PressureCurve PressureCurve
+	// RampUp, when set, scales down the nominal quota during its window, for
+	// example, to admit workloads gradually after the quota was raised. See
+	// EffectiveNominal.
+	RampUp *RampUp
+
+	// DefaultBorrowingLimit is the borrowing limit, in the units of the quota
+	// accounting, for the resources that don't define one. When nil, those
+	// resources can borrow without limit.
+	DefaultBorrowingLimit *int64
+
+	// UsageEpsilon is the amount, in the units of the quota accounting, i.e.
+	// milli-units for CPU, by which the usage can exceed the nominal quota, or
+	// the available quota, without being considered over it.
+	UsageEpsilon int64
+
+	// SystemWorkloadLabel is the key of the workload label that marks, with
+	// the value "true", the system workloads. They are admitted regardless of
+	// the available quota and their usage is also tracked in SystemUsage.
+	SystemWorkloadLabel string
+	// SystemReservation is the quota, per flavor and resource, reserved for the
+	// system workloads. The regular workloads can't use the part of it that the
+	// system workloads don't use.
+	SystemReservation FlavorResourceQuantities
+	// SystemUsage is the part of Usage that comes from system workloads.
+	SystemUsage FlavorResourceQuantities
+
+	// BorrowAuditSink, when set, receives an event every time the amount that
+	// the ClusterQueue borrows for a flavor and resource changes. It's called
+	// synchronously, while the cache is locked, so it must not block; sinks
+	// that persist the events must hand them off, for example, to a buffered
+	// channel.
+	BorrowAuditSink func(event BorrowEvent)
+
+	// OnFull and OnFreed, when set, are called with the name of the
+	// ClusterQueue when AtCapacity becomes true and false, respectively, after
+	// a workload is added or removed. They are only called on transitions and,
+	// unlike BorrowAuditSink, after the cache is unlocked, so they may call
+	// back into the cache.
+	OnFull  func(cqName string)
+	OnFreed func(cqName string)
+	// capacityNotifications is the queue of the cache where the calls to
+	// OnFull and OnFreed wait for the cache to be unlocked.
+	capacityNotifications *[]func()
+
+	// labels are the ClusterQueue labels with a key in retainedLabelKeys.
+	labels map[string]string
+	// generation is incremented every time the ClusterQueue changes.
+	generation int64
+	// nominalFraction is the fraction set with SetEffectiveNominalFraction.
+	nominalFraction float64
+	// pressure is the last pressure, from 0 to 1, reported by the
+	// PressureProvider. See SamplePressure.
+	pressure float64
+	// sampledAt is the time of the last SamplePressure, at which the RampUp
+	// is evaluated.
+	sampledAt time.Time
+	// idleSince is the time when the ClusterQueue stopped using any quota. It's
+	// zero while the ClusterQueue uses quota.
+	idleSince time.Time
+	// decayedUsage is the DecayedUsage at decayedAt, when the usage last
+	// changed.
+	decayedUsage FlavorResourceQuantities
+	decayedAt    time.Time
+	// flavorWorkloads is the number of admitted workloads that use each flavor.
+	flavorWorkloads map[kueue.ResourceFlavorReference]int
+	// pendingReservations are the pending workloads, by key, whose requests
+	// are held for them. See ReserveForPending.
+	pendingReservations map[string]*workload.Info
+
 	// The following fields are not populated in a snapshot.
 
 	// Key is localQueue's key (namespace/name).
 	localQueues       map[string]*queue
 	podsReadyTracking bool
+	// recorder, when set, receives the events about changes of the borrowing
+	// state.
+	recorder record.EventRecorder
+	// retainedLabelKeys are the keys of the ClusterQueue labels that are kept
+	// in labels.
+	retainedLabelKeys sets.Set[string]
+
+	// batchMetrics defers the report of the metrics that change on every
+	// admission to flushMetrics. metricsDirty indicates that there are metrics
+	// to report.
+	batchMetrics bool
+	metricsDirty bool
+	// simulated indicates a copy of the ClusterQueue used to simulate
+	// admissions, which doesn't report metrics. See AdmissionPlan.
+	simulated bool
+
+	// usageHistory is a ring buffer with the last usageHistoryLength samples
+	// of the usage. usageHistoryNext is the position of the next sample.
+	usageHistory     []FlavorResourceQuantities
+	usageHistoryNext int
+
+	// frozen rejects the updates of the quotas and defers the changes of the
+	// workloads. See Freeze.
+	frozen bool
+	// frozenWorkloads holds the last version of the workloads added, or nil
+	// for the ones deleted, while the ClusterQueue is frozen.
+	frozenWorkloads map[string]*kueue.Workload
+
+	// warmingUp indicates that the usage may be incomplete. Until MarkWarm is
+	// called, workloads can't borrow from the cohort.
+	warmingUp bool
+
+	// requeues tracks the admission failures of the pending workloads, by key.
+	requeues map[string]*requeueState
+	// churnEvents are the times, oldest first, of the admissions and
+	// evictions of the last churnRetention. See ChurnRate.
+	churnEvents []time.Time
+	clock       clock.Clock
+}
+
+const (
+	requeueBaseBackoff = time.Second
+	requeueMaxBackoff  = 5 * time.Minute
+
+	usageHistoryLength = 32
+
+	churnRetention = time.Hour
+)
+
+type requeueState struct {
+	count     int
+	nextRetry time.Time
+}
+
+// BorrowEvent records a change of the amount that a ClusterQueue borrows.
+type BorrowEvent struct {
+	ClusterQueue string
+	Flavor       kueue.ResourceFlavorReference
+	Resource     corev1.ResourceName
+	// BorrowedDelta is positive when the ClusterQueue borrows more, and
+	// negative when it returns borrowed quota.
+	BorrowedDelta int64
+	Timestamp     time.Time
+}
+
+// PressureCurve returns the fraction, from 0 to 1, of the nominal quota that
+// stays available under the given pressure, from 0 to 1.
+type PressureCurve func(pressure float64) float64
+
+// LinearPressureCurve returns a curve that scales the quota linearly from the
+// whole nominal quota, without pressure, down to the floor fraction of it, at
+// full pressure.
+func LinearPressureCurve(floor float64) PressureCurve {
+	return func(pressure float64) float64 {
+		return 1 - pressure*(1-floor)
+	}
+}
+
+// DefaultPressureCurve keeps half of the nominal quota at full pressure.
+var DefaultPressureCurve = LinearPressureCurve(0.5)
+
+// RampUp is a window during which the nominal quota grows linearly from 0, at
+// Start, to the whole nominal quota, at Start plus Duration.
+type RampUp struct {
+	Start    time.Time
+	Duration time.Duration
+}
+
+// fraction returns the fraction of the nominal quota available at now. It's 1
+// outside of the window, or without a ramp-up.
+func (r *RampUp) fraction(now time.Time) float64 {
+	if r == nil || now.Before(r.Start) {
+		return 1
+	}
+	elapsed := now.Sub(r.Start)
+	if elapsed >= r.Duration {
+		return 1
+	}
+	return float64(elapsed) / float64(r.Duration)
 }
 
-// Cohort is a set of ClusterQueues that can borrow resources from each other.
-type Cohort struct {
-	Name    string
-	Members sets.Set[*ClusterQueue]
+// AdmissionGate returns an error if the workload must not be admitted in the
+// ClusterQueue. It only gets read-only access to the ClusterQueue.
+type AdmissionGate func(wi *workload.Info, cq ClusterQueueView) error
+
+// FlavorOverride returns the flavor of the resource group that the workload
+// must use, and true, or false to keep the default selection of the flavor.
+// The workload is only admitted if the forced flavor has capacity for it.
+type FlavorOverride func(wi *workload.Info, rg *ResourceGroup) (kueue.ResourceFlavorReference, bool)
+
+// AdmissionCostWeights weigh the components of the cost of admitting a
+// workload.
+type AdmissionCostWeights struct {
+	// Borrowing is the cost of borrowing the equivalent of the whole nominal
+	// quota of a flavor and resource.
+	Borrowing float64
+	// Preemption is the cost of an admission that requires preemption.
+	Preemption float64
+}
 
-	// These fields are only populated for a snapshot.
-	RequestableResources FlavorResourceQuantities
-	Usage                FlavorResourceQuantities
+// DefaultAdmissionCostWeights make any admission requiring preemption more
+// costly than borrowing up to several times the nominal quota.
+var DefaultAdmissionCostWeights = AdmissionCostWeights{
+	Borrowing:  1,
+	Preemption: 10,
 }
 
+// BorrowingPolicy defines the unused quota of the cohort that a ClusterQueue
+// can borrow.
+type BorrowingPolicy string
+
+const (
+	// BorrowingPolicyAny allows borrowing any unused quota of the cohort.
+	// It's the default.
+	BorrowingPolicyAny BorrowingPolicy = "Any"
+	// BorrowingPolicyIdlePeers only allows borrowing the nominal quota of the
+	// peers that don't use the flavor and resource at all, so that the peers
+	// with usage below their nominal quota keep it available for themselves.
+	BorrowingPolicyIdlePeers BorrowingPolicy = "IdlePeers"
+)
+
+// BorrowVsPreemptPolicy defines the preference of a ClusterQueue when a
+// workload can be admitted either by borrowing or by preempting.
+type BorrowVsPreemptPolicy string
+
+const (
+	// BorrowVsPreemptPreferBorrow admits the workload by borrowing the unused
+	// quota of the cohort. It's the default.
+	BorrowVsPreemptPreferBorrow BorrowVsPreemptPolicy = "PreferBorrow"
+	// BorrowVsPreemptPreferPreempt admits the workload in the nominal quota
+	// of the ClusterQueue by preempting, if the WithinClusterQueue preemption
+	// policy allows it, so that the quota of the cohort stays unused. The
+	// workload borrows if there aren't enough workloads to preempt.
+	BorrowVsPreemptPreferPreempt BorrowVsPreemptPolicy = "PreferPreempt"
+)
+
+// FlavorUnavailablePolicy defines the behavior of a ClusterQueue when any of
+// its flavors doesn't exist.
+type FlavorUnavailablePolicy string
+
+const (
+	// FlavorUnavailablePendWholeQueue makes the ClusterQueue pending, so that
+	// it doesn't admit any workload. It's the default.
+	FlavorUnavailablePendWholeQueue FlavorUnavailablePolicy = "PendWholeQueue"
+	// FlavorUnavailableDisableGroupOnly disables only the resource groups with
+	// a missing flavor. The ClusterQueue stays active and keeps admitting the
+	// workloads that don't request the resources of those groups. It's only
+	// pending if all its resource groups are disabled.
+	FlavorUnavailableDisableGroupOnly FlavorUnavailablePolicy = "DisableGroupOnly"
+)
+
+// TerminatingLendingPolicy defines whether a terminating ClusterQueue lends
+// its unused nominal quota to the cohort.
+type TerminatingLendingPolicy string
+
+const (
+	// TerminatingKeepLending keeps counting the whole nominal quota of the
+	// terminating ClusterQueue in the cohort. It's the default.
+	TerminatingKeepLending TerminatingLendingPolicy = "KeepLending"
+	// TerminatingStopLending only counts the nominal quota that the
+	// terminating ClusterQueue uses, so that the cohort doesn't borrow its
+	// quota while its workloads drain. The snapshots already exclude the
+	// terminating ClusterQueues, as they aren't active.
+	TerminatingStopLending TerminatingLendingPolicy = "StopLending"
+)
+
+// UsageRoundingPolicy defines how the usage of a ClusterQueue is rounded when
+// it's reported.
+type UsageRoundingPolicy string
+
+const (
+	// UsageRoundingNone reports the exact usage. It's the default.
+	UsageRoundingNone UsageRoundingPolicy = "None"
+	// UsageRoundingCeilToUnit rounds the usage of cpu, tracked in millicores,
+	// up to whole cores.
+	UsageRoundingCeilToUnit UsageRoundingPolicy = "CeilToUnit"
+)
+
 type ResourceGroup struct {
 	CoveredResources sets.Set[corev1.ResourceName]
 	Flavors          []FlavorQuotas
@@ -58,237 +426,2782 @@ type ResourceGroup struct {
 	// Those keys define the affinity terms of a workload
 	// that can be matched against the flavors.
 	LabelKeys sets.Set[string]
+	// Disabled indicates that the group has a missing flavor and, under the
+	// DisableGroupOnly policy, it can't admit workloads.
+	Disabled bool
+	// NamespaceSelector, when set, restricts the resources of the group to the
+	// workloads in the matching namespaces, in addition to the NamespaceSelector
+	// of the ClusterQueue. It's set with the ResourceGroupSettingsAnnotation, as
+	// the Priority and the PreemptionPriorityThreshold.
+	NamespaceSelector labels.Selector
+	// Priority defines the order in which the groups are evaluated for the
+	// flavor assignment, highest first. See ResourceGroupsByPriority.
+	Priority int
+	// PreemptionPriorityThreshold, when set, protects the workloads that use
+	// resources of the group and have a higher priority from being selected
+	// as preemption candidates.
+	PreemptionPriorityThreshold *int32
+}
+
+// ConflictingLabelKeys returns the sorted node label keys that more than one
+// flavor of the group defines, with different values. The flavors of the group
+// that aren't in the flavors map are ignored.
+func (rg *ResourceGroup) ConflictingLabelKeys(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) []string {
+	values := make(map[string]sets.Set[string])
+	for _, fQuotas := range rg.Flavors {
+		flv, found := flavors[fQuotas.Name]
+		if !found {
+			continue
+		}
+		for k, v := range flv.Spec.NodeLabels {
+			if values[k] == nil {
+				values[k] = sets.New[string]()
+			}
+			values[k].Insert(v)
+		}
+	}
+	var conflicting []string
+	for k, v := range values {
+		if v.Len() > 1 {
+			conflicting = append(conflicting, k)
+		}
+	}
+	sort.Strings(conflicting)
+	return conflicting
+}
+
+// FlavorQuotas holds a processed ClusterQueue flavor quota.
+type FlavorQuotas struct {
+	Name      kueue.ResourceFlavorReference
+	Resources map[corev1.ResourceName]*ResourceQuota
+	// Exclusive indicates that the flavor can only be used by one workload at
+	// a time, regardless of the remaining quota. It's set with the
+	// ResourceGroupSettingsAnnotation, as MaxWorkloads.
+	Exclusive bool
+	// MaxWorkloads, when set, is the maximum number of admitted workloads that
+	// can use the flavor, regardless of the remaining quota.
+	MaxWorkloads *int
+}
+
+type ResourceQuota struct {
+	// Nominal is the nominal quota before the scaling of EffectiveNominal. It's
+	// the ConfiguredNominal, unless derived from MinNominal and MaxNominal.
+	Nominal int64
+	// ConfiguredNominal is the nominal quota in the spec.
+	ConfiguredNominal int64
+	BorrowingLimit    *int64
+	// BorrowingLimitPercent expresses the borrowing limit as a percentage of
+	// the cohort's requestable resources for the flavor and resource.
+	// When set, BorrowingLimit is derived from it every time the cohort
+	// membership changes. It can't be combined with an absolute borrowingLimit.
+	// It's set with the ResourceGroupSettingsAnnotation, as MinNominal and
+	// MaxNominal.
+	BorrowingLimitPercent *int
+	// MinNominal and MaxNominal, when both set, bound the nominal quota, which
+	// is then derived from the fraction set with SetEffectiveNominalFraction,
+	// instead of taken from the spec.
+	MinNominal *int64
+	MaxNominal *int64
+}
+
+// hasNominalBounds returns whether the nominal quota is derived from
+// MinNominal and MaxNominal.
+func (q *ResourceQuota) hasNominalBounds() bool {
+	return q.MinNominal != nil && q.MaxNominal != nil
+}
+
+// boundedNominal returns the nominal quota at the fraction f, from 0 to 1, of
+// the range between MinNominal and MaxNominal.
+func (q *ResourceQuota) boundedNominal(f float64) int64 {
+	return *q.MinNominal + int64(math.Round(f*float64(*q.MaxNominal-*q.MinNominal)))
+}
+
+// BorrowOnly returns whether the quota guarantees nothing and can only be
+// used by borrowing from the cohort, up to the borrowing limit.
+func (q *ResourceQuota) BorrowOnly() bool {
+	return q.Nominal == 0 && q.BorrowingLimit != nil
+}
+
+type FlavorResourceQuantities map[kueue.ResourceFlavorReference]map[corev1.ResourceName]int64
+
+func (q FlavorResourceQuantities) clone() FlavorResourceQuantities {
+	ret := make(FlavorResourceQuantities, len(q))
+	for fName, rQuantities := range q {
+		rQuantitiesCopy := make(map[corev1.ResourceName]int64, len(rQuantities))
+		for rName, v := range rQuantities {
+			rQuantitiesCopy[rName] = v
+		}
+		ret[fName] = rQuantitiesCopy
+	}
+	return ret
+}
+
+// LocalQueueWeightAnnotation is the annotation in a LocalQueue that holds its
+// weight, a positive integer, to split the nominal quota of the ClusterQueue
+// among its local queues. Local queues without a valid weight have a weight of
+// 1.
+const LocalQueueWeightAnnotation = "kueue.x-k8s.io/quota-weight"
+
+// AdmissionDeadlineAnnotation is the annotation in a Workload that holds the
+// time, in RFC 3339 format, after which the workload can't be admitted.
+const AdmissionDeadlineAnnotation = "kueue.x-k8s.io/admission-deadline"
+
+// BorrowingCohortAnnotation is the annotation in a Workload that holds the
+// name of the only cohort that the workload can borrow from. If the
+// ClusterQueue isn't in that cohort, the workload can't borrow.
+const BorrowingCohortAnnotation = "kueue.x-k8s.io/borrowing-cohort"
+
+// AvoidFlavorsAnnotation is the annotation in a Workload that holds a comma
+// separated list of the flavors that the workload must not be assigned, even
+// if they have capacity for it.
+const AvoidFlavorsAnnotation = "kueue.x-k8s.io/avoid-flavors"
+
+// ResourceGroupSettingsAnnotation is the annotation in a ClusterQueue that
+// holds, as JSON encoded ResourceGroupSettings, the settings of its resource
+// groups, flavors and resources that aren't part of the spec.
+const ResourceGroupSettingsAnnotation = "kueue.x-k8s.io/resource-group-settings"
+
+// ResourceGroupSettings are the settings in the
+// ResourceGroupSettingsAnnotation of a ClusterQueue.
+type ResourceGroupSettings struct {
+	// ResourceGroups are matched with the resource groups of the spec by
+	// their covered resources.
+	ResourceGroups []ResourceGroupSetting `json:"resourceGroups,omitempty"`
+	// Flavors are matched with the flavors of the spec by name.
+	Flavors []FlavorSetting `json:"flavors,omitempty"`
+}
+
+// ResourceGroupSetting holds the settings of the resource group that covers
+// exactly CoveredResources. See ResourceGroup.
+type ResourceGroupSetting struct {
+	CoveredResources            []corev1.ResourceName `json:"coveredResources"`
+	NamespaceSelector           *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	Priority                    int                   `json:"priority,omitempty"`
+	PreemptionPriorityThreshold *int32                `json:"preemptionPriorityThreshold,omitempty"`
+}
+
+// FlavorSetting holds the settings of the flavor Name. See FlavorQuotas.
+type FlavorSetting struct {
+	Name         kueue.ResourceFlavorReference `json:"name"`
+	Exclusive    bool                          `json:"exclusive,omitempty"`
+	MaxWorkloads *int                          `json:"maxWorkloads,omitempty"`
+	Resources    []ResourceSetting             `json:"resources,omitempty"`
+}
+
+// ResourceSetting holds the settings of the resource Name of a flavor. See
+// ResourceQuota.
+type ResourceSetting struct {
+	Name                  corev1.ResourceName `json:"name"`
+	BorrowingLimitPercent *int                `json:"borrowingLimitPercent,omitempty"`
+	MinNominal            *resource.Quantity  `json:"minNominal,omitempty"`
+	MaxNominal            *resource.Quantity  `json:"maxNominal,omitempty"`
+}
+
+// resourceGroupSettings parses the ResourceGroupSettingsAnnotation of the
+// ClusterQueue, if any.
+func resourceGroupSettings(cq *kueue.ClusterQueue) (*ResourceGroupSettings, error) {
+	settings := &ResourceGroupSettings{}
+	value, found := cq.Annotations[ResourceGroupSettingsAnnotation]
+	if !found {
+		return settings, nil
+	}
+	if err := json.Unmarshal([]byte(value), settings); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidResourceGroupSettings, err)
+	}
+	for _, fSetting := range settings.Flavors {
+		for _, rSetting := range fSetting.Resources {
+			if p := rSetting.BorrowingLimitPercent; p != nil && *p < 0 {
+				return nil, fmt.Errorf("%w: negative borrowingLimitPercent for %s in flavor %s", errInvalidResourceGroupSettings, rSetting.Name, fSetting.Name)
+			}
+			if (rSetting.MinNominal == nil) != (rSetting.MaxNominal == nil) {
+				return nil, fmt.Errorf("%w: minNominal and maxNominal for %s in flavor %s must be set together", errInvalidResourceGroupSettings, rSetting.Name, fSetting.Name)
+			}
+			if rSetting.MinNominal != nil && rSetting.MinNominal.Cmp(*rSetting.MaxNominal) > 0 {
+				return nil, fmt.Errorf("%w: minNominal for %s in flavor %s is greater than maxNominal", errInvalidResourceGroupSettings, rSetting.Name, fSetting.Name)
+			}
+		}
+	}
+	return settings, nil
+}
+
+func (s *ResourceGroupSettings) forResourceGroup(covered sets.Set[corev1.ResourceName]) *ResourceGroupSetting {
+	for i := range s.ResourceGroups {
+		if covered.Equal(sets.New(s.ResourceGroups[i].CoveredResources...)) {
+			return &s.ResourceGroups[i]
+		}
+	}
+	return nil
+}
+
+func (s *ResourceGroupSettings) forFlavor(fName kueue.ResourceFlavorReference) *FlavorSetting {
+	for i := range s.Flavors {
+		if s.Flavors[i].Name == fName {
+			return &s.Flavors[i]
+		}
+	}
+	return nil
+}
+
+func (s *FlavorSetting) forResource(rName corev1.ResourceName) *ResourceSetting {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Resources {
+		if s.Resources[i].Name == rName {
+			return &s.Resources[i]
+		}
+	}
+	return nil
+}
+
+type queue struct {
+	key               string
+	admittedWorkloads int
+	usage             FlavorResourceQuantities
+	weight            int64
+}
+
+// localQueueWeight returns the weight of the LocalQueue from its annotation.
+func localQueueWeight(q *kueue.LocalQueue) int64 {
+	if w, err := strconv.ParseInt(q.Annotations[LocalQueueWeightAnnotation], 10, 64); err == nil && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (c *ClusterQueue) GetName() string {
+	return c.Name
+}
+
+func (c *ClusterQueue) GetUsage() FlavorResourceQuantities {
+	return c.Usage.clone()
+}
+
+// UsageSummary returns a one line summary of the usage, suitable for logs,
+// like "flavorA{cpu:3,memory:6Gi} flavorB{gpu:1}". The flavors and resources
+// are sorted by name and those that aren't used are omitted.
+func (c *ClusterQueue) UsageSummary() string {
+	fNames := make([]string, 0, len(c.Usage))
+	for fName := range c.Usage {
+		fNames = append(fNames, string(fName))
+	}
+	sort.Strings(fNames)
+	var b strings.Builder
+	for _, fName := range fNames {
+		rUsage := c.Usage[kueue.ResourceFlavorReference(fName)]
+		rNames := make([]string, 0, len(rUsage))
+		for rName, v := range rUsage {
+			if v != 0 {
+				rNames = append(rNames, string(rName))
+			}
+		}
+		if len(rNames) == 0 {
+			continue
+		}
+		sort.Strings(rNames)
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fName)
+		b.WriteByte('{')
+		for i, rName := range rNames {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			q := workload.ResourceQuantity(corev1.ResourceName(rName), rUsage[corev1.ResourceName(rName)])
+			fmt.Fprintf(&b, "%s:%s", rName, q.String())
+		}
+		b.WriteByte('}')
+	}
+	return b.String()
+}
+
+func (c *ClusterQueue) IsBorrowing() bool {
+	if c.Cohort == nil || len(c.Usage) == 0 {
+		return false
+	}
+	for _, rg := range c.ResourceGroups {
+		for _, flvQuotas := range rg.Flavors {
+			if flvUsage, isUsing := c.Usage[flvQuotas.Name]; isUsing {
+				for rName, rQuota := range flvQuotas.Resources {
+					used := flvUsage[rName]
+					if c.overNominal(used, rQuota) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// HasNegativeUsage returns the first resource, in the order of ForEachQuota,
+// with a negative usage for any flavor, which can only be the result of a bug
+// in the accounting, like deleting a workload twice. It logs the negative
+// usage, if found.
+func (c *ClusterQueue) HasNegativeUsage() (corev1.ResourceName, bool) {
+	var found bool
+	var negative corev1.ResourceName
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, _ *ResourceQuota) {
+		if v := c.Usage[fName][rName]; !found && v < 0 {
+			found = true
+			negative = rName
+			ctrl.Log.WithName("cache").Error(nil, "Negative usage in ClusterQueue", "clusterQueue", klog.KRef("", c.Name), "flavor", fName, "resource", rName, "usage", v)
+		}
+	})
+	return negative, found
+}
+
+// SharesCohortWith returns whether both ClusterQueues belong to the same
+// cohort, which is required to borrow from each other.
+func (c *ClusterQueue) SharesCohortWith(other *ClusterQueue) bool {
+	return c.Cohort != nil && c.Cohort == other.Cohort
+}
+
+func (c *ClusterQueue) Active() bool {
+	return c.Status == active
+}
+
+// PreemptionCandidates returns the workloads admitted in the ClusterQueue that
+// the WithinClusterQueue policy allows wl to preempt, sorted by PreemptionScore,
+// highest first. Workloads that are still in their preemption protection window,
+// or above the PreemptionPriorityThreshold of a resource group they use, are
+// excluded.
+func (c *ClusterQueue) PreemptionCandidates(wl *kueue.Workload, now time.Time) []*workload.Info {
+	if c.Preemption.WithinClusterQueue == kueue.PreemptionPolicyNever {
+		return nil
+	}
+	var candidates []*workload.Info
+	wlPriority := priority.Priority(wl)
+	considerSamePrio := c.Preemption.WithinClusterQueue == kueue.PreemptionPolicyLowerOrNewerEqualPriority
+	preemptorTS := workload.GetQueueOrderTimestamp(wl)
+	for _, candidateWl := range c.Workloads {
+		candidatePriority := priority.Priority(candidateWl.Obj)
+		if candidatePriority > wlPriority {
+			continue
+		}
+		if candidatePriority == wlPriority && !(considerSamePrio && preemptorTS.Before(workload.GetQueueOrderTimestamp(candidateWl.Obj))) {
+			continue
+		}
+		if c.InPreemptionProtectionWindow(candidateWl, now) || c.AbovePreemptionPriorityThreshold(candidateWl) {
+			continue
+		}
+		candidates = append(candidates, candidateWl)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		si, sj := c.PreemptionScore(candidates[i]), c.PreemptionScore(candidates[j])
+		if si != sj {
+			return si > sj
+		}
+		return workload.Key(candidates[i].Obj) < workload.Key(candidates[j].Obj)
+	})
+	return candidates
+}
+
+// PreemptionScore returns how much the workload is preferred as a preemption
+// victim. It's the footprint of the workload, as the sum of its requests
+// relative to the nominal quota of the ClusterQueue, scaled by the inverse of
+// its priority: 1/(1+p) for non-negative priorities and 1+|p| for negative
+// ones. So a big workload scores higher than a small one of the same priority,
+// and a low-priority workload scores higher than a high-priority one of the
+// same size.
+func (c *ClusterQueue) PreemptionScore(wi *workload.Info) float64 {
+	var footprint float64
+	for fName, rRequests := range workloadRequests(wi) {
+		for rName, v := range rRequests {
+			if rQuota := c.quotaFor(fName, rName); rQuota != nil && rQuota.Nominal > 0 {
+				footprint += float64(v) / float64(rQuota.Nominal)
+			}
+		}
+	}
+	p := float64(priority.Priority(wi.Obj))
+	if p >= 0 {
+		return footprint / (1 + p)
+	}
+	return footprint * (1 - p)
+}
+
+// PendingByAge returns the pending workloads ordered by creation time, oldest
+// first, and by name for the workloads created at the same time. The input
+// slice isn't modified.
+func (c *ClusterQueue) PendingByAge(pending []*workload.Info) []*workload.Info {
+	sorted := make([]*workload.Info, len(pending))
+	copy(sorted, pending)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Obj, sorted[j].Obj
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+		return a.Name < b.Name
+	})
+	return sorted
+}
+
+// WorkloadsOnFlavor returns the admitted workloads that use the flavor for any
+// resource, sorted by key.
+func (c *ClusterQueue) WorkloadsOnFlavor(flavor kueue.ResourceFlavorReference) []*workload.Info {
+	var wis []*workload.Info
+	for _, wi := range c.Workloads {
+		if _, found := workloadRequests(wi)[flavor]; found {
+			wis = append(wis, wi)
+		}
+	}
+	sort.Slice(wis, func(i, j int) bool {
+		return workload.Key(wis[i].Obj) < workload.Key(wis[j].Obj)
+	})
+	return wis
+}
+
+// InPreemptionProtectionWindow returns whether the workload was admitted by
+// the ClusterQueue too recently to be preempted.
+func (c *ClusterQueue) InPreemptionProtectionWindow(wi *workload.Info, now time.Time) bool {
+	if c.PreemptionProtectionWindow <= 0 {
+		return false
+	}
+	admitted, ok := admissionTime(wi.Obj)
+	if !ok {
+		return false
+	}
+	return now.Sub(admitted) < c.PreemptionProtectionWindow
+}
+
+// AbovePreemptionPriorityThreshold returns whether the workload uses resources
+// of a group with a PreemptionPriorityThreshold lower than its priority, which
+// protects it from preemption.
+func (c *ClusterQueue) AbovePreemptionPriorityThreshold(wi *workload.Info) bool {
+	p := priority.Priority(wi.Obj)
+	for _, rRequests := range workloadRequests(wi) {
+		for rName := range rRequests {
+			if rg := c.RGByResource[rName]; rg != nil && rg.PreemptionPriorityThreshold != nil && p > *rg.PreemptionPriorityThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admissionTime returns the time at which the workload was admitted, if it's
+// admitted.
+func admissionTime(wl *kueue.Workload) (time.Time, bool) {
+	cond := apimeta.FindStatusCondition(wl.Status.Conditions, kueue.WorkloadAdmitted)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		return time.Time{}, false
+	}
+	return cond.LastTransitionTime.Time, true
+}
+
+var defaultPreemption = kueue.ClusterQueuePreemption{
+	ReclaimWithinCohort: kueue.PreemptionPolicyNever,
+	WithinClusterQueue:  kueue.PreemptionPolicyNever,
+}
+
+// flavorQuotas returns the quotas for the flavor, or nil if the ClusterQueue
+// doesn't define any.
+func (c *ClusterQueue) flavorQuotas(fName kueue.ResourceFlavorReference) *FlavorQuotas {
+	return findFlavorQuotas(c.ResourceGroups, fName)
+}
+
+// CanFit returns whether the workload fits in the available quota of the
+// ClusterQueue, including what can be borrowed from the cohort, and respects
+// the flavor constraints.
+func (c *ClusterQueue) CanFit(wi *workload.Info) bool {
+	if err := c.checkAdmissible(wi); err != nil {
+		return false
+	}
+	if c.IsSystemWorkload(wi) {
+		return true
+	}
+	if c.warmingUp && !c.FitsWithoutCohort(wi) {
+		return false
+	}
+	if !c.BorrowingAllowedFor(wi) && !c.FitsWithoutCohort(wi) {
+		return false
+	}
+	return len(c.Shortfall(wi)) == 0
+}
+
+// checkAdmissible runs the admission checks of the workload that don't depend
+// on the quota, which releasing quota can't change.
+func (c *ClusterQueue) checkAdmissible(wi *workload.Info) error {
+	if err := CheckAdmissionDeadline(wi, c.now()); err != nil {
+		return err
+	}
+	if err := c.RunAdmissionGates(wi); err != nil {
+		return err
+	}
+	if err := checkAvoidedFlavors(wi); err != nil {
+		return err
+	}
+	if err := c.checkFlavorConstraints(wi); err != nil {
+		return err
+	}
+	return c.checkGroupsEnabled(wi)
+}
+
+// BorrowingAllowedFor returns whether the BorrowingCohortAnnotation of the
+// workload, if any, allows it to borrow from the cohort of the ClusterQueue.
+func (c *ClusterQueue) BorrowingAllowedFor(wi *workload.Info) bool {
+	name, found := wi.Obj.Annotations[BorrowingCohortAnnotation]
+	if !found {
+		return true
+	}
+	return c.Cohort != nil && c.Cohort.Name == name
+}
+
+// ReserveForPending holds the requests of the pending workloads, so that the
+// workloads with a lower priority don't take the quota they need. It replaces
+// the previous reservations. The workloads must have the flavors assigned, the
+// reservation only applies to those flavors. The reservation of a workload is
+// released when it's admitted or with ReleaseReservation.
+func (c *ClusterQueue) ReserveForPending(wis []*workload.Info) {
+	c.pendingReservations = make(map[string]*workload.Info, len(wis))
+	for _, wi := range wis {
+		c.pendingReservations[workload.Key(wi.Obj)] = wi
+	}
+}
+
+// ReleaseReservation releases the reservation of the pending workload with the
+// key, for example, when it's deleted.
+func (c *ClusterQueue) ReleaseReservation(key string) {
+	delete(c.pendingReservations, key)
+}
+
+// ReservedFor returns the quota reserved for the pending workloads with a
+// higher priority than the workload. The flavor assigner doesn't assign it to
+// the workload.
+func (c *ClusterQueue) ReservedFor(wi *workload.Info) FlavorResourceQuantities {
+	if len(c.pendingReservations) == 0 {
+		return nil
+	}
+	p := priority.Priority(wi.Obj)
+	reserved := make(FlavorResourceQuantities)
+	for _, pending := range c.pendingReservations {
+		if priority.Priority(pending.Obj) <= p {
+			continue
+		}
+		for fName, rRequests := range c.accountedRequests(pending) {
+			if reserved[fName] == nil {
+				reserved[fName] = make(map[corev1.ResourceName]int64, len(rRequests))
+			}
+			for rName, v := range rRequests {
+				reserved[fName][rName] += v
+			}
+		}
+	}
+	return reserved
+}
+
+// IsSystemWorkload returns whether the workload has the SystemWorkloadLabel
+// set to "true".
+func (c *ClusterQueue) IsSystemWorkload(wi *workload.Info) bool {
+	return c.SystemWorkloadLabel != "" && wi.Obj.Labels[c.SystemWorkloadLabel] == "true"
+}
+
+// UnusedSystemReservation returns the part of the SystemReservation for the
+// flavor and resource that the system workloads don't use. The flavor assigner
+// doesn't assign it to regular workloads.
+func (c *ClusterQueue) UnusedSystemReservation(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	if unused := c.SystemReservation[fName][rName] - c.SystemUsage[fName][rName]; unused > 0 {
+		return unused
+	}
+	return 0
+}
+
+// RemainingQuota returns the nominal quota for the flavor and resource that
+// regular workloads can still use, excluding the unused SystemReservation.
+func (c *ClusterQueue) RemainingQuota(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	remaining := c.EffectiveNominal(fName, rName) - c.Usage[fName][rName] - c.UnusedSystemReservation(fName, rName)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// BorrowingHeadroom returns how much more of the flavor and resource the
+// ClusterQueue can borrow from the cohort before reaching its borrowing limit.
+// It returns math.MaxInt64 when there is no borrowing limit, and 0 when the
+// ClusterQueue isn't in a cohort.
+func (c *ClusterQueue) BorrowingHeadroom(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	rQuota := c.quotaFor(fName, rName)
+	if c.Cohort == nil || rQuota == nil {
+		return 0
+	}
+	borrowingLimit := c.BorrowingLimit(rQuota)
+	if borrowingLimit == nil {
+		return math.MaxInt64
+	}
+	if headroom := *borrowingLimit - c.borrowed(fName, rName); headroom > 0 {
+		return headroom
+	}
+	return 0
+}
+
+// MinHeadroomRatio returns the smallest (Nominal-Usage)/Nominal across the
+// flavors and resources of the ClusterQueue, where Nominal is the
+// EffectiveNominal, which is negative when the ClusterQueue borrows. The
+// resources without nominal quota are ignored. It returns 1 when no resource
+// has nominal quota.
+func (c *ClusterQueue) MinHeadroomRatio() float64 {
+	minRatio := 1.0
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, _ *ResourceQuota) {
+		nominal := c.EffectiveNominal(fName, rName)
+		if nominal == 0 {
+			return
+		}
+		if r := float64(nominal-c.Usage[fName][rName]) / float64(nominal); r < minRatio {
+			minRatio = r
+		}
+	})
+	return minRatio
+}
+
+// TotalAvailable returns, per flavor and resource, the quota that the
+// ClusterQueue can still admit: its RemainingQuota plus its BorrowingHeadroom,
+// where the latter is bounded by what the cohort has available for it.
+func (c *ClusterQueue) TotalAvailable() FlavorResourceQuantities {
+	var cohortAvailable FlavorResourceQuantities
+	if c.Cohort != nil {
+		cohortAvailable = c.Cohort.AvailableFor(c)
+	}
+	total := make(FlavorResourceQuantities)
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, _ *ResourceQuota) {
+		if total[fName] == nil {
+			total[fName] = make(map[corev1.ResourceName]int64)
+		}
+		borrowable := c.BorrowingHeadroom(fName, rName)
+		if available := cohortAvailable[fName][rName]; available < borrowable {
+			borrowable = available
+		}
+		total[fName][rName] = c.RemainingQuota(fName, rName) + borrowable
+	})
+	return total
+}
+
+// LargestFit returns the largest RemainingQuota of the resource in a single
+// flavor, that is, the largest request for the resource that can be placed
+// in the nominal quota. It can be lower than the total remaining quota when
+// it's fragmented across flavors. The disabled resource groups are ignored.
+// The request is deflated by the SafetyMargin, so that it fits once inflated.
+func (c *ClusterQueue) LargestFit(rName corev1.ResourceName) int64 {
+	rg := c.RGByResource[rName]
+	if rg == nil || rg.Disabled {
+		return 0
+	}
+	var largest int64
+	for _, fQuotas := range rg.Flavors {
+		if _, found := fQuotas.Resources[rName]; !found {
+			continue
+		}
+		if remaining := c.RemainingQuota(fQuotas.Name, rName); remaining > largest {
+			largest = remaining
+		}
+	}
+	if c.SafetyMargin > 0 {
+		largest = int64(math.Floor(float64(largest) / (1 + c.SafetyMargin)))
+	}
+	return largest
+}
+
+// CheckNamespaceForResourceGroups verifies that the namespace labels match the
+// NamespaceSelector of the resource groups covering the resources requested
+// by the workload. The NamespaceSelector of the ClusterQueue isn't checked.
+func (c *ClusterQueue) CheckNamespaceForResourceGroups(wi *workload.Info, nsLabels map[string]string) error {
+	for _, ps := range wi.TotalRequests {
+		for rName := range ps.Requests {
+			rg := c.RGByResource[rName]
+			if rg != nil && rg.NamespaceSelector != nil && !rg.NamespaceSelector.Matches(labels.Set(nsLabels)) {
+				return fmt.Errorf("%w: resource %s", errNamespaceNotInGroup, rName)
+			}
+		}
+	}
+	return nil
+}
+
+// checkGroupsEnabled verifies that none of the resources assigned to the
+// workload belongs to a disabled resource group.
+func (c *ClusterQueue) checkGroupsEnabled(wi *workload.Info) error {
+	for _, ps := range wi.TotalRequests {
+		for rName := range ps.Flavors {
+			if rg := c.RGByResource[rName]; rg != nil && rg.Disabled {
+				return fmt.Errorf("%w: resource %s", errResourceGroupDisabled, rName)
+			}
+		}
+	}
+	return nil
+}
+
+// CouldEverFit returns whether the workload would fit in the ClusterQueue if
+// no quota was used, which is up to the nominal quota plus the borrowing
+// limit, and up to the quota of the cohort, for the assigned flavors.
+// The workloads that fit eventually are distinguished from those too big to
+// ever be admitted.
+func (c *ClusterQueue) CouldEverFit(wi *workload.Info) bool {
+	for fName, rRequests := range c.accountedRequests(wi) {
+		for rName, v := range rRequests {
+			rQuota := c.quotaFor(fName, rName)
+			if rQuota == nil {
+				return false
+			}
+			ceiling := rQuota.Nominal
+			if c.Cohort != nil {
+				ceiling = c.Cohort.requestable(fName, rName)
+				if borrowingLimit := c.BorrowingLimit(rQuota); borrowingLimit != nil && rQuota.Nominal+*borrowingLimit < ceiling {
+					ceiling = rQuota.Nominal + *borrowingLimit
+				}
+			}
+			if v > ceiling {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AdmissionSimulation is the result of the checks for the admission of a
+// workload in a ClusterQueue. See ClusterQueue.Simulate.
+type AdmissionSimulation struct {
+	// Fits indicates that the workload can be admitted now.
+	Fits bool
+	// WouldBorrow indicates that the workload doesn't fit in the remaining
+	// nominal quota, so it needs quota from the cohort.
+	WouldBorrow bool
+	// Shortfall is the quota missing for the workload to fit, per flavor and
+	// resource.
+	Shortfall FlavorResourceQuantities
+	// RequiresPreemption indicates that the workload doesn't fit now, but it
+	// would if quota was released by preempting the workloads that the
+	// Preemption policies of the ClusterQueue allow it to preempt. It's false
+	// when the workload is rejected for reasons other than the quota.
+	RequiresPreemption bool
+}
+
+// Simulate runs the admission checks for the workload without modifying the
+// ClusterQueue.
+func (c *ClusterQueue) Simulate(wi *workload.Info) AdmissionSimulation {
+	fits := c.CanFit(wi)
+	return AdmissionSimulation{
+		Fits:               fits,
+		WouldBorrow:        c.Cohort != nil && !c.FitsWithoutCohort(wi),
+		Shortfall:          c.Shortfall(wi),
+		RequiresPreemption: !fits && c.requiresPreemption(wi),
+	}
+}
+
+// requiresPreemption returns whether the workload passes the admission checks
+// that don't depend on the quota and its shortfall can be covered, within the
+// nominal quota, by preempting the candidates of the ClusterQueue and
+// reclaiming the quota borrowed by the cohort. Reclaiming only covers up to
+// the unused nominal quota of the ClusterQueue.
+func (c *ClusterQueue) requiresPreemption(wi *workload.Info) bool {
+	if c.checkAdmissible(wi) != nil {
+		return false
+	}
+	short := c.Shortfall(wi)
+	if len(short) == 0 {
+		return false
+	}
+	now := c.now()
+	requests := c.accountedRequests(wi)
+	candidates := c.PreemptionCandidates(wi.Obj, now)
+	for fName, rShort := range short {
+		for rName, s := range rShort {
+			if c.Exceeds(requests[fName][rName] - c.EffectiveNominal(fName, rName) + c.UnusedSystemReservation(fName, rName)) {
+				return false
+			}
+			var freed int64
+			for _, candidate := range candidates {
+				freed += c.accountedRequests(candidate)[fName][rName]
+			}
+			if c.Cohort != nil && c.Exceeds(s-freed) {
+				var reclaimed int64
+				for _, candidate := range c.Cohort.PreemptionCandidates(wi.Obj, fName, rName, s-freed, c, now) {
+					reclaimed += c.accountedRequests(candidate)[fName][rName]
+				}
+				// The preempted candidates of the ClusterQueue leave more of its
+				// nominal quota unused.
+				if unused := c.EffectiveNominal(fName, rName) - c.Usage[fName][rName] + freed; reclaimed > unused {
+					reclaimed = unused
+				}
+				if reclaimed > 0 {
+					freed += reclaimed
+				}
+			}
+			if c.Exceeds(s - freed) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AdmissionPlan simulates admitting the candidates in order, each one on top of
+// the candidates admitted before it, and returns the keys of the candidates
+// that would be admitted and rejected. A rejected candidate doesn't stop the
+// simulation. The candidates must have the flavors assigned. The simulation
+// runs on a copy of the ClusterQueue and its cohort, the ClusterQueue is left
+// as it was.
+func (c *ClusterQueue) AdmissionPlan(candidates []*workload.Info) (admitted []string, rejected []string) {
+	plan := c.simulationCopy()
+	for _, wi := range candidates {
+		key := workload.Key(wi.Obj)
+		if !plan.CanFit(wi) || plan.addWorkload(wi.Obj) != nil {
+			rejected = append(rejected, key)
+			continue
+		}
+		admitted = append(admitted, key)
+	}
+	return admitted, rejected
+}
+
+// simulationCopy returns a copy of the ClusterQueue where workloads can be
+// added without modifying the ClusterQueue or reporting metrics. The copy is
+// a member of a copy of the cohort, which references the other members.
+func (c *ClusterQueue) simulationCopy() *ClusterQueue {
+	cc := c.snapshot()
+	cc.simulated = true
+	cc.clock = c.clock
+	cc.pressure = c.pressure
+	cc.sampledAt = c.sampledAt
+	cc.TerminatingLendingPolicy = c.TerminatingLendingPolicy
+	if c.Cohort == nil {
+		return cc
+	}
+	cohort := newCohort(c.Cohort.Name, c.Cohort.Members.Len())
+	cohort.parent = c.Cohort.parent
+	for member := range c.Cohort.Members {
+		if member == c {
+			member = cc
+		}
+		cohort.Members.Insert(member)
+	}
+	cc.Cohort = cohort
+	return cc
+}
+
+// WorkloadValidationError is the error returned by ValidateWorkload. It lists
+// the requests of the workload that the ClusterQueue can't account for.
+type WorkloadValidationError struct {
+	// UncoveredResources are the resources requested by the workload that
+	// the ClusterQueue, or the flavor assigned to them, doesn't define a quota
+	// for, sorted by name.
+	UncoveredResources []corev1.ResourceName
+	// UnknownFlavors are the flavors assigned to the workload that the
+	// ClusterQueue doesn't define, sorted by name.
+	UnknownFlavors []kueue.ResourceFlavorReference
+}
+
+func (e *WorkloadValidationError) Error() string {
+	var problems []string
+	if len(e.UncoveredResources) > 0 {
+		problems = append(problems, fmt.Sprintf("uncovered resources %v", e.UncoveredResources))
+	}
+	if len(e.UnknownFlavors) > 0 {
+		problems = append(problems, fmt.Sprintf("unknown flavors %v", e.UnknownFlavors))
+	}
+	return fmt.Sprintf("workload isn't valid for ClusterQueue: %s", strings.Join(problems, ", "))
+}
+
+// ValidateWorkload verifies that the ClusterQueue defines a quota for every
+// resource that the workload requests and every flavor assigned to it. It
+// returns a *WorkloadValidationError otherwise.
+func (c *ClusterQueue) ValidateWorkload(wi *workload.Info) error {
+	uncovered := sets.New[corev1.ResourceName]()
+	unknown := sets.New[kueue.ResourceFlavorReference]()
+	for _, ps := range wi.TotalRequests {
+		for rName := range ps.Requests {
+			fName, assigned := ps.Flavors[rName]
+			switch {
+			case c.RGByResource[rName] == nil:
+				uncovered.Insert(rName)
+			case !assigned:
+				// The flavor is verified once it's assigned.
+			case c.flavorQuotas(fName) == nil:
+				unknown.Insert(fName)
+			case c.quotaFor(fName, rName) == nil:
+				uncovered.Insert(rName)
+			}
+		}
+	}
+	if uncovered.Len() == 0 && unknown.Len() == 0 {
+		return nil
+	}
+	return &WorkloadValidationError{
+		UncoveredResources: sets.List(uncovered),
+		UnknownFlavors:     sets.List(unknown),
+	}
+}
+
+// checkRequestsCovered verifies that the ClusterQueue defines a quota for all
+// the flavors and resources assigned to the workload, so that its usage is
+// either fully counted or not counted at all.
+func (c *ClusterQueue) checkRequestsCovered(wi *workload.Info) error {
+	for fName, rRequests := range workloadRequests(wi) {
+		for rName := range rRequests {
+			if _, covered := c.Usage[fName][rName]; !covered {
+				return fmt.Errorf("%w: flavor %s, resource %s", errFlavorResourceNotCovered, fName, rName)
+			}
+		}
+	}
+	return nil
+}
+
+// reportedQuantity returns the quantity to report for the value of the
+// resource, rounded according to the UsageRounding policy.
+// It must not be used for admission decisions.
+func (c *ClusterQueue) reportedQuantity(rName corev1.ResourceName, v int64) resource.Quantity {
+	if c.UsageRounding == UsageRoundingCeilToUnit && rName == corev1.ResourceCPU && v%1000 != 0 {
+		v = (v/1000 + 1) * 1000
+	}
+	return workload.ResourceQuantity(rName, v)
+}
+
+// RunAdmissionGates runs the AdmissionGates for the pending workload and
+// returns the first error.
+func (c *ClusterQueue) RunAdmissionGates(wi *workload.Info) error {
+	for _, gate := range c.AdmissionGates {
+		if err := gate(wi, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckAdmissionDeadline verifies that admitting the workload at the given
+// time meets the deadline in its AdmissionDeadlineAnnotation, if any. Invalid
+// deadlines are ignored. The scheduler checks it before assigning flavors; the
+// workloads already admitted are accounted for regardless of the deadline.
+func CheckAdmissionDeadline(wi *workload.Info, at time.Time) error {
+	value, found := wi.Obj.Annotations[AdmissionDeadlineAnnotation]
+	if !found {
+		return nil
+	}
+	deadline, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil
+	}
+	if at.After(deadline) {
+		return fmt.Errorf("%w: deadline was %s", errAdmissionDeadlinePassed, value)
+	}
+	return nil
+}
+
+// AvoidedFlavors returns the flavors in the AvoidFlavorsAnnotation of the
+// workload.
+func AvoidedFlavors(wi *workload.Info) sets.Set[kueue.ResourceFlavorReference] {
+	avoided := sets.New[kueue.ResourceFlavorReference]()
+	for _, name := range strings.Split(wi.Obj.Annotations[AvoidFlavorsAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			avoided.Insert(kueue.ResourceFlavorReference(name))
+		}
+	}
+	return avoided
+}
+
+// checkAvoidedFlavors verifies that the workload isn't assigned any of the
+// flavors that it avoids.
+func checkAvoidedFlavors(wi *workload.Info) error {
+	avoided := AvoidedFlavors(wi)
+	if avoided.Len() == 0 {
+		return nil
+	}
+	for fName := range workloadRequests(wi) {
+		if avoided.Has(fName) {
+			return fmt.Errorf("%w: %s", errFlavorAvoided, fName)
+		}
+	}
+	return nil
+}
+
+// checkFlavorConstraints verifies that the workload can use the flavors
+// assigned to it, besides the quota.
+func (c *ClusterQueue) checkFlavorConstraints(wi *workload.Info) error {
+	for fName := range workloadRequests(wi) {
+		if holder, held := c.ExclusiveFlavorHolder(fName); held && holder != workload.Key(wi.Obj) {
+			return fmt.Errorf("%w: flavor %s is used by workload %s", errExclusiveFlavorInUse, fName, holder)
+		}
+	}
+	return c.checkFlavorWorkloadsLimit(wi)
+}
+
+// checkFlavorWorkloadsLimit verifies that the flavors assigned to the workload
+// didn't reach their MaxWorkloads.
+func (c *ClusterQueue) checkFlavorWorkloadsLimit(wi *workload.Info) error {
+	// An admitted workload is already counted.
+	if _, admitted := c.Workloads[workload.Key(wi.Obj)]; admitted {
+		return nil
+	}
+	for fName := range workloadRequests(wi) {
+		if c.FlavorAtWorkloadsLimit(fName) {
+			return fmt.Errorf("%w: flavor %s has %d workloads", errFlavorWorkloadsLimit, fName, c.flavorWorkloads[fName])
+		}
+	}
+	return nil
+}
+
+// FlavorAtWorkloadsLimit returns whether the admitted workloads that use the
+// flavor reached its MaxWorkloads. The flavor assigner doesn't assign such a
+// flavor to workloads that aren't admitted yet.
+func (c *ClusterQueue) FlavorAtWorkloadsLimit(fName kueue.ResourceFlavorReference) bool {
+	fQuotas := c.flavorQuotas(fName)
+	return fQuotas != nil && fQuotas.MaxWorkloads != nil && c.flavorWorkloads[fName] >= *fQuotas.MaxWorkloads
+}
+
+// AssignedFlavors returns the flavor assigned to each resource of the admitted
+// workload with the key, as recorded when it was added to the ClusterQueue.
+// When the pod sets of the workload use different flavors for the same
+// resource, the flavor of the first pod set is returned.
+func (c *ClusterQueue) AssignedFlavors(key string) (map[corev1.ResourceName]kueue.ResourceFlavorReference, bool) {
+	wi, found := c.Workloads[key]
+	if !found {
+		return nil, false
+	}
+	assigned := make(map[corev1.ResourceName]kueue.ResourceFlavorReference)
+	for _, ps := range wi.TotalRequests {
+		for rName, fName := range ps.Flavors {
+			if _, set := assigned[rName]; !set {
+				assigned[rName] = fName
+			}
+		}
+	}
+	return assigned, true
+}
+
+// ExclusiveFlavorHolder returns the key of the admitted workload that uses the
+// flavor, if the flavor is exclusive. The flavor assigner doesn't assign a
+// held exclusive flavor to other workloads.
+func (c *ClusterQueue) ExclusiveFlavorHolder(fName kueue.ResourceFlavorReference) (string, bool) {
+	if fQuotas := c.flavorQuotas(fName); fQuotas == nil || !fQuotas.Exclusive {
+		return "", false
+	}
+	for k, wi := range c.Workloads {
+		if _, uses := workloadRequests(wi)[fName]; uses {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// quotaFor returns the quota for the flavor and resource, or nil if the
+// ClusterQueue doesn't define one.
+func (c *ClusterQueue) quotaFor(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) *ResourceQuota {
+	rg := c.RGByResource[rName]
+	if rg == nil {
+		return nil
+	}
+	for i := range rg.Flavors {
+		if rg.Flavors[i].Name == fName {
+			return rg.Flavors[i].Resources[rName]
+		}
+	}
+	return nil
+}
+
+// available returns how much of the flavor and resource can still be used by
+// the ClusterQueue, including what it can borrow from the cohort.
+func (c *ClusterQueue) available(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	rQuota := c.quotaFor(fName, rName)
+	if rQuota == nil {
+		return 0
+	}
+	used := c.Usage[fName][rName]
+	nominal := c.scaleNominal(rQuota.Nominal)
+	if c.Cohort == nil {
+		return nominal - used
+	}
+	available := c.Cohort.requestable(fName, rName) - c.Cohort.used(fName, rName)
+	if c.BorrowingPolicy == BorrowingPolicyIdlePeers {
+		if limit := nominal - used + c.Cohort.IdlePeersNominal(fName, rName, c); limit < available {
+			available = limit
+		}
+	}
+	if borrowingLimit := c.BorrowingLimit(rQuota); borrowingLimit != nil {
+		if limit := nominal + *borrowingLimit - used; limit < available {
+			available = limit
+		}
+	}
+	return available
+}
+
+// cohortNominal returns the nominal quota for the flavor and resource that the
+// ClusterQueue contributes to its cohort. See TerminatingLendingPolicy.
+func (c *ClusterQueue) cohortNominal(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) int64 {
+	if c.Status != terminating || c.TerminatingLendingPolicy != TerminatingStopLending {
+		return rQuota.Nominal
+	}
+	if used := c.Usage[fName][rName]; used < rQuota.Nominal {
+		return used
+	}
+	return rQuota.Nominal
+}
+
+// BorrowingLimit returns the borrowing limit of the quota or, if it doesn't
+// define one, the DefaultBorrowingLimit of the ClusterQueue.
+func (c *ClusterQueue) BorrowingLimit(rQuota *ResourceQuota) *int64 {
+	if rQuota.BorrowingLimit != nil {
+		return rQuota.BorrowingLimit
+	}
+	return c.DefaultBorrowingLimit
+}
+
+// EffectiveNominal returns the nominal quota for the flavor and resource,
+// scaled down by the PressureCurve according to the last pressure sampled from
+// the PressureProvider, and by the RampUp at the time of that sample. It's the
+// nominal quota when there is no PressureProvider and no RampUp. The quota
+// checks, the borrowing accounting and the requestable quota of the cohort use
+// it instead of the nominal quota.
+func (c *ClusterQueue) EffectiveNominal(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	rQuota := c.quotaFor(fName, rName)
+	if rQuota == nil {
+		return 0
+	}
+	return c.scaleNominal(rQuota.Nominal)
+}
+
+// scaleNominal scales the nominal quota down according to the last sample.
+// See EffectiveNominal.
+func (c *ClusterQueue) scaleNominal(nominal int64) int64 {
+	return c.scaleNominalAt(nominal, c.sampledAt)
+}
+
+// scaleNominalAt scales the nominal quota down according to the last sampled
+// pressure and to the RampUp at now.
+func (c *ClusterQueue) scaleNominalAt(nominal int64, now time.Time) int64 {
+	if c.PressureProvider == nil && c.RampUp == nil {
+		return nominal
+	}
+	factor := c.RampUp.fraction(now)
+	if c.PressureProvider != nil {
+		curve := c.PressureCurve
+		if curve == nil {
+			curve = DefaultPressureCurve
+		}
+		pressureFactor := curve(c.pressure)
+		if pressureFactor < 0 {
+			pressureFactor = 0
+		} else if pressureFactor > 1 {
+			pressureFactor = 1
+		}
+		factor *= pressureFactor
+	}
+	return int64(math.Round(float64(nominal) * factor))
+}
+
+// SamplePressure records the pressure reported by the PressureProvider, if
+// any, and the time at which the RampUp is evaluated, which EffectiveNominal
+// uses until the next sample. The snapshots sample it when they are taken.
+func (c *ClusterQueue) SamplePressure() {
+	c.sampledAt = c.now()
+	if c.PressureProvider == nil {
+		return
+	}
+	pressure := c.PressureProvider()
+	if pressure < 0 {
+		pressure = 0
+	} else if pressure > 1 {
+		pressure = 1
+	}
+	c.pressure = pressure
+}
+
+// QuotaDivergence returns, per flavor and resource, the nominal quota in effect
+// at now, see EffectiveNominal, minus the ConfiguredNominal. It's zero
+// everywhere when no dynamic adjustment of the nominal quota is active: the
+// MinNominal and MaxNominal bounds, the pressure scaling, with the last sampled
+// pressure, or the RampUp window.
+func (c *ClusterQueue) QuotaDivergence(now time.Time) FlavorResourceQuantities {
+	divergence := make(FlavorResourceQuantities)
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+		if divergence[fName] == nil {
+			divergence[fName] = make(map[corev1.ResourceName]int64)
+		}
+		divergence[fName][rName] = c.scaleNominalAt(rQuota.Nominal, now) - rQuota.ConfiguredNominal
+	})
+	return divergence
+}
+
+// ForEachQuota calls fn for every flavor and resource with a quota in the
+// ClusterQueue, sorted by flavor name and then by resource name.
+func (c *ClusterQueue) ForEachQuota(fn func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota)) {
+	var flavors []*FlavorQuotas
+	for i := range c.ResourceGroups {
+		for j := range c.ResourceGroups[i].Flavors {
+			flavors = append(flavors, &c.ResourceGroups[i].Flavors[j])
+		}
+	}
+	sort.Slice(flavors, func(i, j int) bool {
+		return flavors[i].Name < flavors[j].Name
+	})
+	for _, flvQuotas := range flavors {
+		resources := make([]corev1.ResourceName, 0, len(flvQuotas.Resources))
+		for rName := range flvQuotas.Resources {
+			resources = append(resources, rName)
+		}
+		sort.Slice(resources, func(i, j int) bool {
+			return resources[i] < resources[j]
+		})
+		for _, rName := range resources {
+			fn(flvQuotas.Name, rName, flvQuotas.Resources[rName])
+		}
+	}
+}
+
+// borrowed returns how much of the flavor and resource the ClusterQueue is
+// borrowing from the cohort.
+func (c *ClusterQueue) borrowed(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	rQuota := c.quotaFor(fName, rName)
+	if c.Cohort == nil || rQuota == nil {
+		return 0
+	}
+	if b := c.Usage[fName][rName] - c.scaleNominal(rQuota.Nominal); c.Exceeds(b) {
+		return b
+	}
+	return 0
+}
+
+// WorkloadBorrowingContribution returns, per key of the admitted workloads,
+// the part of their requests, per flavor and resource, that goes over the
+// nominal quota. The workloads are accounted for in admission order, so the
+// borrowed amount is attributed to the workloads admitted last. The workloads
+// that don't contribute to the borrowing are omitted.
+func (c *ClusterQueue) WorkloadBorrowingContribution() map[string]FlavorResourceQuantities {
+	wis := make([]*workload.Info, 0, len(c.Workloads))
+	for _, wi := range c.Workloads {
+		wis = append(wis, wi)
+	}
+	sort.Slice(wis, func(i, j int) bool {
+		ti, _ := admissionTime(wis[i].Obj)
+		tj, _ := admissionTime(wis[j].Obj)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return workload.Key(wis[i].Obj) < workload.Key(wis[j].Obj)
+	})
+	contributions := make(map[string]FlavorResourceQuantities)
+	accumulated := make(FlavorResourceQuantities)
+	for _, wi := range wis {
+		for fName, rRequests := range workloadRequests(wi) {
+			if accumulated[fName] == nil {
+				accumulated[fName] = make(map[corev1.ResourceName]int64)
+			}
+			for rName, v := range rRequests {
+				accumulated[fName][rName] += v
+				rQuota := c.quotaFor(fName, rName)
+				if rQuota == nil {
+					continue
+				}
+				over := accumulated[fName][rName] - c.scaleNominal(rQuota.Nominal)
+				if over > v {
+					over = v
+				}
+				if over <= 0 {
+					continue
+				}
+				key := workload.Key(wi.Obj)
+				if contributions[key] == nil {
+					contributions[key] = make(FlavorResourceQuantities)
+				}
+				if contributions[key][fName] == nil {
+					contributions[key][fName] = make(map[corev1.ResourceName]int64)
+				}
+				contributions[key][fName][rName] = over
+			}
+		}
+	}
+	return contributions
+}
+
+// GroupBorrowed returns how much the ClusterQueue is borrowing from the cohort
+// for each flavor and resource of the resource group. The flavors and
+// resources that aren't borrowing are omitted. The amount that the group
+// borrows for a resource is the sum over its flavors.
+func (c *ClusterQueue) GroupBorrowed(rg *ResourceGroup) FlavorResourceQuantities {
+	borrowed := make(FlavorResourceQuantities)
+	for _, fQuotas := range rg.Flavors {
+		for rName := range fQuotas.Resources {
+			if b := c.borrowed(fQuotas.Name, rName); b > 0 {
+				if borrowed[fQuotas.Name] == nil {
+					borrowed[fQuotas.Name] = make(map[corev1.ResourceName]int64)
+				}
+				borrowed[fQuotas.Name][rName] = b
+			}
+		}
+	}
+	return borrowed
+}
+
+// NominalToEliminateBorrowing returns, per flavor and resource of the
+// ClusterQueue, the nominal quota in effect that it would need so that its
+// current usage doesn't borrow from the cohort, that is, the maximum of the
+// usage and the EffectiveNominal.
+func (c *ClusterQueue) NominalToEliminateBorrowing() FlavorResourceQuantities {
+	required := make(FlavorResourceQuantities)
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, _ *ResourceQuota) {
+		if required[fName] == nil {
+			required[fName] = make(map[corev1.ResourceName]int64)
+		}
+		required[fName][rName] = c.EffectiveNominal(fName, rName)
+		if used := c.Usage[fName][rName]; used > required[fName][rName] {
+			required[fName][rName] = used
+		}
+	})
+	return required
+}
+
+// overNominal returns whether the usage exceeds the nominal quota by more
+// than UsageEpsilon.
+func (c *ClusterQueue) overNominal(used int64, rQuota *ResourceQuota) bool {
+	return c.Exceeds(used - c.scaleNominal(rQuota.Nominal))
+}
+
+// Exceeds returns whether the excess of an amount over a limit, i.e. the
+// amount minus the limit, is larger than UsageEpsilon. CanFit and the flavor
+// assigner compare the usage and the requests with the quota through it.
+func (c *ClusterQueue) Exceeds(excess int64) bool {
+	return excess > c.UsageEpsilon
+}
+
+// Shortfall returns, per flavor and resource assigned to the workload, the
+// amount that doesn't fit in the available quota, including the quota that
+// can be borrowed from the cohort. An empty result means that the workload fits.
+// Only the requests with an assigned flavor are considered.
+func (c *ClusterQueue) Shortfall(wi *workload.Info) FlavorResourceQuantities {
+	short := make(FlavorResourceQuantities)
+	system := c.IsSystemWorkload(wi)
+	reserved := c.ReservedFor(wi)
+	for fName, rRequests := range c.accountedRequests(wi) {
+		for rName, v := range rRequests {
+			available := c.available(fName, rName)
+			if !system {
+				available -= c.UnusedSystemReservation(fName, rName)
+			}
+			available -= reserved[fName][rName]
+			if s := v - available; c.Exceeds(s) {
+				if short[fName] == nil {
+					short[fName] = make(map[corev1.ResourceName]int64)
+				}
+				short[fName][rName] = s
+			}
+		}
+	}
+	return short
+}
+
+// FitsWithoutCohort returns whether the workload fits in the nominal quota of
+// the ClusterQueue, without borrowing from the cohort. Unlike CanFit, it only
+// checks the quota.
+func (c *ClusterQueue) FitsWithoutCohort(wi *workload.Info) bool {
+	system := c.IsSystemWorkload(wi)
+	for fName, rRequests := range c.accountedRequests(wi) {
+		for rName, v := range rRequests {
+			if c.quotaFor(fName, rName) == nil {
+				return false
+			}
+			available := c.EffectiveNominal(fName, rName) - c.Usage[fName][rName]
+			if !system {
+				available -= c.UnusedSystemReservation(fName, rName)
+			}
+			if c.Exceeds(v - available) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ReclaimNeeded returns how much of the nominal quota that the ClusterQueue
+// lent to the cohort it must reclaim, per flavor and resource, to admit the
+// workload within its nominal quota. The resources that don't need any reclaim
+// are omitted. Only the part of the requests within the unused nominal quota
+// can be reclaimed; the rest would need borrowing.
+func (c *ClusterQueue) ReclaimNeeded(wi *workload.Info) FlavorResourceQuantities {
+	reclaim := make(FlavorResourceQuantities)
+	if c.Cohort == nil {
+		return reclaim
+	}
+	for fName, rRequests := range c.accountedRequests(wi) {
+		for rName, v := range rRequests {
+			if c.quotaFor(fName, rName) == nil {
+				continue
+			}
+			entitled := c.EffectiveNominal(fName, rName) - c.Usage[fName][rName]
+			if v < entitled {
+				entitled = v
+			}
+			free := c.Cohort.requestable(fName, rName) - c.Cohort.used(fName, rName)
+			if r := entitled - free; c.Exceeds(r) {
+				if reclaim[fName] == nil {
+					reclaim[fName] = make(map[corev1.ResourceName]int64)
+				}
+				reclaim[fName][rName] = r
+			}
+		}
+	}
+	return reclaim
+}
+
+// AdmissionCost returns the marginal cost of admitting the workload. It's 0
+// when the workload fits within the nominal quota, it grows with the amount
+// that the workload would borrow, relative to the nominal quota, and it's
+// higher when the workload doesn't fit and would require preemption.
+func (c *ClusterQueue) AdmissionCost(wi *workload.Info) float64 {
+	weights := DefaultAdmissionCostWeights
+	if c.AdmissionCostWeights != nil {
+		weights = *c.AdmissionCostWeights
+	}
+	var cost float64
+	for fName, rRequests := range c.accountedRequests(wi) {
+		for rName, v := range rRequests {
+			rQuota := c.quotaFor(fName, rName)
+			if rQuota == nil || v == 0 {
+				continue
+			}
+			used := c.Usage[fName][rName]
+			nominal := c.scaleNominal(rQuota.Nominal)
+			borrowedBefore := used - nominal
+			if borrowedBefore < 0 {
+				borrowedBefore = 0
+			}
+			borrowed := used + v - nominal - borrowedBefore
+			if borrowed <= 0 {
+				continue
+			}
+			base := rQuota.Nominal
+			if base == 0 {
+				base = v
+			}
+			cost += weights.Borrowing * float64(borrowed) / float64(base)
+		}
+	}
+	if len(c.Shortfall(wi)) > 0 {
+		cost += weights.Preemption
+	}
+	return cost
+}
+
+// BestClusterQueue returns the candidate where the workload fits with the
+// lowest AdmissionCost, preferring the candidates where it fits without
+// borrowing from the cohort. Ties are broken by name. It returns false if the
+// workload doesn't fit in any candidate.
+func BestClusterQueue(candidates []*ClusterQueue, wi *workload.Info) (*ClusterQueue, bool) {
+	var best *ClusterQueue
+	var bestSelfSufficient bool
+	var bestCost float64
+	for _, cq := range candidates {
+		if !cq.CanFit(wi) {
+			continue
+		}
+		selfSufficient := cq.FitsWithoutCohort(wi)
+		cost := cq.AdmissionCost(wi)
+		if best != nil {
+			if selfSufficient != bestSelfSufficient {
+				if !selfSufficient {
+					continue
+				}
+			} else if cost > bestCost || (cost == bestCost && cq.Name >= best.Name) {
+				continue
+			}
+		}
+		best, bestSelfSufficient, bestCost = cq, selfSufficient, cost
+	}
+	return best, best != nil
+}
+
+// ProjectUsage returns the usage that the ClusterQueue would have after
+// admitting all the workloads, without modifying the ClusterQueue.
+func (c *ClusterQueue) ProjectUsage(wis []*workload.Info) FlavorResourceQuantities {
+	projected := c.Usage.clone()
+	for _, wi := range wis {
+		updateUsage(wi, projected, 1, c.SafetyMargin)
+	}
+	return projected
+}
+
+// EstimateAdmissionDelay returns a rough estimate of the time until the
+// workload fits in the ClusterQueue, assuming that the used quota is released
+// at recentDrainRate units per second. The units are those of the quota
+// accounting, i.e. milli-units for CPU.
+// It returns zero if the workload fits now, and the maximum duration if it
+// doesn't fit and the drain rate isn't positive.
+func (c *ClusterQueue) EstimateAdmissionDelay(wi *workload.Info, recentDrainRate float64) time.Duration {
+	var maxShort int64
+	for _, rShort := range c.Shortfall(wi) {
+		for _, s := range rShort {
+			if s > maxShort {
+				maxShort = s
+			}
+		}
+	}
+	if maxShort == 0 {
+		return 0
+	}
+	if recentDrainRate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	seconds := float64(maxShort) / recentDrainRate
+	if seconds >= float64(math.MaxInt64)/float64(time.Second) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// MaxAdmissibleReplicas returns how many replicas, each requesting perReplica,
+// fit in the available quota of the ClusterQueue, including borrowing. The
+// result is capped at desired.
+func (c *ClusterQueue) MaxAdmissibleReplicas(perReplica FlavorResourceQuantities, desired int) int {
+	replicas := int64(desired)
+	for fName, rRequests := range perReplica {
+		for rName, v := range rRequests {
+			if v <= 0 {
+				continue
+			}
+			available := c.available(fName, rName)
+			if available <= 0 {
+				return 0
+			}
+			if n := available / v; n < replicas {
+				replicas = n
+			}
+		}
+	}
+	return int(replicas)
+}
+
+// update updates the ClusterQueue from its API object. flavorRenames, which
+// can be nil, maps old flavor names to new ones, so that the usage of the old
+// flavors is carried forward to the new ones.
+func (c *ClusterQueue) update(in *kueue.ClusterQueue, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, flavorRenames map[kueue.ResourceFlavorReference]kueue.ResourceFlavorReference) error {
+	if c.frozen {
+		return ErrClusterQueueFrozen
+	}
+	settings, err := resourceGroupSettings(in)
+	if err != nil {
+		return err
+	}
+	if err := c.updateResourceGroups(in.Spec.ResourceGroups, settings); err != nil {
+		return err
+	}
+	nsSelector, err := metav1.LabelSelectorAsSelector(in.Spec.NamespaceSelector)
+	if err != nil {
+		return err
+	}
+	c.NamespaceSelector = nsSelector
+	c.renameFlavors(flavorRenames)
+
+	// Cleanup removed flavors or resources.
+	usedFlavorResources := make(FlavorResourceQuantities)
+	for _, rg := range in.Spec.ResourceGroups {
+		for _, f := range rg.Flavors {
+			existingUsedResources := c.Usage[f.Name]
+			usedResources := make(map[corev1.ResourceName]int64, len(f.Resources))
+			for _, r := range f.Resources {
+				usedResources[r.Name] = existingUsedResources[r.Name]
+			}
+			usedFlavorResources[f.Name] = usedResources
+		}
+	}
+	c.Usage = usedFlavorResources
+	c.UpdateWithFlavors(resourceFlavors)
+
+	if in.Spec.Preemption != nil {
+		c.Preemption = *in.Spec.Preemption
+	} else {
+		c.Preemption = defaultPreemption
+	}
+
+	if c.updateLabels(in.Labels) {
+		c.reportLabeledMetrics()
+	}
+	c.generation++
+	return nil
+}
+
+// updateLabels keeps a copy of the labels with a retained key. It returns
+// whether the retained labels changed.
+func (c *ClusterQueue) updateLabels(in map[string]string) bool {
+	var labels map[string]string
+	for k, v := range in {
+		if !c.retainedLabelKeys.Has(k) {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(c.retainedLabelKeys))
+		}
+		labels[k] = v
+	}
+	changed := !equality.Semantic.DeepEqual(c.labels, labels)
+	c.labels = labels
+	return changed
+}
+
+// reportLabeledMetrics reports again the metrics that have the ClusterQueue
+// labels, dropping the ones with the previous labels.
+func (c *ClusterQueue) reportLabeledMetrics() {
+	metrics.ClearClusterQueueLabeledMetrics(c.Name)
+	metrics.ReportClusterQueueStatus(c.Name, c.labels, c.Status)
+	c.reportNominalQuotas(nil)
+	c.reportAdmittedActiveWorkloads()
+}
+
+// Label returns the value of the ClusterQueue label with the given key.
+// Only the labels with a key retained by the cache are available.
+func (c *ClusterQueue) Label(key string) (string, bool) {
+	v, ok := c.labels[key]
+	return v, ok
+}
+
+// renameFlavors moves the usage of the flavors, including the usage of the
+// local queues and the flavors assigned to the workloads, to their new names.
+func (c *ClusterQueue) renameFlavors(renames map[kueue.ResourceFlavorReference]kueue.ResourceFlavorReference) {
+	if len(renames) == 0 {
+		return
+	}
+	renameUsage := func(usage FlavorResourceQuantities) {
+		for oldName, newName := range renames {
+			oldUsage, found := usage[oldName]
+			if !found {
+				continue
+			}
+			delete(usage, oldName)
+			if usage[newName] == nil {
+				usage[newName] = make(map[corev1.ResourceName]int64, len(oldUsage))
+			}
+			for rName, v := range oldUsage {
+				usage[newName][rName] += v
+			}
+		}
+	}
+	renameUsage(c.Usage)
+	renameUsage(c.SystemUsage)
+	for oldName, newName := range renames {
+		if n, found := c.flavorWorkloads[oldName]; found {
+			delete(c.flavorWorkloads, oldName)
+			c.flavorWorkloads[newName] += n
+		}
+	}
+	for _, q := range c.localQueues {
+		renameUsage(q.usage)
+	}
+	for _, wi := range c.Workloads {
+		for i := range wi.TotalRequests {
+			ps := &wi.TotalRequests[i]
+			// The flavors might be shared with the workload admission.
+			var flavors map[corev1.ResourceName]kueue.ResourceFlavorReference
+			for rName, fName := range ps.Flavors {
+				newName, renamed := renames[fName]
+				if !renamed {
+					continue
+				}
+				if flavors == nil {
+					flavors = maps.Clone(ps.Flavors)
+				}
+				flavors[rName] = newName
+			}
+			if flavors != nil {
+				ps.Flavors = flavors
+			}
+		}
+	}
+}
+
+func (c *ClusterQueue) updateResourceGroups(in []kueue.ResourceGroup, settings *ResourceGroupSettings) error {
+	oldResourceGroups := c.ResourceGroups
+	c.ResourceGroups = make([]ResourceGroup, len(in))
+	for i, rgIn := range in {
+		rg := &c.ResourceGroups[i]
+		*rg = ResourceGroup{
+			CoveredResources: sets.New(rgIn.CoveredResources...),
+			Flavors:          make([]FlavorQuotas, 0, len(rgIn.Flavors)),
+		}
+		if rgSetting := settings.forResourceGroup(rg.CoveredResources); rgSetting != nil {
+			if rgSetting.NamespaceSelector != nil {
+				nsSelector, err := metav1.LabelSelectorAsSelector(rgSetting.NamespaceSelector)
+				if err != nil {
+					c.ResourceGroups = oldResourceGroups
+					return fmt.Errorf("%w: %v", errInvalidResourceGroupSettings, err)
+				}
+				rg.NamespaceSelector = nsSelector
+			}
+			rg.Priority = rgSetting.Priority
+			rg.PreemptionPriorityThreshold = rgSetting.PreemptionPriorityThreshold
+		}
+		for i := range rgIn.Flavors {
+			fIn := &rgIn.Flavors[i]
+			fQuotas := FlavorQuotas{
+				Name:      fIn.Name,
+				Resources: make(map[corev1.ResourceName]*ResourceQuota, len(fIn.Resources)),
+			}
+			fSetting := settings.forFlavor(fIn.Name)
+			if fSetting != nil {
+				fQuotas.Exclusive = fSetting.Exclusive
+				fQuotas.MaxWorkloads = fSetting.MaxWorkloads
+			}
+			for _, rIn := range fIn.Resources {
+				nominal := workload.ResourceValue(rIn.Name, rIn.NominalQuota)
+				rQuota := ResourceQuota{
+					Nominal:           nominal,
+					ConfiguredNominal: nominal,
+				}
+				if rIn.BorrowingLimit != nil {
+					rQuota.BorrowingLimit = pointer.Int64(workload.ResourceValue(rIn.Name, *rIn.BorrowingLimit))
+				}
+				rSetting := fSetting.forResource(rIn.Name)
+				if rSetting != nil && rSetting.BorrowingLimitPercent != nil {
+					if rIn.BorrowingLimit != nil {
+						c.ResourceGroups = oldResourceGroups
+						return errMixedBorrowingLimits
+					}
+					// The BorrowingLimit is resolved with the requestable
+					// resources of the cohort.
+					rQuota.BorrowingLimitPercent = pointer.Int(*rSetting.BorrowingLimitPercent)
+				}
+				if rSetting != nil && rSetting.MinNominal != nil {
+					rQuota.MinNominal = pointer.Int64(workload.ResourceValue(rIn.Name, *rSetting.MinNominal))
+					rQuota.MaxNominal = pointer.Int64(workload.ResourceValue(rIn.Name, *rSetting.MaxNominal))
+					rQuota.Nominal = rQuota.boundedNominal(c.nominalFraction)
+				}
+				fQuotas.Resources[rIn.Name] = &rQuota
+			}
+			rg.Flavors = append(rg.Flavors, fQuotas)
+		}
+	}
+	c.UpdateRGByResource()
+	c.reportNominalQuotas(oldResourceGroups)
+	return nil
+}
+
+// reportNominalQuotas reports the nominal quotas of the ClusterQueue and clears
+// the ones for flavors and resources that were removed.
+func (c *ClusterQueue) reportNominalQuotas(oldResourceGroups []ResourceGroup) {
+	for _, rg := range oldResourceGroups {
+		for _, flvQuotas := range rg.Flavors {
+			for rName := range flvQuotas.Resources {
+				if c.quotaFor(flvQuotas.Name, rName) == nil {
+					metrics.ClearClusterQueueNominalQuota(c.Name, string(flvQuotas.Name), string(rName))
+				}
+			}
+		}
+	}
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+		nominal := workload.ResourceQuantity(rName, rQuota.Nominal)
+		metrics.ReportClusterQueueNominalQuota(c.Name, c.labels, string(fName), string(rName), nominal.AsApproximateFloat64())
+	})
+}
+
+// SetEffectiveNominalFraction sets the nominal quota of the flavors and
+// resources with MinNominal and MaxNominal to the fraction f of the range
+// between them, from 0, for MinNominal, to 1, for MaxNominal. The fraction
+// also applies to the quotas updated later on.
+func (c *ClusterQueue) SetEffectiveNominalFraction(f float64) {
+	if f < 0 {
+		f = 0
+	} else if f > 1 {
+		f = 1
+	}
+	c.nominalFraction = f
+	hasBounds := false
+	c.ForEachQuota(func(_ kueue.ResourceFlavorReference, _ corev1.ResourceName, rQuota *ResourceQuota) {
+		hasBounds = hasBounds || rQuota.hasNominalBounds()
+	})
+	if !hasBounds {
+		return
+	}
+	// The ResourceGroups are shared with the snapshots, so they are replaced
+	// instead of modified in place.
+	resourceGroups := make([]ResourceGroup, len(c.ResourceGroups))
+	for i, rg := range c.ResourceGroups {
+		resourceGroups[i] = rg
+		resourceGroups[i].Flavors = make([]FlavorQuotas, len(rg.Flavors))
+		for j, flvQuotas := range rg.Flavors {
+			flvQuotasCopy := flvQuotas
+			flvQuotasCopy.Resources = make(map[corev1.ResourceName]*ResourceQuota, len(flvQuotas.Resources))
+			for rName, rQuota := range flvQuotas.Resources {
+				rQuotaCopy := *rQuota
+				if rQuota.hasNominalBounds() {
+					rQuotaCopy.Nominal = rQuota.boundedNominal(f)
+				}
+				flvQuotasCopy.Resources[rName] = &rQuotaCopy
+			}
+			resourceGroups[i].Flavors[j] = flvQuotasCopy
+		}
+	}
+	c.ResourceGroups = resourceGroups
+	c.UpdateRGByResource()
+	c.reportNominalQuotas(nil)
+	c.generation++
+	if c.Cohort != nil {
+		c.Cohort.resolveBorrowingLimits()
+	}
+}
+
+func findFlavorQuotas(rgs []ResourceGroup, fName kueue.ResourceFlavorReference) *FlavorQuotas {
+	for i := range rgs {
+		for j := range rgs[i].Flavors {
+			if rgs[i].Flavors[j].Name == fName {
+				return &rgs[i].Flavors[j]
+			}
+		}
+	}
+	return nil
+}
+
+// ResourceGroupsByPriority returns the resource groups sorted by priority,
+// highest first. The groups with the same priority keep the order of the
+// spec.
+func (c *ClusterQueue) ResourceGroupsByPriority() []*ResourceGroup {
+	rgs := make([]*ResourceGroup, len(c.ResourceGroups))
+	for i := range c.ResourceGroups {
+		rgs[i] = &c.ResourceGroups[i]
+	}
+	sort.SliceStable(rgs, func(i, j int) bool {
+		return rgs[i].Priority > rgs[j].Priority
+	})
+	return rgs
+}
+
+// MoveToCohort moves the ClusterQueue, with its usage, from its current
+// cohort to newCohort. Either of them can be nil, for a ClusterQueue that
+// joins or leaves a cohort. The aggregates of both cohorts are recomputed.
+func (c *ClusterQueue) MoveToCohort(newCohort *Cohort) {
+	oldCohort := c.Cohort
+	if oldCohort == newCohort {
+		return
+	}
+	c.Cohort = newCohort
+	if oldCohort != nil {
+		oldCohort.Members.Delete(c)
+		oldCohort.recomputeAggregates()
+	}
+	if newCohort != nil {
+		newCohort.Members.Insert(c)
+		newCohort.recomputeAggregates()
+	}
+}
+
+// resolveBorrowingLimits derives the BorrowingLimit of the quotas that are
+// expressed as a percentage of the cohort's requestable resources.
+// The ResourceGroups are shared with the snapshots, so they are replaced
+// instead of modified in place.
+func (c *ClusterQueue) resolveBorrowingLimits(cohortRequestable FlavorResourceQuantities) {
+	hasPercents := false
+	for _, rg := range c.ResourceGroups {
+		for _, flvQuotas := range rg.Flavors {
+			for _, rQuota := range flvQuotas.Resources {
+				hasPercents = hasPercents || rQuota.BorrowingLimitPercent != nil
+			}
+		}
+	}
+	if !hasPercents {
+		return
+	}
+	resourceGroups := make([]ResourceGroup, len(c.ResourceGroups))
+	for i, rg := range c.ResourceGroups {
+		resourceGroups[i] = rg
+		resourceGroups[i].Flavors = make([]FlavorQuotas, len(rg.Flavors))
+		for j, flvQuotas := range rg.Flavors {
+			flvQuotasCopy := flvQuotas
+			flvQuotasCopy.Resources = make(map[corev1.ResourceName]*ResourceQuota, len(flvQuotas.Resources))
+			for rName, rQuota := range flvQuotas.Resources {
+				rQuotaCopy := *rQuota
+				if rQuota.BorrowingLimitPercent != nil {
+					rQuotaCopy.BorrowingLimit = pointer.Int64(cohortRequestable[flvQuotas.Name][rName] * int64(*rQuota.BorrowingLimitPercent) / 100)
+				}
+				flvQuotasCopy.Resources[rName] = &rQuotaCopy
+			}
+			resourceGroups[i].Flavors[j] = flvQuotasCopy
+		}
+	}
+	c.ResourceGroups = resourceGroups
+	c.UpdateRGByResource()
+	c.generation++
+}
+
+func (c *ClusterQueue) UpdateRGByResource() {
+	c.RGByResource = make(map[corev1.ResourceName]*ResourceGroup)
+	for i := range c.ResourceGroups {
+		rg := &c.ResourceGroups[i]
+		for rName := range rg.CoveredResources {
+			c.RGByResource[rName] = rg
+		}
+	}
+}
+
+// UpdateWithFlavors updates a ClusterQueue based on the passed ResourceFlavors set.
+// Exported only for testing.
+func (c *ClusterQueue) UpdateWithFlavors(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) {
+	status := active
+	if flavorNotFound := c.updateLabelKeys(flavors); flavorNotFound {
+		if c.FlavorUnavailablePolicy != FlavorUnavailableDisableGroupOnly || c.allGroupsDisabled() {
+			status = pending
+		}
+	}
+
+	if c.Status != terminating {
+		c.Status = status
+	}
+	metrics.ReportClusterQueueStatus(c.Name, c.labels, c.Status)
+}
+
+func (c *ClusterQueue) updateLabelKeys(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) bool {
+	var flavorNotFound bool
+	for i := range c.ResourceGroups {
+		rg := &c.ResourceGroups[i]
+		rg.Disabled = false
+		if len(rg.Flavors) == 0 {
+			rg.LabelKeys = nil
+			continue
+		}
+		keys := sets.New[string]()
+		for _, rf := range rg.Flavors {
+			if flv, exist := flavors[rf.Name]; exist {
+				for k := range flv.Spec.NodeLabels {
+					keys.Insert(k)
+				}
+			} else {
+				flavorNotFound = true
+				rg.Disabled = c.FlavorUnavailablePolicy == FlavorUnavailableDisableGroupOnly
+			}
+		}
+
+		if keys.Len() > 0 {
+			rg.LabelKeys = keys
+		}
+	}
+
+	return flavorNotFound
+}
+
+// MissingFlavors returns the flavors of the ClusterQueue that aren't in the
+// flavors map, sorted by name.
+func (c *ClusterQueue) MissingFlavors(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) []kueue.ResourceFlavorReference {
+	var missing []kueue.ResourceFlavorReference
+	for _, rg := range c.ResourceGroups {
+		for _, flvQuotas := range rg.Flavors {
+			if _, found := flavors[flvQuotas.Name]; !found {
+				missing = append(missing, flvQuotas.Name)
+			}
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i] < missing[j]
+	})
+	return missing
+}
+
+// FlavorResource identifies a resource of a flavor.
+type FlavorResource struct {
+	Flavor   kueue.ResourceFlavorReference
+	Resource corev1.ResourceName
+}
+
+// ZeroQuotaResources returns the flavors and resources of the ClusterQueue
+// with a nominal quota of zero, sorted by flavor and resource. They are
+// likely misconfigured, as the ClusterQueue can only use them by borrowing.
+func (c *ClusterQueue) ZeroQuotaResources() []FlavorResource {
+	var zero []FlavorResource
+	for _, rg := range c.ResourceGroups {
+		for _, flvQuotas := range rg.Flavors {
+			for rName, rQuota := range flvQuotas.Resources {
+				if rQuota.Nominal == 0 {
+					zero = append(zero, FlavorResource{Flavor: flvQuotas.Name, Resource: rName})
+				}
+			}
+		}
+	}
+	sort.Slice(zero, func(i, j int) bool {
+		if zero[i].Flavor != zero[j].Flavor {
+			return zero[i].Flavor < zero[j].Flavor
+		}
+		return zero[i].Resource < zero[j].Resource
+	})
+	return zero
+}
+
+// allGroupsDisabled returns whether all the resource groups with flavors are
+// disabled.
+func (c *ClusterQueue) allGroupsDisabled() bool {
+	for _, rg := range c.ResourceGroups {
+		if len(rg.Flavors) > 0 && !rg.Disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// addWorkload accounts the admitted workload. While the ClusterQueue is
+// frozen, the addition is deferred until Thaw and it returns
+// ErrClusterQueueFrozen.
+func (c *ClusterQueue) addWorkload(w *kueue.Workload) error {
+	k := workload.Key(w)
+	if c.hasWorkload(k) {
+		return fmt.Errorf("workload already exists in ClusterQueue")
+	}
+	if c.frozen {
+		c.frozenWorkloads[k] = w
+		return ErrClusterQueueFrozen
+	}
+	wi := c.newWorkloadInfo(w)
+	c.Workloads[k] = wi
+	c.updateWorkloadUsage(wi, 1)
+	delete(c.requeues, k)
+	delete(c.pendingReservations, k)
+	c.generation++
+	if c.podsReadyTracking && !apimeta.IsStatusConditionTrue(w.Status.Conditions, kueue.WorkloadPodsReady) {
+		c.WorkloadsNotReady.Insert(k)
+	}
+	c.reportAdmittedActiveWorkloads()
+	return nil
+}
+
+// deleteWorkload stops accounting the workload. While the ClusterQueue is
+// frozen, the deletion is deferred until Thaw and it returns
+// ErrClusterQueueFrozen.
+func (c *ClusterQueue) deleteWorkload(w *kueue.Workload) error {
+	k := workload.Key(w)
+	if c.frozen {
+		if c.hasWorkload(k) {
+			c.frozenWorkloads[k] = nil
+		}
+		return ErrClusterQueueFrozen
+	}
+	wi, exist := c.Workloads[k]
+	if !exist {
+		return nil
+	}
+	c.updateWorkloadUsage(wi, -1)
+	if c.podsReadyTracking && !apimeta.IsStatusConditionTrue(w.Status.Conditions, kueue.WorkloadPodsReady) {
+		c.WorkloadsNotReady.Delete(k)
+	}
+	delete(c.Workloads, k)
+	c.generation++
+	c.reportAdmittedActiveWorkloads()
+	return nil
+}
+
+// hasWorkload returns whether the workload with the key is admitted in the
+// ClusterQueue, including the changes deferred while it's frozen.
+func (c *ClusterQueue) hasWorkload(k string) bool {
+	if w, deferred := c.frozenWorkloads[k]; deferred {
+		return w != nil
+	}
+	_, exist := c.Workloads[k]
+	return exist
+}
+
+// recordChurn records an admission or an eviction of a workload for
+// ChurnRate, and forgets the ones older than churnRetention.
+func (c *ClusterQueue) recordChurn() {
+	now := c.now()
+	cutoff := now.Add(-churnRetention)
+	i := 0
+	for i < len(c.churnEvents) && c.churnEvents[i].Before(cutoff) {
+		i++
+	}
+	c.churnEvents = append(c.churnEvents[i:], now)
+}
+
+// ChurnRate returns the number of admissions and evictions of workloads per
+// second in the window before now. Updates of the admitted workloads aren't
+// counted. Only the events of the last hour are kept, so longer windows don't
+// count the older events.
+func (c *ClusterQueue) ChurnRate(window time.Duration, now time.Time) float64 {
+	if window <= 0 {
+		return 0
+	}
+	start := now.Add(-window)
+	var count int
+	for _, t := range c.churnEvents {
+		if t.After(start) && !t.After(now) {
+			count++
+		}
+	}
+	return float64(count) / window.Seconds()
+}
+
+// Freeze stops applying the changes of the admitted workloads and of the
+// quotas to the ClusterQueue until Thaw is called. While the ClusterQueue is
+// frozen, the changes return ErrClusterQueueFrozen: the updates of the quotas
+// are rejected, and the changes of the workloads admitted in the API are
+// deferred until Thaw, so that the usage matches the API afterwards. Read only
+// methods keep working on the frozen state.
+func (c *ClusterQueue) Freeze() {
+	if c.frozen {
+		return
+	}
+	c.frozen = true
+	c.frozenWorkloads = make(map[string]*kueue.Workload)
+}
+
+// Thaw replays the changes of the workloads deferred by Freeze and resumes
+// applying the mutations.
+func (c *ClusterQueue) Thaw() {
+	if !c.frozen {
+		return
+	}
+	c.frozen = false
+	deferred := c.frozenWorkloads
+	c.frozenWorkloads = nil
+	for k, w := range deferred {
+		if existing, found := c.Workloads[k]; found {
+			c.deleteWorkload(existing.Obj)
+		}
+		if w != nil {
+			// The workload was deleted above, so it can't fail.
+			_ = c.addWorkload(w)
+		}
+	}
+}
+
+// MarkWarm indicates that the usage of the ClusterQueue and of its cohort is
+// complete, so that workloads can borrow again.
+func (c *ClusterQueue) MarkWarm() {
+	c.warmingUp = false
+}
+
+// IsWarm returns whether the usage of the ClusterQueue is complete.
+func (c *ClusterQueue) IsWarm() bool {
+	return !c.warmingUp
+}
+
+// IsFrozen returns whether the ClusterQueue is frozen.
+func (c *ClusterQueue) IsFrozen() bool {
+	return c.frozen
+}
+
+// AdmitWithPreemption evicts the victims, which must be admitted in the
+// ClusterQueue, and admits the workload, if it fits afterwards. The fit is
+// checked before evicting anything, so on failure the ClusterQueue is left
+// untouched.
+func (c *ClusterQueue) AdmitWithPreemption(wi *workload.Info, victims []*workload.Info) error {
+	if c.frozen {
+		return ErrClusterQueueFrozen
+	}
+	if c.hasWorkload(workload.Key(wi.Obj)) {
+		return fmt.Errorf("workload already exists in ClusterQueue")
+	}
+	evicted := make([]*workload.Info, 0, len(victims))
+	seen := sets.New[string]()
+	for _, v := range victims {
+		k := workload.Key(v.Obj)
+		admitted, found := c.Workloads[k]
+		if !found {
+			return fmt.Errorf("%w: %s", errVictimNotAdmitted, k)
+		}
+		if !seen.Has(k) {
+			seen.Insert(k)
+			evicted = append(evicted, admitted)
+		}
+	}
+	if !c.canFitAfterEvicting(wi, evicted) {
+		return errDoesNotFitAfterEviction
+	}
+	for _, v := range evicted {
+		c.deleteWorkload(v.Obj)
+	}
+	return c.addWorkload(wi.Obj)
+}
+
+// canFitAfterEvicting returns whether the workload would fit, see CanFit, once
+// the admitted victims are evicted. The state of the ClusterQueue is restored
+// before returning.
+func (c *ClusterQueue) canFitAfterEvicting(wi *workload.Info, victims []*workload.Info) bool {
+	usage, systemUsage, flavorWorkloads, workloads := c.Usage, c.SystemUsage, c.flavorWorkloads, c.Workloads
+	defer func() {
+		c.Usage, c.SystemUsage, c.flavorWorkloads, c.Workloads = usage, systemUsage, flavorWorkloads, workloads
+	}()
+	c.Usage = usage.clone()
+	c.SystemUsage = systemUsage.clone()
+	c.flavorWorkloads = maps.Clone(flavorWorkloads)
+	c.Workloads = maps.Clone(workloads)
+	for _, v := range victims {
+		updateUsage(v, c.Usage, -1, c.SafetyMargin)
+		if c.IsSystemWorkload(v) {
+			c.updateSystemUsage(v, -1)
+		}
+		c.updateFlavorWorkloads(v, -1)
+		delete(c.Workloads, workload.Key(v.Obj))
+	}
+	return c.CanFit(wi)
+}
+
+// RecordRequeue records that the workload with the key failed admission and
+// was requeued. The time until the next retry doubles with every requeue, up to
+// requeueMaxBackoff.
+func (c *ClusterQueue) RecordRequeue(key string) {
+	if c.requeues == nil {
+		c.requeues = make(map[string]*requeueState)
+	}
+	state := c.requeues[key]
+	if state == nil {
+		state = &requeueState{}
+		c.requeues[key] = state
+	}
+	state.count++
+	backoff := requeueBaseBackoff
+	for i := 1; i < state.count && backoff < requeueMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > requeueMaxBackoff {
+		backoff = requeueMaxBackoff
+	}
+	state.nextRetry = c.now().Add(backoff)
+}
+
+// NextRetryAfter returns the time after which the workload with the key can be
+// retried. It returns the zero time if the workload wasn't requeued since it
+// was last admitted.
+func (c *ClusterQueue) NextRetryAfter(key string) time.Time {
+	if state, found := c.requeues[key]; found {
+		return state.nextRetry
+	}
+	return time.Time{}
+}
+
+func (c *ClusterQueue) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// observeFlavorUsageRatios observes the usage ratio of the flavors assigned
+// to the workload, which are the only ones whose usage changed.
+func (c *ClusterQueue) observeFlavorUsageRatios(wi *workload.Info) {
+	if c.simulated {
+		return
+	}
+	for fName := range workloadRequests(wi) {
+		fQuotas := c.flavorQuotas(fName)
+		if fQuotas == nil {
+			continue
+		}
+		var ratio float64
+		observed := false
+		for rName, rQuota := range fQuotas.Resources {
+			if rQuota.Nominal == 0 {
+				continue
+			}
+			observed = true
+			if r := float64(c.Usage[fName][rName]) / float64(rQuota.Nominal); r > ratio {
+				ratio = r
+			}
+		}
+		if observed {
+			metrics.ObserveClusterQueueFlavorUsageRatio(c.Name, string(fName), ratio)
+		}
+	}
+}
+
+// AtCapacity returns whether the ClusterQueue has no unused nominal quota
+// left, in any of its flavors, for some resource. The resources without
+// nominal quota in any flavor are ignored.
+func (c *ClusterQueue) AtCapacity() bool {
+	remaining := make(map[corev1.ResourceName]int64)
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+		if rQuota.Nominal == 0 {
+			return
+		}
+		remaining[rName] += c.RemainingQuota(fName, rName)
+	})
+	for _, r := range remaining {
+		if r == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyCapacityTransition queues the call to OnFull or OnFreed, if set, for
+// the ClusterQueue becoming full or freeing up. Without a cache queue, the
+// callback is called right away.
+func (c *ClusterQueue) notifyCapacityTransition(atCapacity bool) {
+	callback := c.OnFreed
+	if atCapacity {
+		callback = c.OnFull
+	}
+	if callback == nil {
+		return
+	}
+	name := c.Name
+	if c.capacityNotifications == nil {
+		callback(name)
+		return
+	}
+	*c.capacityNotifications = append(*c.capacityNotifications, func() { callback(name) })
+}
+
+// recordBorrowingTransition emits an event for the ClusterQueue starting or
+// stopping to borrow, naming the flavor and resource of the workload that
+// caused it.
+func (c *ClusterQueue) recordBorrowingTransition(wi *workload.Info, m int64, borrowing bool) {
+	if c.recorder == nil {
+		return
+	}
+	reason, verb := "StoppedBorrowing", "stopped"
+	if borrowing {
+		reason, verb = "StartedBorrowing", "started"
+	}
+	fName, rName := c.borrowingTrigger(wi, m)
+	cqObj := &kueue.ClusterQueue{ObjectMeta: metav1.ObjectMeta{Name: c.Name}}
+	c.recorder.Eventf(cqObj, corev1.EventTypeNormal, reason, "ClusterQueue %s borrowing %s of flavor %s, triggered by workload %s", verb, rName, fName, workload.Key(wi.Obj))
+}
+
+// borrowingTrigger returns the flavor and resource of the workload requests
+// whose borrowing state flipped when its usage was applied m times.
+func (c *ClusterQueue) borrowingTrigger(wi *workload.Info, m int64) (kueue.ResourceFlavorReference, corev1.ResourceName) {
+	type flavorResource struct {
+		flavor   kueue.ResourceFlavorReference
+		resource corev1.ResourceName
+	}
+	var flipped []flavorResource
+	for fName, requests := range workloadRequests(wi) {
+		for rName, v := range requests {
+			rQuota := c.quotaFor(fName, rName)
+			if rQuota == nil {
+				continue
+			}
+			used := c.Usage[fName][rName]
+			if c.overNominal(used, rQuota) != c.overNominal(used-v*m, rQuota) {
+				flipped = append(flipped, flavorResource{flavor: fName, resource: rName})
+			}
+		}
+	}
+	if len(flipped) == 0 {
+		return "", ""
+	}
+	sort.Slice(flipped, func(i, j int) bool {
+		if flipped[i].flavor != flipped[j].flavor {
+			return flipped[i].flavor < flipped[j].flavor
+		}
+		return flipped[i].resource < flipped[j].resource
+	})
+	return flipped[0].flavor, flipped[0].resource
+}
+
+// SyncWorkloads converges the workloads of the ClusterQueue to the desired
+// admitted workloads: it adds the missing ones, removes the extra ones and
+// updates the ones whose requests changed. It returns the number of workloads
+// added and removed. The workloads that fail to be added aren't counted.
+func (c *ClusterQueue) SyncWorkloads(desired []*kueue.Workload) (added, removed int) {
+	desiredKeys := sets.New[string]()
+	for _, w := range desired {
+		desiredKeys.Insert(workload.Key(w))
+	}
+	for k, wi := range c.Workloads {
+		if !desiredKeys.Has(k) {
+			c.deleteWorkload(wi.Obj)
+			removed++
+		}
+	}
+	for _, w := range desired {
+		k := workload.Key(w)
+		if existing, found := c.Workloads[k]; found {
+			wi := c.newWorkloadInfo(w)
+			if equality.Semantic.DeepEqual(existing.TotalRequests, wi.TotalRequests) {
+				continue
+			}
+			c.deleteWorkload(existing.Obj)
+			if err := c.addWorkload(w); err != nil {
+				removed++
+			}
+			continue
+		}
+		if err := c.addWorkload(w); err == nil {
+			added++
+		}
+	}
+	return added, removed
 }
 
-// FlavorQuotas holds a processed ClusterQueue flavor quota.
-type FlavorQuotas struct {
-	Name      kueue.ResourceFlavorReference
-	Resources map[corev1.ResourceName]*ResourceQuota
+// newWorkloadInfo returns the info of the workload as it's accounted for in
+// the ClusterQueue, with the resource aliases folded and the default requests
+// applied.
+func (c *ClusterQueue) newWorkloadInfo(w *kueue.Workload) *workload.Info {
+	wi := workload.NewInfo(w)
+	c.foldResourceAliases(wi)
+	c.applyDefaultRequests(wi)
+	return wi
 }
 
-type ResourceQuota struct {
-	Nominal        int64
-	BorrowingLimit *int64
+// foldResourceAliases replaces the aliased resources in the requests of the
+// workload with their canonical resource, adding up their requests.
+func (c *ClusterQueue) foldResourceAliases(wi *workload.Info) {
+	if len(c.ResourceAliases) == 0 {
+		return
+	}
+	for i := range wi.TotalRequests {
+		ps := &wi.TotalRequests[i]
+		// The flavors might be shared with the workload admission.
+		var flavors map[corev1.ResourceName]kueue.ResourceFlavorReference
+		for alias, canonical := range c.ResourceAliases {
+			v, requested := ps.Requests[alias]
+			if !requested {
+				continue
+			}
+			if flavors == nil {
+				flavors = maps.Clone(ps.Flavors)
+			}
+			delete(ps.Requests, alias)
+			ps.Requests[canonical] += v
+			if fName, assigned := flavors[alias]; assigned {
+				delete(flavors, alias)
+				flavors[canonical] = fName
+			}
+		}
+		if flavors != nil {
+			ps.Flavors = flavors
+		}
+	}
 }
 
-type FlavorResourceQuantities map[kueue.ResourceFlavorReference]map[corev1.ResourceName]int64
-
-type queue struct {
-	key               string
-	admittedWorkloads int
-	usage             FlavorResourceQuantities
+// applyDefaultRequests adds the DefaultRequests to the pod sets of the workload
+// that don't request the resources. Explicit requests are never overridden.
+func (c *ClusterQueue) applyDefaultRequests(wi *workload.Info) {
+	if len(c.DefaultRequests) == 0 {
+		return
+	}
+	for i := range wi.TotalRequests {
+		ps := &wi.TotalRequests[i]
+		// The flavors might be shared with the workload admission.
+		flavors := maps.Clone(ps.Flavors)
+		for rName, rg := range c.RGByResource {
+			if _, requested := ps.Requests[rName]; requested {
+				continue
+			}
+			fName, assigned := assignedFlavorInGroup(ps, rg)
+			if !assigned {
+				continue
+			}
+			v, hasDefault := c.DefaultRequests[fName][rName]
+			if !hasDefault {
+				continue
+			}
+			if ps.Requests == nil {
+				ps.Requests = make(workload.Requests)
+			}
+			ps.Requests[rName] = v * int64(ps.Count)
+			flavors[rName] = fName
+		}
+		ps.Flavors = flavors
+	}
 }
 
-func newCohort(name string, size int) *Cohort {
-	return &Cohort{
-		Name:    name,
-		Members: make(sets.Set[*ClusterQueue], size),
+// assignedFlavorInGroup returns the flavor assigned to the pod set for any of
+// the resources covered by the resource group.
+func assignedFlavorInGroup(ps *workload.PodSetResources, rg *ResourceGroup) (kueue.ResourceFlavorReference, bool) {
+	for rName, fName := range ps.Flavors {
+		if rg.CoveredResources.Has(rName) {
+			return fName, true
+		}
 	}
+	return "", false
 }
 
-func (c *Cohort) HasBorrowingQueues() bool {
-	for cq := range c.Members {
-		if cq.IsBorrowing() {
-			return true
+// updateWorkloadUsage updates the usage of the ClusterQueue for the workload
+// and the number of admitted workloads for local queues.
+func (c *ClusterQueue) updateWorkloadUsage(wi *workload.Info, m int64) {
+	wasBorrowing := c.IsBorrowing()
+	notifyCapacity := c.OnFull != nil || c.OnFreed != nil
+	var wasAtCapacity bool
+	if notifyCapacity {
+		wasAtCapacity = c.AtCapacity()
+	}
+	var borrowedBefore FlavorResourceQuantities
+	if c.BorrowAuditSink != nil {
+		borrowedBefore = c.borrowedFor(wi)
+	}
+	c.updateDecayedUsage()
+	updateUsage(wi, c.Usage, m, c.SafetyMargin)
+	if c.IsSystemWorkload(wi) {
+		c.updateSystemUsage(wi, m)
+	}
+	c.updateFlavorWorkloads(wi, int(m))
+	if isBorrowing := c.IsBorrowing(); isBorrowing != wasBorrowing {
+		c.recordBorrowingTransition(wi, m, isBorrowing)
+	}
+	if c.BorrowAuditSink != nil {
+		c.auditBorrowing(borrowedBefore, c.borrowedFor(wi))
+	}
+	if notifyCapacity {
+		if atCapacity := c.AtCapacity(); atCapacity != wasAtCapacity {
+			c.notifyCapacityTransition(atCapacity)
 		}
 	}
-	return false
+	c.observeFlavorUsageRatios(wi)
+	c.updateIdleSince()
+	qKey := workload.QueueKey(wi.Obj)
+	if _, ok := c.localQueues[qKey]; ok {
+		updateUsage(wi, c.localQueues[qKey].usage, m, c.SafetyMargin)
+		c.localQueues[qKey].admittedWorkloads += int(m)
+	}
 }
 
-func (c *ClusterQueue) IsBorrowing() bool {
-	if c.Cohort == nil || len(c.Usage) == 0 {
-		return false
+// updateFlavorWorkloads updates the count of workloads of the flavors that
+// the workload uses.
+func (c *ClusterQueue) updateFlavorWorkloads(wi *workload.Info, m int) {
+	if c.flavorWorkloads == nil {
+		c.flavorWorkloads = make(map[kueue.ResourceFlavorReference]int)
 	}
-	for _, rg := range c.ResourceGroups {
-		for _, flvQuotas := range rg.Flavors {
-			if flvUsage, isUsing := c.Usage[flvQuotas.Name]; isUsing {
-				for rName, rQuota := range flvQuotas.Resources {
-					used := flvUsage[rName]
-					if used > rQuota.Nominal {
-						return true
-					}
-				}
-			}
+	for fName := range workloadRequests(wi) {
+		c.flavorWorkloads[fName] += m
+		if c.flavorWorkloads[fName] <= 0 {
+			delete(c.flavorWorkloads, fName)
 		}
 	}
-	return false
 }
 
-func (c *ClusterQueue) Active() bool {
-	return c.Status == active
+// updateSystemUsage updates the SystemUsage for a system workload.
+func (c *ClusterQueue) updateSystemUsage(wi *workload.Info, m int64) {
+	if c.SystemUsage == nil {
+		c.SystemUsage = make(FlavorResourceQuantities)
+	}
+	for fName, rRequests := range c.accountedRequests(wi) {
+		if c.SystemUsage[fName] == nil {
+			c.SystemUsage[fName] = make(map[corev1.ResourceName]int64, len(rRequests))
+		}
+		for rName, v := range rRequests {
+			c.SystemUsage[fName][rName] += v * m
+		}
+	}
 }
 
-var defaultPreemption = kueue.ClusterQueuePreemption{
-	ReclaimWithinCohort: kueue.PreemptionPolicyNever,
-	WithinClusterQueue:  kueue.PreemptionPolicyNever,
+// updateDecayedUsage records the DecayedUsage before the usage changes.
+func (c *ClusterQueue) updateDecayedUsage() {
+	if c.UsageDecayHalfLife <= 0 {
+		return
+	}
+	now := c.now()
+	c.decayedUsage = c.DecayedUsage(now)
+	c.decayedAt = now
 }
 
-func (c *ClusterQueue) update(in *kueue.ClusterQueue, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) error {
-	c.updateResourceGroups(in.Spec.ResourceGroups)
-	nsSelector, err := metav1.LabelSelectorAsSelector(in.Spec.NamespaceSelector)
-	if err != nil {
-		return err
+// DecayedUsage returns, per flavor and resource, the usage smoothed over time:
+// after the usage changes, the decayed usage approaches it exponentially, with
+// a half-life of UsageDecayHalfLife. A ClusterQueue that recently started to
+// use quota has a decayed usage lower than its usage, which gives it an
+// advantage when the ClusterQueues are ordered by fairness. The admission
+// always uses the usage.
+func (c *ClusterQueue) DecayedUsage(now time.Time) FlavorResourceQuantities {
+	if c.UsageDecayHalfLife <= 0 || c.decayedAt.IsZero() {
+		return c.Usage.clone()
 	}
-	c.NamespaceSelector = nsSelector
-
-	// Cleanup removed flavors or resources.
-	usedFlavorResources := make(FlavorResourceQuantities)
-	for _, rg := range in.Spec.ResourceGroups {
-		for _, f := range rg.Flavors {
-			existingUsedResources := c.Usage[f.Name]
-			usedResources := make(map[corev1.ResourceName]int64, len(f.Resources))
-			for _, r := range f.Resources {
-				usedResources[r.Name] = existingUsedResources[r.Name]
-			}
-			usedFlavorResources[f.Name] = usedResources
+	factor := 1.0
+	if elapsed := now.Sub(c.decayedAt); elapsed > 0 {
+		factor = math.Exp2(-float64(elapsed) / float64(c.UsageDecayHalfLife))
+	}
+	decayed := make(FlavorResourceQuantities, len(c.Usage))
+	for fName, rUsage := range c.Usage {
+		decayed[fName] = make(map[corev1.ResourceName]int64, len(rUsage))
+		for rName, used := range rUsage {
+			diff := c.decayedUsage[fName][rName] - used
+			decayed[fName][rName] = used + int64(math.Round(float64(diff)*factor))
 		}
 	}
-	c.Usage = usedFlavorResources
-	c.UpdateWithFlavors(resourceFlavors)
+	return decayed
+}
 
-	if in.Spec.Preemption != nil {
-		c.Preemption = *in.Spec.Preemption
-	} else {
-		c.Preemption = defaultPreemption
+// updateIdleSince records the time when the ClusterQueue stops using quota,
+// and clears it when the ClusterQueue uses quota again.
+func (c *ClusterQueue) updateIdleSince() {
+	if c.hasUsage() {
+		c.idleSince = time.Time{}
+	} else if c.idleSince.IsZero() {
+		c.idleSince = c.now()
 	}
-
-	return nil
 }
 
-func (c *ClusterQueue) updateResourceGroups(in []kueue.ResourceGroup) {
-	c.ResourceGroups = make([]ResourceGroup, len(in))
-	for i, rgIn := range in {
-		rg := &c.ResourceGroups[i]
-		*rg = ResourceGroup{
-			CoveredResources: sets.New(rgIn.CoveredResources...),
-			Flavors:          make([]FlavorQuotas, 0, len(rgIn.Flavors)),
-		}
-		for i := range rgIn.Flavors {
-			fIn := &rgIn.Flavors[i]
-			fQuotas := FlavorQuotas{
-				Name:      fIn.Name,
-				Resources: make(map[corev1.ResourceName]*ResourceQuota, len(fIn.Resources)),
-			}
-			for _, rIn := range fIn.Resources {
-				rQuota := ResourceQuota{
-					Nominal: workload.ResourceValue(rIn.Name, rIn.NominalQuota),
-				}
-				if rIn.BorrowingLimit != nil {
-					rQuota.BorrowingLimit = pointer.Int64(workload.ResourceValue(rIn.Name, *rIn.BorrowingLimit))
-				}
-				fQuotas.Resources[rIn.Name] = &rQuota
+func (c *ClusterQueue) hasUsage() bool {
+	for _, rUsage := range c.Usage {
+		for _, v := range rUsage {
+			if v != 0 {
+				return true
 			}
-			rg.Flavors = append(rg.Flavors, fQuotas)
 		}
 	}
-	c.UpdateRGByResource()
+	return false
 }
 
-func (c *ClusterQueue) UpdateRGByResource() {
-	c.RGByResource = make(map[corev1.ResourceName]*ResourceGroup)
-	for i := range c.ResourceGroups {
-		rg := &c.ResourceGroups[i]
-		for rName := range rg.CoveredResources {
-			c.RGByResource[rName] = rg
-		}
+// IdleSince returns the time since when the ClusterQueue doesn't use any
+// quota, or false if it's using quota.
+// A ClusterQueue that never used quota is idle since it was added to the cache.
+func (c *ClusterQueue) IdleSince() (time.Time, bool) {
+	if c.idleSince.IsZero() {
+		return time.Time{}, false
 	}
+	return c.idleSince, true
 }
 
-// UpdateWithFlavors updates a ClusterQueue based on the passed ResourceFlavors set.
-// Exported only for testing.
-func (c *ClusterQueue) UpdateWithFlavors(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) {
-	status := active
-	if flavorNotFound := c.updateLabelKeys(flavors); flavorNotFound {
-		status = pending
-	}
-
-	if c.Status != terminating {
-		c.Status = status
+// SampleUsage records the current usage in the usage history, which keeps the
+// last usageHistoryLength samples.
+func (c *ClusterQueue) SampleUsage() {
+	if len(c.usageHistory) < usageHistoryLength {
+		c.usageHistory = append(c.usageHistory, c.Usage.clone())
+		return
 	}
-	metrics.ReportClusterQueueStatus(c.Name, c.Status)
+	c.usageHistory[c.usageHistoryNext] = c.Usage.clone()
+	c.usageHistoryNext = (c.usageHistoryNext + 1) % usageHistoryLength
 }
 
-func (c *ClusterQueue) updateLabelKeys(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) bool {
-	var flavorNotFound bool
-	for i := range c.ResourceGroups {
-		rg := &c.ResourceGroups[i]
-		if len(rg.Flavors) == 0 {
-			rg.LabelKeys = nil
-			continue
+// UsageTrend returns, per flavor and resource, the slope of the usage over the
+// samples in the usage history, as the change of the usage per sample fitted
+// by least squares. A positive slope means that the usage is rising.
+// It's empty when there are less than two samples.
+func (c *ClusterQueue) UsageTrend() FlavorResourceQuantities {
+	trend := make(FlavorResourceQuantities)
+	n := len(c.usageHistory)
+	if n < 2 {
+		return trend
+	}
+	// The samples are at x = 0..n-1, from the oldest to the newest.
+	meanX := float64(n-1) / 2
+	var varX float64
+	for i := 0; i < n; i++ {
+		varX += (float64(i) - meanX) * (float64(i) - meanX)
+	}
+	samples := make([]FlavorResourceQuantities, n)
+	for i := range samples {
+		samples[i] = c.usageHistory[(c.usageHistoryNext+i)%n]
+	}
+	sampled := make(map[kueue.ResourceFlavorReference]sets.Set[corev1.ResourceName])
+	for _, sample := range samples {
+		for fName, rUsage := range sample {
+			if sampled[fName] == nil {
+				sampled[fName] = sets.New[corev1.ResourceName]()
+			}
+			for rName := range rUsage {
+				sampled[fName].Insert(rName)
+			}
 		}
-		keys := sets.New[string]()
-		for _, rf := range rg.Flavors {
-			if flv, exist := flavors[rf.Name]; exist {
-				for k := range flv.Spec.NodeLabels {
-					keys.Insert(k)
-				}
-			} else {
-				flavorNotFound = true
+	}
+	for fName, rNames := range sampled {
+		trend[fName] = make(map[corev1.ResourceName]int64, rNames.Len())
+		for rName := range rNames {
+			var meanY float64
+			for _, sample := range samples {
+				meanY += float64(sample[fName][rName])
+			}
+			meanY /= float64(n)
+			var covXY float64
+			for i, sample := range samples {
+				covXY += (float64(i) - meanX) * (float64(sample[fName][rName]) - meanY)
 			}
+			trend[fName][rName] = int64(math.Round(covXY / varX))
 		}
+	}
+	return trend
+}
 
-		if keys.Len() > 0 {
-			rg.LabelKeys = keys
+// borrowedFor returns the amount borrowed for the flavors and resources
+// assigned to the workload.
+func (c *ClusterQueue) borrowedFor(wi *workload.Info) FlavorResourceQuantities {
+	borrowed := make(FlavorResourceQuantities)
+	for fName, rRequests := range workloadRequests(wi) {
+		borrowed[fName] = make(map[corev1.ResourceName]int64, len(rRequests))
+		for rName := range rRequests {
+			borrowed[fName][rName] = c.borrowed(fName, rName)
 		}
 	}
-
-	return flavorNotFound
+	return borrowed
 }
 
-func (c *ClusterQueue) addWorkload(w *kueue.Workload) error {
-	k := workload.Key(w)
-	if _, exist := c.Workloads[k]; exist {
-		return fmt.Errorf("workload already exists in ClusterQueue")
+// auditBorrowing sends a BorrowEvent to the BorrowAuditSink for every flavor
+// and resource whose borrowed amount changed, in a stable order.
+func (c *ClusterQueue) auditBorrowing(before, after FlavorResourceQuantities) {
+	var events []BorrowEvent
+	now := c.now()
+	for fName, rAfter := range after {
+		for rName, v := range rAfter {
+			if delta := v - before[fName][rName]; delta != 0 {
+				events = append(events, BorrowEvent{
+					ClusterQueue:  c.Name,
+					Flavor:        fName,
+					Resource:      rName,
+					BorrowedDelta: delta,
+					Timestamp:     now,
+				})
+			}
+		}
 	}
-	wi := workload.NewInfo(w)
-	c.Workloads[k] = wi
-	c.updateWorkloadUsage(wi, 1)
-	if c.podsReadyTracking && !apimeta.IsStatusConditionTrue(w.Status.Conditions, kueue.WorkloadPodsReady) {
-		c.WorkloadsNotReady.Insert(k)
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Flavor != events[j].Flavor {
+			return events[i].Flavor < events[j].Flavor
+		}
+		return events[i].Resource < events[j].Resource
+	})
+	for _, e := range events {
+		c.BorrowAuditSink(e)
 	}
-	reportAdmittedActiveWorkloads(wi.ClusterQueue, len(c.Workloads))
-	return nil
 }
 
-func (c *ClusterQueue) deleteWorkload(w *kueue.Workload) {
-	k := workload.Key(w)
-	wi, exist := c.Workloads[k]
-	if !exist {
-		return
-	}
-	c.updateWorkloadUsage(wi, -1)
-	if c.podsReadyTracking && !apimeta.IsStatusConditionTrue(w.Status.Conditions, kueue.WorkloadPodsReady) {
-		c.WorkloadsNotReady.Delete(k)
+// workloadRequests returns the total requests of an admitted workload, per
+// assigned flavor and resource.
+func workloadRequests(wi *workload.Info) FlavorResourceQuantities {
+	requests := make(FlavorResourceQuantities)
+	for _, ps := range wi.TotalRequests {
+		for wlRes, wlResFlv := range ps.Flavors {
+			v, wlResExist := ps.Requests[wlRes]
+			if !wlResExist {
+				continue
+			}
+			if requests[wlResFlv] == nil {
+				requests[wlResFlv] = make(map[corev1.ResourceName]int64)
+			}
+			requests[wlResFlv][wlRes] += v
+		}
 	}
-	delete(c.Workloads, k)
-	reportAdmittedActiveWorkloads(wi.ClusterQueue, len(c.Workloads))
+	return requests
 }
 
-// updateWorkloadUsage updates the usage of the ClusterQueue for the workload
-// and the number of admitted workloads for local queues.
-func (c *ClusterQueue) updateWorkloadUsage(wi *workload.Info, m int64) {
-	updateUsage(wi, c.Usage, m)
-	qKey := workload.QueueKey(wi.Obj)
-	if _, ok := c.localQueues[qKey]; ok {
-		updateUsage(wi, c.localQueues[qKey].usage, m)
-		c.localQueues[qKey].admittedWorkloads += int(m)
+// accountedRequests returns the requests of the workload per flavor and
+// resource as they are counted in the usage, that is, inflated by the
+// SafetyMargin like in updateUsage.
+func (c *ClusterQueue) accountedRequests(wi *workload.Info) FlavorResourceQuantities {
+	requests := make(FlavorResourceQuantities)
+	for _, ps := range wi.TotalRequests {
+		for wlRes, wlResFlv := range ps.Flavors {
+			v, wlResExist := ps.Requests[wlRes]
+			if !wlResExist {
+				continue
+			}
+			if requests[wlResFlv] == nil {
+				requests[wlResFlv] = make(map[corev1.ResourceName]int64)
+			}
+			requests[wlResFlv][wlRes] += withSafetyMargin(v, c.SafetyMargin)
+		}
 	}
+	return requests
+}
+
+// AccountedRequest returns the request for a flavor and resource as it's
+// counted in the usage of the ClusterQueue, inflated by the SafetyMargin.
+func (c *ClusterQueue) AccountedRequest(v int64) int64 {
+	return withSafetyMargin(v, c.SafetyMargin)
 }
 
-func updateUsage(wi *workload.Info, flvUsage FlavorResourceQuantities, m int64) {
+// updateUsage adds the requests of the workload, multiplied by m, to the usage.
+// The requests are inflated by the safety margin, rounding up, so that adding
+// and removing a workload with the same margin leaves the usage unchanged.
+func updateUsage(wi *workload.Info, flvUsage FlavorResourceQuantities, m int64, margin float64) {
 	for _, ps := range wi.TotalRequests {
 		for wlRes, wlResFlv := range ps.Flavors {
 			v, wlResExist := ps.Requests[wlRes]
 			flv, flvExist := flvUsage[wlResFlv]
 			if flvExist && wlResExist {
 				if _, exists := flv[wlRes]; exists {
-					flv[wlRes] += v * m
+					flv[wlRes] += withSafetyMargin(v, margin) * m
 				}
 			}
 		}
 	}
 }
 
+// withSafetyMargin returns the request inflated by the margin, rounding up.
+func withSafetyMargin(v int64, margin float64) int64 {
+	if margin <= 0 {
+		return v
+	}
+	return int64(math.Ceil(float64(v) * (1 + margin)))
+}
+
 func (c *ClusterQueue) addLocalQueue(q *kueue.LocalQueue) error {
 	qKey := queueKey(q)
 	if _, ok := c.localQueues[qKey]; ok {
@@ -300,23 +3213,173 @@ func (c *ClusterQueue) addLocalQueue(q *kueue.LocalQueue) error {
 		key:               qKey,
 		admittedWorkloads: 0,
 		usage:             make(FlavorResourceQuantities),
+		weight:            localQueueWeight(q),
 	}
 	if err := qImpl.resetFlavorsAndResources(c.Usage); err != nil {
 		return err
 	}
 	for _, wl := range c.Workloads {
 		if workloadBelongsToLocalQueue(wl.Obj, q) {
-			updateUsage(wl, qImpl.usage, 1)
+			updateUsage(wl, qImpl.usage, 1, c.SafetyMargin)
 			qImpl.admittedWorkloads++
 		}
 	}
 	c.localQueues[qKey] = qImpl
+	c.generation++
 	return nil
 }
 
+func (c *ClusterQueue) updateLocalQueue(q *kueue.LocalQueue) {
+	qImpl, ok := c.localQueues[queueKey(q)]
+	if !ok {
+		return
+	}
+	// The weight splits the quota among the local queues, see
+	// LocalQueueGuarantee.
+	if weight := localQueueWeight(q); weight != qImpl.weight {
+		qImpl.weight = weight
+		c.generation++
+	}
+}
+
 func (c *ClusterQueue) deleteLocalQueue(q *kueue.LocalQueue) {
 	qKey := queueKey(q)
 	delete(c.localQueues, qKey)
+	c.generation++
+}
+
+// Generation returns a number that increases every time the ClusterQueue
+// changes. A snapshot has the generation of the ClusterQueue when it was taken.
+func (c *ClusterQueue) Generation() int64 {
+	return c.generation
+}
+
+// LocalQueueSatisfaction returns, per local queue key, the dominant share of
+// the local queue usage relative to an even split of the ClusterQueue nominal
+// quota among its local queues. Values under 1 mean that the local queue uses
+// less than its even share.
+func (c *ClusterQueue) LocalQueueSatisfaction() map[string]float64 {
+	satisfaction := make(map[string]float64, len(c.localQueues))
+	if len(c.localQueues) == 0 {
+		return satisfaction
+	}
+	evenSplit := float64(len(c.localQueues))
+	for qKey, q := range c.localQueues {
+		satisfaction[qKey] = c.localQueueDominantShare(q) * evenSplit
+	}
+	return satisfaction
+}
+
+// localQueueDominantShare returns the highest ratio between the usage of the
+// local queue and the nominal quota of the ClusterQueue, across flavors and
+// resources.
+func (c *ClusterQueue) localQueueDominantShare(q *queue) float64 {
+	var dominant float64
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+		if rQuota.Nominal == 0 {
+			return
+		}
+		if share := float64(q.usage[fName][rName]) / float64(rQuota.Nominal); share > dominant {
+			dominant = share
+		}
+	})
+	return dominant
+}
+
+// LocalQueueUtilizationPercentile returns the p-th percentile, with p from 0
+// to 1, of the dominant share of the nominal quota that the local queues use,
+// interpolating linearly between the closest local queues. It returns 0 when
+// the ClusterQueue has no local queues.
+func (c *ClusterQueue) LocalQueueUtilizationPercentile(p float64) float64 {
+	if len(c.localQueues) == 0 {
+		return 0
+	}
+	shares := make([]float64, 0, len(c.localQueues))
+	for _, q := range c.localQueues {
+		shares = append(shares, c.localQueueDominantShare(q))
+	}
+	sort.Float64s(shares)
+	p = math.Max(0, math.Min(1, p))
+	rank := p * float64(len(shares)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return shares[lower] + (shares[upper]-shares[lower])*(rank-float64(lower))
+}
+
+// LocalQueueGuarantee returns the slice of the EffectiveNominal quota of the
+// ClusterQueue guaranteed to the local queue, proportional to its weight over
+// the total weight of the local queues. It returns nil if the local queue isn't
+// known.
+func (c *ClusterQueue) LocalQueueGuarantee(qKey string) FlavorResourceQuantities {
+	q, ok := c.localQueues[qKey]
+	if !ok {
+		return nil
+	}
+	var totalWeight int64
+	for _, lq := range c.localQueues {
+		totalWeight += lq.weight
+	}
+	guarantee := make(FlavorResourceQuantities)
+	c.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, _ *ResourceQuota) {
+		if guarantee[fName] == nil {
+			guarantee[fName] = make(map[corev1.ResourceName]int64)
+		}
+		guarantee[fName][rName] = c.EffectiveNominal(fName, rName) * q.weight / totalWeight
+	})
+	return guarantee
+}
+
+// StarvedLocalQueues returns the sorted keys of the local queues whose pending
+// demand, per flavor and resource, can't be met because their siblings use
+// part of their LocalQueueGuarantee. That is, for some flavor and resource,
+// the pending demand exceeds the remaining quota of the ClusterQueue, and the
+// siblings use more than the nominal quota minus the guarantee of the local
+// queue. The pending demand of unknown local queues is ignored.
+func (c *ClusterQueue) StarvedLocalQueues(pendingByQueue map[string]FlavorResourceQuantities) []string {
+	var starved []string
+	for qKey, pending := range pendingByQueue {
+		q, ok := c.localQueues[qKey]
+		if !ok {
+			continue
+		}
+		guarantee := c.LocalQueueGuarantee(qKey)
+		if c.starvedBySiblings(q, guarantee, pending) {
+			starved = append(starved, qKey)
+		}
+	}
+	sort.Strings(starved)
+	return starved
+}
+
+// starvedBySiblings returns whether some pending demand of the local queue
+// doesn't fit because its siblings use part of its guarantee.
+func (c *ClusterQueue) starvedBySiblings(q *queue, guarantee, pending FlavorResourceQuantities) bool {
+	for fName, rPending := range pending {
+		for rName, v := range rPending {
+			if v <= 0 || c.quotaFor(fName, rName) == nil || v <= c.RemainingQuota(fName, rName) {
+				continue
+			}
+			siblingsUsage := c.Usage[fName][rName] - q.usage[fName][rName]
+			if siblingsUsage > c.EffectiveNominal(fName, rName)-guarantee[fName][rName] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OverFairLocalQueues returns the sorted keys of the local queues whose
+// dominant share of the nominal quota exceeds an even slice, that is, 1 over
+// the number of local queues.
+func (c *ClusterQueue) OverFairLocalQueues() []string {
+	var over []string
+	for qKey, satisfaction := range c.LocalQueueSatisfaction() {
+		if satisfaction > 1 {
+			over = append(over, qKey)
+		}
+	}
+	sort.Strings(over)
+	return over
 }
 
 func (c *ClusterQueue) flavorInUse(flavor string) bool {
@@ -349,6 +3412,24 @@ func workloadBelongsToLocalQueue(wl *kueue.Workload, q *kueue.LocalQueue) bool {
 	return wl.Namespace == q.Namespace && wl.Spec.QueueName == q.Name
 }
 
-func reportAdmittedActiveWorkloads(cqName string, val int) {
-	metrics.AdmittedActiveWorkloads.WithLabelValues(cqName).Set(float64(val))
+// reportAdmittedActiveWorkloads reports the number of admitted workloads, or
+// defers it to the next flushMetrics when the metrics are batched.
+func (c *ClusterQueue) reportAdmittedActiveWorkloads() {
+	if c.simulated {
+		return
+	}
+	if c.batchMetrics {
+		c.metricsDirty = true
+		return
+	}
+	metrics.ReportAdmittedActiveWorkloads(c.Name, c.labels, len(c.Workloads))
+}
+
+// flushMetrics reports the metrics deferred since the last flush.
+func (c *ClusterQueue) flushMetrics() {
+	if !c.metricsDirty {
+		return
+	}
+	c.metricsDirty = false
+	metrics.ReportAdmittedActiveWorkloads(c.Name, c.labels, len(c.Workloads))
 }
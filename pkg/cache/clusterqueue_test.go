@@ -1,11 +1,29 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	testingclock "k8s.io/utils/clock/testing"
 
 	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
 	"sigs.k8s.io/kueue/pkg/metrics"
+	"sigs.k8s.io/kueue/pkg/util/maps"
+	"sigs.k8s.io/kueue/pkg/util/pointer"
 	utiltesting "sigs.k8s.io/kueue/pkg/util/testing"
+	"sigs.k8s.io/kueue/pkg/workload"
 )
 
 func TestClusterQueueUpdateWithFlavors(t *testing.T) {
@@ -66,3 +84,4532 @@ func TestClusterQueueUpdateWithFlavors(t *testing.T) {
 		})
 	}
 }
+
+func TestClusterQueuePreemptionCandidates(t *testing.T) {
+	now := time.Now()
+	admittedAt := func(name string, priority int32, ts time.Time) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "").
+			Priority(priority).
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			SetOrReplaceCondition(metav1.Condition{
+				Type:               kueue.WorkloadAdmitted,
+				Status:             metav1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(ts),
+			}).
+			Obj()
+	}
+	workloads := []*kueue.Workload{
+		admittedAt("old", 0, now.Add(-time.Hour)),
+		admittedAt("recent", 0, now.Add(-time.Minute)),
+		admittedAt("high-priority", 200, now.Add(-time.Hour)),
+	}
+	preemptor := utiltesting.MakeWorkload("preemptor", "").Priority(100).Obj()
+
+	cases := map[string]struct {
+		window         time.Duration
+		wantCandidates []string
+	}{
+		"no protection window": {
+			wantCandidates: []string{"/old", "/recent"},
+		},
+		"recently admitted workload is protected": {
+			window:         10 * time.Minute,
+			wantCandidates: []string{"/old"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient(), WithPreemptionProtectionWindow(tc.window))
+			cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+				Preemption(kueue.ClusterQueuePreemption{WithinClusterQueue: kueue.PreemptionPolicyLowerPriority}).
+				Obj())
+			if err != nil {
+				t.Fatalf("Failed to create ClusterQueue: %v", err)
+			}
+			for _, wl := range workloads {
+				if err := cq.addWorkload(wl); err != nil {
+					t.Fatalf("Failed adding workload: %v", err)
+				}
+			}
+			var gotCandidates []string
+			for _, wi := range cq.PreemptionCandidates(preemptor, now) {
+				gotCandidates = append(gotCandidates, workload.Key(wi.Obj))
+			}
+			if diff := cmp.Diff(tc.wantCandidates, gotCandidates, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("Unexpected candidates (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueViewUsageIsACopy(t *testing.T) {
+	cq := &ClusterQueue{
+		Name: "cq",
+		Usage: FlavorResourceQuantities{
+			"default": {corev1.ResourceCPU: 1_000},
+		},
+	}
+	var view ClusterQueueView = cq
+	usage := view.GetUsage()
+	usage["default"][corev1.ResourceCPU] = 5_000
+	usage["other"] = map[corev1.ResourceName]int64{corev1.ResourceMemory: 1}
+
+	wantUsage := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 1_000},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Internal usage changed after modifying the returned copy (-want,+got):\n%s", diff)
+	}
+	if view.GetName() != "cq" {
+		t.Errorf("Unexpected name %q", view.GetName())
+	}
+}
+
+func TestClusterQueueEstimateAdmissionDelay(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	if err := cq.addWorkload(utiltesting.MakeWorkload("running", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "8").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	cases := map[string]struct {
+		cpu       string
+		drainRate float64
+		wantDelay time.Duration
+	}{
+		"fits now": {
+			cpu:       "2",
+			drainRate: 500,
+		},
+		"backlog drained at 500m per second": {
+			cpu:       "4",
+			drainRate: 500,
+			wantDelay: 4 * time.Second,
+		},
+		"no drain": {
+			cpu:       "4",
+			wantDelay: time.Duration(math.MaxInt64),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wi := workload.NewInfo(utiltesting.MakeWorkload("pending", "").
+				Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", tc.cpu).Obj()).
+				Obj())
+			if got := cq.EstimateAdmissionDelay(wi, tc.drainRate); got != tc.wantDelay {
+				t.Errorf("EstimateAdmissionDelay() = %v, want %v", got, tc.wantDelay)
+			}
+		})
+	}
+}
+
+func TestClusterQueueMaxAdmissibleReplicas(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").
+			Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	if err := cq.addWorkload(utiltesting.MakeWorkload("running", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "4").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	cases := map[string]struct {
+		perReplica FlavorResourceQuantities
+		want       int
+	}{
+		"capacity allows 3 of 5 replicas": {
+			perReplica: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 2_000, corev1.ResourceMemory: 1024 * 1024 * 1024},
+			},
+			want: 3,
+		},
+		"capacity allows all 5 replicas": {
+			perReplica: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 1_000, corev1.ResourceMemory: 1024 * 1024 * 1024},
+			},
+			want: 5,
+		},
+		"flavor not in the ClusterQueue": {
+			perReplica: FlavorResourceQuantities{
+				"other": {corev1.ResourceCPU: 1_000},
+			},
+			want: 0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := cq.MaxAdmissibleReplicas(tc.perReplica, 5); got != tc.want {
+				t.Errorf("MaxAdmissibleReplicas() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterQueueNominalQuotaMetric(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.ClusterQueueNominalQuota)
+	reportedQuotas := func(cqName string) map[string]float64 {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Failed gathering metrics: %v", err)
+		}
+		quotas := make(map[string]float64)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["cluster_queue"] == cqName {
+					quotas[labels["flavor"]+"/"+labels["resource"]] = m.GetGauge().GetValue()
+				}
+			}
+		}
+		return quotas
+	}
+
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("nominal-quota").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "500m").Obj(),
+		).
+		Obj()
+	if err := cache.AddClusterQueue(context.Background(), cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wantQuotas := map[string]float64{
+		"on-demand/cpu": 10,
+		"spot/cpu":      0.5,
+	}
+	if diff := cmp.Diff(wantQuotas, reportedQuotas(cq.Name)); diff != "" {
+		t.Errorf("Unexpected nominal quota metrics after adding the ClusterQueue (-want,+got):\n%s", diff)
+	}
+
+	cq = utiltesting.MakeClusterQueue("nominal-quota").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "20").Obj()).
+		Obj()
+	if err := cache.UpdateClusterQueue(cq); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	wantQuotas = map[string]float64{
+		"on-demand/cpu": 20,
+	}
+	if diff := cmp.Diff(wantQuotas, reportedQuotas(cq.Name)); diff != "" {
+		t.Errorf("Unexpected nominal quota metrics after removing a flavor (-want,+got):\n%s", diff)
+	}
+
+	cache.DeleteClusterQueue(cq)
+	if diff := cmp.Diff(map[string]float64{}, reportedQuotas(cq.Name)); diff != "" {
+		t.Errorf("Unexpected nominal quota metrics after deleting the ClusterQueue (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueMetricsLabels(t *testing.T) {
+	if err := metrics.SetClusterQueueLabelKeys("example.com/team", "example.com.team"); err == nil {
+		t.Errorf("Setting label keys that map to the same label didn't fail")
+	}
+	if err := metrics.SetClusterQueueLabelKeys("example.com/team"); err != nil {
+		t.Fatalf("Failed setting the label keys: %v", err)
+	}
+	defer func() {
+		if err := metrics.SetClusterQueueLabelKeys(); err != nil {
+			t.Errorf("Failed resetting the label keys: %v", err)
+		}
+	}()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.AdmittedActiveWorkloads, metrics.ClusterQueueNominalQuota)
+	reportedLabels := func() map[string][]map[string]string {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Failed gathering metrics: %v", err)
+		}
+		reported := make(map[string][]map[string]string)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				reported[family.GetName()] = append(reported[family.GetName()], labels)
+			}
+		}
+		return reported
+	}
+
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("labeled").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	cq.Labels = map[string]string{"example.com/team": "ml", "env": "prod"}
+	if err := cache.AddClusterQueue(context.Background(), cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission(cq.Name).Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+	want := map[string][]map[string]string{
+		"kueue_admitted_active_workloads": {
+			{"cluster_queue": "labeled", "example_com_team": "ml"},
+		},
+		"kueue_cluster_queue_nominal_quota": {
+			{"cluster_queue": "labeled", "flavor": "default", "resource": "cpu", "example_com_team": "ml"},
+		},
+	}
+	if diff := cmp.Diff(want, reportedLabels()); diff != "" {
+		t.Errorf("Unexpected metric labels (-want,+got):\n%s", diff)
+	}
+
+	cq.Labels["example.com/team"] = "search"
+	if err := cache.UpdateClusterQueue(cq); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	want = map[string][]map[string]string{
+		"kueue_admitted_active_workloads": {
+			{"cluster_queue": "labeled", "example_com_team": "search"},
+		},
+		"kueue_cluster_queue_nominal_quota": {
+			{"cluster_queue": "labeled", "flavor": "default", "resource": "cpu", "example_com_team": "search"},
+		},
+	}
+	if diff := cmp.Diff(want, reportedLabels()); diff != "" {
+		t.Errorf("Unexpected metric labels after updating the labels (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueExclusiveFlavor(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("gpu-8x").Resource("example.com/gpu", "16").Obj()).
+		Annotation(ResourceGroupSettingsAnnotation, `{"flavors":[{"name":"gpu-8x","exclusive":true}]}`).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	first := utiltesting.MakeWorkload("first", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment("example.com/gpu", "gpu-8x", "8").Obj()).
+		Obj()
+	second := utiltesting.MakeWorkload("second", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment("example.com/gpu", "gpu-8x", "8").Obj()).
+		Obj()
+
+	if !cq.CanFit(workload.NewInfo(first)) {
+		t.Errorf("First workload doesn't fit in the exclusive flavor")
+	}
+	if err := cq.addWorkload(first); err != nil {
+		t.Fatalf("Failed adding the first workload: %v", err)
+	}
+	if holder, _ := cq.ExclusiveFlavorHolder("gpu-8x"); holder != "/first" {
+		t.Errorf("Unexpected holder of the exclusive flavor %q, want /first", holder)
+	}
+	if cq.CanFit(workload.NewInfo(second)) {
+		t.Errorf("Second workload fits in the exclusive flavor while it's in use")
+	}
+
+	cq.deleteWorkload(first)
+	if !cq.CanFit(workload.NewInfo(second)) {
+		t.Errorf("Second workload doesn't fit in the exclusive flavor after deleting the first")
+	}
+	if err := cq.addWorkload(second); err != nil {
+		t.Errorf("Failed adding the second workload after deleting the first: %v", err)
+	}
+	if holder, _ := cq.ExclusiveFlavorHolder("gpu-8x"); holder != "/second" {
+		t.Errorf("Unexpected holder of the exclusive flavor %q, want /second", holder)
+	}
+}
+
+func TestClusterQueueResourceGroupSettings(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("x86").Resource(corev1.ResourceCPU, "10").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj()).
+		Cohort("one").
+		Annotation(ResourceGroupSettingsAnnotation, `{
+			"resourceGroups": [{
+				"coveredResources": ["example.com/gpu"],
+				"namespaceSelector": {"matchLabels": {"team": "ml"}},
+				"preemptionPriorityThreshold": 100
+			}],
+			"flavors": [{
+				"name": "a100",
+				"exclusive": true,
+				"maxWorkloads": 1,
+				"resources": [{"name": "example.com/gpu", "borrowingLimitPercent": 50}]
+			}, {
+				"name": "x86",
+				"resources": [{"name": "cpu", "minNominal": "2", "maxNominal": "6"}]
+			}]
+		}`).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cqObj); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+
+	type settings struct {
+		NamespaceSelector           string
+		PreemptionPriorityThreshold *int32
+		Exclusive                   bool
+		MaxWorkloads                *int
+		BorrowingLimitPercent       *int
+		BorrowingLimit              *int64
+		Nominal                     int64
+		MinNominal                  *int64
+		MaxNominal                  *int64
+	}
+	gotSettings := func() []settings {
+		cq := cache.clusterQueues["cq"]
+		var got []settings
+		for _, rg := range cq.ResourceGroups {
+			for _, fQuotas := range rg.Flavors {
+				for _, rQuota := range fQuotas.Resources {
+					s := settings{
+						PreemptionPriorityThreshold: rg.PreemptionPriorityThreshold,
+						Exclusive:                   fQuotas.Exclusive,
+						MaxWorkloads:                fQuotas.MaxWorkloads,
+						BorrowingLimitPercent:       rQuota.BorrowingLimitPercent,
+						BorrowingLimit:              rQuota.BorrowingLimit,
+						Nominal:                     rQuota.Nominal,
+						MinNominal:                  rQuota.MinNominal,
+						MaxNominal:                  rQuota.MaxNominal,
+					}
+					if rg.NamespaceSelector != nil {
+						s.NamespaceSelector = rg.NamespaceSelector.String()
+					}
+					got = append(got, s)
+				}
+			}
+		}
+		return got
+	}
+	want := []settings{
+		{
+			Nominal:    2_000,
+			MinNominal: pointer.Int64(2_000),
+			MaxNominal: pointer.Int64(6_000),
+		},
+		{
+			NamespaceSelector:           "team=ml",
+			PreemptionPriorityThreshold: pointer.Int32(100),
+			Exclusive:                   true,
+			MaxWorkloads:                pointer.Int(1),
+			BorrowingLimitPercent:       pointer.Int(50),
+			BorrowingLimit:              pointer.Int64(1),
+			Nominal:                     2,
+		},
+	}
+	if diff := cmp.Diff(want, gotSettings()); diff != "" {
+		t.Errorf("Unexpected settings after adding the ClusterQueue (-want,+got):\n%s", diff)
+	}
+
+	invalid := cqObj.DeepCopy()
+	invalid.Annotations[ResourceGroupSettingsAnnotation] = `{"flavors":[{"name":"x86","resources":[{"name":"cpu","minNominal":"2"}]}]}`
+	if err := cache.UpdateClusterQueue(invalid); !errors.Is(err, errInvalidResourceGroupSettings) {
+		t.Errorf("Unexpected error updating with invalid settings: %v", err)
+	}
+	invalid.Annotations[ResourceGroupSettingsAnnotation] = `{"flavors":`
+	if err := cache.UpdateClusterQueue(invalid); !errors.Is(err, errInvalidResourceGroupSettings) {
+		t.Errorf("Unexpected error updating with malformed settings: %v", err)
+	}
+	if diff := cmp.Diff(want, gotSettings()); diff != "" {
+		t.Errorf("Unexpected settings after rejected updates (-want,+got):\n%s", diff)
+	}
+
+	// The settings removed from the annotation are cleared.
+	cleared := cqObj.DeepCopy()
+	delete(cleared.Annotations, ResourceGroupSettingsAnnotation)
+	if err := cache.UpdateClusterQueue(cleared); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	want = []settings{{Nominal: 10_000}, {Nominal: 2}}
+	if diff := cmp.Diff(want, gotSettings()); diff != "" {
+		t.Errorf("Unexpected settings after removing the annotation (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueFlavorMaxWorkloads(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj()).
+		Annotation(ResourceGroupSettingsAnnotation, `{"flavors":[{"name":"on-demand","maxWorkloads":2}]}`).
+		Obj()
+	cq, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	// The setting is kept on updates of the spec.
+	updated := cqObj.DeepCopy()
+	updated.Spec.ResourceGroups[0].Flavors[0].Resources[0].NominalQuota = resource.MustParse("20")
+	if err := cq.update(updated, nil, nil); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+
+	wls := make([]*kueue.Workload, 3)
+	for i := range wls {
+		wls[i] = utiltesting.MakeWorkload(fmt.Sprintf("wl-%d", i), "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "on-demand", "1").Obj()).
+			Obj()
+	}
+	for _, wl := range wls[:2] {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %s: %v", wl.Name, err)
+		}
+	}
+	if got := cq.flavorWorkloads["on-demand"]; got != 2 {
+		t.Errorf("Got %d workloads in the flavor, want 2", got)
+	}
+	if cq.CanFit(workload.NewInfo(wls[2])) {
+		t.Errorf("The third workload fits in the flavor at its workload limit")
+	}
+	if !cq.FlavorAtWorkloadsLimit("on-demand") {
+		t.Errorf("The flavor isn't reported at its workload limit")
+	}
+
+	cq.deleteWorkload(wls[0])
+	if !cq.CanFit(workload.NewInfo(wls[2])) {
+		t.Errorf("The third workload doesn't fit after deleting the first")
+	}
+	if cq.FlavorAtWorkloadsLimit("on-demand") {
+		t.Errorf("The flavor is reported at its workload limit after deleting a workload")
+	}
+
+	// Admitted workloads are always accounted, even over the limit.
+	for _, wl := range []*kueue.Workload{wls[0], wls[2]} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Errorf("Failed adding workload %s: %v", wl.Name, err)
+		}
+	}
+	if got := cq.flavorWorkloads["on-demand"]; got != 3 {
+		t.Errorf("Got %d workloads in the flavor, want 3", got)
+	}
+}
+
+func TestClusterQueueLabel(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient(), WithRetainedLabels("team"))
+	cqObj := utiltesting.MakeClusterQueue("cq").Obj()
+	cqObj.Labels = map[string]string{
+		"team":        "ml",
+		"cost-center": "1234",
+	}
+	cq, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	if v, ok := cq.Label("team"); !ok || v != "ml" {
+		t.Errorf("Unexpected value for the retained label: %q, %t", v, ok)
+	}
+	if v, ok := cq.Label("cost-center"); ok {
+		t.Errorf("Unexpected value for a label that isn't retained: %q", v)
+	}
+	if v, ok := cq.snapshot().Label("team"); !ok || v != "ml" {
+		t.Errorf("Unexpected value for the retained label in the snapshot: %q, %t", v, ok)
+	}
+
+	delete(cqObj.Labels, "team")
+	if err := cq.update(cqObj, nil, nil); err != nil {
+		t.Fatalf("Failed to update ClusterQueue: %v", err)
+	}
+	if v, ok := cq.Label("team"); ok {
+		t.Errorf("Unexpected value for a removed label: %q", v)
+	}
+}
+
+func TestClusterQueueDefaultRequests(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	cq.DefaultRequests = FlavorResourceQuantities{
+		"default": {corev1.ResourceMemory: 1 * utiltesting.Gi},
+	}
+
+	missingMemory := utiltesting.MakeWorkload("missing-memory", "").
+		PodSets(*utiltesting.MakePodSet("main", 2).Request(corev1.ResourceCPU, "1").Obj()).
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "2").AssignmentPodCount(2).Obj()).
+		Obj()
+	if err := cq.addWorkload(missingMemory); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	wantUsage := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 2_000, corev1.ResourceMemory: 2 * utiltesting.Gi},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage with the default memory request (-want,+got):\n%s", diff)
+	}
+	if _, found := missingMemory.Status.Admission.PodSetAssignments[0].Flavors[corev1.ResourceMemory]; found {
+		t.Errorf("The default request modified the workload admission")
+	}
+
+	withMemory := utiltesting.MakeWorkload("with-memory", "").
+		PodSets(*utiltesting.MakePodSet("main", 1).
+			Request(corev1.ResourceCPU, "1").
+			Request(corev1.ResourceMemory, "3Gi").Obj()).
+		Admit(utiltesting.MakeAdmission("cq").
+			Assignment(corev1.ResourceCPU, "default", "1").
+			Assignment(corev1.ResourceMemory, "default", "3Gi").Obj()).
+		Obj()
+	if err := cq.addWorkload(withMemory); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	wantUsage = FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 3_000, corev1.ResourceMemory: 5 * utiltesting.Gi},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage with an explicit memory request (-want,+got):\n%s", diff)
+	}
+
+	cq.deleteWorkload(missingMemory)
+	wantUsage = FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 1_000, corev1.ResourceMemory: 3 * utiltesting.Gi},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after deleting the workload with the default (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueUsageWithInitContainersAndOverhead(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "20").
+			Resource(corev1.ResourceMemory, "20Gi").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	wl := utiltesting.MakeWorkload("wl", "").
+		PodSets(*utiltesting.MakePodSet("main", 2).
+			Request(corev1.ResourceCPU, "1").
+			Request(corev1.ResourceMemory, "1Gi").
+			InitContainers(corev1.Container{
+				Name: "init",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("4"),
+						corev1.ResourceMemory: resource.MustParse("512Mi"),
+					},
+				},
+			}).
+			Overhead(corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("256Mi"),
+			}).Obj()).
+		Obj()
+
+	// The admission carries the usage computed from the pending pod sets, the
+	// same way the scheduler builds it.
+	admission := utiltesting.MakeAdmission("cq").AssignmentPodCount(2)
+	for rName, v := range workload.NewInfo(wl).TotalRequests[0].Requests {
+		q := workload.ResourceQuantity(rName, v)
+		admission.Assignment(rName, "default", q.String())
+	}
+	wl.Status.Admission = admission.Obj()
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	wantUsage := FlavorResourceQuantities{
+		"default": {
+			corev1.ResourceCPU:    2 * 4_500,
+			corev1.ResourceMemory: 2 * (1024 + 256) * utiltesting.Mi,
+		},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueLocalQueueSatisfaction(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "9").
+			Resource(corev1.ResourceMemory, "9Gi").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := cq.addLocalQueue(utiltesting.MakeLocalQueue(name, "ns").ClusterQueue("cq").Obj()); err != nil {
+			t.Fatalf("Failed adding local queue %q: %v", name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "ns").Queue("a").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "ns").Queue("b").
+			Admit(utiltesting.MakeAdmission("cq").
+				Assignment(corev1.ResourceCPU, "default", "1").
+				Assignment(corev1.ResourceMemory, "default", "6Gi").Obj()).Obj(),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+
+	want := map[string]float64{
+		"ns/a": 1,
+		"ns/b": 2,
+		"ns/c": 0,
+	}
+	if diff := cmp.Diff(want, cq.LocalQueueSatisfaction(), cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+		t.Errorf("Unexpected satisfaction (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueLocalQueueUtilizationPercentile(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	if got := cq.LocalQueueUtilizationPercentile(0.5); got != 0 {
+		t.Errorf("Unexpected median without local queues: %v, want 0", got)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := cq.addLocalQueue(utiltesting.MakeLocalQueue(name, "ns").ClusterQueue("cq").Obj()); err != nil {
+			t.Fatalf("Failed adding local queue %q: %v", name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "ns").Queue("a").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "ns").Queue("b").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+		utiltesting.MakeWorkload("c1", "ns").Queue("c").
+			Admit(utiltesting.MakeAdmission("cq").
+				Assignment(corev1.ResourceCPU, "default", "1").
+				Assignment(corev1.ResourceMemory, "default", "6Gi").Obj()).Obj(),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+
+	// The dominant shares are 0, 0.1, 0.3 and 0.6.
+	cases := map[string]struct {
+		p    float64
+		want float64
+	}{
+		"minimum": {p: 0, want: 0},
+		"median":  {p: 0.5, want: 0.2},
+		"maximum": {p: 1, want: 0.6},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := cq.LocalQueueUtilizationPercentile(tc.p); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("LocalQueueUtilizationPercentile(%v) = %v, want %v", tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterQueueLocalQueueGuarantee(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "9").
+			Resource(corev1.ResourceMemory, "3Gi").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for name, weight := range map[string]string{"a": "1", "b": "2"} {
+		lq := utiltesting.MakeLocalQueue(name, "ns").ClusterQueue("cq").Obj()
+		lq.Annotations = map[string]string{LocalQueueWeightAnnotation: weight}
+		if err := cq.addLocalQueue(lq); err != nil {
+			t.Fatalf("Failed adding local queue %q: %v", name, err)
+		}
+	}
+
+	cases := map[string]struct {
+		qKey string
+		want FlavorResourceQuantities
+	}{
+		"weight 1": {
+			qKey: "ns/a",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 3_000, corev1.ResourceMemory: utiltesting.Gi},
+			},
+		},
+		"weight 2": {
+			qKey: "ns/b",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 6_000, corev1.ResourceMemory: 2 * utiltesting.Gi},
+			},
+		},
+		"unknown local queue": {
+			qKey: "ns/c",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, cq.LocalQueueGuarantee(tc.qKey)); diff != "" {
+				t.Errorf("Unexpected guarantee (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueLocalQueueWeightUpdate(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "9").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	lq := utiltesting.MakeLocalQueue("a", "ns").ClusterQueue("cq").Obj()
+	if err := cq.addLocalQueue(lq); err != nil {
+		t.Fatalf("Failed adding local queue: %v", err)
+	}
+
+	generation := cq.Generation()
+	cq.updateLocalQueue(lq.DeepCopy())
+	if got := cq.Generation(); got != generation {
+		t.Errorf("Got generation %d after an update without changes, want %d", got, generation)
+	}
+	updated := lq.DeepCopy()
+	updated.Annotations = map[string]string{LocalQueueWeightAnnotation: "2"}
+	cq.updateLocalQueue(updated)
+	if got := cq.Generation(); got <= generation {
+		t.Errorf("Got generation %d after changing the weight, want more than %d", got, generation)
+	}
+}
+
+func TestClusterQueueStarvedLocalQueues(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "9").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	for name, weight := range map[string]string{"a": "1", "b": "2"} {
+		lq := utiltesting.MakeLocalQueue(name, "ns").ClusterQueue("cq").Obj()
+		lq.Annotations = map[string]string{LocalQueueWeightAnnotation: weight}
+		if err := cache.AddLocalQueue(lq); err != nil {
+			t.Fatalf("Failed adding local queue %q: %v", name, err)
+		}
+	}
+	wl := utiltesting.MakeWorkload("b1", "ns").
+		Queue("b").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "8").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+
+	cases := map[string]struct {
+		pending map[string]FlavorResourceQuantities
+		want    []string
+	}{
+		"sibling uses the guarantee": {
+			pending: map[string]FlavorResourceQuantities{
+				"ns/a": {"default": {corev1.ResourceCPU: 2_000}},
+			},
+			want: []string{"ns/a"},
+		},
+		"demand fits in the remaining quota": {
+			pending: map[string]FlavorResourceQuantities{
+				"ns/a": {"default": {corev1.ResourceCPU: 1_000}},
+			},
+		},
+		"queue over its own guarantee": {
+			pending: map[string]FlavorResourceQuantities{
+				"ns/b": {"default": {corev1.ResourceCPU: 2_000}},
+			},
+		},
+		"unknown local queue": {
+			pending: map[string]FlavorResourceQuantities{
+				"ns/c": {"default": {corev1.ResourceCPU: 2_000}},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := cache.clusterQueues["cq"].StarvedLocalQueues(tc.pending)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected starved local queues (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueBorrowingEvents(t *testing.T) {
+	ctx := context.Background()
+	recorder := record.NewFakeRecorder(10)
+	cache := New(utiltesting.NewFakeClient(), WithEventRecorder(recorder))
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	admitted := func(name, cpu string) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj()
+	}
+	first, second, third := admitted("first", "1"), admitted("second", "2"), admitted("third", "1")
+	for _, wl := range []*kueue.Workload{first, second, third} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	for _, wl := range []*kueue.Workload{second, third, first} {
+		if err := cache.DeleteWorkload(wl); err != nil {
+			t.Fatalf("Failed deleting workload %q: %v", wl.Name, err)
+		}
+	}
+
+	close(recorder.Events)
+	var gotEvents []string
+	for e := range recorder.Events {
+		gotEvents = append(gotEvents, e)
+	}
+	wantEvents := []string{
+		"Normal StartedBorrowing ClusterQueue started borrowing cpu of flavor default, triggered by workload /second",
+		"Normal StoppedBorrowing ClusterQueue stopped borrowing cpu of flavor default, triggered by workload /second",
+	}
+	if diff := cmp.Diff(wantEvents, gotEvents); diff != "" {
+		t.Errorf("Unexpected events (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueAddWorkloadAccountsAdmitted(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("model-a").Resource("example.com/gpu", "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("cq").
+			Assignment(corev1.ResourceCPU, "default", "2").
+			Assignment("example.com/gpu", "model-b", "1").Obj()).
+		Obj()
+
+	// The workload is admitted in the API, so the cache accounts for it even if
+	// the ClusterQueue doesn't cover one of its flavors anymore.
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Unexpected error adding a workload with an uncovered flavor: %v", err)
+	}
+	wantUsage := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 2_000},
+		"model-a": {"example.com/gpu": 0},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after adding the workload (-want,+got):\n%s", diff)
+	}
+	if _, found := cq.Workloads[workload.Key(wl)]; !found {
+		t.Errorf("The workload wasn't added")
+	}
+	cq.deleteWorkload(wl)
+	wantUsage["default"][corev1.ResourceCPU] = 0
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after deleting the workload (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCacheAssumeWorkloadIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	if err := cache.AddClusterQueue(ctx, utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("model-a").Resource("example.com/gpu", "4").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("cq").
+			Assignment(corev1.ResourceCPU, "default", "2").
+			Assignment("example.com/gpu", "model-b", "1").Obj()).
+		Obj()
+
+	if err := cache.AssumeWorkload(wl); !errors.Is(err, errFlavorResourceNotCovered) {
+		t.Errorf("Unexpected error assuming a workload with an uncovered flavor: %v", err)
+	}
+	cq := cache.clusterQueues["cq"]
+	wantUsage := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 0},
+		"model-a": {"example.com/gpu": 0},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after a failed assumption (-want,+got):\n%s", diff)
+	}
+	if len(cq.Workloads) != 0 {
+		t.Errorf("Unexpected workloads after a failed assumption: %v", sets.List(sets.KeySet(cq.Workloads)))
+	}
+	if len(cache.assumedWorkloads) != 0 {
+		t.Errorf("The workload was assumed after a failed assumption")
+	}
+}
+
+func TestClusterQueueValidateWorkload(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	cases := map[string]struct {
+		wl      *kueue.Workload
+		wantErr *WorkloadValidationError
+	}{
+		"valid": {
+			wl: utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+				Obj(),
+		},
+		"uncovered resource": {
+			wl: utiltesting.MakeWorkload("wl", "").
+				Request(corev1.ResourceCPU, "1").
+				Request("example.com/gpu", "1").
+				Obj(),
+			wantErr: &WorkloadValidationError{
+				UncoveredResources: []corev1.ResourceName{"example.com/gpu"},
+			},
+		},
+		"unknown flavor": {
+			wl: utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "spot", "2").Obj()).
+				Obj(),
+			wantErr: &WorkloadValidationError{
+				UnknownFlavors: []kueue.ResourceFlavorReference{"spot"},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			usage := cq.Usage.clone()
+			err := cq.ValidateWorkload(workload.NewInfo(tc.wl))
+			var gotErr *WorkloadValidationError
+			if err != nil && !errors.As(err, &gotErr) {
+				t.Fatalf("Unexpected error type: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantErr, gotErr, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Unexpected error (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(usage, cq.Usage); diff != "" {
+				t.Errorf("The validation modified the usage (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueShortfall(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "2", "1").
+				Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+
+	cases := map[string]struct {
+		cpu, memory   string
+		wantShortfall FlavorResourceQuantities
+	}{
+		"fits borrowing": {
+			cpu:           "3",
+			memory:        "1Gi",
+			wantShortfall: FlavorResourceQuantities{},
+		},
+		"short on two resources": {
+			cpu:    "5",
+			memory: "8Gi",
+			wantShortfall: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 2_000, corev1.ResourceMemory: 2 * utiltesting.Gi},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wl := utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").
+					Assignment(corev1.ResourceCPU, "default", tc.cpu).
+					Assignment(corev1.ResourceMemory, "default", tc.memory).Obj()).
+				Obj()
+			if diff := cmp.Diff(tc.wantShortfall, cq.Shortfall(workload.NewInfo(wl))); diff != "" {
+				t.Errorf("Unexpected shortfall (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueAdmissionDeadline(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	deadline := now.Add(time.Hour)
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	fakeClock := testingclock.NewFakeClock(now)
+	cq.clock = fakeClock
+	makeWorkload := func(name string, admittedAt time.Time) *kueue.Workload {
+		wl := utiltesting.MakeWorkload(name, "ns").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			SetOrReplaceCondition(metav1.Condition{
+				Type:               kueue.WorkloadAdmitted,
+				Status:             metav1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(admittedAt),
+			}).
+			Obj()
+		wl.Annotations = map[string]string{AdmissionDeadlineAnnotation: deadline.Format(time.RFC3339)}
+		return wl
+	}
+
+	pending := workload.NewInfo(makeWorkload("pending", now))
+	if !cq.CanFit(pending) {
+		t.Errorf("Workload doesn't fit before the deadline")
+	}
+	if err := CheckAdmissionDeadline(pending, now); err != nil {
+		t.Errorf("Unexpected error checking the deadline before it passed: %v", err)
+	}
+
+	fakeClock.SetTime(deadline.Add(time.Second))
+	if cq.CanFit(pending) {
+		t.Errorf("Workload fits after the deadline")
+	}
+	if err := CheckAdmissionDeadline(pending, deadline.Add(time.Second)); !errors.Is(err, errAdmissionDeadlinePassed) {
+		t.Errorf("Unexpected error checking the deadline after it passed: %v, want %v", err, errAdmissionDeadlinePassed)
+	}
+	// The deadline only applies to the admission decisions, the cache accounts
+	// for the workloads that are admitted, regardless of the deadline.
+	if err := cq.addWorkload(makeWorkload("after", deadline.Add(time.Second))); err != nil {
+		t.Errorf("Failed adding workload admitted after the deadline: %v", err)
+	}
+}
+
+func TestClusterQueueBorrowingCohort(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+
+	cases := map[string]struct {
+		cpu     string
+		cohort  string
+		wantFit bool
+	}{
+		"borrowing without restriction": {
+			cpu:     "6",
+			wantFit: true,
+		},
+		"borrowing restricted to its own cohort": {
+			cpu:     "6",
+			cohort:  "one",
+			wantFit: true,
+		},
+		"borrowing restricted to a mismatched cohort": {
+			cpu:    "6",
+			cohort: "two",
+		},
+		"mismatched cohort within the nominal quota": {
+			cpu:     "4",
+			cohort:  "two",
+			wantFit: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wl := utiltesting.MakeWorkload("wl", "ns").
+				Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", tc.cpu).Obj()).
+				Obj()
+			if tc.cohort != "" {
+				wl.Annotations = map[string]string{BorrowingCohortAnnotation: tc.cohort}
+			}
+			if got := cache.clusterQueues["a"].CanFit(workload.NewInfo(wl)); got != tc.wantFit {
+				t.Errorf("CanFit() = %t, want %t", got, tc.wantFit)
+			}
+		})
+	}
+}
+
+func TestClusterQueueChurnRate(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wl := utiltesting.MakeWorkload(fmt.Sprintf("wl%d", i), "ns").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj()
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+		// Updates of the admitted workload aren't churn.
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed updating workload %q", wl.Name)
+		}
+		if err := cache.DeleteWorkload(wl); err != nil {
+			t.Fatalf("Failed deleting workload %q: %v", wl.Name, err)
+		}
+	}
+	// Forgetting an assumed workload only undoes the assumption.
+	assumed := utiltesting.MakeWorkload("assumed", "ns").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	if err := cache.AssumeWorkload(assumed); err != nil {
+		t.Fatalf("Failed assuming workload: %v", err)
+	}
+	if err := cache.ForgetWorkload(assumed); err != nil {
+		t.Fatalf("Failed forgetting workload: %v", err)
+	}
+
+	now := time.Now()
+	if got, want := cache.clusterQueues["cq"].ChurnRate(time.Minute, now), 7.0/60; got != want {
+		t.Errorf("ChurnRate() = %v, want %v", got, want)
+	}
+	if got := cache.clusterQueues["cq"].ChurnRate(time.Minute, now.Add(2*time.Minute)); got != 0 {
+		t.Errorf("ChurnRate() after the window = %v, want 0", got)
+	}
+}
+
+func TestClusterQueueAvoidedFlavors(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	cases := map[string]struct {
+		flavor  kueue.ResourceFlavorReference
+		avoid   string
+		wantFit bool
+	}{
+		"no avoided flavors": {
+			flavor:  "spot",
+			wantFit: true,
+		},
+		"assigned an avoided flavor": {
+			flavor: "spot",
+			avoid:  "preemptible, spot",
+		},
+		"assigned another flavor": {
+			flavor:  "on-demand",
+			avoid:   "spot",
+			wantFit: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wl := utiltesting.MakeWorkload("wl", "ns").
+				Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, tc.flavor, "1").Obj()).
+				Obj()
+			if tc.avoid != "" {
+				wl.Annotations = map[string]string{AvoidFlavorsAnnotation: tc.avoid}
+			}
+			if got := cq.CanFit(workload.NewInfo(wl)); got != tc.wantFit {
+				t.Errorf("CanFit() = %t, want %t", got, tc.wantFit)
+			}
+		})
+	}
+}
+
+func TestClusterQueueRequeueBackoff(t *testing.T) {
+	now := time.Now()
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	cq.clock = testingclock.NewFakeClock(now)
+	wl := utiltesting.MakeWorkload("wl", "ns").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	key := workload.Key(wl)
+
+	if got := cq.NextRetryAfter(key); !got.IsZero() {
+		t.Errorf("Unexpected retry time before any requeue: %v", got)
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		cq.RecordRequeue(key)
+		if got := cq.NextRetryAfter(key).Sub(now); got != want {
+			t.Errorf("Unexpected backoff after %d requeues: %v, want %v", i+1, got, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		cq.RecordRequeue(key)
+	}
+	if got := cq.NextRetryAfter(key).Sub(now); got != requeueMaxBackoff {
+		t.Errorf("Unexpected backoff after many requeues: %v, want %v", got, requeueMaxBackoff)
+	}
+
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if got := cq.NextRetryAfter(key); !got.IsZero() {
+		t.Errorf("Unexpected retry time after admission: %v", got)
+	}
+	cq.RecordRequeue(key)
+	if got := cq.NextRetryAfter(key).Sub(now); got != time.Second {
+		t.Errorf("Unexpected backoff for a requeue after admission: %v, want %v", got, time.Second)
+	}
+}
+
+func TestClusterQueueAdmissionGates(t *testing.T) {
+	errMissingTeam := errors.New("missing team label")
+	cache := New(utiltesting.NewFakeClient(), WithAdmissionGates(
+		func(wi *workload.Info, cq ClusterQueueView) error {
+			if _, ok := wi.Obj.Labels["team"]; !ok {
+				return errMissingTeam
+			}
+			return nil
+		},
+	))
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	admitted := func(name string, labels map[string]string) *kueue.Workload {
+		wl := utiltesting.MakeWorkload(name, "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj()
+		wl.Labels = labels
+		return wl
+	}
+	rejected := admitted("rejected", nil)
+	allowed := admitted("allowed", map[string]string{"team": "ml"})
+
+	if err := cq.RunAdmissionGates(workload.NewInfo(rejected)); !errors.Is(err, errMissingTeam) {
+		t.Errorf("Unexpected error running the gates for a workload without the required label: %v", err)
+	}
+	if cq.CanFit(workload.NewInfo(rejected)) {
+		t.Errorf("Workload without the required label fits")
+	}
+	if err := cq.RunAdmissionGates(workload.NewInfo(allowed)); err != nil {
+		t.Errorf("Unexpected error running the gates for a workload with the required label: %v", err)
+	}
+	if !cq.CanFit(workload.NewInfo(allowed)) {
+		t.Errorf("Workload with the required label doesn't fit")
+	}
+	// The gates don't run when the admitted workloads are added to the cache.
+	if err := cq.addWorkload(rejected); err != nil {
+		t.Errorf("Failed adding an admitted workload without the required label: %v", err)
+	}
+	wantUsage := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 1_000},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueFlavorUsageRatioMetric(t *testing.T) {
+	type observations struct {
+		Count uint64
+		Sum   float64
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.ClusterQueueFlavorUsageRatio)
+	observed := func(cqName string) map[string]observations {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Failed gathering metrics: %v", err)
+		}
+		result := make(map[string]observations)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				if labels["cluster_queue"] == cqName {
+					result[labels["flavor"]] = observations{
+						Count: m.GetHistogram().GetSampleCount(),
+						Sum:   m.GetHistogram().GetSampleSum(),
+					}
+				}
+			}
+		}
+		return result
+	}
+
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("usage-ratio").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").Obj(),
+		).
+		Obj()
+	if err := cache.AddClusterQueue(context.Background(), cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission(cq.Name).
+			Assignment(corev1.ResourceCPU, "on-demand", "2").
+			Assignment(corev1.ResourceMemory, "on-demand", "5Gi").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload")
+	}
+	if err := cache.DeleteWorkload(wl); err != nil {
+		t.Fatalf("Failed deleting workload: %v", err)
+	}
+	want := map[string]observations{
+		"on-demand": {Count: 2, Sum: 0.5},
+	}
+	if diff := cmp.Diff(want, observed(cq.Name)); diff != "" {
+		t.Errorf("Unexpected usage ratio observations (-want,+got):\n%s", diff)
+	}
+
+	cache.DeleteClusterQueue(cq)
+	if diff := cmp.Diff(map[string]observations{}, observed(cq.Name)); diff != "" {
+		t.Errorf("Unexpected usage ratio observations after deleting the ClusterQueue (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueSyncWorkloads(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		Obj()
+	admitted := func(name, cpu, memory string) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "ns").
+			Admit(utiltesting.MakeAdmission("cq").
+				Assignment(corev1.ResourceCPU, "default", cpu).
+				Assignment(corev1.ResourceMemory, "default", memory).Obj()).
+			Obj()
+	}
+	cq, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for _, wl := range []*kueue.Workload{
+		admitted("unchanged", "1", "1Gi"),
+		admitted("changed", "1", "1Gi"),
+		admitted("extra", "2", "2Gi"),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+
+	desired := []*kueue.Workload{
+		admitted("unchanged", "1", "1Gi"),
+		admitted("changed", "3", "1Gi"),
+		admitted("missing", "1", "4Gi"),
+	}
+	added, removed := cq.SyncWorkloads(desired)
+	if added != 1 || removed != 1 {
+		t.Errorf("Unexpected counts: added %d, removed %d, want 1 and 1", added, removed)
+	}
+
+	fromScratch, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for _, wl := range desired {
+		if err := fromScratch.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+	if diff := cmp.Diff(fromScratch.Usage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after syncing (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(sets.KeySet(fromScratch.Workloads), sets.KeySet(cq.Workloads)); diff != "" {
+		t.Errorf("Unexpected workloads after syncing (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueResourceAliases(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("model-a").Resource("example.com/gpu", "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	cq.ResourceAliases = map[corev1.ResourceName]corev1.ResourceName{
+		"nvidia.com/gpu": "example.com/gpu",
+	}
+
+	aliased := utiltesting.MakeWorkload("aliased", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment("nvidia.com/gpu", "model-a", "1").Obj()).
+		Obj()
+	canonical := utiltesting.MakeWorkload("canonical", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment("example.com/gpu", "model-a", "2").Obj()).
+		Obj()
+	for _, wl := range []*kueue.Workload{aliased, canonical} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+	wantUsage := FlavorResourceQuantities{
+		"model-a": {"example.com/gpu": 3},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage (-want,+got):\n%s", diff)
+	}
+	if _, found := aliased.Status.Admission.PodSetAssignments[0].Flavors["example.com/gpu"]; found {
+		t.Errorf("Folding the aliases modified the workload admission")
+	}
+
+	cq.deleteWorkload(aliased)
+	wantUsage = FlavorResourceQuantities{
+		"model-a": {"example.com/gpu": 2},
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after deleting the aliased workload (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueForEachQuota(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("spot").
+				Resource(corev1.ResourceMemory, "10Gi").
+				Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("on-demand").
+				Resource(corev1.ResourceMemory, "20Gi").
+				Resource(corev1.ResourceCPU, "20").Obj(),
+		).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("model-a").Resource("example.com/gpu", "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+
+	want := []string{
+		"model-a/example.com/gpu=4",
+		"on-demand/cpu=20000",
+		"on-demand/memory=21474836480",
+		"spot/cpu=10000",
+		"spot/memory=10737418240",
+	}
+	for i := 0; i < 5; i++ {
+		var got []string
+		cq.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+			got = append(got, fmt.Sprintf("%s/%s=%d", fName, rName, rQuota.Nominal))
+		})
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Unexpected visited quotas (-want,+got):\n%s", diff)
+		}
+	}
+}
+
+func TestClusterQueueRenameFlavor(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("old").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	lq := utiltesting.MakeLocalQueue("lq", "ns").ClusterQueue("cq").Obj()
+	if err := cache.AddLocalQueue(lq); err != nil {
+		t.Fatalf("Failed adding LocalQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "ns").Queue("lq").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "old", "4").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload")
+	}
+
+	renamed := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("new").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	renames := map[kueue.ResourceFlavorReference]kueue.ResourceFlavorReference{"old": "new"}
+	if err := cache.UpdateClusterQueueRenamingFlavors(renamed, renames); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	cqImpl := cache.clusterQueues["cq"]
+	wantUsage := FlavorResourceQuantities{"new": {corev1.ResourceCPU: 4_000}}
+	if diff := cmp.Diff(wantUsage, cqImpl.Usage); diff != "" {
+		t.Errorf("Unexpected usage after renaming the flavor (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantUsage, cqImpl.localQueues["ns/lq"].usage); diff != "" {
+		t.Errorf("Unexpected LocalQueue usage after renaming the flavor (-want,+got):\n%s", diff)
+	}
+
+	if err := cache.DeleteWorkload(wl); err != nil {
+		t.Fatalf("Failed deleting workload: %v", err)
+	}
+	wantUsage = FlavorResourceQuantities{"new": {corev1.ResourceCPU: 0}}
+	if diff := cmp.Diff(wantUsage, cqImpl.Usage); diff != "" {
+		t.Errorf("Unexpected usage after deleting the workload (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueAdmissionCost(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+
+	cases := map[string]struct {
+		weights  *AdmissionCostWeights
+		cpu      string
+		wantCost float64
+	}{
+		"fits within nominal": {
+			cpu:      "2",
+			wantCost: 0,
+		},
+		"fits borrowing": {
+			cpu:      "6",
+			wantCost: 0.5,
+		},
+		"requires preemption": {
+			cpu:      "10",
+			wantCost: 11.5,
+		},
+		"custom weights": {
+			weights:  &AdmissionCostWeights{Borrowing: 2, Preemption: 100},
+			cpu:      "10",
+			wantCost: 103,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cq.AdmissionCostWeights = tc.weights
+			wl := utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", tc.cpu).Obj()).
+				Obj()
+			if got := cq.AdmissionCost(workload.NewInfo(wl)); got != tc.wantCost {
+				t.Errorf("Unexpected cost: %v, want %v", got, tc.wantCost)
+			}
+		})
+	}
+}
+
+func TestClusterQueueGeneration(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	cq, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	lq := utiltesting.MakeLocalQueue("lq", "ns").ClusterQueue("cq").Obj()
+	wl := utiltesting.MakeWorkload("wl", "ns").Queue("lq").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+
+	mutations := []struct {
+		name   string
+		mutate func() error
+	}{
+		{
+			name:   "update",
+			mutate: func() error { return cq.update(cqObj, nil, nil) },
+		},
+		{
+			name:   "add local queue",
+			mutate: func() error { return cq.addLocalQueue(lq) },
+		},
+		{
+			name:   "add workload",
+			mutate: func() error { return cq.addWorkload(wl) },
+		},
+		{
+			name: "delete workload",
+			mutate: func() error {
+				cq.deleteWorkload(wl)
+				return nil
+			},
+		},
+		{
+			name: "delete local queue",
+			mutate: func() error {
+				cq.deleteLocalQueue(lq)
+				return nil
+			},
+		},
+	}
+	for _, m := range mutations {
+		before := cq.Generation()
+		if err := m.mutate(); err != nil {
+			t.Fatalf("Failed to %s: %v", m.name, err)
+		}
+		if cq.Generation() <= before {
+			t.Errorf("Generation didn't advance on %s: %d, was %d", m.name, cq.Generation(), before)
+		}
+		if got := cq.snapshot().Generation(); got != cq.Generation() {
+			t.Errorf("Unexpected generation in the snapshot after %s: %d, want %d", m.name, got, cq.Generation())
+		}
+	}
+}
+
+func TestClusterQueueBorrowingPolicy(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("busy").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("idle").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	busy := utiltesting.MakeWorkload("busy", "").
+		Admit(utiltesting.MakeAdmission("busy").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(busy) {
+		t.Fatalf("Failed adding workload")
+	}
+	cq := cache.clusterQueues["a"]
+
+	cases := map[string]struct {
+		policy        BorrowingPolicy
+		wantAvailable int64
+	}{
+		"any unused quota": {
+			policy:        BorrowingPolicyAny,
+			wantAvailable: 9_000,
+		},
+		"only from idle peers": {
+			policy:        BorrowingPolicyIdlePeers,
+			wantAvailable: 6_000,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cq.BorrowingPolicy = tc.policy
+			if got := cq.available("default", corev1.ResourceCPU); got != tc.wantAvailable {
+				t.Errorf("Unexpected available quota: %d, want %d", got, tc.wantAvailable)
+			}
+			wl := utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "7").Obj()).
+				Obj()
+			if fits, wantFits := cq.CanFit(workload.NewInfo(wl)), tc.wantAvailable >= 7_000; fits != wantFits {
+				t.Errorf("Unexpected fit of a workload borrowing from the busy peer: %t, want %t", fits, wantFits)
+			}
+		})
+	}
+}
+
+func TestClusterQueueOverFairLocalQueues(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "9").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := cq.addLocalQueue(utiltesting.MakeLocalQueue(name, "ns").ClusterQueue("cq").Obj()); err != nil {
+			t.Fatalf("Failed adding local queue %q: %v", name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "ns").Queue("a").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "6").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "ns").Queue("b").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+
+	if diff := cmp.Diff([]string{"ns/a"}, cq.OverFairLocalQueues()); diff != "" {
+		t.Errorf("Unexpected local queues over their fair slice (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueBorrowAuditSink(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "2").
+				Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	var events []BorrowEvent
+	cq := cache.clusterQueues["a"]
+	cq.clock = testingclock.NewFakeClock(now)
+	cq.BorrowAuditSink = func(event BorrowEvent) {
+		events = append(events, event)
+	}
+
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("a").
+			Assignment(corev1.ResourceCPU, "default", "5").
+			Assignment(corev1.ResourceMemory, "default", "1Gi").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload")
+	}
+	if err := cache.DeleteWorkload(wl); err != nil {
+		t.Fatalf("Failed deleting workload: %v", err)
+	}
+
+	wantEvents := []BorrowEvent{
+		{ClusterQueue: "a", Flavor: "default", Resource: corev1.ResourceCPU, BorrowedDelta: 3_000, Timestamp: now},
+		{ClusterQueue: "a", Flavor: "default", Resource: corev1.ResourceCPU, BorrowedDelta: -3_000, Timestamp: now},
+	}
+	if diff := cmp.Diff(wantEvents, events); diff != "" {
+		t.Errorf("Unexpected borrow events (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueSharesCohortWith(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").Cohort("one").Obj(),
+		utiltesting.MakeClusterQueue("b").Cohort("one").Obj(),
+		utiltesting.MakeClusterQueue("c").Cohort("two").Obj(),
+		utiltesting.MakeClusterQueue("d").Obj(),
+		utiltesting.MakeClusterQueue("e").Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cases := map[string]struct {
+		cq, other string
+		want      bool
+	}{
+		"same cohort": {
+			cq:    "a",
+			other: "b",
+			want:  true,
+		},
+		"different cohorts": {
+			cq:    "a",
+			other: "c",
+		},
+		"one without cohort": {
+			cq:    "a",
+			other: "d",
+		},
+		"both without cohort": {
+			cq:    "d",
+			other: "e",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := cache.clusterQueues[tc.cq].SharesCohortWith(cache.clusterQueues[tc.other])
+			if got != tc.want {
+				t.Errorf("SharesCohortWith returned %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterQueuePreemptionScore(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Preemption(kueue.ClusterQueuePreemption{WithinClusterQueue: kueue.PreemptionPolicyLowerPriority}).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	admitted := func(name string, prio int32, cpu string) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "").Priority(prio).
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj()
+	}
+	large := admitted("large", 0, "6")
+	small := admitted("small", 0, "1")
+	tinyLowPriority := admitted("tiny-low-priority", -1, "1")
+	largeHighPriority := admitted("large-high-priority", 9, "6")
+	for _, wl := range []*kueue.Workload{large, small, tinyLowPriority, largeHighPriority} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+
+	if ls, ss := cq.PreemptionScore(workload.NewInfo(large)), cq.PreemptionScore(workload.NewInfo(small)); ls <= ss {
+		t.Errorf("The large workload scores %v, not more than the small one, %v", ls, ss)
+	}
+	if ls, hs := cq.PreemptionScore(workload.NewInfo(large)), cq.PreemptionScore(workload.NewInfo(largeHighPriority)); ls <= hs {
+		t.Errorf("The low-priority workload scores %v, not more than the high-priority one, %v", ls, hs)
+	}
+
+	preemptor := utiltesting.MakeWorkload("preemptor", "").Priority(10).Obj()
+	var got []string
+	for _, wi := range cq.PreemptionCandidates(preemptor, time.Now()) {
+		got = append(got, workload.Key(wi.Obj))
+	}
+	want := []string{"/large", "/tiny-low-priority", "/small", "/large-high-priority"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected order of the candidates (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueProjectUsage(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").
+				Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").
+				Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	if err := cq.addWorkload(utiltesting.MakeWorkload("running", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "on-demand", "2").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	wantUsage := cq.Usage.clone()
+
+	var batch []*workload.Info
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a", "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "on-demand", "3").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("b", "").
+			Admit(utiltesting.MakeAdmission("cq").
+				Assignment(corev1.ResourceCPU, "spot", "1").
+				Assignment(corev1.ResourceMemory, "spot", "2Gi").
+				Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("c", "").
+			Admit(utiltesting.MakeAdmission("cq").
+				Assignment(corev1.ResourceCPU, "on-demand", "4").
+				Assignment(corev1.ResourceMemory, "on-demand", "1Gi").
+				Obj()).
+			Obj(),
+	} {
+		batch = append(batch, workload.NewInfo(wl))
+	}
+
+	got := cq.ProjectUsage(batch)
+	want := FlavorResourceQuantities{
+		"on-demand": {
+			corev1.ResourceCPU:    9_000,
+			corev1.ResourceMemory: utiltesting.Gi,
+		},
+		"spot": {
+			corev1.ResourceCPU:    1_000,
+			corev1.ResourceMemory: 2 * utiltesting.Gi,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected projected usage (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("The projection changed the usage (-want,+got):\n%s", diff)
+	}
+	if len(cq.Workloads) != 1 {
+		t.Errorf("The projection changed the workloads, got %d, want 1", len(cq.Workloads))
+	}
+}
+
+func TestClusterQueueFlavorUnavailablePolicy(t *testing.T) {
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("x86").Resource(corev1.ResourceCPU, "5").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj()).
+		Obj()
+	x86 := utiltesting.MakeResourceFlavor("x86").Obj()
+	a100 := utiltesting.MakeResourceFlavor("a100").Obj()
+	cpuWorkload := workload.NewInfo(utiltesting.MakeWorkload("cpu", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "x86", "1").Obj()).
+		Obj())
+	gpuWorkload := workload.NewInfo(utiltesting.MakeWorkload("gpu", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment("example.com/gpu", "a100", "1").Obj()).
+		Obj())
+
+	cases := map[string]struct {
+		policy       FlavorUnavailablePolicy
+		flavors      []*kueue.ResourceFlavor
+		wantStatus   metrics.ClusterQueueStatus
+		wantCPUFits  bool
+		wantGPUFits  bool
+		wantDisabled []bool
+	}{
+		"all flavors exist": {
+			policy:       FlavorUnavailableDisableGroupOnly,
+			flavors:      []*kueue.ResourceFlavor{x86, a100},
+			wantStatus:   active,
+			wantCPUFits:  true,
+			wantGPUFits:  true,
+			wantDisabled: []bool{false, false},
+		},
+		"missing flavor pends the whole queue": {
+			flavors:      []*kueue.ResourceFlavor{x86},
+			wantStatus:   pending,
+			wantCPUFits:  true,
+			wantGPUFits:  true,
+			wantDisabled: []bool{false, false},
+		},
+		"missing flavor disables its group only": {
+			policy:       FlavorUnavailableDisableGroupOnly,
+			flavors:      []*kueue.ResourceFlavor{x86},
+			wantStatus:   active,
+			wantCPUFits:  true,
+			wantDisabled: []bool{false, true},
+		},
+		"all groups disabled": {
+			policy:       FlavorUnavailableDisableGroupOnly,
+			wantStatus:   pending,
+			wantDisabled: []bool{true, true},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient(), WithFlavorUnavailablePolicy(tc.policy))
+			for _, rf := range tc.flavors {
+				cache.AddOrUpdateResourceFlavor(rf)
+			}
+			if err := cache.AddClusterQueue(context.Background(), cq); err != nil {
+				t.Fatalf("Failed adding ClusterQueue: %v", err)
+			}
+			cqImpl := cache.clusterQueues["cq"]
+			if cqImpl.Status != tc.wantStatus {
+				t.Errorf("Got status %v, want %v", cqImpl.Status, tc.wantStatus)
+			}
+			var gotDisabled []bool
+			for _, rg := range cqImpl.ResourceGroups {
+				gotDisabled = append(gotDisabled, rg.Disabled)
+			}
+			if diff := cmp.Diff(tc.wantDisabled, gotDisabled); diff != "" {
+				t.Errorf("Unexpected disabled resource groups (-want,+got):\n%s", diff)
+			}
+			if got := cqImpl.CanFit(cpuWorkload); got != tc.wantCPUFits {
+				t.Errorf("CanFit(cpu) = %t, want %t", got, tc.wantCPUFits)
+			}
+			if got := cqImpl.CanFit(gpuWorkload); got != tc.wantGPUFits {
+				t.Errorf("CanFit(gpu) = %t, want %t", got, tc.wantGPUFits)
+			}
+		})
+	}
+}
+
+func TestClusterQueueUsageSummary(t *testing.T) {
+	cq := &ClusterQueue{
+		Usage: FlavorResourceQuantities{
+			"spot": {
+				"example.com/gpu": 1,
+			},
+			"on-demand": {
+				corev1.ResourceMemory: 6 * utiltesting.Gi,
+				corev1.ResourceCPU:    3_500,
+				corev1.ResourcePods:   0,
+			},
+			"unused": {
+				corev1.ResourceCPU: 0,
+			},
+		},
+	}
+	want := "on-demand{cpu:3500m,memory:6Gi} spot{example.com/gpu:1}"
+	for i := 0; i < 5; i++ {
+		if got := cq.UsageSummary(); got != want {
+			t.Fatalf("UsageSummary() = %q, want %q", got, want)
+		}
+	}
+	if got := (&ClusterQueue{}).UsageSummary(); got != "" {
+		t.Errorf("UsageSummary() of an empty ClusterQueue = %q, want empty", got)
+	}
+}
+
+func TestClusterQueueWorkloadsOnFlavor(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("c", "ns").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("b", "ns").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "on-demand", "1").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("a", "ns").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).
+			Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	cases := map[string]struct {
+		flavor kueue.ResourceFlavorReference
+		want   []string
+	}{
+		"spot": {
+			flavor: "spot",
+			want:   []string{"ns/a", "ns/c"},
+		},
+		"on-demand": {
+			flavor: "on-demand",
+			want:   []string{"ns/b"},
+		},
+		"unknown flavor": {
+			flavor: "reserved",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, wi := range cache.clusterQueues["a"].WorkloadsOnFlavor(tc.flavor) {
+				got = append(got, workload.Key(wi.Obj))
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected workloads (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueuePendingByAge(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	var pending []*workload.Info
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("newest", "ns1").Creation(now).Obj(),
+		utiltesting.MakeWorkload("old-b", "ns2").Creation(now.Add(-time.Hour)).Obj(),
+		utiltesting.MakeWorkload("oldest", "ns1").Creation(now.Add(-2 * time.Hour)).Obj(),
+		utiltesting.MakeWorkload("old-a", "ns1").Creation(now.Add(-time.Hour)).Obj(),
+	} {
+		pending = append(pending, workload.NewInfo(wl))
+	}
+	var cq ClusterQueue
+
+	var got []string
+	for _, wi := range cq.PendingByAge(pending) {
+		got = append(got, wi.Obj.Name)
+	}
+	want := []string{"oldest", "old-a", "old-b", "newest"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected order (-want,+got):\n%s", diff)
+	}
+	if pending[0].Obj.Name != "newest" {
+		t.Errorf("PendingByAge modified its input")
+	}
+}
+
+func TestClusterQueueEffectiveNominal(t *testing.T) {
+	cases := map[string]struct {
+		provider func() float64
+		curve    PressureCurve
+		want     int64
+		wantFits bool
+	}{
+		"no provider": {
+			want:     10_000,
+			wantFits: true,
+		},
+		"no pressure": {
+			provider: func() float64 { return 0 },
+			want:     10_000,
+			wantFits: true,
+		},
+		"half pressure": {
+			provider: func() float64 { return 0.5 },
+			want:     7_500,
+			wantFits: true,
+		},
+		"full pressure": {
+			provider: func() float64 { return 1 },
+			want:     5_000,
+		},
+		"pressure above 1 is capped": {
+			provider: func() float64 { return 3 },
+			want:     5_000,
+		},
+		"custom curve": {
+			provider: func() float64 { return 1 },
+			curve:    LinearPressureCurve(0.2),
+			want:     2_000,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient())
+			cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+				Obj())
+			if err != nil {
+				t.Fatalf("Failed to create ClusterQueue: %v", err)
+			}
+			cq.PressureProvider = tc.provider
+			cq.PressureCurve = tc.curve
+			cq.SamplePressure()
+			if got := cq.EffectiveNominal("default", corev1.ResourceCPU); got != tc.want {
+				t.Errorf("EffectiveNominal() = %d, want %d", got, tc.want)
+			}
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "6").Obj()).
+				Obj())
+			if got := cq.CanFit(wi); got != tc.wantFits {
+				t.Errorf("CanFit() = %t, want %t", got, tc.wantFits)
+			}
+		})
+	}
+}
+
+func TestClusterQueuePressureInCohort(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cache.AddOrUpdateResourceFlavor(utiltesting.MakeResourceFlavor("default").Obj())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	var calls int
+	for _, cq := range cache.clusterQueues {
+		cq.PressureProvider = func() float64 {
+			calls++
+			return 1
+		}
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "6").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload")
+	}
+	cq := cache.clusterQueues["a"]
+	if cq.IsBorrowing() {
+		t.Errorf("The ClusterQueue is borrowing before the pressure is sampled")
+	}
+
+	cache.SamplePressure()
+	if calls != 2 {
+		t.Errorf("Got %d calls to the PressureProvider after sampling, want 2", calls)
+	}
+	if !cq.IsBorrowing() {
+		t.Errorf("The ClusterQueue isn't borrowing over its effective nominal quota")
+	}
+	if got := cq.borrowed("default", corev1.ResourceCPU); got != 1_000 {
+		t.Errorf("Got %d borrowed, want 1000", got)
+	}
+	if got := cq.Cohort.requestable("default", corev1.ResourceCPU); got != 10_000 {
+		t.Errorf("Got %d requestable in the cohort, want 10000", got)
+	}
+	pending := workload.NewInfo(utiltesting.MakeWorkload("pending", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "5").Obj()).
+		Obj())
+	if cq.CanFit(pending) {
+		t.Errorf("The workload fits over the effective nominal quota of the cohort")
+	}
+	if calls != 2 {
+		t.Errorf("Got %d calls to the PressureProvider after the quota checks, want 2", calls)
+	}
+
+	snapshot := cache.Snapshot()
+	if calls != 4 {
+		t.Errorf("Got %d calls to the PressureProvider after the snapshot, want 4", calls)
+	}
+	cohort := snapshot.ClusterQueues["a"].Cohort
+	if got := cohort.RequestableResources["default"][corev1.ResourceCPU]; got != 10_000 {
+		t.Errorf("Got %d requestable in the snapshot of the cohort, want 10000", got)
+	}
+}
+
+func TestClusterQueueQuotaDivergence(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	cases := map[string]struct {
+		provider    func() float64
+		rampUp      *RampUp
+		annotations map[string]string
+		want        FlavorResourceQuantities
+	}{
+		"no dynamic adjustment": {
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+			},
+		},
+		"scaled down by pressure": {
+			provider: func() float64 { return 1 },
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: -5_000, corev1.ResourceMemory: -2 * utiltesting.Gi},
+			},
+		},
+		"during the ramp-up window": {
+			rampUp: &RampUp{Start: now.Add(-time.Minute), Duration: 4 * time.Minute},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: -7_500, corev1.ResourceMemory: -3 * utiltesting.Gi},
+			},
+		},
+		"during the ramp-up window and scaled down by pressure": {
+			provider: func() float64 { return 1 },
+			rampUp:   &RampUp{Start: now.Add(-time.Minute), Duration: 2 * time.Minute},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: -7_500, corev1.ResourceMemory: -3 * utiltesting.Gi},
+			},
+		},
+		"after the ramp-up window": {
+			rampUp: &RampUp{Start: now.Add(-time.Hour), Duration: time.Minute},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+			},
+		},
+		"before the ramp-up window": {
+			rampUp: &RampUp{Start: now.Add(time.Minute), Duration: time.Minute},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+			},
+		},
+		"bounded nominal": {
+			annotations: map[string]string{
+				ResourceGroupSettingsAnnotation: `{"flavors":[{"name":"default","resources":[{"name":"cpu","minNominal":"2","maxNominal":"6"}]}]}`,
+			},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: -8_000, corev1.ResourceMemory: 0},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient())
+			cqObj := utiltesting.MakeClusterQueue("cq").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+					Resource(corev1.ResourceCPU, "10").
+					Resource(corev1.ResourceMemory, "4Gi").Obj()).
+				Obj()
+			cqObj.Annotations = tc.annotations
+			cq, err := cache.newClusterQueue(cqObj)
+			if err != nil {
+				t.Fatalf("Failed to create ClusterQueue: %v", err)
+			}
+			cq.clock = testingclock.NewFakeClock(now)
+			cq.PressureProvider = tc.provider
+			cq.RampUp = tc.rampUp
+			cq.SamplePressure()
+			if diff := cmp.Diff(tc.want, cq.QuotaDivergence(now)); diff != "" {
+				t.Errorf("Unexpected quota divergence (-want,+got):\n%s", diff)
+			}
+			// The quota in effect follows the sample.
+			wantEffective := 10_000 + tc.want["default"][corev1.ResourceCPU]
+			if got := cq.EffectiveNominal("default", corev1.ResourceCPU); got != wantEffective {
+				t.Errorf("EffectiveNominal() = %d, want %d", got, wantEffective)
+			}
+		})
+	}
+}
+
+func TestClusterQueueRampUp(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	start := time.Now().Truncate(time.Second)
+	fakeClock := testingclock.NewFakeClock(start)
+	cq.clock = fakeClock
+	cq.RampUp = &RampUp{Start: start, Duration: 10 * time.Minute}
+	wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "4").Obj()).
+		Obj())
+
+	cq.SamplePressure()
+	if cq.CanFit(wi) {
+		t.Errorf("The workload fits at the start of the ramp-up window")
+	}
+	fakeClock.Step(5 * time.Minute)
+	if cq.CanFit(wi) {
+		t.Errorf("The workload fits before the next sample")
+	}
+	cq.SamplePressure()
+	if !cq.CanFit(wi) {
+		t.Errorf("The workload doesn't fit in the middle of the ramp-up window")
+	}
+	if got := cq.QuotaDivergence(start.Add(8 * time.Minute))["default"][corev1.ResourceCPU]; got != -2_000 {
+		t.Errorf("Got divergence %d later in the ramp-up window, want -2000", got)
+	}
+}
+
+func TestClusterQueueHasNegativeUsage(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").
+			Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("cq").
+			Assignment(corev1.ResourceCPU, "default", "1").
+			Assignment(corev1.ResourceMemory, "default", "1Gi").
+			Obj()).
+		Obj()
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if rName, found := cq.HasNegativeUsage(); found {
+		t.Errorf("Unexpected negative usage of %s", rName)
+	}
+
+	// Account for the deletion of the workload twice.
+	wi := workload.NewInfo(wl)
+	cq.updateWorkloadUsage(wi, -1)
+	cq.updateWorkloadUsage(wi, -1)
+	rName, found := cq.HasNegativeUsage()
+	if !found {
+		t.Fatalf("Negative usage not detected, usage: %v", cq.Usage)
+	}
+	if rName != corev1.ResourceCPU {
+		t.Errorf("Got negative usage of %s, want %s", rName, corev1.ResourceCPU)
+	}
+}
+
+func TestClusterQueueResourceGroupNamespaceSelector(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("x86").Resource(corev1.ResourceCPU, "10").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj()).
+		Annotation(ResourceGroupSettingsAnnotation, `{"resourceGroups":[{"coveredResources":["example.com/gpu"],"namespaceSelector":{"matchLabels":{"team":"ml"}}}]}`).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+
+	// The selector is kept on updates of the spec.
+	updated := cq.DeepCopy()
+	updated.Spec.ResourceGroups[1].Flavors[0].Resources[0].NominalQuota = resource.MustParse("4")
+	if err := cache.UpdateClusterQueue(updated); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	cqImpl := cache.clusterQueues["cq"]
+	if sel := cqImpl.ResourceGroups[1].NamespaceSelector; sel == nil || sel.String() != "team=ml" {
+		t.Fatalf("Unexpected namespace selector of the resource group: %v", sel)
+	}
+
+	cpuWorkload := workload.NewInfo(utiltesting.MakeWorkload("cpu", "").Request(corev1.ResourceCPU, "1").Obj())
+	gpuWorkload := workload.NewInfo(utiltesting.MakeWorkload("gpu", "").
+		Request(corev1.ResourceCPU, "1").
+		Request("example.com/gpu", "1").
+		Obj())
+	cases := map[string]struct {
+		wi       *workload.Info
+		nsLabels map[string]string
+		wantErr  error
+	}{
+		"cpu in any namespace": {
+			wi:       cpuWorkload,
+			nsLabels: map[string]string{"team": "web"},
+		},
+		"gpu in a matching namespace": {
+			wi:       gpuWorkload,
+			nsLabels: map[string]string{"team": "ml"},
+		},
+		"gpu in a namespace not matching the group": {
+			wi:       gpuWorkload,
+			nsLabels: map[string]string{"team": "web"},
+			wantErr:  errNamespaceNotInGroup,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := cqImpl.CheckNamespaceForResourceGroups(tc.wi, tc.nsLabels)
+			if diff := cmp.Diff(tc.wantErr, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("Unexpected error (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueSystemReservation(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	cq.SystemWorkloadLabel = "example.com/system"
+	cq.SystemReservation = FlavorResourceQuantities{"default": {corev1.ResourceCPU: 2_000}}
+
+	admitted := func(name, cpu string, system bool) *kueue.Workload {
+		w := utiltesting.MakeWorkload(name, "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", cpu).Obj())
+		if system {
+			w.Label("example.com/system", "true")
+		}
+		return w.Obj()
+	}
+	if got := cq.RemainingQuota("default", corev1.ResourceCPU); got != 8_000 {
+		t.Errorf("RemainingQuota() = %d, want 8000", got)
+	}
+	if cq.CanFit(workload.NewInfo(admitted("regular-large", "9", false))) {
+		t.Errorf("A regular workload fits in the system reservation")
+	}
+	regular := admitted("regular", "8", false)
+	if !cq.CanFit(workload.NewInfo(regular)) {
+		t.Fatalf("A regular workload doesn't fit in the unreserved quota")
+	}
+	if err := cq.addWorkload(regular); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if got := cq.RemainingQuota("default", corev1.ResourceCPU); got != 0 {
+		t.Errorf("RemainingQuota() = %d, want 0", got)
+	}
+	if cq.CanFit(workload.NewInfo(admitted("regular-small", "1", false))) {
+		t.Errorf("A regular workload fits in the system reservation")
+	}
+
+	system := admitted("system", "2", true)
+	if !cq.CanFit(workload.NewInfo(system)) {
+		t.Fatalf("A system workload doesn't fit in the system reservation")
+	}
+	if err := cq.addWorkload(system); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if !cq.CanFit(workload.NewInfo(admitted("system-extra", "4", true))) {
+		t.Errorf("A system workload doesn't fit beyond the quota")
+	}
+	wantUsage := FlavorResourceQuantities{"default": {corev1.ResourceCPU: 2_000}}
+	if diff := cmp.Diff(wantUsage, cq.SystemUsage); diff != "" {
+		t.Errorf("Unexpected system usage (-want,+got):\n%s", diff)
+	}
+	if got := cq.Usage["default"][corev1.ResourceCPU]; got != 10_000 {
+		t.Errorf("Got usage %d, want 10000", got)
+	}
+
+	cq.deleteWorkload(system)
+	wantUsage = FlavorResourceQuantities{"default": {corev1.ResourceCPU: 0}}
+	if diff := cmp.Diff(wantUsage, cq.SystemUsage); diff != "" {
+		t.Errorf("Unexpected system usage after deletion (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueEffectiveNominalFraction(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cache.AddOrUpdateResourceFlavor(utiltesting.MakeResourceFlavor("default").Obj())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Annotation(ResourceGroupSettingsAnnotation, `{"flavors":[{"name":"default","resources":[{"name":"cpu","minNominal":"4","maxNominal":"12"}]}]}`).
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+	if !cache.AddOrUpdateWorkload(utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "6").Obj()).
+		Obj()) {
+		t.Fatalf("Failed adding workload")
+	}
+
+	cases := []struct {
+		fraction      float64
+		wantNominal   int64
+		wantBorrowing bool
+		wantRemaining int64
+	}{
+		{fraction: 0, wantNominal: 4_000, wantBorrowing: true, wantRemaining: 0},
+		{fraction: 0.5, wantNominal: 8_000, wantRemaining: 2_000},
+		{fraction: 1, wantNominal: 12_000, wantRemaining: 6_000},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.fraction), func(t *testing.T) {
+			snapshot := cache.Snapshot()
+			snapshotNominal := snapshot.ClusterQueues["a"].quotaFor("default", corev1.ResourceCPU).Nominal
+			cq.SetEffectiveNominalFraction(tc.fraction)
+			if got := cq.quotaFor("default", corev1.ResourceCPU).Nominal; got != tc.wantNominal {
+				t.Errorf("Got nominal %d, want %d", got, tc.wantNominal)
+			}
+			if got := cq.IsBorrowing(); got != tc.wantBorrowing {
+				t.Errorf("IsBorrowing() = %t, want %t", got, tc.wantBorrowing)
+			}
+			if got := cq.RemainingQuota("default", corev1.ResourceCPU); got != tc.wantRemaining {
+				t.Errorf("RemainingQuota() = %d, want %d", got, tc.wantRemaining)
+			}
+			if got := cache.cohorts["one"].requestable("default", corev1.ResourceCPU); got != tc.wantNominal+10_000 {
+				t.Errorf("Got cohort requestable %d, want %d", got, tc.wantNominal+10_000)
+			}
+			if got := snapshot.ClusterQueues["a"].quotaFor("default", corev1.ResourceCPU).Nominal; got != snapshotNominal {
+				t.Errorf("The snapshot quota changed from %d to %d", snapshotNominal, got)
+			}
+		})
+	}
+}
+
+func TestClusterQueueIdleSince(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	if _, idle := cq.IdleSince(); !idle {
+		t.Errorf("A new ClusterQueue isn't idle")
+	}
+	now := time.Now().Truncate(time.Second)
+	fakeClock := testingclock.NewFakeClock(now)
+	cq.clock = fakeClock
+
+	first := utiltesting.MakeWorkload("first", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	second := utiltesting.MakeWorkload("second", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+		Obj()
+	for _, wl := range []*kueue.Workload{first, second} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %q: %v", wl.Name, err)
+		}
+	}
+	if since, idle := cq.IdleSince(); idle {
+		t.Errorf("The ClusterQueue is idle since %v while using quota", since)
+	}
+
+	fakeClock.Step(time.Minute)
+	cq.deleteWorkload(first)
+	if since, idle := cq.IdleSince(); idle {
+		t.Errorf("The ClusterQueue is idle since %v while using quota", since)
+	}
+	fakeClock.Step(time.Minute)
+	cq.deleteWorkload(second)
+	wantSince := now.Add(2 * time.Minute)
+	if since, idle := cq.IdleSince(); !idle || !since.Equal(wantSince) {
+		t.Errorf("IdleSince() = %v, %t, want %v, true", since, idle, wantSince)
+	}
+
+	// The time doesn't move while the ClusterQueue stays idle.
+	fakeClock.Step(time.Minute)
+	cq.updateIdleSince()
+	if since, _ := cq.IdleSince(); !since.Equal(wantSince) {
+		t.Errorf("IdleSince() = %v, want %v", since, wantSince)
+	}
+
+	if err := cq.addWorkload(first); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if since, idle := cq.IdleSince(); idle {
+		t.Errorf("The ClusterQueue is idle since %v after admitting a workload", since)
+	}
+}
+
+func TestClusterQueueUsageEpsilon(t *testing.T) {
+	cases := map[string]struct {
+		epsilon       int64
+		cpu           string
+		wantFits      bool
+		wantBorrowing bool
+	}{
+		"overshoot without epsilon": {
+			cpu:           "10001m",
+			wantBorrowing: true,
+		},
+		"overshoot within epsilon": {
+			epsilon:  1,
+			cpu:      "10001m",
+			wantFits: true,
+		},
+		"overshoot beyond epsilon": {
+			epsilon:       1,
+			cpu:           "10002m",
+			wantBorrowing: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := New(utiltesting.NewFakeClient())
+			for _, cq := range []*kueue.ClusterQueue{
+				utiltesting.MakeClusterQueue("a").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+					Cohort("one").
+					Obj(),
+				utiltesting.MakeClusterQueue("b").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "0").Obj()).
+					Cohort("one").
+					Obj(),
+			} {
+				if err := cache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+				}
+			}
+			cq := cache.clusterQueues["a"]
+			cq.UsageEpsilon = tc.epsilon
+			wl := utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", tc.cpu).Obj()).
+				Obj()
+			if got := cq.CanFit(workload.NewInfo(wl)); got != tc.wantFits {
+				t.Errorf("CanFit() = %t, want %t", got, tc.wantFits)
+			}
+			if !cache.AddOrUpdateWorkload(wl) {
+				t.Fatalf("Failed adding workload")
+			}
+			if got := cq.IsBorrowing(); got != tc.wantBorrowing {
+				t.Errorf("IsBorrowing() = %t, want %t", got, tc.wantBorrowing)
+			}
+		})
+	}
+}
+
+func TestClusterQueueDecayedUsage(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient(), WithUsageDecayHalfLife(time.Minute))
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	now := time.Now().Truncate(time.Second)
+	fakeClock := testingclock.NewFakeClock(now)
+	cq.clock = fakeClock
+	decayedCPU := func(at time.Time) int64 {
+		return cq.DecayedUsage(at)["default"][corev1.ResourceCPU]
+	}
+
+	wl := utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "4").Obj()).
+		Obj()
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		want    int64
+	}{
+		{elapsed: 0, want: 0},
+		{elapsed: time.Minute, want: 2_000},
+		{elapsed: 2 * time.Minute, want: 3_000},
+	} {
+		if got := decayedCPU(now.Add(tc.elapsed)); got != tc.want {
+			t.Errorf("Unexpected decayed usage %v after adding the workload: %d, want %d", tc.elapsed, got, tc.want)
+		}
+	}
+
+	fakeClock.Step(2 * time.Minute)
+	cq.deleteWorkload(wl)
+	if got := decayedCPU(now.Add(3 * time.Minute)); got != 1_500 {
+		t.Errorf("Unexpected decayed usage a minute after deleting the workload: %d, want 1500", got)
+	}
+	if got := cq.Usage["default"][corev1.ResourceCPU]; got != 0 {
+		t.Errorf("Unexpected usage after deleting the workload: %d, want 0", got)
+	}
+}
+
+func TestClusterQueueUsageTrend(t *testing.T) {
+	cq := &ClusterQueue{
+		Usage: FlavorResourceQuantities{
+			"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 8 * utiltesting.Gi},
+		},
+	}
+	if diff := cmp.Diff(FlavorResourceQuantities{}, cq.UsageTrend()); diff != "" {
+		t.Errorf("Unexpected trend without history (-want,+got):\n%s", diff)
+	}
+	cq.SampleUsage()
+	if diff := cmp.Diff(FlavorResourceQuantities{}, cq.UsageTrend()); diff != "" {
+		t.Errorf("Unexpected trend with a single sample (-want,+got):\n%s", diff)
+	}
+
+	// Overflow the history, so that only the rising part of the series is kept.
+	for i := 0; i < usageHistoryLength; i++ {
+		cq.Usage["default"][corev1.ResourceCPU] = int64(i) * 500
+		cq.Usage["default"][corev1.ResourceMemory] = 8 * utiltesting.Gi
+		cq.SampleUsage()
+	}
+	want := FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 500, corev1.ResourceMemory: 0},
+	}
+	if diff := cmp.Diff(want, cq.UsageTrend()); diff != "" {
+		t.Errorf("Unexpected trend (-want,+got):\n%s", diff)
+	}
+
+	cq.Usage["default"][corev1.ResourceMemory] = 0
+	cq.SampleUsage()
+	if got := cq.UsageTrend()["default"][corev1.ResourceMemory]; got >= 0 {
+		t.Errorf("Got memory trend %d after a drop, want negative", got)
+	}
+}
+
+func TestClusterQueueAdmitWithPreemption(t *testing.T) {
+	admitted := func(name, cpu string) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj()
+	}
+	cases := map[string]struct {
+		preemptor     *kueue.Workload
+		victims       []string
+		wantErr       error
+		wantWorkloads []string
+		wantUsage     int64
+	}{
+		"preempting two victims": {
+			preemptor:     admitted("preemptor", "6"),
+			victims:       []string{"a", "b"},
+			wantWorkloads: []string{"/c", "/preemptor"},
+			wantUsage:     8_000,
+		},
+		"not enough preempted": {
+			preemptor:     admitted("preemptor", "9"),
+			victims:       []string{"a", "b"},
+			wantErr:       errDoesNotFitAfterEviction,
+			wantWorkloads: []string{"/a", "/b", "/c"},
+			wantUsage:     8_000,
+		},
+		"victim not admitted": {
+			preemptor:     admitted("preemptor", "6"),
+			victims:       []string{"a", "unknown"},
+			wantErr:       errVictimNotAdmitted,
+			wantWorkloads: []string{"/a", "/b", "/c"},
+			wantUsage:     8_000,
+		},
+		"victim listed twice": {
+			preemptor:     admitted("preemptor", "6"),
+			victims:       []string{"a", "a"},
+			wantErr:       errDoesNotFitAfterEviction,
+			wantWorkloads: []string{"/a", "/b", "/c"},
+			wantUsage:     8_000,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient(), WithPodsReadyTracking(true))
+			cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+				Obj())
+			if err != nil {
+				t.Fatalf("Failed to create ClusterQueue: %v", err)
+			}
+			cq.OnFull = func(string) {}
+			cq.OnFreed = func(string) {}
+			wls := map[string]*kueue.Workload{
+				"a":       admitted("a", "3"),
+				"b":       admitted("b", "3"),
+				"c":       admitted("c", "2"),
+				"unknown": admitted("unknown", "1"),
+			}
+			for _, name := range []string{"a", "b", "c"} {
+				if err := cq.addWorkload(wls[name]); err != nil {
+					t.Fatalf("Failed adding workload %q: %v", name, err)
+				}
+			}
+			preemptorInfo := workload.NewInfo(tc.preemptor)
+			cq.RecordRequeue(workload.Key(tc.preemptor))
+			cq.ReserveForPending([]*workload.Info{preemptorInfo})
+			type state struct {
+				Generation          int64
+				Requeues            []string
+				PendingReservations []string
+				WorkloadsNotReady   []string
+				FlavorWorkloads     map[kueue.ResourceFlavorReference]int
+				Notifications       int
+			}
+			currentState := func() state {
+				return state{
+					Generation:          cq.Generation(),
+					Requeues:            sets.List(sets.KeySet(cq.requeues)),
+					PendingReservations: sets.List(sets.KeySet(cq.pendingReservations)),
+					WorkloadsNotReady:   sets.List(cq.WorkloadsNotReady),
+					FlavorWorkloads:     maps.Clone(cq.flavorWorkloads),
+					Notifications:       len(cache.capacityNotifications),
+				}
+			}
+			before := currentState()
+			var victims []*workload.Info
+			for _, name := range tc.victims {
+				victims = append(victims, workload.NewInfo(wls[name]))
+			}
+
+			err = cq.AdmitWithPreemption(preemptorInfo, victims)
+			if diff := cmp.Diff(tc.wantErr, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("Unexpected error (-want,+got):\n%s", diff)
+			}
+			if tc.wantErr != nil {
+				if diff := cmp.Diff(before, currentState()); diff != "" {
+					t.Errorf("Unexpected state after a failed admission (-want,+got):\n%s", diff)
+				}
+			}
+			if diff := cmp.Diff(tc.wantWorkloads, sets.List(sets.KeySet(cq.Workloads))); diff != "" {
+				t.Errorf("Unexpected workloads (-want,+got):\n%s", diff)
+			}
+			if got := cq.Usage["default"][corev1.ResourceCPU]; got != tc.wantUsage {
+				t.Errorf("Got usage %d, want %d", got, tc.wantUsage)
+			}
+			if tc.wantErr == nil {
+				after := currentState()
+				if after.Generation == before.Generation {
+					t.Errorf("The generation didn't change after the admission")
+				}
+				if len(after.Requeues) != 0 || len(after.PendingReservations) != 0 {
+					t.Errorf("The requeues %v and reservations %v of the admitted workload weren't released", after.Requeues, after.PendingReservations)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterQueueDefaultBorrowingLimit(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "2").
+				Resource(corev1.ResourceMemory, "2Gi", "1Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+	cq.DefaultBorrowingLimit = pointer.Int64(1_000)
+
+	cases := map[string]struct {
+		resource corev1.ResourceName
+		quantity string
+		wantFits bool
+	}{
+		"cpu within the default limit": {
+			resource: corev1.ResourceCPU,
+			quantity: "3",
+			wantFits: true,
+		},
+		"cpu beyond the default limit": {
+			resource: corev1.ResourceCPU,
+			quantity: "3500m",
+		},
+		"memory within the explicit limit": {
+			resource: corev1.ResourceMemory,
+			quantity: "3Gi",
+			wantFits: true,
+		},
+		"memory beyond the explicit limit": {
+			resource: corev1.ResourceMemory,
+			quantity: "3.5Gi",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").Assignment(tc.resource, "default", tc.quantity).Obj()).
+				Obj())
+			if got := cq.CanFit(wi); got != tc.wantFits {
+				t.Errorf("CanFit() = %t, want %t", got, tc.wantFits)
+			}
+		})
+	}
+}
+
+func TestClusterQueueCouldEverFit(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi", "2Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("alone").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	// The cohort is full, so no new workload fits now.
+	if !cache.AddOrUpdateWorkload(utiltesting.MakeWorkload("b1", "").
+		Admit(utiltesting.MakeAdmission("b").
+			Assignment(corev1.ResourceCPU, "default", "8").
+			Assignment(corev1.ResourceMemory, "default", "8Gi").
+			Obj()).
+		Obj()) {
+		t.Fatalf("Failed adding workload")
+	}
+
+	cases := map[string]struct {
+		cq       string
+		resource corev1.ResourceName
+		quantity string
+		want     bool
+	}{
+		"fits eventually borrowing from the cohort": {
+			cq:       "a",
+			resource: corev1.ResourceCPU,
+			quantity: "8",
+			want:     true,
+		},
+		"bigger than the cohort": {
+			cq:       "a",
+			resource: corev1.ResourceCPU,
+			quantity: "9",
+		},
+		"fits eventually within the borrowing limit": {
+			cq:       "a",
+			resource: corev1.ResourceMemory,
+			quantity: "6Gi",
+			want:     true,
+		},
+		"beyond the borrowing limit": {
+			cq:       "a",
+			resource: corev1.ResourceMemory,
+			quantity: "7Gi",
+		},
+		"bigger than the nominal quota without cohort": {
+			cq:       "alone",
+			resource: corev1.ResourceCPU,
+			quantity: "5",
+		},
+		"resource without quota": {
+			cq:       "alone",
+			resource: corev1.ResourceMemory,
+			quantity: "1Gi",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cq := cache.clusterQueues[tc.cq]
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission(tc.cq).Assignment(tc.resource, "default", tc.quantity).Obj()).
+				Obj())
+			if got := cq.CouldEverFit(wi); got != tc.want {
+				t.Errorf("CouldEverFit() = %t, want %t", got, tc.want)
+			}
+			if cq.CanFit(wi) {
+				t.Errorf("The workload fits now")
+			}
+		})
+	}
+}
+
+func TestClusterQueueResourceGroupsByPriority(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("x86").Resource(corev1.ResourceCPU, "10").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("ssd").Resource(corev1.ResourceEphemeralStorage, "100Gi").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("fast-net").Resource("example.com/nic", "4").Obj()).
+		Annotation(ResourceGroupSettingsAnnotation, `{"resourceGroups":[
+			{"coveredResources":["example.com/gpu"],"priority":10},
+			{"coveredResources":["example.com/nic"],"priority":10},
+			{"coveredResources":["ephemeral-storage"],"priority":-1}
+		]}`).
+		Obj()
+	if err := cache.AddClusterQueue(context.Background(), cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+
+	// The priorities are kept on updates of the spec.
+	updated := cq.DeepCopy()
+	updated.Spec.ResourceGroups[0].Flavors[0].Resources[0].NominalQuota = resource.MustParse("20")
+	if err := cache.UpdateClusterQueue(updated); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+
+	var got []kueue.ResourceFlavorReference
+	for _, rg := range cache.clusterQueues["cq"].ResourceGroupsByPriority() {
+		got = append(got, rg.Flavors[0].Name)
+	}
+	want := []kueue.ResourceFlavorReference{"a100", "fast-net", "x86", "ssd"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected order of the resource groups (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueFreeze(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	cq, err := cache.newClusterQueue(cqObj)
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	first := utiltesting.MakeWorkload("first", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+		Obj()
+	second := utiltesting.MakeWorkload("second", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+		Obj()
+	if err := cq.addWorkload(first); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	cq.Freeze()
+	if !cq.IsFrozen() {
+		t.Errorf("The ClusterQueue isn't frozen after Freeze")
+	}
+	if err := cq.addWorkload(second); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("addWorkload() returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+	if err := cq.addWorkload(second); err == nil || errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("addWorkload() of a workload added while frozen returned %v, want the already exists error", err)
+	}
+	if err := cq.deleteWorkload(first); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("deleteWorkload() returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+	updated := cqObj.DeepCopy()
+	updated.Spec.ResourceGroups[0].Flavors[0].Resources[0].NominalQuota = resource.MustParse("20")
+	if err := cq.update(updated, nil, nil); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("update() returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+
+	// The read methods keep serving the state from before the freeze.
+	wantUsage := FlavorResourceQuantities{"default": {corev1.ResourceCPU: 2_000}}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage while frozen (-want,+got):\n%s", diff)
+	}
+	if got := cq.RemainingQuota("default", corev1.ResourceCPU); got != 8_000 {
+		t.Errorf("RemainingQuota() while frozen = %d, want 8000", got)
+	}
+	if got := len(cq.Workloads); got != 1 {
+		t.Errorf("Got %d workloads while frozen, want 1", got)
+	}
+
+	// The deferred changes of the workloads are applied on thaw.
+	cq.Thaw()
+	if cq.IsFrozen() {
+		t.Errorf("The ClusterQueue is frozen after Thaw")
+	}
+	wantUsage = FlavorResourceQuantities{"default": {corev1.ResourceCPU: 3_000}}
+	if diff := cmp.Diff(wantUsage, cq.Usage); diff != "" {
+		t.Errorf("Unexpected usage after thaw (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"/second"}, sets.List(sets.KeySet(cq.Workloads))); diff != "" {
+		t.Errorf("Unexpected workloads after thaw (-want,+got):\n%s", diff)
+	}
+	if err := cq.update(updated, nil, nil); err != nil {
+		t.Errorf("Failed updating ClusterQueue after thaw: %v", err)
+	}
+	if got := cq.ResourceGroups[0].Flavors[0].Resources[corev1.ResourceCPU].Nominal; got != 20_000 {
+		t.Errorf("Unexpected nominal quota after thaw: %d, want 20000", got)
+	}
+}
+
+func TestClusterQueueFreezeInCache(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cache.AddOrUpdateResourceFlavor(utiltesting.MakeResourceFlavor("default").Obj())
+	cqObj := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cqObj); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	first := utiltesting.MakeWorkload("first", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+		Obj()
+	second := utiltesting.MakeWorkload("second", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(first) {
+		t.Fatalf("Failed adding workload")
+	}
+	usage := func() []kueue.FlavorUsage {
+		usage, _, err := cache.Usage(cqObj)
+		if err != nil {
+			t.Fatalf("Failed getting the usage: %v", err)
+		}
+		return usage
+	}
+	usageBefore := usage()
+
+	if err := cache.FreezeClusterQueue("cq"); err != nil {
+		t.Fatalf("Failed freezing ClusterQueue: %v", err)
+	}
+	updatedFirst := first.DeepCopy()
+	updatedFirst.Spec.PodSets[0].Count = 2
+	if err := cache.UpdateWorkload(first, updatedFirst); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("UpdateWorkload() while frozen returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+	if err := cache.DeleteWorkload(updatedFirst); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("DeleteWorkload() while frozen returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+	// The workloads that aren't admitted in the API aren't deferred.
+	if err := cache.AssumeWorkload(second); !errors.Is(err, ErrClusterQueueFrozen) {
+		t.Errorf("AssumeWorkload() while frozen returned %v, want %v", err, ErrClusterQueueFrozen)
+	}
+	if diff := cmp.Diff(usageBefore, usage()); diff != "" {
+		t.Errorf("Unexpected usage while frozen (-want,+got):\n%s", diff)
+	}
+
+	if err := cache.ThawClusterQueue("cq"); err != nil {
+		t.Fatalf("Failed thawing ClusterQueue: %v", err)
+	}
+	if cache.IsAssumedOrAdmittedWorkload(*workload.NewInfo(second)) {
+		t.Errorf("The workload assumed while frozen is admitted after thaw")
+	}
+	if err := cache.AssumeWorkload(second); err != nil {
+		t.Errorf("Failed assuming workload after thaw: %v", err)
+	}
+	want := []kueue.FlavorUsage{{
+		Name: "default",
+		Resources: []kueue.ResourceUsage{{
+			Name:  corev1.ResourceCPU,
+			Total: resource.MustParse("3"),
+		}},
+	}}
+	if diff := cmp.Diff(want, usage()); diff != "" {
+		t.Errorf("Unexpected usage after thaw (-want,+got):\n%s", diff)
+	}
+	if !cache.IsAssumedOrAdmittedWorkload(*workload.NewInfo(second)) {
+		t.Errorf("The workload assumed after thaw isn't admitted")
+	}
+}
+
+func TestClusterQueueFitsWithoutCohort(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+	if err := cq.addWorkload(utiltesting.MakeWorkload("admitted", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	cases := map[string]struct {
+		resource corev1.ResourceName
+		quantity string
+		want     bool
+	}{
+		"within the nominal quota": {
+			resource: corev1.ResourceCPU,
+			quantity: "3",
+			want:     true,
+		},
+		"needs borrowing": {
+			resource: corev1.ResourceCPU,
+			quantity: "4",
+		},
+		"resource without quota": {
+			resource: corev1.ResourceMemory,
+			quantity: "1Gi",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("a").Assignment(tc.resource, "default", tc.quantity).Obj()).
+				Obj())
+			if got := cq.FitsWithoutCohort(wi); got != tc.want {
+				t.Errorf("FitsWithoutCohort() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+
+	// The workload that needs borrowing fits with the cohort.
+	if !cq.CanFit(workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "4").Obj()).
+		Obj())) {
+		t.Errorf("The workload that needs borrowing doesn't fit with the cohort")
+	}
+}
+
+func TestClusterQueueAssignedFlavors(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("wl", "ns").
+		Admit(utiltesting.MakeAdmission("cq").
+			Assignment(corev1.ResourceCPU, "spot", "2").
+			Assignment(corev1.ResourceMemory, "spot", "1Gi").
+			Assignment("example.com/gpu", "a100", "1").
+			Obj()).
+		Obj()
+	if err := cq.addWorkload(wl); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+
+	got, found := cq.AssignedFlavors("ns/wl")
+	if !found {
+		t.Fatalf("No flavors recorded for the admitted workload")
+	}
+	want := map[corev1.ResourceName]kueue.ResourceFlavorReference{
+		corev1.ResourceCPU:    "spot",
+		corev1.ResourceMemory: "spot",
+		"example.com/gpu":     "a100",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected assigned flavors (-want,+got):\n%s", diff)
+	}
+
+	if _, found := cq.AssignedFlavors("ns/other"); found {
+		t.Errorf("Got flavors for a workload that isn't admitted")
+	}
+}
+
+func TestClusterQueueReclaimNeeded(t *testing.T) {
+	cases := map[string]struct {
+		borrowerUsage string
+		request       string
+		want          FlavorResourceQuantities
+	}{
+		"free nominal quota": {
+			borrowerUsage: "2",
+			request:       "5",
+			want:          FlavorResourceQuantities{},
+		},
+		"lent quota must be reclaimed": {
+			borrowerUsage: "8",
+			request:       "5",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 3_000},
+			},
+		},
+		"only the nominal quota is reclaimed": {
+			borrowerUsage: "8",
+			request:       "12",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 8_000},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := New(utiltesting.NewFakeClient())
+			for _, cq := range []*kueue.ClusterQueue{
+				utiltesting.MakeClusterQueue("lender").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+					Cohort("one").
+					Obj(),
+				utiltesting.MakeClusterQueue("borrower").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "0").Obj()).
+					Cohort("one").
+					Obj(),
+			} {
+				if err := cache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+				}
+			}
+			if err := cache.clusterQueues["borrower"].addWorkload(utiltesting.MakeWorkload("borrowing", "").
+				Admit(utiltesting.MakeAdmission("borrower").Assignment(corev1.ResourceCPU, "default", tc.borrowerUsage).Obj()).
+				Obj()); err != nil {
+				t.Fatalf("Failed adding workload: %v", err)
+			}
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				Admit(utiltesting.MakeAdmission("lender").Assignment(corev1.ResourceCPU, "default", tc.request).Obj()).
+				Obj())
+			got := cache.clusterQueues["lender"].ReclaimNeeded(wi)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected reclaim (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBestClusterQueue(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a-borrowing").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b-lender").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c-self-sufficient").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Obj(),
+		utiltesting.MakeClusterQueue("d-self-sufficient").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Obj(),
+		utiltesting.MakeClusterQueue("e-small").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "1").Obj()).
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+		Admit(utiltesting.MakeAdmission("").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+		Obj())
+
+	cases := map[string]struct {
+		candidates []string
+		want       string
+		wantFound  bool
+	}{
+		"prefers fitting without borrowing": {
+			candidates: []string{"a-borrowing", "d-self-sufficient"},
+			want:       "d-self-sufficient",
+			wantFound:  true,
+		},
+		"borrows when needed": {
+			candidates: []string{"a-borrowing", "e-small"},
+			want:       "a-borrowing",
+			wantFound:  true,
+		},
+		"ties broken by name": {
+			candidates: []string{"d-self-sufficient", "c-self-sufficient"},
+			want:       "c-self-sufficient",
+			wantFound:  true,
+		},
+		"fits nowhere": {
+			candidates: []string{"e-small"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			candidates := make([]*ClusterQueue, 0, len(tc.candidates))
+			for _, name := range tc.candidates {
+				candidates = append(candidates, cache.clusterQueues[name])
+			}
+			got, found := BestClusterQueue(candidates, wi)
+			if found != tc.wantFound {
+				t.Fatalf("BestClusterQueue() found = %t, want %t", found, tc.wantFound)
+			}
+			if found && got.Name != tc.want {
+				t.Errorf("BestClusterQueue() = %s, want %s", got.Name, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterQueueWorkloadBorrowingContribution(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	now := time.Now()
+	admitted := func(name, cpu string, at time.Time) *kueue.Workload {
+		return utiltesting.MakeWorkload(name, "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			SetOrReplaceCondition(metav1.Condition{
+				Type:               kueue.WorkloadAdmitted,
+				Status:             metav1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(at),
+			}).
+			Obj()
+	}
+	for _, wl := range []*kueue.Workload{
+		admitted("c-first", "2", now.Add(-3*time.Minute)),
+		admitted("b-second", "2", now.Add(-2*time.Minute)),
+		admitted("a-third", "3", now.Add(-time.Minute)),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	want := map[string]FlavorResourceQuantities{
+		"/a-third": {"default": {corev1.ResourceCPU: 3_000}},
+	}
+	if diff := cmp.Diff(want, cache.clusterQueues["a"].WorkloadBorrowingContribution()); diff != "" {
+		t.Errorf("Unexpected borrowing contribution (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueNominalToEliminateBorrowing(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "8Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "10Gi").
+				Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	wl := utiltesting.MakeWorkload("borrowing", "").
+		Admit(utiltesting.MakeAdmission("a").
+			Assignment(corev1.ResourceCPU, "default", "6").
+			Assignment(corev1.ResourceMemory, "default", "2Gi").
+			Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+
+	want := FlavorResourceQuantities{
+		"default": {
+			corev1.ResourceCPU:    6_000,
+			corev1.ResourceMemory: 8 * utiltesting.Gi,
+		},
+	}
+	if diff := cmp.Diff(want, cache.clusterQueues["a"].NominalToEliminateBorrowing()); diff != "" {
+		t.Errorf("Unexpected required nominal quota (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueGroupBorrowed(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj(),
+				*utiltesting.MakeFlavorQuotas("t4").Resource("example.com/gpu", "4").Obj()).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "4").Obj(),
+				*utiltesting.MakeFlavorQuotas("t4").Resource("example.com/gpu", "4").Obj()).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a100", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment("example.com/gpu", "a100", "3").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("t4", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment("example.com/gpu", "t4", "6").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("cpu", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "5").Obj()).
+			Obj(),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %s: %v", wl.Name, err)
+		}
+	}
+
+	got := cq.GroupBorrowed(&cq.ResourceGroups[0])
+	want := FlavorResourceQuantities{
+		"a100": {"example.com/gpu": 1},
+		"t4":   {"example.com/gpu": 2},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected borrowed quota for the GPU group (-want,+got):\n%s", diff)
+	}
+	var total int64
+	for _, rBorrowed := range got {
+		total += rBorrowed["example.com/gpu"]
+	}
+	if total != 3 {
+		t.Errorf("The GPU group borrows %d, want 3", total)
+	}
+
+	if got := cq.GroupBorrowed(&cq.ResourceGroups[1]); len(got) != 0 {
+		t.Errorf("Unexpected borrowed quota for the CPU group: %v", got)
+	}
+}
+
+func TestClusterQueueReserveForPending(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	// The flavors are assigned to the pending workloads, as the scheduler does
+	// before admitting them.
+	high := utiltesting.MakeWorkload("high", "").
+		Priority(100).
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "8").Obj()).
+		Obj()
+	otherHigh := utiltesting.MakeWorkload("other-high", "").
+		Priority(100).
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "7").Obj()).
+		Obj()
+	low := workload.NewInfo(utiltesting.MakeWorkload("low", "").
+		Priority(1).
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "default", "4").Obj()).
+		Obj())
+
+	cq.ReserveForPending([]*workload.Info{workload.NewInfo(high), workload.NewInfo(otherHigh)})
+	if cq.CanFit(low) {
+		t.Errorf("The low priority workload fits in the quota reserved for the pending workloads")
+	}
+	if !cq.CanFit(workload.NewInfo(high)) {
+		t.Errorf("The high priority workload doesn't fit in its reservation")
+	}
+	if !cq.snapshot().CanFit(workload.NewInfo(high)) {
+		t.Errorf("The high priority workload doesn't fit in its reservation in the snapshot")
+	}
+	if cq.snapshot().CanFit(low) {
+		t.Errorf("The low priority workload fits in the reserved quota in the snapshot")
+	}
+
+	// Admitting the high priority workload releases its reservation.
+	if err := cq.addWorkload(high); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if cq.CanFit(low) {
+		t.Errorf("The low priority workload fits in the quota used by the high priority workload")
+	}
+	cq.deleteWorkload(high)
+	if cq.CanFit(low) {
+		t.Errorf("The low priority workload fits while a pending workload has a reservation")
+	}
+
+	cq.ReleaseReservation(workload.Key(otherHigh))
+	if !cq.CanFit(low) {
+		t.Errorf("The low priority workload doesn't fit after the reservations are released")
+	}
+}
+
+func TestClusterQueueLargestFit(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("reserved").Resource(corev1.ResourceCPU, "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("on-demand", "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "on-demand", "7").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("spot", "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "spot", "8").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("reserved", "").
+			Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "reserved", "2").Obj()).
+			Obj(),
+	} {
+		if err := cq.addWorkload(wl); err != nil {
+			t.Fatalf("Failed adding workload %s: %v", wl.Name, err)
+		}
+	}
+
+	var total int64
+	for _, fName := range []kueue.ResourceFlavorReference{"on-demand", "spot", "reserved"} {
+		total += cq.RemainingQuota(fName, corev1.ResourceCPU)
+	}
+	if total != 7_000 {
+		t.Errorf("Got a total remaining quota of %d, want 7000", total)
+	}
+	if got := cq.LargestFit(corev1.ResourceCPU); got != 3_000 {
+		t.Errorf("LargestFit(cpu) = %d, want 3000", got)
+	}
+	if got := cq.LargestFit(corev1.ResourceMemory); got != 0 {
+		t.Errorf("LargestFit(memory) = %d, want 0", got)
+	}
+}
+
+func TestClusterQueueZeroQuotaResources(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("on-demand").
+				Resource(corev1.ResourceCPU, "10").
+				Resource(corev1.ResourceMemory, "0").Obj(),
+			*utiltesting.MakeFlavorQuotas("spot").
+				Resource(corev1.ResourceCPU, "0").
+				Resource(corev1.ResourceMemory, "0").Obj()).
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "4").Obj()).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	want := []FlavorResource{
+		{Flavor: "on-demand", Resource: corev1.ResourceMemory},
+		{Flavor: "spot", Resource: corev1.ResourceCPU},
+		{Flavor: "spot", Resource: corev1.ResourceMemory},
+	}
+	if diff := cmp.Diff(want, cq.ZeroQuotaResources()); diff != "" {
+		t.Errorf("Unexpected resources with zero quota (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueAdmissionPlan(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "6").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("running", "ns").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+	candidate := func(name, cpu string) *workload.Info {
+		return workload.NewInfo(utiltesting.MakeWorkload(name, "ns").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj())
+	}
+	candidates := []*workload.Info{
+		candidate("first", "2"),
+		candidate("second", "2"),
+		candidate("third", "2"),
+		candidate("fourth", "1"),
+	}
+
+	usage := cache.clusterQueues["a"].Usage.clone()
+	admitted, rejected := cache.clusterQueues["a"].AdmissionPlan(candidates)
+	if diff := cmp.Diff([]string{"ns/first", "ns/second", "ns/fourth"}, admitted); diff != "" {
+		t.Errorf("Unexpected admitted workloads (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ns/third"}, rejected); diff != "" {
+		t.Errorf("Unexpected rejected workloads (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff(usage, cache.clusterQueues["a"].Usage); diff != "" {
+		t.Errorf("The plan modified the usage (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ns/running"}, sets.List(sets.KeySet(cache.clusterQueues["a"].Workloads))); diff != "" {
+		t.Errorf("The plan modified the workloads (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueAdmissionPlanExclusiveFlavor(t *testing.T) {
+	cache := New(utiltesting.NewFakeClient())
+	cq, err := cache.newClusterQueue(utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("gpu-8x").Resource("example.com/gpu", "16").Obj()).
+		Annotation(ResourceGroupSettingsAnnotation, `{"flavors":[{"name":"gpu-8x","exclusive":true}]}`).
+		Obj())
+	if err != nil {
+		t.Fatalf("Failed to create ClusterQueue: %v", err)
+	}
+	candidate := func(name string) *workload.Info {
+		return workload.NewInfo(utiltesting.MakeWorkload(name, "ns").
+			Admit(utiltesting.MakeAdmission("cq").Assignment("example.com/gpu", "gpu-8x", "8").Obj()).
+			Obj())
+	}
+
+	admitted, rejected := cq.AdmissionPlan([]*workload.Info{candidate("first"), candidate("second")})
+	if diff := cmp.Diff([]string{"ns/first"}, admitted); diff != "" {
+		t.Errorf("Unexpected admitted workloads (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ns/second"}, rejected); diff != "" {
+		t.Errorf("Unexpected rejected workloads (-want,+got):\n%s", diff)
+	}
+	if len(cq.Workloads) != 0 {
+		t.Errorf("The plan added workloads to the ClusterQueue: %v", sets.List(sets.KeySet(cq.Workloads)))
+	}
+	if holder, held := cq.ExclusiveFlavorHolder("gpu-8x"); held {
+		t.Errorf("The plan left the exclusive flavor held by %q", holder)
+	}
+}
+
+func TestClusterQueueSimulate(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Preemption(kueue.ClusterQueuePreemption{WithinClusterQueue: kueue.PreemptionPolicyLowerPriority}).
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "default", "3").
+				Assignment(corev1.ResourceMemory, "default", "1Gi").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+			Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+
+	cases := map[string]struct {
+		cpu    string
+		memory string
+		want   AdmissionSimulation
+	}{
+		"fits in the nominal quota": {
+			cpu:    "1",
+			memory: "1Gi",
+			want: AdmissionSimulation{
+				Fits:      true,
+				Shortfall: FlavorResourceQuantities{},
+			},
+		},
+		"fits borrowing": {
+			cpu:    "2",
+			memory: "1Gi",
+			want: AdmissionSimulation{
+				Fits:        true,
+				WouldBorrow: true,
+				Shortfall:   FlavorResourceQuantities{},
+			},
+		},
+		"requires preemption": {
+			cpu:    "4",
+			memory: "1Gi",
+			want: AdmissionSimulation{
+				WouldBorrow: true,
+				Shortfall: FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 2_000},
+				},
+				RequiresPreemption: true,
+			},
+		},
+		"never fits": {
+			cpu:    "9",
+			memory: "1Gi",
+			want: AdmissionSimulation{
+				WouldBorrow: true,
+				Shortfall: FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 7_000},
+				},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wi := workload.NewInfo(utiltesting.MakeWorkload("wl", "").Priority(10).
+				Admit(utiltesting.MakeAdmission("a").
+					Assignment(corev1.ResourceCPU, "default", tc.cpu).
+					Assignment(corev1.ResourceMemory, "default", tc.memory).Obj()).
+				Obj())
+			usage := cq.Usage.clone()
+			if diff := cmp.Diff(tc.want, cq.Simulate(wi)); diff != "" {
+				t.Errorf("Unexpected simulation (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(usage, cq.Usage); diff != "" {
+				t.Errorf("The simulation modified the usage (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueSimulateRequiresPreemption(t *testing.T) {
+	ctx := context.Background()
+	lowerPriority := kueue.ClusterQueuePreemption{
+		WithinClusterQueue:  kueue.PreemptionPolicyLowerPriority,
+		ReclaimWithinCohort: kueue.PreemptionPolicyNever,
+	}
+	reclaimAny := kueue.ClusterQueuePreemption{
+		WithinClusterQueue:  kueue.PreemptionPolicyNever,
+		ReclaimWithinCohort: kueue.PreemptionPolicyAny,
+	}
+	never := kueue.ClusterQueuePreemption{
+		WithinClusterQueue:  kueue.PreemptionPolicyNever,
+		ReclaimWithinCohort: kueue.PreemptionPolicyNever,
+	}
+	rejectAll := func(*workload.Info, ClusterQueueView) error {
+		return errors.New("rejected")
+	}
+	cases := map[string]struct {
+		preemption  kueue.ClusterQueuePreemption
+		settings    string
+		gates       []AdmissionGate
+		cpu         string
+		annotations map[string]string
+		want        bool
+	}{
+		"preempting lower priority workloads of the ClusterQueue": {
+			preemption: lowerPriority,
+			cpu:        "2",
+			want:       true,
+		},
+		"reclaiming the quota borrowed by the cohort": {
+			preemption: reclaimAny,
+			cpu:        "1",
+			want:       true,
+		},
+		"WithinClusterQueue is Never": {
+			preemption: reclaimAny,
+			cpu:        "2",
+		},
+		"ReclaimWithinCohort is Never": {
+			preemption: never,
+			cpu:        "1",
+		},
+		"larger than the nominal quota": {
+			preemption: lowerPriority,
+			cpu:        "5",
+		},
+		"admission deadline passed": {
+			preemption:  lowerPriority,
+			cpu:         "2",
+			annotations: map[string]string{AdmissionDeadlineAnnotation: "2000-01-01T00:00:00Z"},
+		},
+		"rejected by an admission gate": {
+			preemption: lowerPriority,
+			gates:      []AdmissionGate{rejectAll},
+			cpu:        "2",
+		},
+		"avoided flavor": {
+			preemption:  lowerPriority,
+			cpu:         "2",
+			annotations: map[string]string{AvoidFlavorsAnnotation: "default"},
+		},
+		"exclusive flavor held by another workload": {
+			preemption: lowerPriority,
+			settings:   `{"flavors":[{"name":"default","exclusive":true}]}`,
+			cpu:        "2",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cache := New(utiltesting.NewFakeClient(), WithAdmissionGates(tc.gates...))
+			cqA := utiltesting.MakeClusterQueue("a").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+				Cohort("one").
+				Preemption(tc.preemption)
+			if tc.settings != "" {
+				cqA.Annotation(ResourceGroupSettingsAnnotation, tc.settings)
+			}
+			for _, cq := range []*kueue.ClusterQueue{
+				cqA.Obj(),
+				utiltesting.MakeClusterQueue("b").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+					Cohort("one").
+					Obj(),
+			} {
+				if err := cache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+				}
+			}
+			// The cohort is full: "a" uses 3 of its 4 and "b" borrows 1.
+			for _, wl := range []*kueue.Workload{
+				utiltesting.MakeWorkload("a1", "").
+					Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+					Obj(),
+				utiltesting.MakeWorkload("b1", "").
+					Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "5").Obj()).
+					Obj(),
+			} {
+				if !cache.AddOrUpdateWorkload(wl) {
+					t.Fatalf("Failed adding workload %q", wl.Name)
+				}
+			}
+			wl := utiltesting.MakeWorkload("wl", "").Priority(10).
+				Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", tc.cpu).Obj())
+			for k, v := range tc.annotations {
+				wl.Annotation(k, v)
+			}
+			got := cache.clusterQueues["a"].Simulate(workload.NewInfo(wl.Obj()))
+			if got.Fits {
+				t.Fatalf("The workload fits")
+			}
+			if got.RequiresPreemption != tc.want {
+				t.Errorf("Got RequiresPreemption %t, want %t", got.RequiresPreemption, tc.want)
+			}
+		})
+	}
+}
+
+func TestClusterQueueTotalAvailable(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4", "6").
+				Resource(corev1.ResourceMemory, "4Gi", "1Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").Obj()).
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("c1", "").
+			Admit(utiltesting.MakeAdmission("c").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	cases := map[string]struct {
+		cq   string
+		want FlavorResourceQuantities
+	}{
+		"cohort availability limits the borrowing headroom": {
+			cq: "a",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 4_000, corev1.ResourceMemory: 5 * utiltesting.Gi},
+			},
+		},
+		"no borrowing limit": {
+			cq: "b",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 4_000, corev1.ResourceMemory: 8 * utiltesting.Gi},
+			},
+		},
+		"without cohort": {
+			cq: "c",
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 3_000},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, cache.clusterQueues[tc.cq].TotalAvailable()); diff != "" {
+				t.Errorf("Unexpected total available (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterQueueSafetyMargin(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithSafetyMargin(0.1))
+	cq := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "10").
+			Resource(corev1.ResourceMemory, "10Gi").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wl := utiltesting.MakeWorkload("a1", "").
+		Admit(utiltesting.MakeAdmission("a").
+			Assignment(corev1.ResourceCPU, "default", "2").
+			Assignment(corev1.ResourceMemory, "default", "1Gi").
+			Obj()).
+		Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+
+	wantUsage := FlavorResourceQuantities{
+		"default": {
+			corev1.ResourceCPU:    2_200,
+			corev1.ResourceMemory: int64(math.Ceil(1.1 * utiltesting.Gi)),
+		},
+	}
+	if diff := cmp.Diff(wantUsage, cache.clusterQueues["a"].Usage); diff != "" {
+		t.Errorf("Unexpected usage after adding the workload (-want,+got):\n%s", diff)
+	}
+
+	if err := cache.DeleteWorkload(wl); err != nil {
+		t.Fatalf("Failed deleting workload %q: %v", wl.Name, err)
+	}
+	wantUsage = FlavorResourceQuantities{
+		"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+	}
+	if diff := cmp.Diff(wantUsage, cache.clusterQueues["a"].Usage); diff != "" {
+		t.Errorf("Unexpected usage after deleting the workload (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueSafetyMarginFits(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithSafetyMargin(0.1))
+	if err := cache.AddClusterQueue(ctx, utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	cq := cache.clusterQueues["a"]
+	pending := func(cpu string) *workload.Info {
+		return workload.NewInfo(utiltesting.MakeWorkload("pending", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj())
+	}
+
+	// The request equals the nominal quota, but it's counted as 11 in the
+	// usage, so it doesn't fit.
+	exact := pending("10")
+	if cq.CanFit(exact) {
+		t.Errorf("A request equal to the nominal quota fits with a safety margin")
+	}
+	wantShortfall := FlavorResourceQuantities{"default": {corev1.ResourceCPU: 1_000}}
+	if diff := cmp.Diff(wantShortfall, cq.Shortfall(exact)); diff != "" {
+		t.Errorf("Unexpected shortfall (-want,+got):\n%s", diff)
+	}
+	if cq.CouldEverFit(exact) {
+		t.Errorf("A request equal to the nominal quota could ever fit with a safety margin")
+	}
+
+	if got, want := cq.LargestFit(corev1.ResourceCPU), int64(9_090); got != want {
+		t.Errorf("Got largest fit %d, want %d", got, want)
+	}
+	if largest := pending("9090m"); !cq.CanFit(largest) {
+		t.Errorf("The largest fit doesn't fit")
+	}
+
+	// The system usage is inflated like the usage, so a system workload using
+	// the whole reservation leaves nothing of it unused.
+	cq.SystemWorkloadLabel = "example.com/system"
+	cq.SystemReservation = FlavorResourceQuantities{"default": {corev1.ResourceCPU: 2_200}}
+	system := utiltesting.MakeWorkload("system", "").
+		Label("example.com/system", "true").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+		Obj()
+	if err := cq.addWorkload(system); err != nil {
+		t.Fatalf("Failed adding workload: %v", err)
+	}
+	if got := cq.UnusedSystemReservation("default", corev1.ResourceCPU); got != 0 {
+		t.Errorf("Got unused system reservation %d, want 0", got)
+	}
+}
+
+func TestClusterQueueCapacityCallbacks(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cq := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+			Resource(corev1.ResourceCPU, "4").
+			Resource(corev1.ResourceMemory, "8Gi").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	var events []string
+	// The callbacks are called with the cache unlocked, so they can use it.
+	cache.clusterQueues["a"].OnFull = func(cqName string) {
+		if !cache.ClusterQueueEmpty(cqName) {
+			events = append(events, "full "+cqName)
+		}
+	}
+	cache.clusterQueues["a"].OnFreed = func(cqName string) {
+		if !cache.ClusterQueueEmpty(cqName) {
+			events = append(events, "freed "+cqName)
+		}
+	}
+	wls := make([]*kueue.Workload, 3)
+	for i := range wls {
+		wls[i] = utiltesting.MakeWorkload(fmt.Sprintf("wl%d", i), "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "default", "2").
+				Assignment(corev1.ResourceMemory, "default", "1Gi").
+				Obj()).
+			Obj()
+	}
+
+	steps := []struct {
+		add        *kueue.Workload
+		remove     *kueue.Workload
+		wantEvents []string
+	}{
+		{add: wls[0]},
+		{add: wls[1], wantEvents: []string{"full a"}},
+		{add: wls[2], wantEvents: []string{"full a"}},
+		{remove: wls[2], wantEvents: []string{"full a"}},
+		{remove: wls[1], wantEvents: []string{"full a", "freed a"}},
+		{remove: wls[0], wantEvents: []string{"full a", "freed a"}},
+	}
+	for i, step := range steps {
+		if step.add != nil && !cache.AddOrUpdateWorkload(step.add) {
+			t.Fatalf("Failed adding workload %q", step.add.Name)
+		}
+		if step.remove != nil {
+			if err := cache.DeleteWorkload(step.remove); err != nil {
+				t.Fatalf("Failed deleting workload %q: %v", step.remove.Name, err)
+			}
+		}
+		if diff := cmp.Diff(step.wantEvents, events); diff != "" {
+			t.Errorf("Unexpected events after step %d (-want,+got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestClusterQueueMinHeadroomRatio(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "8Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "8Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "default", "3600m").
+				Assignment(corev1.ResourceMemory, "default", "2Gi").
+				Obj()).
+			Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").
+				Assignment(corev1.ResourceCPU, "default", "6").
+				Assignment(corev1.ResourceMemory, "default", "1Gi").
+				Obj()).
+			Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	cases := map[string]struct {
+		cq   string
+		want float64
+	}{
+		"nearly full resource dominates": {
+			cq:   "a",
+			want: 0.1,
+		},
+		"borrowing": {
+			cq:   "b",
+			want: -0.5,
+		},
+		"unused": {
+			cq:   "c",
+			want: 1,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := cache.clusterQueues[tc.cq].MinHeadroomRatio(); got != tc.want {
+				t.Errorf("MinHeadroomRatio() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResourceGroupConflictingLabelKeys(t *testing.T) {
+	rg := ResourceGroup{
+		Flavors: []FlavorQuotas{{Name: "on-demand"}, {Name: "spot"}, {Name: "missing"}},
+	}
+	flavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"on-demand": utiltesting.MakeResourceFlavor("on-demand").
+			Label("instance-type", "on-demand").
+			Label("region", "us-east").Obj(),
+		"spot": utiltesting.MakeResourceFlavor("spot").
+			Label("instance-type", "spot").
+			Label("region", "us-east").Obj(),
+	}
+	if diff := cmp.Diff([]string{"instance-type"}, rg.ConflictingLabelKeys(flavors)); diff != "" {
+		t.Errorf("Unexpected conflicting label keys (-want,+got):\n%s", diff)
+	}
+}
+
+func TestClusterQueueConservativeWarmup(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithConservativeWarmup(true))
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cq := cache.clusterQueues["a"]
+	pending := func(cpu string) *workload.Info {
+		return workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+			Obj())
+	}
+
+	if cq.IsWarm() {
+		t.Errorf("The ClusterQueue is warm before MarkWarm")
+	}
+	if !cq.CanFit(pending("2")) {
+		t.Errorf("A workload that fits in the nominal quota doesn't fit before the warmup")
+	}
+	if cq.CanFit(pending("3")) {
+		t.Errorf("A workload that needs to borrow fits before the warmup")
+	}
+
+	cache.MarkWarm()
+	if !cq.IsWarm() {
+		t.Errorf("The ClusterQueue isn't warm after MarkWarm")
+	}
+	if !cq.CanFit(pending("3")) {
+		t.Errorf("A workload that needs to borrow doesn't fit after the warmup")
+	}
+}
+
+func TestCacheAccountsAdmittedWorkloads(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithConservativeWarmup(true))
+	cq := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+		Obj()
+	if err := cache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	wls := []kueue.Workload{
+		*utiltesting.MakeWorkload("admitted", "ns").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj(),
+		*utiltesting.MakeWorkload("pending", "ns").Obj(),
+		*utiltesting.MakeWorkload("unknown-cq", "ns").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+			Obj(),
+	}
+
+	if cache.AccountsAdmittedWorkloads(wls) {
+		t.Errorf("The cache accounts the admitted workloads before adding them")
+	}
+	if !cache.AddOrUpdateWorkload(&wls[0]) {
+		t.Fatalf("Failed adding workload %q", wls[0].Name)
+	}
+	if !cache.AccountsAdmittedWorkloads(wls) {
+		t.Errorf("The cache doesn't account the admitted workloads after adding them")
+	}
+}
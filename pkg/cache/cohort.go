@@ -0,0 +1,617 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	"sigs.k8s.io/kueue/pkg/util/priority"
+	"sigs.k8s.io/kueue/pkg/workload"
+)
+
+var errCohortCycle = errors.New("cohort can't be its own ancestor")
+
+// Cohort is a set of ClusterQueues that can borrow resources from each other.
+type Cohort struct {
+	Name    string
+	Members sets.Set[*ClusterQueue]
+
+	// These fields are only populated for a snapshot.
+	RequestableResources FlavorResourceQuantities
+	Usage                FlavorResourceQuantities
+
+	// parent is the cohort that this cohort is nested in, if any. See
+	// AvailableWithinDepth.
+	parent *Cohort
+}
+
+func newCohort(name string, size int) *Cohort {
+	return &Cohort{
+		Name:    name,
+		Members: make(sets.Set[*ClusterQueue], size),
+	}
+}
+
+func (c *Cohort) HasBorrowingQueues() bool {
+	for cq := range c.Members {
+		if cq.IsBorrowing() {
+			return true
+		}
+	}
+	return false
+}
+
+// ReclaimCandidates returns the workloads of the other cohort members that the
+// ReclaimWithinCohort policy of requestingCQ allows wl to preempt: none with
+// Never, the ones with a lower priority than wl with LowerPriority and all of
+// them with Any. The workloads in the preemption protection window of their
+// ClusterQueue at now, or above the PreemptionPriorityThreshold of a resource
+// group they use, are skipped. Whether the members are borrowing the resources
+// that wl needs is left to the caller.
+func (c *Cohort) ReclaimCandidates(wl *kueue.Workload, requestingCQ *ClusterQueue, now time.Time) []*workload.Info {
+	var candidates []*workload.Info
+	c.forEachReclaimCandidate(wl, requestingCQ, now, func(_ *ClusterQueue, wi *workload.Info) {
+		candidates = append(candidates, wi)
+	})
+	return candidates
+}
+
+// forEachReclaimCandidate calls f with each of the ReclaimCandidates and the
+// member it's admitted in.
+func (c *Cohort) forEachReclaimCandidate(wl *kueue.Workload, requestingCQ *ClusterQueue, now time.Time, f func(cq *ClusterQueue, wi *workload.Info)) {
+	policy := requestingCQ.Preemption.ReclaimWithinCohort
+	if policy == kueue.PreemptionPolicyNever {
+		return
+	}
+	for cq := range c.Members {
+		if cq == requestingCQ {
+			continue
+		}
+		for _, wi := range cq.Workloads {
+			if policy == kueue.PreemptionPolicyLowerPriority && priority.Priority(wi.Obj) >= priority.Priority(wl) {
+				continue
+			}
+			if cq.InPreemptionProtectionWindow(wi, now) || cq.AbovePreemptionPriorityThreshold(wi) {
+				continue
+			}
+			f(cq, wi)
+		}
+	}
+}
+
+// PreemptionCandidates returns the ReclaimCandidates for wl that can be
+// preempted to reclaim the needed amount of the flavor and resource for
+// requestingCQ. Only members borrowing the flavor and resource are considered.
+// The candidates are ordered by priority, lowest first, and by admission time,
+// most recent first. The list stops once the needed amount is covered, and it
+// doesn't reclaim more than what each member is borrowing, counting the
+// requests as they're accounted in the usage of the members.
+func (c *Cohort) PreemptionCandidates(wl *kueue.Workload, fName kueue.ResourceFlavorReference, rName corev1.ResourceName, needed int64, requestingCQ *ClusterQueue, now time.Time) []*workload.Info {
+	if needed <= 0 {
+		return nil
+	}
+	type candidate struct {
+		wi    *workload.Info
+		cq    *ClusterQueue
+		usage int64
+	}
+	var candidates []candidate
+	c.forEachReclaimCandidate(wl, requestingCQ, now, func(cq *ClusterQueue, wi *workload.Info) {
+		if cq.borrowed(fName, rName) == 0 {
+			return
+		}
+		if usage := cq.accountedRequests(wi)[fName][rName]; usage > 0 {
+			candidates = append(candidates, candidate{wi: wi, cq: cq, usage: usage})
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].wi, candidates[j].wi
+		if pa, pb := priority.Priority(a.Obj), priority.Priority(b.Obj); pa != pb {
+			return pa < pb
+		}
+		ta, _ := admissionTime(a.Obj)
+		tb, _ := admissionTime(b.Obj)
+		if !ta.Equal(tb) {
+			return tb.Before(ta)
+		}
+		return workload.Key(a.Obj) < workload.Key(b.Obj)
+	})
+
+	var result []*workload.Info
+	var reclaimed int64
+	reclaimedPerCQ := make(map[*ClusterQueue]int64)
+	for _, cand := range candidates {
+		if reclaimed >= needed {
+			break
+		}
+		if reclaimedPerCQ[cand.cq] >= cand.cq.borrowed(fName, rName) {
+			continue
+		}
+		reclaimedPerCQ[cand.cq] += cand.usage
+		reclaimed += cand.usage
+		result = append(result, cand.wi)
+	}
+	return result
+}
+
+// ReclaimCost estimates the disruption of reclaiming the needed amount of the
+// flavor and resource from the members borrowing it: the fewest workloads to
+// preempt, taking the largest ones first, and the amount that preempting them
+// frees. Like in PreemptionCandidates, the workloads protected at now are
+// skipped and no more than what each member borrows is reclaimed. When the
+// needed amount can't be reclaimed, it returns the cost of reclaiming as much
+// as possible.
+func (c *Cohort) ReclaimCost(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, needed int64, now time.Time) (victims int, resourceFreed int64) {
+	if needed <= 0 {
+		return 0, 0
+	}
+	type candidate struct {
+		cq    *ClusterQueue
+		usage int64
+	}
+	var candidates []candidate
+	for cq := range c.Members {
+		if cq.borrowed(fName, rName) == 0 {
+			continue
+		}
+		for _, wi := range cq.Workloads {
+			usage := cq.accountedRequests(wi)[fName][rName]
+			if usage == 0 || cq.InPreemptionProtectionWindow(wi, now) || cq.AbovePreemptionPriorityThreshold(wi) {
+				continue
+			}
+			candidates = append(candidates, candidate{cq: cq, usage: usage})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].usage > candidates[j].usage
+	})
+
+	reclaimedPerCQ := make(map[*ClusterQueue]int64)
+	for _, cand := range candidates {
+		if resourceFreed >= needed {
+			break
+		}
+		if reclaimedPerCQ[cand.cq] >= cand.cq.borrowed(fName, rName) {
+			continue
+		}
+		reclaimedPerCQ[cand.cq] += cand.usage
+		resourceFreed += cand.usage
+		victims++
+	}
+	return victims, resourceFreed
+}
+
+// BorrowersOf returns the members borrowing the flavor and resource from the
+// cohort, sorted by borrowed amount, highest first, and then by name.
+func (c *Cohort) BorrowersOf(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) []*ClusterQueue {
+	var borrowers []*ClusterQueue
+	for cq := range c.Members {
+		if cq.borrowed(fName, rName) > 0 {
+			borrowers = append(borrowers, cq)
+		}
+	}
+	sort.Slice(borrowers, func(i, j int) bool {
+		if bi, bj := borrowers[i].borrowed(fName, rName), borrowers[j].borrowed(fName, rName); bi != bj {
+			return bi > bj
+		}
+		return borrowers[i].Name < borrowers[j].Name
+	})
+	return borrowers
+}
+
+// NetPositions returns, per member name, flavor and resource, how much the
+// member borrows from the cohort, as a positive value, or lends to it, as a
+// negative value. What the borrowers take is attributed to the lenders in
+// proportion to their unused nominal quota, so the positions of a flavor and
+// resource add up to zero, up to rounding, as long as the lenders can cover
+// the borrowers.
+func (c *Cohort) NetPositions() map[string]FlavorResourceQuantities {
+	borrowed := make(FlavorResourceQuantities)
+	unused := make(FlavorResourceQuantities)
+	for cq := range c.Members {
+		cq.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+			if borrowed[fName] == nil {
+				borrowed[fName] = make(map[corev1.ResourceName]int64)
+				unused[fName] = make(map[corev1.ResourceName]int64)
+			}
+			borrowed[fName][rName] += cq.borrowed(fName, rName)
+			if u := cq.cohortNominal(fName, rName, rQuota) - cq.Usage[fName][rName]; u > 0 {
+				unused[fName][rName] += u
+			}
+		})
+	}
+	positions := make(map[string]FlavorResourceQuantities, len(c.Members))
+	for cq := range c.Members {
+		position := make(FlavorResourceQuantities)
+		cq.ForEachQuota(func(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, rQuota *ResourceQuota) {
+			if position[fName] == nil {
+				position[fName] = make(map[corev1.ResourceName]int64)
+			}
+			if b := cq.borrowed(fName, rName); b > 0 {
+				position[fName][rName] = b
+				return
+			}
+			totalUnused := unused[fName][rName]
+			u := cq.cohortNominal(fName, rName, rQuota) - cq.Usage[fName][rName]
+			if totalUnused == 0 || u <= 0 {
+				return
+			}
+			lent := int64(math.Round(float64(borrowed[fName][rName]) * float64(u) / float64(totalUnused)))
+			if lent > u {
+				lent = u
+			}
+			position[fName][rName] = -lent
+		})
+		positions[cq.Name] = position
+	}
+	return positions
+}
+
+// FairnessReport returns, per member name, the ratio of the member usage to
+// its fair share of the cohort usage, for the dominant flavor and resource.
+// The fair share of a member is weighted by its nominal quota, so values near
+// 1 mean that the member uses the cohort resources in proportion to what it
+// contributes. A member using a flavor and resource for which it has no
+// nominal quota has no fair share to compare with, so it's left out of the
+// report.
+func (c *Cohort) FairnessReport() map[string]float64 {
+	requestable := c.totalRequestable()
+	report := make(map[string]float64, len(c.Members))
+	for cq := range c.Members {
+		var dominant float64
+		noShare := false
+		for fName, rRequestable := range requestable {
+			for rName, total := range rRequestable {
+				used := cq.Usage[fName][rName]
+				if total == 0 || used == 0 {
+					continue
+				}
+				var nominal int64
+				if rQuota := cq.quotaFor(fName, rName); rQuota != nil {
+					nominal = rQuota.Nominal
+				}
+				if nominal == 0 {
+					noShare = true
+					continue
+				}
+				fairShare := float64(c.used(fName, rName)) * float64(nominal) / float64(total)
+				if ratio := float64(used) / fairShare; ratio > dominant {
+					dominant = ratio
+				}
+			}
+		}
+		if !noShare {
+			report[cq.Name] = dominant
+		}
+	}
+	return report
+}
+
+// LendingImbalance returns how lopsided the lending is in the cohort, as the
+// spread between the largest and the smallest net position of the members,
+// for the flavor and resource with the largest spread. The net position of a
+// member is its unused nominal quota, negative when borrowing, as a fraction
+// of the cohort requestable quota. The result is 0 when all the members have
+// the same net position and grows up to 2 as the lending concentrates.
+func (c *Cohort) LendingImbalance() float64 {
+	var imbalance float64
+	for fName, rRequestable := range c.totalRequestable() {
+		for rName, total := range rRequestable {
+			if total == 0 {
+				continue
+			}
+			first := true
+			var minPos, maxPos int64
+			for cq := range c.Members {
+				var nominal int64
+				if rQuota := cq.quotaFor(fName, rName); rQuota != nil {
+					nominal = rQuota.Nominal
+				}
+				pos := nominal - cq.Usage[fName][rName]
+				if first || pos < minPos {
+					minPos = pos
+				}
+				if first || pos > maxPos {
+					maxPos = pos
+				}
+				first = false
+			}
+			if spread := float64(maxPos-minPos) / float64(total); spread > imbalance {
+				imbalance = spread
+			}
+		}
+	}
+	return imbalance
+}
+
+// Bottleneck returns the flavor and resource with the highest ratio of usage
+// to requestable quota in the cohort, and the ratio. The flavors and resources
+// without requestable quota are ignored. Ties are broken by flavor name and
+// then by resource name. It returns empty names and 0 if no member has quota.
+func (c *Cohort) Bottleneck() (kueue.ResourceFlavorReference, corev1.ResourceName, float64) {
+	var bFlavor kueue.ResourceFlavorReference
+	var bResource corev1.ResourceName
+	var bRatio float64
+	found := false
+	for fName, rRequestable := range c.totalRequestable() {
+		for rName, total := range rRequestable {
+			if total == 0 {
+				continue
+			}
+			ratio := float64(c.used(fName, rName)) / float64(total)
+			if !found || ratio > bRatio || (ratio == bRatio && (fName < bFlavor || (fName == bFlavor && rName < bResource))) {
+				bFlavor, bResource, bRatio = fName, rName, ratio
+				found = true
+			}
+		}
+	}
+	return bFlavor, bResource, bRatio
+}
+
+// OverSubscription returns, per flavor and resource, how much the sum of the
+// members' nominal quota exceeds the capacity of the flavor. Only the flavors
+// and resources that are over-subscribed are included; those missing from the
+// capacity are ignored.
+func (c *Cohort) OverSubscription(flavorCapacity FlavorResourceQuantities) FlavorResourceQuantities {
+	over := make(FlavorResourceQuantities)
+	for fName, rRequestable := range c.totalRequestable() {
+		for rName, total := range rRequestable {
+			capacity, known := flavorCapacity[fName][rName]
+			if !known || total <= capacity {
+				continue
+			}
+			if over[fName] == nil {
+				over[fName] = make(map[corev1.ResourceName]int64)
+			}
+			over[fName][rName] = total - capacity
+		}
+	}
+	return over
+}
+
+// MissingFlavors returns, by member name, the flavors of the members that
+// aren't in the flavors map. The members without missing flavors are omitted.
+func (c *Cohort) MissingFlavors(flavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor) map[string][]kueue.ResourceFlavorReference {
+	missing := make(map[string][]kueue.ResourceFlavorReference)
+	for cq := range c.Members {
+		if cqMissing := cq.MissingFlavors(flavors); len(cqMissing) > 0 {
+			missing[cq.Name] = cqMissing
+		}
+	}
+	return missing
+}
+
+// CohortExport is a serializable view of a cohort, its members and their
+// usage.
+type CohortExport struct {
+	Name string `json:"name"`
+	// Members are sorted by name.
+	Members     []CohortMemberExport     `json:"members"`
+	Requestable FlavorResourceQuantities `json:"requestable"`
+	Usage       FlavorResourceQuantities `json:"usage"`
+}
+
+// CohortMemberExport is a serializable view of a member of a cohort.
+type CohortMemberExport struct {
+	Name  string                   `json:"name"`
+	Usage FlavorResourceQuantities `json:"usage"`
+}
+
+// Export returns a serializable view of the cohort, with the usage of each
+// member and the requestable quota and usage aggregated for the cohort.
+func (c *Cohort) Export() CohortExport {
+	export := CohortExport{
+		Name:        c.Name,
+		Members:     make([]CohortMemberExport, 0, len(c.Members)),
+		Requestable: c.totalRequestable(),
+		Usage:       make(FlavorResourceQuantities),
+	}
+	for cq := range c.Members {
+		export.Members = append(export.Members, CohortMemberExport{
+			Name:  cq.Name,
+			Usage: cq.Usage.clone(),
+		})
+		for fName, rUsage := range cq.Usage {
+			if export.Usage[fName] == nil {
+				export.Usage[fName] = make(map[corev1.ResourceName]int64, len(rUsage))
+			}
+			for rName, v := range rUsage {
+				export.Usage[fName][rName] += v
+			}
+		}
+	}
+	sort.Slice(export.Members, func(i, j int) bool {
+		return export.Members[i].Name < export.Members[j].Name
+	})
+	return export
+}
+
+// totalRequestable returns the sum of the nominal quotas of all the members,
+// per flavor and resource.
+func (c *Cohort) totalRequestable() FlavorResourceQuantities {
+	requestable := make(FlavorResourceQuantities)
+	for cq := range c.Members {
+		for _, rg := range cq.ResourceGroups {
+			for _, flvQuotas := range rg.Flavors {
+				res := requestable[flvQuotas.Name]
+				if res == nil {
+					res = make(map[corev1.ResourceName]int64, len(flvQuotas.Resources))
+					requestable[flvQuotas.Name] = res
+				}
+				for rName, rQuota := range flvQuotas.Resources {
+					res[rName] += cq.cohortNominal(flvQuotas.Name, rName, rQuota)
+				}
+			}
+		}
+	}
+	return requestable
+}
+
+// requestable returns the sum of the members' nominal quota for the flavor and
+// resource.
+func (c *Cohort) requestable(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	var total int64
+	for cq := range c.Members {
+		if rQuota := cq.quotaFor(fName, rName); rQuota != nil {
+			total += cq.scaleNominal(cq.cohortNominal(fName, rName, rQuota))
+		}
+	}
+	return total
+}
+
+// IdlePeersNominal returns the sum of the nominal quota for the flavor and
+// resource of the members, other than cq, that don't use it.
+func (c *Cohort) IdlePeersNominal(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, cq *ClusterQueue) int64 {
+	var total int64
+	for member := range c.Members {
+		if member == cq || member.Usage[fName][rName] > 0 {
+			continue
+		}
+		if rQuota := member.quotaFor(fName, rName); rQuota != nil {
+			total += member.scaleNominal(rQuota.Nominal)
+		}
+	}
+	return total
+}
+
+// used returns the sum of the members' usage for the flavor and resource.
+func (c *Cohort) used(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	var total int64
+	for cq := range c.Members {
+		total += cq.Usage[fName][rName]
+	}
+	return total
+}
+
+// Available returns the quota of the flavor and resource that isn't used by
+// any member of the cohort.
+func (c *Cohort) Available(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) int64 {
+	available := c.requestable(fName, rName) - c.used(fName, rName)
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// AvailableFor returns, per flavor and resource, the quota of the cohort that
+// isn't used by any member, excluding the unused nominal quota of requester,
+// which it can't borrow from itself. Like Available, it uses the
+// EffectiveNominal of the members.
+func (c *Cohort) AvailableFor(requester *ClusterQueue) FlavorResourceQuantities {
+	available := make(FlavorResourceQuantities)
+	for fName, rRequestable := range c.totalRequestable() {
+		available[fName] = make(map[corev1.ResourceName]int64, len(rRequestable))
+		for rName := range rRequestable {
+			v := c.Available(fName, rName)
+			if lendable := requester.EffectiveNominal(fName, rName) - requester.Usage[fName][rName]; lendable > 0 {
+				v -= lendable
+			}
+			if v < 0 {
+				v = 0
+			}
+			available[fName][rName] = v
+		}
+	}
+	return available
+}
+
+// Surplus returns, per flavor and resource, the quota of the cohort that isn't
+// used by any member, clamped at zero. Unlike AvailableFor, it doesn't exclude
+// the quota of any member, so it's the quota that a new member could borrow.
+func (c *Cohort) Surplus() FlavorResourceQuantities {
+	surplus := make(FlavorResourceQuantities)
+	for fName, rRequestable := range c.totalRequestable() {
+		surplus[fName] = make(map[corev1.ResourceName]int64, len(rRequestable))
+		for rName := range rRequestable {
+			surplus[fName][rName] = c.Available(fName, rName)
+		}
+	}
+	return surplus
+}
+
+// SetParent nests the cohort in parent, or makes it a root cohort if parent is
+// nil. It fails if the cohort would become its own ancestor.
+func (c *Cohort) SetParent(parent *Cohort) error {
+	for p := parent; p != nil; p = p.parent {
+		if p == c {
+			return errCohortCycle
+		}
+	}
+	c.parent = parent
+	return nil
+}
+
+// Parent returns the cohort that the cohort is nested in, or nil.
+func (c *Cohort) Parent() *Cohort {
+	return c.parent
+}
+
+// AvailableWithinDepth returns, per flavor and resource, the Surplus of the
+// cohort added to the Surplus of up to depth of its ancestors. Depth 0 is the
+// cohort alone.
+func (c *Cohort) AvailableWithinDepth(depth int) FlavorResourceQuantities {
+	available := c.Surplus()
+	for p, level := c.parent, 0; p != nil && level < depth; p, level = p.parent, level+1 {
+		for fName, rSurplus := range p.Surplus() {
+			if available[fName] == nil {
+				available[fName] = make(map[corev1.ResourceName]int64, len(rSurplus))
+			}
+			for rName, v := range rSurplus {
+				available[fName][rName] += v
+			}
+		}
+	}
+	return available
+}
+
+// FlavorExhausted returns whether no member of the cohort has quota left for
+// the flavor and resource.
+func (c *Cohort) FlavorExhausted(fName kueue.ResourceFlavorReference, rName corev1.ResourceName) bool {
+	return c.Available(fName, rName) == 0
+}
+
+// recomputeAggregates updates the values that depend on the members after the
+// membership changes.
+func (c *Cohort) recomputeAggregates() {
+	c.resolveBorrowingLimits()
+	// RequestableResources and Usage are only populated for a snapshot.
+	if c.RequestableResources == nil && c.Usage == nil {
+		return
+	}
+	c.RequestableResources = make(FlavorResourceQuantities)
+	c.Usage = make(FlavorResourceQuantities)
+	for cq := range c.Members {
+		cq.accumulateResources(c)
+	}
+}
+
+// resolveBorrowingLimits updates the borrowing limits of the members that are
+// expressed as a percentage of the cohort. It needs to be called every time
+// the members or their quotas change.
+func (c *Cohort) resolveBorrowingLimits() {
+	requestable := c.totalRequestable()
+	for cq := range c.Members {
+		cq.resolveBorrowingLimits(requestable)
+	}
+}
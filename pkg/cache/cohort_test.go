@@ -0,0 +1,1170 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	"sigs.k8s.io/kueue/pkg/util/pointer"
+	utiltesting "sigs.k8s.io/kueue/pkg/util/testing"
+	"sigs.k8s.io/kueue/pkg/workload"
+)
+
+func TestCohortBorrowingLimitPercent(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cqA := utiltesting.MakeClusterQueue("a").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Cohort("one").
+		Obj()
+	withPercent := cqA.DeepCopy()
+	withPercent.Annotations = map[string]string{
+		ResourceGroupSettingsAnnotation: `{"flavors":[{"name":"default","resources":[{"name":"cpu","borrowingLimitPercent":25}]}]}`,
+	}
+	cqB := utiltesting.MakeClusterQueue("b").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "30").Obj()).
+		Cohort("one").
+		Obj()
+	cqC := utiltesting.MakeClusterQueue("c").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "40").Obj()).
+		Cohort("one").
+		Obj()
+	for _, cq := range []*kueue.ClusterQueue{cqA, cqB} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+
+	borrowingLimit := func() *int64 {
+		return cache.clusterQueues["a"].ResourceGroups[0].Flavors[0].Resources[corev1.ResourceCPU].BorrowingLimit
+	}
+	if diff := cmp.Diff((*int64)(nil), borrowingLimit()); diff != "" {
+		t.Errorf("Unexpected borrowing limit without a percent (-want,+got):\n%s", diff)
+	}
+	if err := cache.UpdateClusterQueue(withPercent); err != nil {
+		t.Fatalf("Failed updating ClusterQueue: %v", err)
+	}
+	if diff := cmp.Diff(pointer.Int64(10_000), borrowingLimit()); diff != "" {
+		t.Errorf("Unexpected borrowing limit for 25%% of the cohort (-want,+got):\n%s", diff)
+	}
+
+	if err := cache.AddClusterQueue(ctx, cqC); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	if diff := cmp.Diff(pointer.Int64(20_000), borrowingLimit()); diff != "" {
+		t.Errorf("Unexpected borrowing limit after a ClusterQueue joined the cohort (-want,+got):\n%s", diff)
+	}
+
+	cache.DeleteClusterQueue(cqB)
+	if diff := cmp.Diff(pointer.Int64(12_500), borrowingLimit()); diff != "" {
+		t.Errorf("Unexpected borrowing limit after a ClusterQueue left the cohort (-want,+got):\n%s", diff)
+	}
+
+	mixed := withPercent.DeepCopy()
+	mixed.Spec.ResourceGroups[0].Flavors[0].Resources[0].BorrowingLimit = pointer.Quantity(resource.MustParse("5"))
+	if err := cache.UpdateClusterQueue(mixed); !errors.Is(err, errMixedBorrowingLimits) {
+		t.Errorf("Unexpected error mixing absolute and percent borrowing limits: %v", err)
+	}
+	if diff := cmp.Diff(pointer.Int64(12_500), borrowingLimit()); diff != "" {
+		t.Errorf("Unexpected borrowing limit after a rejected update (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortPreemptionCandidates(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithPreemptionProtectionWindow(30*time.Minute))
+	clusterQueue := func(name, nominal string) *kueue.ClusterQueue {
+		return utiltesting.MakeClusterQueue(name).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, nominal).Obj()).
+			Cohort("one").
+			Preemption(kueue.ClusterQueuePreemption{ReclaimWithinCohort: kueue.PreemptionPolicyAny}).
+			Obj()
+	}
+	for _, cq := range []*kueue.ClusterQueue{
+		clusterQueue("requester", "10"),
+		clusterQueue("borrower-b", "2"),
+		clusterQueue("borrower-c", "2"),
+		clusterQueue("lender", "10"),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("own", "").Priority(-10).
+			Admit(utiltesting.MakeAdmission("requester").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("borrower-b").Assignment(corev1.ResourceCPU, "default", "2").Obj()).
+			SetOrReplaceCondition(metav1.Condition{
+				Type:               kueue.WorkloadAdmitted,
+				Status:             metav1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour)),
+			}).Obj(),
+		utiltesting.MakeWorkload("b2", "").Priority(10).
+			Admit(utiltesting.MakeAdmission("borrower-b").Assignment(corev1.ResourceCPU, "default", "4").Obj()).Obj(),
+		utiltesting.MakeWorkload("c1", "").Priority(5).
+			Admit(utiltesting.MakeAdmission("borrower-c").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+		utiltesting.MakeWorkload("c2", "").
+			Admit(utiltesting.MakeAdmission("borrower-c").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+		utiltesting.MakeWorkload("l1", "").Priority(-10).
+			Admit(utiltesting.MakeAdmission("lender").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	requester := cache.clusterQueues["requester"]
+	later := time.Now().Add(time.Hour)
+	cases := map[string]struct {
+		needed         int64
+		now            time.Time
+		policy         kueue.PreemptionPolicy
+		priority       int32
+		wantCandidates []string
+	}{
+		"nothing needed": {
+			now: later,
+		},
+		"candidates from both borrowers": {
+			needed:         5_000,
+			now:            later,
+			wantCandidates: []string{"/c2", "/b1", "/c1"},
+		},
+		"no more than what the members borrow": {
+			needed:         100_000,
+			now:            later,
+			wantCandidates: []string{"/c2", "/b1", "/c1", "/b2"},
+		},
+		"recently admitted workloads are protected": {
+			needed:         5_000,
+			now:            time.Now(),
+			wantCandidates: []string{"/b1"},
+		},
+		"only lower priority workloads with LowerPriority": {
+			needed:         100_000,
+			now:            later,
+			policy:         kueue.PreemptionPolicyLowerPriority,
+			priority:       5,
+			wantCandidates: []string{"/c2", "/b1"},
+		},
+		"nothing with Never": {
+			needed: 100_000,
+			now:    later,
+			policy: kueue.PreemptionPolicyNever,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			policy := kueue.PreemptionPolicyAny
+			if tc.policy != "" {
+				policy = tc.policy
+			}
+			requester.Preemption.ReclaimWithinCohort = policy
+			preemptor := utiltesting.MakeWorkload("preemptor", "").Priority(tc.priority).Obj()
+			var got []string
+			for _, wi := range requester.Cohort.PreemptionCandidates(preemptor, "default", corev1.ResourceCPU, tc.needed, requester, tc.now) {
+				got = append(got, workload.Key(wi.Obj))
+			}
+			if diff := cmp.Diff(tc.wantCandidates, got); diff != "" {
+				t.Errorf("Unexpected candidates (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCohortPreemptionCandidatesPriorityThreshold(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("requester").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "4").Obj()).
+			Cohort("one").
+			Preemption(kueue.ClusterQueuePreemption{ReclaimWithinCohort: kueue.PreemptionPolicyAny}).
+			Obj(),
+		utiltesting.MakeClusterQueue("borrower").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "1").Obj()).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("gpu-high", "").Priority(2000).
+			Admit(utiltesting.MakeAdmission("borrower").
+				Assignment(corev1.ResourceCPU, "default", "2").
+				Assignment("example.com/gpu", "a100", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("cpu-low", "").
+			Admit(utiltesting.MakeAdmission("borrower").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	borrower := cache.clusterQueues["borrower"]
+	borrower.RGByResource["example.com/gpu"].PreemptionPriorityThreshold = pointer.Int32(1000)
+
+	requester := cache.clusterQueues["requester"]
+	preemptor := utiltesting.MakeWorkload("preemptor", "").Obj()
+	var got []string
+	for _, wi := range requester.Cohort.PreemptionCandidates(preemptor, "default", corev1.ResourceCPU, 4_000, requester, time.Now()) {
+		got = append(got, workload.Key(wi.Obj))
+	}
+	if diff := cmp.Diff([]string{"/cpu-low"}, got); diff != "" {
+		t.Errorf("Unexpected candidates (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortPreemptionCandidatesSafetyMargin(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithSafetyMargin(0.5))
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("requester").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Preemption(kueue.ClusterQueuePreemption{ReclaimWithinCohort: kueue.PreemptionPolicyAny}).
+			Obj(),
+		utiltesting.MakeClusterQueue("borrower").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "3").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("borrower").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+		utiltesting.MakeWorkload("b2", "").Priority(1).
+			Admit(utiltesting.MakeAdmission("borrower").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	// Each workload accounts for 3 CPUs with the margin, the borrower only
+	// borrows 3.
+	requester := cache.clusterQueues["requester"]
+	preemptor := utiltesting.MakeWorkload("preemptor", "").Obj()
+	var got []string
+	for _, wi := range requester.Cohort.PreemptionCandidates(preemptor, "default", corev1.ResourceCPU, 100_000, requester, time.Now()) {
+		got = append(got, workload.Key(wi.Obj))
+	}
+	if diff := cmp.Diff([]string{"/b1"}, got); diff != "" {
+		t.Errorf("Unexpected candidates (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortReclaimCost(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient(), WithPreemptionProtectionWindow(30*time.Minute))
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("borrower-b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("borrower-c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("lender").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "20").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("borrower-b").Assignment(corev1.ResourceCPU, "default", "4").Obj()).Obj(),
+		utiltesting.MakeWorkload("b2", "").
+			Admit(utiltesting.MakeAdmission("borrower-b").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+		utiltesting.MakeWorkload("c1", "").
+			Admit(utiltesting.MakeAdmission("borrower-c").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+		utiltesting.MakeWorkload("l1", "").
+			Admit(utiltesting.MakeAdmission("lender").Assignment(corev1.ResourceCPU, "default", "5").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	later := time.Now().Add(time.Hour)
+	cases := map[string]struct {
+		needed      int64
+		now         time.Time
+		wantVictims int
+		wantFreed   int64
+	}{
+		"nothing needed": {
+			now: later,
+		},
+		"one victim": {
+			needed:      3_000,
+			now:         later,
+			wantVictims: 1,
+			wantFreed:   4_000,
+		},
+		"multiple victims": {
+			needed:      6_000,
+			now:         later,
+			wantVictims: 2,
+			wantFreed:   7_000,
+		},
+		"no more than what the members borrow": {
+			needed:      100_000,
+			now:         later,
+			wantVictims: 2,
+			wantFreed:   7_000,
+		},
+		"recently admitted workloads are protected": {
+			needed: 3_000,
+			now:    time.Now(),
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			victims, freed := cache.cohorts["one"].ReclaimCost("default", corev1.ResourceCPU, tc.needed, tc.now)
+			if victims != tc.wantVictims || freed != tc.wantFreed {
+				t.Errorf("ReclaimCost() = (%d, %d), want (%d, %d)", victims, freed, tc.wantVictims, tc.wantFreed)
+			}
+		})
+	}
+}
+
+func TestCohortBorrowersOf(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, name := range []string{"a", "b", "c"} {
+		cq := utiltesting.MakeClusterQueue(name).
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "4").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "4").Obj(),
+			).
+			Cohort("one").
+			Obj()
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "on-demand", "5").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "on-demand", "7").Obj()).Obj(),
+		utiltesting.MakeWorkload("c1", "").
+			Admit(utiltesting.MakeAdmission("c").Assignment(corev1.ResourceCPU, "spot", "6").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	var got []string
+	for _, cq := range cache.cohorts["one"].BorrowersOf("on-demand", corev1.ResourceCPU) {
+		got = append(got, cq.Name)
+	}
+	if diff := cmp.Diff([]string{"b", "a"}, got); diff != "" {
+		t.Errorf("Unexpected borrowers (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortFlavorExhausted(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "4").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "4").Obj(),
+			).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "2").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "2").Obj(),
+			).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "on-demand", "5").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "on-demand", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("b2", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	cohort := cache.cohorts["one"]
+	if !cohort.FlavorExhausted("on-demand", corev1.ResourceCPU) {
+		t.Errorf("Flavor on-demand isn't exhausted, available %d", cohort.Available("on-demand", corev1.ResourceCPU))
+	}
+	if cohort.FlavorExhausted("spot", corev1.ResourceCPU) {
+		t.Errorf("Flavor spot is exhausted")
+	}
+	if got := cohort.Available("spot", corev1.ResourceCPU); got != 5_000 {
+		t.Errorf("Unexpected available quota for spot: %d, want 5000", got)
+	}
+}
+
+func TestCohortFairnessReport(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("over").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "5").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("under").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "5").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("idle").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("no-quota").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "0").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("over", "").
+			Admit(utiltesting.MakeAdmission("over").Assignment(corev1.ResourceCPU, "default", "6").Obj()).Obj(),
+		utiltesting.MakeWorkload("under", "").
+			Admit(utiltesting.MakeAdmission("under").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("no-quota", "").
+			Admit(utiltesting.MakeAdmission("no-quota").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	// The cohort uses 8 of 20 cpus, so the fair share of "over" and "under"
+	// is 2 cpus each.
+	want := map[string]float64{
+		"over":  3,
+		"under": 0.5,
+		"idle":  0,
+	}
+	if diff := cmp.Diff(want, cache.cohorts["one"].FairnessReport(), cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+		t.Errorf("Unexpected fairness report (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortLendingImbalance(t *testing.T) {
+	cases := map[string]struct {
+		usage map[string]string
+		want  float64
+	}{
+		"balanced": {
+			usage: map[string]string{"a": "5", "b": "5"},
+			want:  0,
+		},
+		"lopsided": {
+			usage: map[string]string{"a": "18"},
+			want:  0.9,
+		},
+		"idle": {
+			want: 0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := New(utiltesting.NewFakeClient())
+			for _, cqName := range []string{"a", "b"} {
+				cq := utiltesting.MakeClusterQueue(cqName).
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+					Cohort("one").
+					Obj()
+				if err := cache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+				}
+			}
+			for cqName, cpu := range tc.usage {
+				wl := utiltesting.MakeWorkload(cqName, "").
+					Admit(utiltesting.MakeAdmission(cqName).Assignment(corev1.ResourceCPU, "default", cpu).Obj()).
+					Obj()
+				if !cache.AddOrUpdateWorkload(wl) {
+					t.Fatalf("Failed adding workload %q", wl.Name)
+				}
+			}
+			got := cache.cohorts["one"].LendingImbalance()
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+				t.Errorf("Unexpected lending imbalance (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCohortOverSubscription(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "6").
+				Resource(corev1.ResourceMemory, "6Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "6").
+				Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+
+	cases := map[string]struct {
+		capacity FlavorResourceQuantities
+		want     FlavorResourceQuantities
+	}{
+		"balanced": {
+			capacity: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 12_000, corev1.ResourceMemory: 16 * utiltesting.Gi},
+			},
+			want: FlavorResourceQuantities{},
+		},
+		"oversubscribed": {
+			capacity: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 10_000, corev1.ResourceMemory: 16 * utiltesting.Gi},
+			},
+			want: FlavorResourceQuantities{
+				"default": {corev1.ResourceCPU: 2_000},
+			},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := cache.cohorts["one"].OverSubscription(tc.capacity)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Unexpected over-subscription (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCohortAvailableFor(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "6").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "5").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	cohort := cache.cohorts["one"]
+	if got := cohort.Available("default", corev1.ResourceCPU); got != 5_000 {
+		t.Fatalf("Unexpected available quota in the cohort: %d, want 5000", got)
+	}
+	cases := map[string]int64{
+		// a doesn't count the 4 cpus that it isn't using.
+		"a": 1_000,
+		// b is borrowing, so it has nothing to lend.
+		"b": 5_000,
+		"c": 3_000,
+	}
+	for cqName, want := range cases {
+		t.Run(cqName, func(t *testing.T) {
+			got := cohort.AvailableFor(cache.clusterQueues[cqName])
+			if diff := cmp.Diff(FlavorResourceQuantities{"default": {corev1.ResourceCPU: want}}, got); diff != "" {
+				t.Errorf("Unexpected available quota (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCohortAvailableForEffectiveNominal(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "6").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	wl := utiltesting.MakeWorkload("a1", "").
+		Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj()
+	if !cache.AddOrUpdateWorkload(wl) {
+		t.Fatalf("Failed adding workload %q", wl.Name)
+	}
+	// The full pressure halves the nominal quota of a to 3 CPUs.
+	a := cache.clusterQueues["a"]
+	a.PressureProvider = func() float64 { return 1 }
+	a.SamplePressure()
+	if got := a.EffectiveNominal("default", corev1.ResourceCPU); got != 3_000 {
+		t.Fatalf("Unexpected effective nominal quota: %d, want 3000", got)
+	}
+
+	cohort := cache.cohorts["one"]
+	cases := map[string]int64{
+		// a only has 1 CPU left of its effective nominal quota to exclude.
+		"a": 4_000,
+		"b": 1_000,
+	}
+	for cqName, want := range cases {
+		t.Run(cqName, func(t *testing.T) {
+			got := cohort.AvailableFor(cache.clusterQueues[cqName])
+			if diff := cmp.Diff(FlavorResourceQuantities{"default": {corev1.ResourceCPU: want}}, got); diff != "" {
+				t.Errorf("Unexpected available quota (-want,+got):\n%s", diff)
+			}
+		})
+	}
+	if got, want := a.MinHeadroomRatio(), 1.0/3; math.Abs(got-want) > 1e-9 {
+		t.Errorf("Unexpected MinHeadroomRatio: %v, want %v", got, want)
+	}
+	if diff := cmp.Diff(FlavorResourceQuantities{"default": {corev1.ResourceCPU: 3_000}}, a.NominalToEliminateBorrowing()); diff != "" {
+		t.Errorf("Unexpected nominal quota to eliminate borrowing (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortSurplus(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").
+					Resource(corev1.ResourceCPU, "6").
+					Resource(corev1.ResourceMemory, "8Gi").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").
+					Resource(corev1.ResourceCPU, "2").
+					Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").
+					Resource(corev1.ResourceCPU, "4").
+					Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "on-demand", "3").
+				Assignment(corev1.ResourceMemory, "on-demand", "2Gi").Obj()).Obj(),
+		utiltesting.MakeWorkload("a2", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "spot", "2").
+				Assignment(corev1.ResourceMemory, "spot", "2Gi").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").
+				Assignment(corev1.ResourceCPU, "on-demand", "5").
+				Assignment(corev1.ResourceMemory, "on-demand", "1Gi").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	want := FlavorResourceQuantities{
+		"on-demand": {corev1.ResourceCPU: 2_000, corev1.ResourceMemory: 9 * utiltesting.Gi},
+		"spot":      {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+	}
+	if diff := cmp.Diff(want, cache.cohorts["one"].Surplus()); diff != "" {
+		t.Errorf("Unexpected surplus (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortAvailableWithinDepth(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("child").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+			Cohort("parent").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "5").Obj()).
+			Cohort("root").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "3").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	child, parent, root := cache.cohorts["child"], cache.cohorts["parent"], cache.cohorts["root"]
+	if err := child.SetParent(parent); err != nil {
+		t.Fatalf("Failed setting the parent of the child cohort: %v", err)
+	}
+	if err := parent.SetParent(root); err != nil {
+		t.Fatalf("Failed setting the parent of the parent cohort: %v", err)
+	}
+	if err := root.SetParent(child); !errors.Is(err, errCohortCycle) {
+		t.Errorf("Unexpected error nesting the root cohort in its descendant: %v, want %v", err, errCohortCycle)
+	}
+
+	cases := map[string]struct {
+		depth int
+		want  int64
+	}{
+		"depth 0": {
+			depth: 0,
+			want:  1_000,
+		},
+		"depth 1": {
+			depth: 1,
+			want:  9_000,
+		},
+		"depth beyond the root": {
+			depth: 5,
+			want:  14_000,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := child.AvailableWithinDepth(tc.depth)
+			if diff := cmp.Diff(FlavorResourceQuantities{"default": {corev1.ResourceCPU: tc.want}}, got); diff != "" {
+				t.Errorf("Unexpected available quota (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCohortBottleneck(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").
+					Resource(corev1.ResourceCPU, "4").
+					Resource(corev1.ResourceMemory, "4Gi").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").
+					Resource(corev1.ResourceCPU, "4").
+					Resource(corev1.ResourceMemory, "4Gi").Obj(),
+			).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("on-demand").
+					Resource(corev1.ResourceCPU, "4").
+					Resource(corev1.ResourceMemory, "4Gi").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").
+					Resource(corev1.ResourceCPU, "0").
+					Resource(corev1.ResourceMemory, "0").Obj(),
+			).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	cohort := cache.cohorts["one"]
+	if f, r, ratio := cohort.Bottleneck(); ratio != 0 || f != "on-demand" || r != corev1.ResourceCPU {
+		t.Errorf("Unexpected bottleneck without usage: %s, %s, %v", f, r, ratio)
+	}
+
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "on-demand", "2").
+				Assignment(corev1.ResourceMemory, "on-demand", "2Gi").
+				Obj()).Obj(),
+		utiltesting.MakeWorkload("a2", "").
+			Admit(utiltesting.MakeAdmission("a").
+				Assignment(corev1.ResourceCPU, "spot", "1").
+				Assignment(corev1.ResourceMemory, "spot", "3Gi").
+				Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	f, r, ratio := cohort.Bottleneck()
+	if f != "spot" || r != corev1.ResourceMemory || ratio != 0.75 {
+		t.Errorf("Bottleneck() = %s, %s, %v, want spot, memory, 0.75", f, r, ratio)
+	}
+}
+
+func TestCohortExport(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "2").
+				Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "4").
+				Resource(corev1.ResourceMemory, "4Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	if !cache.AddOrUpdateWorkload(utiltesting.MakeWorkload("a1", "").
+		Admit(utiltesting.MakeAdmission("a").
+			Assignment(corev1.ResourceCPU, "default", "3").
+			Assignment(corev1.ResourceMemory, "default", "1Gi").
+			Obj()).
+		Obj()) {
+		t.Fatalf("Failed adding workload")
+	}
+
+	want := CohortExport{
+		Name: "one",
+		Members: []CohortMemberExport{
+			{
+				Name: "a",
+				Usage: FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 3_000, corev1.ResourceMemory: utiltesting.Gi},
+				},
+			},
+			{
+				Name: "b",
+				Usage: FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 0, corev1.ResourceMemory: 0},
+				},
+			},
+		},
+		Requestable: FlavorResourceQuantities{
+			"default": {corev1.ResourceCPU: 6_000, corev1.ResourceMemory: 6 * utiltesting.Gi},
+		},
+		Usage: FlavorResourceQuantities{
+			"default": {corev1.ResourceCPU: 3_000, corev1.ResourceMemory: utiltesting.Gi},
+		},
+	}
+	if diff := cmp.Diff(want, cache.cohorts["one"].Export()); diff != "" {
+		t.Errorf("Unexpected export (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortMissingFlavors(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(
+				*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj(),
+				*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "2").Obj(),
+			).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	flavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"default": utiltesting.MakeResourceFlavor("default").Obj(),
+	}
+	want := map[string][]kueue.ResourceFlavorReference{
+		"a": {"spot"},
+		"b": {"a100"},
+	}
+	if diff := cmp.Diff(want, cache.cohorts["one"].MissingFlavors(flavors)); diff != "" {
+		t.Errorf("Unexpected missing flavors (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortTerminatingLendingPolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy          TerminatingLendingPolicy
+		wantAvailable   int64
+		wantRequestable int64
+	}{
+		"default keeps lending": {
+			wantAvailable:   12_000,
+			wantRequestable: 15_000,
+		},
+		"keep lending": {
+			policy:          TerminatingKeepLending,
+			wantAvailable:   12_000,
+			wantRequestable: 15_000,
+		},
+		"stop lending": {
+			policy:          TerminatingStopLending,
+			wantAvailable:   5_000,
+			wantRequestable: 8_000,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := New(utiltesting.NewFakeClient(), WithTerminatingLendingPolicy(tc.policy))
+			for _, cq := range []*kueue.ClusterQueue{
+				utiltesting.MakeClusterQueue("terminating").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+					Cohort("one").
+					Obj(),
+				utiltesting.MakeClusterQueue("active").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "5").Obj()).
+					Cohort("one").
+					Obj(),
+			} {
+				if err := cache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+				}
+			}
+			if !cache.AddOrUpdateWorkload(utiltesting.MakeWorkload("draining", "").
+				Admit(utiltesting.MakeAdmission("terminating").Assignment(corev1.ResourceCPU, "default", "3").Obj()).
+				Obj()) {
+				t.Fatalf("Failed adding workload")
+			}
+			cohort := cache.cohorts["one"]
+			if got := cohort.Available("default", corev1.ResourceCPU); got != 15_000-3_000 {
+				t.Errorf("Unexpected available quota before terminating: %d, want 12000", got)
+			}
+
+			cache.TerminateClusterQueue("terminating")
+			if got := cohort.Available("default", corev1.ResourceCPU); got != tc.wantAvailable {
+				t.Errorf("Unexpected available quota: %d, want %d", got, tc.wantAvailable)
+			}
+			if got := cohort.totalRequestable()["default"][corev1.ResourceCPU]; got != tc.wantRequestable {
+				t.Errorf("Unexpected requestable quota: %d, want %d", got, tc.wantRequestable)
+			}
+		})
+	}
+}
+
+func TestClusterQueueMoveToCohort(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	cache.AddOrUpdateResourceFlavor(utiltesting.MakeResourceFlavor("default").Obj())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("c").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "6").Obj()).
+			Cohort("two").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("a1", "").
+			Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("b").Assignment(corev1.ResourceCPU, "default", "2").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+	snapshot := cache.Snapshot()
+	a, b, c := snapshot.ClusterQueues["a"], snapshot.ClusterQueues["b"], snapshot.ClusterQueues["c"]
+	one, two := a.Cohort, c.Cohort
+	type aggregates struct {
+		Requestable FlavorResourceQuantities
+		Usage       FlavorResourceQuantities
+		Available   int64
+	}
+	cohortAggregates := func(cohort *Cohort) aggregates {
+		return aggregates{
+			Requestable: cohort.RequestableResources,
+			Usage:       cohort.Usage,
+			Available:   cohort.Available("default", corev1.ResourceCPU),
+		}
+	}
+
+	b.MoveToCohort(two)
+	if b.Cohort != two {
+		t.Errorf("The ClusterQueue isn't in the new cohort")
+	}
+	wantOne := aggregates{
+		Requestable: FlavorResourceQuantities{"default": {corev1.ResourceCPU: 4_000}},
+		Usage:       FlavorResourceQuantities{"default": {corev1.ResourceCPU: 1_000}},
+		Available:   3_000,
+	}
+	if diff := cmp.Diff(wantOne, cohortAggregates(one)); diff != "" {
+		t.Errorf("Unexpected aggregates of the old cohort (-want,+got):\n%s", diff)
+	}
+	wantTwo := aggregates{
+		Requestable: FlavorResourceQuantities{"default": {corev1.ResourceCPU: 8_000}},
+		Usage:       FlavorResourceQuantities{"default": {corev1.ResourceCPU: 2_000}},
+		Available:   6_000,
+	}
+	if diff := cmp.Diff(wantTwo, cohortAggregates(two)); diff != "" {
+		t.Errorf("Unexpected aggregates of the new cohort (-want,+got):\n%s", diff)
+	}
+
+	a.MoveToCohort(nil)
+	if a.Cohort != nil || one.Members.Len() != 0 {
+		t.Errorf("The ClusterQueue didn't leave the cohort")
+	}
+	a.MoveToCohort(two)
+	wantTwo = aggregates{
+		Requestable: FlavorResourceQuantities{"default": {corev1.ResourceCPU: 12_000}},
+		Usage:       FlavorResourceQuantities{"default": {corev1.ResourceCPU: 3_000}},
+		Available:   9_000,
+	}
+	if diff := cmp.Diff(wantTwo, cohortAggregates(two)); diff != "" {
+		t.Errorf("Unexpected aggregates after joining a cohort (-want,+got):\n%s", diff)
+	}
+}
+
+func TestCohortNetPositions(t *testing.T) {
+	ctx := context.Background()
+	cache := New(utiltesting.NewFakeClient())
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("borrower").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "2").
+				Resource(corev1.ResourceMemory, "2Gi").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("lender").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").
+				Resource(corev1.ResourceCPU, "6").
+				Resource(corev1.ResourceMemory, "6Gi").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	for _, wl := range []*kueue.Workload{
+		utiltesting.MakeWorkload("b1", "").
+			Admit(utiltesting.MakeAdmission("borrower").
+				Assignment(corev1.ResourceCPU, "default", "5").
+				Assignment(corev1.ResourceMemory, "default", "1Gi").Obj()).Obj(),
+		utiltesting.MakeWorkload("l1", "").
+			Admit(utiltesting.MakeAdmission("lender").Assignment(corev1.ResourceCPU, "default", "1").Obj()).Obj(),
+	} {
+		if !cache.AddOrUpdateWorkload(wl) {
+			t.Fatalf("Failed adding workload %q", wl.Name)
+		}
+	}
+
+	got := cache.cohorts["one"].NetPositions()
+	want := map[string]FlavorResourceQuantities{
+		"borrower": {"default": {corev1.ResourceCPU: 3_000, corev1.ResourceMemory: 0}},
+		"lender":   {"default": {corev1.ResourceCPU: -3_000, corev1.ResourceMemory: 0}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Unexpected net positions (-want,+got):\n%s", diff)
+	}
+	if sum := got["borrower"]["default"][corev1.ResourceCPU] + got["lender"]["default"][corev1.ResourceCPU]; sum != 0 {
+		t.Errorf("The net positions for cpu add up to %d, want 0", sum)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
+	"sigs.k8s.io/kueue/pkg/util/maps"
 	"sigs.k8s.io/kueue/pkg/workload"
 )
 
@@ -35,9 +36,10 @@ type Snapshot struct {
 func (s *Snapshot) RemoveWorkload(wl *workload.Info) {
 	cq := s.ClusterQueues[wl.ClusterQueue]
 	delete(cq.Workloads, workload.Key(wl.Obj))
-	updateUsage(wl, cq.Usage, -1)
+	updateUsage(wl, cq.Usage, -1, cq.SafetyMargin)
+	cq.updateFlavorWorkloads(wl, -1)
 	if cq.Cohort != nil {
-		updateUsage(wl, cq.Cohort.Usage, -1)
+		updateUsage(wl, cq.Cohort.Usage, -1, cq.SafetyMargin)
 	}
 }
 
@@ -46,9 +48,11 @@ func (s *Snapshot) RemoveWorkload(wl *workload.Info) {
 func (s *Snapshot) AddWorkload(wl *workload.Info) {
 	cq := s.ClusterQueues[wl.ClusterQueue]
 	cq.Workloads[workload.Key(wl.Obj)] = wl
-	updateUsage(wl, cq.Usage, 1)
+	delete(cq.pendingReservations, workload.Key(wl.Obj))
+	updateUsage(wl, cq.Usage, 1, cq.SafetyMargin)
+	cq.updateFlavorWorkloads(wl, 1)
 	if cq.Cohort != nil {
-		updateUsage(wl, cq.Cohort.Usage, 1)
+		updateUsage(wl, cq.Cohort.Usage, 1, cq.SafetyMargin)
 	}
 }
 
@@ -72,8 +76,10 @@ func (c *Cache) Snapshot() Snapshot {
 		// Shallow copy is enough
 		snap.ResourceFlavors[name] = rf
 	}
+	cohortCopies := make(map[*Cohort]*Cohort, len(c.cohorts))
 	for _, cohort := range c.cohorts {
 		cohortCopy := newCohort(cohort.Name, cohort.Members.Len())
+		cohortCopies[cohort] = cohortCopy
 		for cq := range cohort.Members {
 			if cq.Active() {
 				cqCopy := snap.ClusterQueues[cq.Name]
@@ -83,6 +89,9 @@ func (c *Cache) Snapshot() Snapshot {
 			}
 		}
 	}
+	for cohort, cohortCopy := range cohortCopies {
+		cohortCopy.parent = cohortCopies[cohort.parent]
+	}
 	return snap
 }
 
@@ -93,19 +102,43 @@ func (c *ClusterQueue) snapshot() *ClusterQueue {
 		Name:              c.Name,
 		ResourceGroups:    c.ResourceGroups, // Shallow copy is enough.
 		RGByResource:      c.RGByResource,   // Shallow copy is enough.
-		Usage:             make(FlavorResourceQuantities, len(c.Usage)),
+		Usage:             c.Usage.clone(),
 		Workloads:         make(map[string]*workload.Info, len(c.Workloads)),
 		Preemption:        c.Preemption,
 		NamespaceSelector: c.NamespaceSelector,
 		Status:            c.Status,
+		labels:            c.labels, // Shallow copy is enough.
+		generation:        c.generation,
+		idleSince:         c.idleSince,
+		warmingUp:         c.warmingUp,
+		decayedUsage:      c.decayedUsage.clone(),
+		decayedAt:         c.decayedAt,
+		flavorWorkloads:   maps.Clone(c.flavorWorkloads),
+
+		PreemptionProtectionWindow: c.PreemptionProtectionWindow,
+		UsageRounding:              c.UsageRounding,
+		SafetyMargin:               c.SafetyMargin,
+		UsageDecayHalfLife:         c.UsageDecayHalfLife,
+		DefaultRequests:            c.DefaultRequests, // Shallow copy is enough.
+		FlavorAssigner:             c.FlavorAssigner,
+		FlavorOverride:             c.FlavorOverride,
+		AdmissionGates:             c.AdmissionGates,
+		ResourceAliases:            c.ResourceAliases, // Shallow copy is enough.
+		AdmissionCostWeights:       c.AdmissionCostWeights,
+		BorrowingPolicy:            c.BorrowingPolicy,
+		BorrowVsPreemptPolicy:      c.BorrowVsPreemptPolicy,
+		FlavorUnavailablePolicy:    c.FlavorUnavailablePolicy,
+		PressureProvider:           c.PressureProvider,
+		PressureCurve:              c.PressureCurve,
+		RampUp:                     c.RampUp,
+		UsageEpsilon:               c.UsageEpsilon,
+		DefaultBorrowingLimit:      c.DefaultBorrowingLimit,
+		SystemWorkloadLabel:        c.SystemWorkloadLabel,
+		SystemReservation:          c.SystemReservation, // Shallow copy is enough.
+		SystemUsage:                c.SystemUsage.clone(),
+		pendingReservations:        maps.Clone(c.pendingReservations),
 	}
-	for fName, rUsage := range c.Usage {
-		rUsageCopy := make(map[corev1.ResourceName]int64, len(rUsage))
-		for k, v := range rUsage {
-			rUsageCopy[k] = v
-		}
-		cc.Usage[fName] = rUsageCopy
-	}
+	cc.SamplePressure()
 	for k, v := range c.Workloads {
 		// Shallow copy is enough.
 		cc.Workloads[k] = v
@@ -125,7 +158,7 @@ func (c *ClusterQueue) accumulateResources(cohort *Cohort) {
 				cohort.RequestableResources[flvQuotas.Name] = res
 			}
 			for rName, rQuota := range flvQuotas.Resources {
-				res[rName] += rQuota.Nominal
+				res[rName] += c.scaleNominal(rQuota.Nominal)
 			}
 		}
 	}
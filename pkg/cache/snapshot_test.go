@@ -37,6 +37,7 @@ var snapCmpOpts = []cmp.Option{
 	cmpopts.IgnoreUnexported(ClusterQueue{}),
 	cmpopts.IgnoreFields(ClusterQueue{}, "RGByResource"),
 	cmpopts.IgnoreFields(Cohort{}, "Members"), // avoid recursion.
+	cmp.AllowUnexported(Cohort{}),
 	cmpopts.IgnoreFields(metav1.Condition{}, "LastTransitionTime"),
 }
 
@@ -228,13 +229,13 @@ func TestSnapshot(t *testing.T) {
 										{
 											Name: "demand",
 											Resources: map[corev1.ResourceName]*ResourceQuota{
-												corev1.ResourceCPU: {Nominal: 100_000},
+												corev1.ResourceCPU: {Nominal: 100_000, ConfiguredNominal: 100_000},
 											},
 										},
 										{
 											Name: "spot",
 											Resources: map[corev1.ResourceName]*ResourceQuota{
-												corev1.ResourceCPU: {Nominal: 200_000},
+												corev1.ResourceCPU: {Nominal: 200_000, ConfiguredNominal: 200_000},
 											},
 										},
 									},
@@ -268,7 +269,7 @@ func TestSnapshot(t *testing.T) {
 									Flavors: []FlavorQuotas{{
 										Name: "spot",
 										Resources: map[corev1.ResourceName]*ResourceQuota{
-											corev1.ResourceCPU: {Nominal: 100_000},
+											corev1.ResourceCPU: {Nominal: 100_000, ConfiguredNominal: 100_000},
 										},
 									}},
 									LabelKeys: sets.New("instance"),
@@ -278,7 +279,7 @@ func TestSnapshot(t *testing.T) {
 									Flavors: []FlavorQuotas{{
 										Name: "default",
 										Resources: map[corev1.ResourceName]*ResourceQuota{
-											"example.com/gpu": {Nominal: 50},
+											"example.com/gpu": {Nominal: 50, ConfiguredNominal: 50},
 										},
 									}},
 								},
@@ -328,7 +329,7 @@ func TestSnapshot(t *testing.T) {
 									Flavors: []FlavorQuotas{{
 										Name: "default",
 										Resources: map[corev1.ResourceName]*ResourceQuota{
-											corev1.ResourceCPU: {Nominal: 100_000},
+											corev1.ResourceCPU: {Nominal: 100_000, ConfiguredNominal: 100_000},
 										},
 									}},
 								},
@@ -18,6 +18,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -27,12 +28,14 @@ import (
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	kueue "sigs.k8s.io/kueue/apis/kueue/v1beta1"
 	"sigs.k8s.io/kueue/pkg/cache"
@@ -48,6 +51,10 @@ const (
 	pending  = "pending"
 	admitted = "admitted"
 	finished = "finished"
+
+	// warmupCheckPeriod is the period at which warmUpCache checks whether
+	// the cache accounts all the admitted workloads.
+	warmupCheckPeriod = time.Second
 )
 
 var (
@@ -229,7 +236,9 @@ func (r *WorkloadReconciler) Delete(e event.DeleteEvent) bool {
 			// Delete the workload from cache while holding the queues lock
 			// to guarantee that requeueued workloads are taken into account before
 			// the next scheduling cycle.
-			if err := r.cache.DeleteWorkload(wl); err != nil {
+			if err := r.cache.DeleteWorkload(wl); errors.Is(err, cache.ErrClusterQueueFrozen) {
+				log.V(2).Info("ClusterQueue is frozen; deferred the deletion of the workload from cache")
+			} else if err != nil {
 				if !e.DeleteStateUnknown {
 					log.Error(err, "Failed to delete workload from cache")
 				}
@@ -288,7 +297,9 @@ func (r *WorkloadReconciler) Update(e event.UpdateEvent) bool {
 			// Delete the workload from cache while holding the queues lock
 			// to guarantee that requeueued workloads are taken into account before
 			// the next scheduling cycle.
-			if err := r.cache.DeleteWorkload(oldWl); err != nil && prevStatus == admitted {
+			if err := r.cache.DeleteWorkload(oldWl); errors.Is(err, cache.ErrClusterQueueFrozen) {
+				log.V(2).Info("ClusterQueue is frozen; deferred the deletion of the workload from cache")
+			} else if err != nil && prevStatus == admitted {
 				log.Error(err, "Failed to delete workload from cache")
 			}
 		})
@@ -309,7 +320,9 @@ func (r *WorkloadReconciler) Update(e event.UpdateEvent) bool {
 			// Delete the workload from cache while holding the queues lock
 			// to guarantee that requeueued workloads are taken into account before
 			// the next scheduling cycle.
-			if err := r.cache.DeleteWorkload(wl); err != nil {
+			if err := r.cache.DeleteWorkload(wl); errors.Is(err, cache.ErrClusterQueueFrozen) {
+				log.V(2).Info("ClusterQueue is frozen; deferred the deletion of the workload from cache")
+			} else if err != nil {
 				log.Error(err, "Failed to delete workload from cache")
 			}
 		})
@@ -320,7 +333,9 @@ func (r *WorkloadReconciler) Update(e event.UpdateEvent) bool {
 	default:
 		// Workload update in the cache is handled here; however, some fields are immutable
 		// and are not supposed to actually change anything.
-		if err := r.cache.UpdateWorkload(oldWl, wlCopy); err != nil {
+		if err := r.cache.UpdateWorkload(oldWl, wlCopy); errors.Is(err, cache.ErrClusterQueueFrozen) {
+			log.V(2).Info("ClusterQueue is frozen; deferred the update of the workload in cache")
+		} else if err != nil {
 			log.Error(err, "Updating workload in cache")
 		}
 	}
@@ -344,6 +359,9 @@ func (r *WorkloadReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	ruh := &resourceUpdatesHandler{
 		r: r,
 	}
+	if err := mgr.Add(manager.RunnableFunc(r.warmUpCache)); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&kueue.Workload{}).
 		Watches(&corev1.LimitRange{}, ruh).
@@ -352,6 +370,29 @@ func (r *WorkloadReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
+// warmUpCache marks the cache warm once it accounts all the admitted
+// workloads, which the reconciler adds as it receives them after the initial
+// list. The workloads are listed again on every check, so that the ones
+// deleted in the meantime don't block the warmup. See
+// cache.WithConservativeWarmup.
+func (r *WorkloadReconciler) warmUpCache(ctx context.Context) error {
+	err := wait.PollUntilContextCancel(ctx, warmupCheckPeriod, true, func(ctx context.Context) (bool, error) {
+		var wls kueue.WorkloadList
+		if err := r.client.List(ctx, &wls); err != nil {
+			r.log.Error(err, "Failed listing the workloads to warm up the cache")
+			return false, nil
+		}
+		return r.cache.AccountsAdmittedWorkloads(wls.Items), nil
+	})
+	if err != nil {
+		// The context is done before the cache is warm.
+		return nil
+	}
+	r.log.V(2).Info("The cache accounts all the admitted workloads")
+	r.cache.MarkWarm()
+	return nil
+}
+
 // admittedNotReadyWorkload returns as pair of values. The first boolean determines
 // if the workload is currently counting towards the timeout for PodsReady, i.e.
 // it has the Admitted condition True and the PodsReady condition not equal
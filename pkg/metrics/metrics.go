@@ -17,6 +17,8 @@ limitations under the License.
 package metrics
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -48,9 +50,18 @@ const (
 	CQStatusTerminating ClusterQueueStatus = "terminating"
 )
 
+var (
+	errAlreadyRegistered = errors.New("the metrics are already registered")
+	errInvalidLabelKey   = errors.New("invalid ClusterQueue label key")
+)
+
 var (
 	CQStatuses = []ClusterQueueStatus{CQStatusPending, CQStatusActive, CQStatusTerminating}
 
+	// registered indicates that Register was called, after which the label
+	// keys of the ClusterQueue metrics can't change.
+	registered bool
+
 	admissionAttemptsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Subsystem: constants.KueueName,
@@ -105,23 +116,130 @@ The label 'result' can have the following values:
 
 	// Metrics tied to the cache.
 
-	AdmittedActiveWorkloads = prometheus.NewGaugeVec(
+	// clusterQueueLabelKeys are the keys of the ClusterQueue labels added as
+	// labels to the metrics of the ClusterQueues. See SetClusterQueueLabelKeys.
+	clusterQueueLabelKeys []string
+
+	AdmittedActiveWorkloads  = newAdmittedActiveWorkloads()
+	ClusterQueueByStatus     = newClusterQueueByStatus()
+	ClusterQueueNominalQuota = newClusterQueueNominalQuota()
+
+	ClusterQueueFlavorUsageRatio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: constants.KueueName,
+			Name:      "cluster_queue_flavor_usage_ratio",
+			Help: `The ratio between the usage and the nominal quota of the dominant resource of a flavor, per 'cluster_queue' and 'flavor'.
+It's observed every time the usage of the flavor changes. Values above 1 mean that the ClusterQueue is borrowing.`,
+			Buckets: []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 5},
+		}, []string{"cluster_queue", "flavor"},
+	)
+)
+
+func newAdmittedActiveWorkloads() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: constants.KueueName,
 			Name:      "admitted_active_workloads",
 			Help:      "The number of admitted Workloads that are active (unsuspended and not finished), per 'cluster_queue'",
-		}, []string{"cluster_queue"},
+		}, clusterQueueLabelNames("cluster_queue"),
 	)
+}
 
-	ClusterQueueByStatus = prometheus.NewGaugeVec(
+func newClusterQueueByStatus() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: constants.KueueName,
 			Name:      "cluster_queue_status",
 			Help: `Reports 'cluster_queue' with its 'status' (with possible values 'pending', 'active' or 'terminated').
 For a ClusterQueue, the metric only reports a value of 1 for one of the statuses.`,
-		}, []string{"cluster_queue", "status"},
+		}, clusterQueueLabelNames("cluster_queue", "status"),
 	)
-)
+}
+
+func newClusterQueueNominalQuota() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: constants.KueueName,
+			Name:      "cluster_queue_nominal_quota",
+			Help:      "The nominal quota, per 'cluster_queue', 'flavor' and 'resource'",
+		}, clusterQueueLabelNames("cluster_queue", "flavor", "resource"),
+	)
+}
+
+// SetClusterQueueLabelKeys sets the keys of the ClusterQueue labels that are
+// added as labels to AdmittedActiveWorkloads, ClusterQueueByStatus and
+// ClusterQueueNominalQuota, so that the metrics can be aggregated, for
+// example, by team. The characters of the keys that aren't valid in a
+// Prometheus label name are replaced by underscores. Only these keys are
+// added, which bounds the cardinality of the metrics.
+// It recreates the metrics, so it fails after Register. It also fails for the
+// keys that map to the same label name, or to the name of another label of the
+// metrics.
+func SetClusterQueueLabelKeys(keys ...string) error {
+	if registered {
+		return errAlreadyRegistered
+	}
+	names := map[string]string{
+		"cluster_queue": "",
+		"status":        "",
+		"flavor":        "",
+		"resource":      "",
+	}
+	for _, k := range keys {
+		if k == "" {
+			return fmt.Errorf("%w: empty key", errInvalidLabelKey)
+		}
+		name := labelName(k)
+		if other, found := names[name]; found {
+			if other == "" {
+				return fmt.Errorf("%w: %q maps to the label %q of the metrics", errInvalidLabelKey, k, name)
+			}
+			return fmt.Errorf("%w: %q and %q map to the same label %q", errInvalidLabelKey, other, k, name)
+		}
+		names[name] = k
+	}
+	clusterQueueLabelKeys = keys
+	AdmittedActiveWorkloads = newAdmittedActiveWorkloads()
+	ClusterQueueByStatus = newClusterQueueByStatus()
+	ClusterQueueNominalQuota = newClusterQueueNominalQuota()
+	return nil
+}
+
+// ClusterQueueLabelKeys returns the keys set with SetClusterQueueLabelKeys.
+func ClusterQueueLabelKeys() []string {
+	return clusterQueueLabelKeys
+}
+
+// clusterQueueLabelNames returns the label names of a ClusterQueue metric
+// followed by the names for the ClusterQueue label keys.
+func clusterQueueLabelNames(names ...string) []string {
+	for _, k := range clusterQueueLabelKeys {
+		names = append(names, labelName(k))
+	}
+	return names
+}
+
+// ClusterQueueLabelValues returns the label values of a ClusterQueue metric
+// followed by the values of the ClusterQueue labels, empty when missing.
+func ClusterQueueLabelValues(cqLabels map[string]string, values ...string) []string {
+	for _, k := range clusterQueueLabelKeys {
+		values = append(values, cqLabels[k])
+	}
+	return values
+}
+
+// labelName replaces the characters that aren't valid in a Prometheus label
+// name by underscores.
+func labelName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		valid := c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || (i > 0 && '0' <= c && c <= '9')
+		if !valid {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
 
 func AdmissionAttempt(result AdmissionResult, duration time.Duration) {
 	admissionAttemptsTotal.WithLabelValues(string(result)).Inc()
@@ -145,24 +263,47 @@ func ClearQueueSystemMetrics(cqName string) {
 	admissionWaitTime.DeleteLabelValues(cqName)
 }
 
-func ReportClusterQueueStatus(cqName string, cqStatus ClusterQueueStatus) {
+func ReportAdmittedActiveWorkloads(cqName string, cqLabels map[string]string, val int) {
+	AdmittedActiveWorkloads.WithLabelValues(ClusterQueueLabelValues(cqLabels, cqName)...).Set(float64(val))
+}
+
+func ReportClusterQueueStatus(cqName string, cqLabels map[string]string, cqStatus ClusterQueueStatus) {
 	for _, status := range CQStatuses {
 		var v float64
 		if status == cqStatus {
 			v = 1
 		}
-		ClusterQueueByStatus.WithLabelValues(cqName, string(status)).Set(v)
+		ClusterQueueByStatus.WithLabelValues(ClusterQueueLabelValues(cqLabels, cqName, string(status))...).Set(v)
 	}
 }
 
+func ReportClusterQueueNominalQuota(cqName string, cqLabels map[string]string, flavor, resource string, value float64) {
+	ClusterQueueNominalQuota.WithLabelValues(ClusterQueueLabelValues(cqLabels, cqName, flavor, resource)...).Set(value)
+}
+
+func ClearClusterQueueNominalQuota(cqName, flavor, resource string) {
+	ClusterQueueNominalQuota.DeletePartialMatch(prometheus.Labels{"cluster_queue": cqName, "flavor": flavor, "resource": resource})
+}
+
+// ClearClusterQueueLabeledMetrics clears the metrics of the ClusterQueue that
+// have its labels, so that they can be reported again when the labels change.
+func ClearClusterQueueLabeledMetrics(cqName string) {
+	AdmittedActiveWorkloads.DeletePartialMatch(prometheus.Labels{"cluster_queue": cqName})
+	ClusterQueueByStatus.DeletePartialMatch(prometheus.Labels{"cluster_queue": cqName})
+	ClusterQueueNominalQuota.DeletePartialMatch(prometheus.Labels{"cluster_queue": cqName})
+}
+
+func ObserveClusterQueueFlavorUsageRatio(cqName, flavor string, ratio float64) {
+	ClusterQueueFlavorUsageRatio.WithLabelValues(cqName, flavor).Observe(ratio)
+}
+
 func ClearCacheMetrics(cqName string) {
-	AdmittedActiveWorkloads.DeleteLabelValues(cqName)
-	for _, status := range CQStatuses {
-		ClusterQueueByStatus.DeleteLabelValues(cqName, string(status))
-	}
+	ClearClusterQueueLabeledMetrics(cqName)
+	ClusterQueueFlavorUsageRatio.DeletePartialMatch(prometheus.Labels{"cluster_queue": cqName})
 }
 
 func Register() {
+	registered = true
 	metrics.Registry.MustRegister(
 		admissionAttemptsTotal,
 		admissionAttemptDuration,
@@ -170,5 +311,7 @@ func Register() {
 		AdmittedActiveWorkloads,
 		AdmittedWorkloadsTotal,
 		admissionWaitTime,
+		ClusterQueueNominalQuota,
+		ClusterQueueFlavorUsageRatio,
 	)
 }
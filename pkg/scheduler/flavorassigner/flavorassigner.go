@@ -42,11 +42,15 @@ type Assignment struct {
 	TotalBorrow cache.FlavorResourceQuantities
 
 	// usedResources is the accumulated usage of resources as pod sets get
-	// flavors assigned.
+	// flavors assigned, counted like in the usage of the ClusterQueue.
 	usage cache.FlavorResourceQuantities
 
 	// representativeMode is the cached representative mode for this assignment.
 	representativeMode *FlavorAssignmentMode
+
+	// preferBorrow ignores the BorrowVsPreemptPreferPreempt policy of the
+	// ClusterQueue. See AssignFlavorsPreferBorrow.
+	preferBorrow bool
 }
 
 func (a *Assignment) Borrows() bool {
@@ -228,22 +232,34 @@ type FlavorAssignment struct {
 // be assigned immediately. Each assigned flavor is accompanied with a
 // FlavorAssignmentMode.
 func AssignFlavors(log logr.Logger, wl *workload.Info, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, cq *cache.ClusterQueue, counts []int32) Assignment {
+	return assignFlavorsForCounts(log, wl, resourceFlavors, cq, counts, false)
+}
+
+// AssignFlavorsPreferBorrow is like AssignFlavors, but it borrows from the
+// cohort even when the ClusterQueue prefers preemption. The scheduler uses it
+// when there are no workloads to preempt.
+func AssignFlavorsPreferBorrow(log logr.Logger, wl *workload.Info, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, cq *cache.ClusterQueue, counts []int32) Assignment {
+	return assignFlavorsForCounts(log, wl, resourceFlavors, cq, counts, true)
+}
+
+func assignFlavorsForCounts(log logr.Logger, wl *workload.Info, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, cq *cache.ClusterQueue, counts []int32, preferBorrow bool) Assignment {
 	if len(counts) == 0 {
-		return assignFlavors(log, wl.TotalRequests, wl.Obj.Spec.PodSets, resourceFlavors, cq)
+		return assignFlavors(log, wl, wl.TotalRequests, wl.Obj.Spec.PodSets, resourceFlavors, cq, preferBorrow)
 	}
 
 	currentResources := make([]workload.PodSetResources, len(wl.TotalRequests))
 	for i := range wl.TotalRequests {
 		currentResources[i] = *wl.TotalRequests[i].ScaledTo(counts[i])
 	}
-	return assignFlavors(log, currentResources, wl.Obj.Spec.PodSets, resourceFlavors, cq)
+	return assignFlavors(log, wl, currentResources, wl.Obj.Spec.PodSets, resourceFlavors, cq, preferBorrow)
 }
 
-func assignFlavors(log logr.Logger, requests []workload.PodSetResources, podSets []kueue.PodSet, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, cq *cache.ClusterQueue) Assignment {
+func assignFlavors(log logr.Logger, wl *workload.Info, requests []workload.PodSetResources, podSets []kueue.PodSet, resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor, cq *cache.ClusterQueue, preferBorrow bool) Assignment {
 	assignment := Assignment{
-		TotalBorrow: make(cache.FlavorResourceQuantities),
-		PodSets:     make([]PodSetAssignment, 0, len(requests)),
-		usage:       make(cache.FlavorResourceQuantities),
+		TotalBorrow:  make(cache.FlavorResourceQuantities),
+		PodSets:      make([]PodSetAssignment, 0, len(requests)),
+		usage:        make(cache.FlavorResourceQuantities),
+		preferBorrow: preferBorrow,
 	}
 	for i, podSet := range requests {
 		if _, found := cq.RGByResource[corev1.ResourcePods]; found {
@@ -257,21 +273,31 @@ func assignFlavors(log logr.Logger, requests []workload.PodSetResources, podSets
 			Count:    podSet.Count,
 		}
 
+		// The resource groups are evaluated in the order of their priority.
+		groups := cq.ResourceGroupsByPriority()
 		for resName := range podSet.Requests {
-			if _, found := psAssignment.Flavors[resName]; found {
-				// This resource got assigned the same flavor as its resource group.
-				// No need to compute again.
+			if _, found := cq.RGByResource[resName]; !found {
+				psAssignment.Flavors = nil
+				psAssignment.Status = &Status{
+					reasons: []string{fmt.Sprintf("resource %s unavailable in ClusterQueue", resName)},
+				}
+				groups = nil
+				break
+			}
+		}
+		for _, rg := range groups {
+			requested := sortedCoveredResources(podSet.Requests, rg)
+			if len(requested) == 0 {
 				continue
 			}
-			rg, found := cq.RGByResource[resName]
-			if !found {
+			if rg.Disabled {
 				psAssignment.Flavors = nil
 				psAssignment.Status = &Status{
-					reasons: []string{fmt.Sprintf("resource %s unavailable in ClusterQueue", resName)},
+					reasons: []string{fmt.Sprintf("resource %s unavailable in ClusterQueue because of a missing flavor", requested[0])},
 				}
 				break
 			}
-			flavors, status := assignment.findFlavorForResourceGroup(log, rg, podSet.Requests, resourceFlavors, cq, &podSets[i].Template.Spec)
+			flavors, status := assignment.findFlavorForResourceGroup(log, wl, rg, podSet.Requests, resourceFlavors, cq, &podSets[i].Template.Spec)
 			if status.IsError() || len(flavors) == 0 {
 				psAssignment.Flavors = nil
 				psAssignment.Status = status
@@ -280,7 +306,7 @@ func assignFlavors(log logr.Logger, requests []workload.PodSetResources, podSets
 			psAssignment.append(flavors, status)
 		}
 
-		assignment.append(podSet.Requests, &psAssignment)
+		assignment.append(podSet.Requests, &psAssignment, cq)
 		if psAssignment.Status.IsError() || (len(podSet.Requests) > 0 && len(psAssignment.Flavors) == 0) {
 			// This assignment failed, no need to continue tracking.
 			assignment.TotalBorrow = nil
@@ -293,6 +319,19 @@ func assignFlavors(log logr.Logger, requests []workload.PodSetResources, podSets
 	return assignment
 }
 
+// sortedCoveredResources returns the sorted names of the requested resources
+// that the resource group covers.
+func sortedCoveredResources(requests workload.Requests, rg *cache.ResourceGroup) []corev1.ResourceName {
+	var covered []corev1.ResourceName
+	for rName := range requests {
+		if rg.CoveredResources.Has(rName) {
+			covered = append(covered, rName)
+		}
+	}
+	sort.Slice(covered, func(i, j int) bool { return covered[i] < covered[j] })
+	return covered
+}
+
 func (psa *PodSetAssignment) append(flavors ResourceAssignment, status *Status) {
 	for resource, assignment := range flavors {
 		psa.Flavors[resource] = assignment
@@ -304,7 +343,7 @@ func (psa *PodSetAssignment) append(flavors ResourceAssignment, status *Status)
 	}
 }
 
-func (a *Assignment) append(requests workload.Requests, psAssignment *PodSetAssignment) {
+func (a *Assignment) append(requests workload.Requests, psAssignment *PodSetAssignment, cq *cache.ClusterQueue) {
 	a.PodSets = append(a.PodSets, *psAssignment)
 	for resource, flvAssignment := range psAssignment.Flavors {
 		if flvAssignment.borrow > 0 {
@@ -318,7 +357,7 @@ func (a *Assignment) append(requests workload.Requests, psAssignment *PodSetAssi
 		if a.usage[flvAssignment.Name] == nil {
 			a.usage[flvAssignment.Name] = make(map[corev1.ResourceName]int64)
 		}
-		a.usage[flvAssignment.Name][resource] += requests[resource]
+		a.usage[flvAssignment.Name][resource] += cq.AccountedRequest(requests[resource])
 	}
 }
 
@@ -326,8 +365,14 @@ func (a *Assignment) append(requests workload.Requests, psAssignment *PodSetAssi
 // request, along with the information about resources that need to be borrowed.
 // If the flavor cannot be immediately assigned, it returns a status with
 // reasons or failure.
+// When the FlavorOverride of the ClusterQueue forces a flavor, only that flavor
+// is considered. The flavors in the AvoidFlavorsAnnotation of the workload, and
+// the exclusive flavors used by another workload, are skipped. When the
+// ClusterQueue has a FlavorAssigner, the flavor that it chooses is evaluated
+// first.
 func (a *Assignment) findFlavorForResourceGroup(
 	log logr.Logger,
+	wl *workload.Info,
 	rg *cache.ResourceGroup,
 	requests workload.Requests,
 	resourceFlavors map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor,
@@ -341,7 +386,36 @@ func (a *Assignment) findFlavorForResourceGroup(
 
 	// We will only check against the flavors' labels for the resource.
 	selector := flavorSelector(spec, rg.LabelKeys)
-	for _, flvQuotas := range rg.Flavors {
+	flavors := rg.Flavors
+	if cq.FlavorOverride != nil {
+		if forced, ok := cq.FlavorOverride(wl, rg); ok {
+			flavors = nil
+			for _, flvQuotas := range rg.Flavors {
+				if flvQuotas.Name == forced {
+					flavors = append(flavors, flvQuotas)
+				}
+			}
+			if len(flavors) == 0 {
+				status.append(fmt.Sprintf("forced flavor %s not in the resource group", forced))
+				return nil, status
+			}
+		}
+	}
+	avoided := cache.AvoidedFlavors(wl)
+	eligible := make([]cache.FlavorQuotas, 0, len(flavors))
+	for _, flvQuotas := range flavors {
+		if avoided.Has(flvQuotas.Name) {
+			status.append(fmt.Sprintf("flavor %s is avoided by the workload", flvQuotas.Name))
+			continue
+		}
+		if holder, held := cq.ExclusiveFlavorHolder(flvQuotas.Name); held && holder != workload.Key(wl.Obj) {
+			status.append(fmt.Sprintf("exclusive flavor %s is used by workload %s", flvQuotas.Name, holder))
+			continue
+		}
+		if _, admitted := cq.Workloads[workload.Key(wl.Obj)]; !admitted && cq.FlavorAtWorkloadsLimit(flvQuotas.Name) {
+			status.append(fmt.Sprintf("flavor %s reached its maximum number of workloads", flvQuotas.Name))
+			continue
+		}
 		flavor, exist := resourceFlavors[flvQuotas.Name]
 		if !exist {
 			log.Error(nil, "Flavor not found", "Flavor", flvQuotas.Name)
@@ -363,14 +437,21 @@ func (a *Assignment) findFlavorForResourceGroup(
 			status.append(fmt.Sprintf("flavor %s doesn't match node affinity", flvQuotas.Name))
 			continue
 		}
+		eligible = append(eligible, flvQuotas)
+	}
+	if cq.FlavorAssigner != nil {
+		eligible = a.preferAssignedFlavor(cq, rg, eligible, requests)
+	}
 
+	for _, flvQuotas := range eligible {
 		assignments := make(ResourceAssignment, len(requests))
 		// Calculate representativeMode for this assignment as the worst mode among all requests.
 		representativeMode := Fit
 		for rName, val := range requests {
 			resQuota := flvQuotas.Resources[rName]
-			// Check considering the flavor usage by previous pod sets.
-			mode, borrow, s := fitsResourceQuota(flvQuotas.Name, rName, val+a.usage[flvQuotas.Name][rName], cq, resQuota)
+			// Check considering the flavor usage by previous pod sets, with the
+			// requests counted like in the usage of the ClusterQueue.
+			mode, borrow, s := fitsResourceQuota(wl, flvQuotas.Name, rName, cq.AccountedRequest(val)+a.usage[flvQuotas.Name][rName], cq, resQuota, !a.preferBorrow && prefersPreemption(cq))
 			if s != nil {
 				status.reasons = append(status.reasons, s.reasons...)
 			}
@@ -401,6 +482,26 @@ func (a *Assignment) findFlavorForResourceGroup(
 	return bestAssignment, status
 }
 
+// preferAssignedFlavor moves the flavor that the FlavorAssigner of the
+// ClusterQueue chooses among the eligible flavors to the front. The assigner
+// only decides the order: the chosen flavor is still subject to all the quota
+// checks, and the other flavors are evaluated after it if it doesn't fit.
+func (a *Assignment) preferAssignedFlavor(cq *cache.ClusterQueue, rg *cache.ResourceGroup, eligible []cache.FlavorQuotas, requests workload.Requests) []cache.FlavorQuotas {
+	candidates := *rg
+	candidates.Flavors = eligible
+	fName, chosen := cq.PreferredFlavor(&candidates, requests, a.usage)
+	if !chosen {
+		return eligible
+	}
+	for i, flvQuotas := range eligible {
+		if flvQuotas.Name == fName {
+			preferred := append([]cache.FlavorQuotas{flvQuotas}, eligible[:i]...)
+			return append(preferred, eligible[i+1:]...)
+		}
+	}
+	return eligible
+}
+
 func flavorSelector(spec *corev1.PodSpec, allowedKeys sets.Set[string]) nodeaffinity.RequiredNodeAffinity {
 	// This function generally replicates the implementation of kube-scheduler's NodeAffintiy
 	// Filter plugin as of v1.24.
@@ -452,41 +553,71 @@ func flavorSelector(spec *corev1.PodSpec, allowedKeys sets.Set[string]) nodeaffi
 // If it fits, also returns any borrowing required.
 // If the flavor doesn't satisfy limits immediately (when waiting or preemption
 // could help), it returns a Status with reasons.
-func fitsResourceQuota(fName kueue.ResourceFlavorReference, rName corev1.ResourceName, val int64, cq *cache.ClusterQueue, rQuota *cache.ResourceQuota) (FlavorAssignmentMode, int64, *Status) {
+func fitsResourceQuota(wl *workload.Info, fName kueue.ResourceFlavorReference, rName corev1.ResourceName, val int64, cq *cache.ClusterQueue, rQuota *cache.ResourceQuota, preferPreemption bool) (FlavorAssignmentMode, int64, *Status) {
+	if cq.IsSystemWorkload(wl) {
+		// System workloads are admitted regardless of the available quota.
+		return Fit, 0, nil
+	}
 	var status Status
-	used := cq.Usage[fName][rName]
+	// The quota reserved for the pending workloads with a higher priority, and
+	// the part of the SystemReservation that the system workloads don't use,
+	// are considered used.
+	reserved := cq.ReservedFor(wl)[fName][rName] + cq.UnusedSystemReservation(fName, rName)
+	used := cq.Usage[fName][rName] + reserved
+	nominal := cq.EffectiveNominal(fName, rName)
 	mode := NoFit
-	if val <= rQuota.Nominal {
+	if !cq.Exceeds(val - nominal) {
 		// The request can be satisfied by the min quota, assuming quota is
 		// reclaimed from the cohort or assuming all active workloads in the
 		// ClusterQueue are preempted.
 		mode = Preempt
 	}
-	if rQuota.BorrowingLimit != nil && used+val > rQuota.Nominal+*rQuota.BorrowingLimit {
+	if borrowingLimit := cq.BorrowingLimit(rQuota); borrowingLimit != nil && cq.Exceeds(used+val-nominal-*borrowingLimit) {
 		status.append(fmt.Sprintf("borrowing limit for %s in flavor %s exceeded", rName, fName))
 		return mode, 0, &status
 	}
 
+	if cq.Cohort != nil && cq.BorrowingPolicy == cache.BorrowingPolicyIdlePeers {
+		if cq.Exceeds(used + val - nominal - cq.Cohort.IdlePeersNominal(fName, rName, cq)) {
+			status.append(fmt.Sprintf("insufficient quota of idle peers in cohort for %s in flavor %s", rName, fName))
+			return mode, 0, &status
+		}
+	}
+
 	cohortUsed := used
-	cohortAvailable := rQuota.Nominal
+	cohortAvailable := nominal
 	if cq.Cohort != nil {
-		cohortUsed = cq.Cohort.Usage[fName][rName]
+		cohortUsed = cq.Cohort.Usage[fName][rName] + reserved
 		cohortAvailable = cq.Cohort.RequestableResources[fName][rName]
 	}
 
 	lack := cohortUsed + val - cohortAvailable
-	if lack <= 0 {
-		borrow := used + val - rQuota.Nominal
-		if borrow < 0 {
+	if !cq.Exceeds(lack) {
+		borrow := used + val - nominal
+		if !cq.Exceeds(borrow) {
 			borrow = 0
 		}
+		if borrow > 0 && !cq.IsWarm() {
+			status.append(fmt.Sprintf("can't borrow %s in flavor %s from cohort %s until the usage of the cache is complete", rName, fName, cq.Cohort.Name))
+			return mode, 0, &status
+		}
+		if borrow > 0 && !cq.BorrowingAllowedFor(wl) {
+			status.append(fmt.Sprintf("workload can't borrow %s in flavor %s from cohort %s", rName, fName, cq.Cohort.Name))
+			return mode, 0, &status
+		}
+		if borrow > 0 && mode == Preempt && preferPreemption {
+			status.append(fmt.Sprintf("ClusterQueue prefers preemption over borrowing for %s in flavor %s", rName, fName))
+			return Preempt, 0, &status
+		}
 		return Fit, borrow, nil
 	}
 
 	lackQuantity := workload.ResourceQuantity(rName, lack)
 	msg := fmt.Sprintf("insufficient unused quota in cohort for %s in flavor %s, %s more needed", rName, fName, &lackQuantity)
 	if cq.Cohort == nil {
-		if mode == NoFit {
+		if rQuota.BorrowOnly() {
+			msg = fmt.Sprintf("borrow-only quota for %s in flavor %s can't be used without a cohort", rName, fName)
+		} else if mode == NoFit {
 			msg = fmt.Sprintf("insufficient quota for %s in flavor %s in ClusterQueue", rName, fName)
 		} else {
 			msg = fmt.Sprintf("insufficient unused quota for %s in flavor %s, %s more needed", rName, fName, &lackQuantity)
@@ -496,6 +627,13 @@ func fitsResourceQuota(fName kueue.ResourceFlavorReference, rName corev1.Resourc
 	return mode, 0, &status
 }
 
+// prefersPreemption returns whether the ClusterQueue prefers to preempt its
+// own workloads rather than borrowing from the cohort.
+func prefersPreemption(cq *cache.ClusterQueue) bool {
+	return cq.BorrowVsPreemptPolicy == cache.BorrowVsPreemptPreferPreempt &&
+		cq.Preemption.WithinClusterQueue != kueue.PreemptionPolicyNever
+}
+
 func filterRequestedResources(req workload.Requests, allowList sets.Set[corev1.ResourceName]) workload.Requests {
 	filtered := make(workload.Requests)
 	for n, v := range req {
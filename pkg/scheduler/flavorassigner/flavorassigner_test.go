@@ -17,6 +17,7 @@ limitations under the License.
 package flavorassigner
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -40,10 +41,12 @@ func TestAssignFlavors(t *testing.T) {
 		"default": {
 			ObjectMeta: metav1.ObjectMeta{Name: "default"},
 		},
-		"one":   utiltesting.MakeResourceFlavor("one").Label("type", "one").Obj(),
-		"two":   utiltesting.MakeResourceFlavor("two").Label("type", "two").Obj(),
-		"b_one": utiltesting.MakeResourceFlavor("b_one").Label("b_type", "one").Obj(),
-		"b_two": utiltesting.MakeResourceFlavor("b_two").Label("b_type", "two").Obj(),
+		"one":       utiltesting.MakeResourceFlavor("one").Label("type", "one").Obj(),
+		"two":       utiltesting.MakeResourceFlavor("two").Label("type", "two").Obj(),
+		"b_one":     utiltesting.MakeResourceFlavor("b_one").Label("b_type", "one").Obj(),
+		"b_two":     utiltesting.MakeResourceFlavor("b_two").Label("b_type", "two").Obj(),
+		"spot":      utiltesting.MakeResourceFlavor("spot").Obj(),
+		"on-demand": utiltesting.MakeResourceFlavor("on-demand").Obj(),
 		"tainted": utiltesting.MakeResourceFlavor("tainted").
 			Taint(corev1.Taint{
 				Key:    "instance",
@@ -55,9 +58,13 @@ func TestAssignFlavors(t *testing.T) {
 	cases := map[string]struct {
 		wlPods            []kueue.PodSet
 		wlReclaimablePods []kueue.ReclaimablePod
+		wlAnnotations     map[string]string
+		wlLabels          map[string]string
 		clusterQueue      cache.ClusterQueue
 		wantRepMode       FlavorAssignmentMode
 		wantAssignment    Assignment
+		// preferBorrow assigns the flavors with AssignFlavorsPreferBorrow.
+		preferBorrow bool
 	}{
 		"single flavor, fits": {
 			wlPods: []kueue.PodSet{
@@ -1010,70 +1017,783 @@ func TestAssignFlavors(t *testing.T) {
 				}},
 			},
 		},
+		"borrow-only flavor fits by borrowing": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "3").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 0, BorrowingLimit: pointer.Int64(4_000)},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 1_000},
+					},
+				},
+			},
+			wantRepMode: Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("3000m"),
+					},
+					Count: 1,
+				}},
+				TotalBorrow: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 4_000},
+				},
+			},
+		},
+		"borrow-only flavor past its borrowing limit": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "4").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 0, BorrowingLimit: pointer.Int64(4_000)},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 1_000},
+					},
+				},
+			},
+			wantRepMode: NoFit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("4000m"),
+					},
+					Status: &Status{
+						reasons: []string{"borrowing limit for cpu in flavor one exceeded"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past the default borrowing limit": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "4").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				DefaultBorrowingLimit: pointer.Int64(2_000),
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 2_000},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 1_000},
+					},
+				},
+			},
+			wantRepMode: NoFit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("4000m"),
+					},
+					Status: &Status{
+						reasons: []string{"borrowing limit for cpu in flavor one exceeded"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"borrow-only flavor without cohort": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "1").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 0, BorrowingLimit: pointer.Int64(4_000)},
+						},
+					}},
+				}},
+			},
+			wantRepMode: NoFit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("1000m"),
+					},
+					Status: &Status{
+						reasons: []string{"borrow-only quota for cpu in flavor one can't be used without a cohort"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"resource group with a missing flavor is disabled": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "1").
+					Request(corev1.ResourceMemory, "1Mi").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				FlavorUnavailablePolicy: cache.FlavorUnavailableDisableGroupOnly,
+				ResourceGroups: []cache.ResourceGroup{
+					{
+						CoveredResources: sets.New(corev1.ResourceCPU),
+						Flavors: []cache.FlavorQuotas{{
+							Name: "one",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4000},
+							},
+						}},
+					},
+					{
+						CoveredResources: sets.New(corev1.ResourceMemory),
+						Flavors: []cache.FlavorQuotas{{
+							Name: "missing",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceMemory: {Nominal: utiltesting.Mi},
+							},
+						}},
+					},
+				},
+			},
+			wantRepMode: NoFit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    resource.MustParse("1000m"),
+						corev1.ResourceMemory: resource.MustParse("1Mi"),
+					},
+					Status: &Status{
+						reasons: []string{"resource memory unavailable in ClusterQueue because of a missing flavor"},
+					},
+					Count: 1,
+				}},
+			},
+		},
 		"past max, but can preempt in ClusterQueue": {
 			wlPods: []kueue.PodSet{
 				*utiltesting.MakePodSet("main", 1).
-					Request(corev1.ResourceCPU, "2").
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 2000, BorrowingLimit: pointer.Int64(8_000)},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 9_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 100_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 9_000},
+					},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+
+					Status: &Status{
+						reasons: []string{"borrowing limit for cpu in flavor one exceeded"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past min, but can preempt in ClusterQueue": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 2000},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"insufficient unused quota for cpu in flavor one, 1 more needed"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past min, but can preempt in cohort and ClusterQueue": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 3000},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 2_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"insufficient unused quota in cohort for cpu in flavor one, 2 more needed"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past min, prefers borrowing over preemption": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 3_000},
+						},
+					}},
+				}},
+				BorrowVsPreemptPolicy: cache.BorrowVsPreemptPreferBorrow,
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 2_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 2_000},
+					},
+				},
+			},
+			wantRepMode: Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Count: 1,
+				}},
+				TotalBorrow: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+			},
+		},
+		"past min, prefers preemption over borrowing": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 3_000},
+						},
+					}},
+				}},
+				BorrowVsPreemptPolicy: cache.BorrowVsPreemptPreferPreempt,
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 2_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 2_000},
+					},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"ClusterQueue prefers preemption over borrowing for cpu in flavor one"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past min, prefers preemption over borrowing, assigned preferring borrowing": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 3_000},
+						},
+					}},
+				}},
+				BorrowVsPreemptPolicy: cache.BorrowVsPreemptPreferPreempt,
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 2_000},
+				},
+				Cohort: &cache.Cohort{
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 2_000},
+					},
+				},
+			},
+			preferBorrow: true,
+			wantRepMode:  Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Count: 1,
+				}},
+				TotalBorrow: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 1_000},
+				},
+			},
+		},
+		"flavor forced by override": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{
+						{
+							Name: "one",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+						{
+							Name: "two",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+					},
+				}},
+				FlavorOverride: func(*workload.Info, *cache.ResourceGroup) (kueue.ResourceFlavorReference, bool) {
+					return "two", true
+				},
+			},
+			wantRepMode: Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "two", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"flavor forced by override without capacity": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{
+						{
+							Name: "one",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+						{
+							Name: "two",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 1_000},
+							},
+						},
+					},
+				}},
+				FlavorOverride: func(*workload.Info, *cache.ResourceGroup) (kueue.ResourceFlavorReference, bool) {
+					return "two", true
+				},
+			},
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"insufficient quota for cpu in flavor two in ClusterQueue"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"past min, borrowing restricted to another cohort": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			wlAnnotations: map[string]string{cache.BorrowingCohortAnnotation: "other"},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "one",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 3_000},
+						},
+					}},
+				}},
+				Usage: cache.FlavorResourceQuantities{
+					"one": {corev1.ResourceCPU: 2_000},
+				},
+				Cohort: &cache.Cohort{
+					Name: "team",
+					RequestableResources: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 10_000},
+					},
+					Usage: cache.FlavorResourceQuantities{
+						"one": {corev1.ResourceCPU: 2_000},
+					},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"workload can't borrow cpu in flavor one from cohort team"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"avoided flavor is skipped": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			wlAnnotations: map[string]string{cache.AvoidFlavorsAnnotation: "spot"},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{
+						{
+							Name: "spot",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+						{
+							Name: "on-demand",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+					},
+				}},
+			},
+			wantRepMode: Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "on-demand", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"regular workload doesn't fit in the system reservation": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "3").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "default",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 4_000},
+						},
+					}},
+				}},
+				SystemWorkloadLabel: "system",
+				SystemReservation: cache.FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 2_000},
+				},
+				Usage: cache.FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 0},
+				},
+			},
+			wantRepMode: Preempt,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "default", Mode: Preempt},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("3000m"),
+					},
+					Status: &Status{
+						reasons: []string{"insufficient unused quota for cpu in flavor default, 1 more needed"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"system workload fits regardless of the quota": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "3").
 					Obj(),
 			},
+			wlLabels: map[string]string{"system": "true"},
 			clusterQueue: cache.ClusterQueue{
 				ResourceGroups: []cache.ResourceGroup{{
 					CoveredResources: sets.New(corev1.ResourceCPU),
 					Flavors: []cache.FlavorQuotas{{
-						Name: "one",
+						Name: "default",
 						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
-							corev1.ResourceCPU: {Nominal: 2000, BorrowingLimit: pointer.Int64(8_000)},
+							corev1.ResourceCPU: {Nominal: 4_000},
 						},
 					}},
 				}},
+				SystemWorkloadLabel: "system",
+				SystemReservation: cache.FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 2_000},
+				},
 				Usage: cache.FlavorResourceQuantities{
-					"one": {corev1.ResourceCPU: 9_000},
+					"default": {corev1.ResourceCPU: 3_000},
 				},
-				Cohort: &cache.Cohort{
-					RequestableResources: cache.FlavorResourceQuantities{
-						"one": {corev1.ResourceCPU: 100_000},
+			},
+			wantRepMode: Fit,
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Flavors: ResourceAssignment{
+						corev1.ResourceCPU: {Name: "default", Mode: Fit},
 					},
-					Usage: cache.FlavorResourceQuantities{
-						"one": {corev1.ResourceCPU: 9_000},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("3000m"),
 					},
+					Count: 1,
+				}},
+			},
+		},
+		"overshoot within the usage epsilon fits": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "1001m").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "default",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 2_000},
+						},
+					}},
+				}},
+				UsageEpsilon: 1,
+				Usage: cache.FlavorResourceQuantities{
+					"default": {corev1.ResourceCPU: 1_000},
 				},
 			},
-			wantRepMode: Preempt,
+			wantRepMode: Fit,
 			wantAssignment: Assignment{
 				PodSets: []PodSetAssignment{{
 					Name: "main",
 					Flavors: ResourceAssignment{
-						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+						corev1.ResourceCPU: {Name: "default", Mode: Fit},
 					},
 					Requests: corev1.ResourceList{
-						corev1.ResourceCPU: resource.MustParse("2000m"),
-					},
-
-					Status: &Status{
-						reasons: []string{"borrowing limit for cpu in flavor one exceeded"},
+						corev1.ResourceCPU: resource.MustParse("1001m"),
 					},
 					Count: 1,
 				}},
 			},
 		},
-		"past min, but can preempt in ClusterQueue": {
+		"overshoot over the usage epsilon doesn't fit": {
 			wlPods: []kueue.PodSet{
 				*utiltesting.MakePodSet("main", 1).
-					Request(corev1.ResourceCPU, "2").
+					Request(corev1.ResourceCPU, "1002m").
 					Obj(),
 			},
 			clusterQueue: cache.ClusterQueue{
 				ResourceGroups: []cache.ResourceGroup{{
 					CoveredResources: sets.New(corev1.ResourceCPU),
 					Flavors: []cache.FlavorQuotas{{
-						Name: "one",
+						Name: "default",
 						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
-							corev1.ResourceCPU: {Nominal: 2000},
+							corev1.ResourceCPU: {Nominal: 2_000},
 						},
 					}},
 				}},
+				UsageEpsilon: 1,
 				Usage: cache.FlavorResourceQuantities{
-					"one": {corev1.ResourceCPU: 1_000},
+					"default": {corev1.ResourceCPU: 1_000},
 				},
 			},
 			wantRepMode: Preempt,
@@ -1081,58 +1801,166 @@ func TestAssignFlavors(t *testing.T) {
 				PodSets: []PodSetAssignment{{
 					Name: "main",
 					Flavors: ResourceAssignment{
-						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+						corev1.ResourceCPU: {Name: "default", Mode: Preempt},
 					},
 					Requests: corev1.ResourceList{
-						corev1.ResourceCPU: resource.MustParse("2000m"),
+						corev1.ResourceCPU: resource.MustParse("1002m"),
 					},
 					Status: &Status{
-						reasons: []string{"insufficient unused quota for cpu in flavor one, 1 more needed"},
+						reasons: []string{"insufficient unused quota for cpu in flavor default, 2m more needed"},
 					},
 					Count: 1,
 				}},
 			},
 		},
-		"past min, but can preempt in cohort and ClusterQueue": {
+		"doesn't fit in the nominal quota scaled down by pressure": {
 			wlPods: []kueue.PodSet{
 				*utiltesting.MakePodSet("main", 1).
-					Request(corev1.ResourceCPU, "2").
+					Request(corev1.ResourceCPU, "3").
 					Obj(),
 			},
 			clusterQueue: cache.ClusterQueue{
 				ResourceGroups: []cache.ResourceGroup{{
 					CoveredResources: sets.New(corev1.ResourceCPU),
 					Flavors: []cache.FlavorQuotas{{
-						Name: "one",
+						Name: "default",
 						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
-							corev1.ResourceCPU: {Nominal: 3000},
+							corev1.ResourceCPU: {Nominal: 4_000},
 						},
 					}},
 				}},
+				PressureProvider: func() float64 { return 1 },
 				Usage: cache.FlavorResourceQuantities{
-					"one": {corev1.ResourceCPU: 2_000},
+					"default": {corev1.ResourceCPU: 0},
 				},
-				Cohort: &cache.Cohort{
-					RequestableResources: cache.FlavorResourceQuantities{
-						"one": {corev1.ResourceCPU: 10_000},
+			},
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("3000m"),
 					},
-					Usage: cache.FlavorResourceQuantities{
-						"one": {corev1.ResourceCPU: 10_000},
+					Status: &Status{
+						reasons: []string{"insufficient quota for cpu in flavor default in ClusterQueue"},
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"exclusive flavor used by another workload": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{
+						{
+							Name:      "spot",
+							Exclusive: true,
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
+						{
+							Name: "on-demand",
+							Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+								corev1.ResourceCPU: {Nominal: 4_000},
+							},
+						},
 					},
+				}},
+				Workloads: map[string]*workload.Info{
+					"/holder": workload.NewInfo(utiltesting.MakeWorkload("holder", "").
+						Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).
+						Obj()),
+				},
+				Usage: cache.FlavorResourceQuantities{
+					"spot":      {corev1.ResourceCPU: 1_000},
+					"on-demand": {corev1.ResourceCPU: 0},
 				},
 			},
-			wantRepMode: Preempt,
+			wantRepMode: Fit,
 			wantAssignment: Assignment{
 				PodSets: []PodSetAssignment{{
 					Name: "main",
 					Flavors: ResourceAssignment{
-						corev1.ResourceCPU: {Name: "one", Mode: Preempt},
+						corev1.ResourceCPU: {Name: "on-demand", Mode: Fit},
+					},
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Count: 1,
+				}},
+			},
+		},
+		"only exclusive flavor is used by another workload": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name:      "spot",
+						Exclusive: true,
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 4_000},
+						},
+					}},
+				}},
+				Workloads: map[string]*workload.Info{
+					"/holder": workload.NewInfo(utiltesting.MakeWorkload("holder", "").
+						Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).
+						Obj()),
+				},
+				Usage: cache.FlavorResourceQuantities{
+					"spot": {corev1.ResourceCPU: 1_000},
+				},
+			},
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU: resource.MustParse("2000m"),
+					},
+					Status: &Status{
+						reasons: []string{"exclusive flavor spot is used by workload /holder"},
 					},
+					Count: 1,
+				}},
+			},
+		},
+		"only avoided flavor has capacity": {
+			wlPods: []kueue.PodSet{
+				*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Obj(),
+			},
+			wlAnnotations: map[string]string{cache.AvoidFlavorsAnnotation: "spot"},
+			clusterQueue: cache.ClusterQueue{
+				ResourceGroups: []cache.ResourceGroup{{
+					CoveredResources: sets.New(corev1.ResourceCPU),
+					Flavors: []cache.FlavorQuotas{{
+						Name: "spot",
+						Resources: map[corev1.ResourceName]*cache.ResourceQuota{
+							corev1.ResourceCPU: {Nominal: 4_000},
+						},
+					}},
+				}},
+			},
+			wantAssignment: Assignment{
+				PodSets: []PodSetAssignment{{
+					Name: "main",
 					Requests: corev1.ResourceList{
 						corev1.ResourceCPU: resource.MustParse("2000m"),
 					},
 					Status: &Status{
-						reasons: []string{"insufficient unused quota in cohort for cpu in flavor one, 2 more needed"},
+						reasons: []string{"flavor spot is avoided by the workload"},
 					},
 					Count: 1,
 				}},
@@ -1447,6 +2275,10 @@ func TestAssignFlavors(t *testing.T) {
 				Verbosity: 2,
 			})
 			wlInfo := workload.NewInfo(&kueue.Workload{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tc.wlAnnotations,
+					Labels:      tc.wlLabels,
+				},
 				Spec: kueue.WorkloadSpec{
 					PodSets: tc.wlPods,
 				},
@@ -1456,7 +2288,12 @@ func TestAssignFlavors(t *testing.T) {
 			})
 			tc.clusterQueue.UpdateWithFlavors(resourceFlavors)
 			tc.clusterQueue.UpdateRGByResource()
-			assignment := AssignFlavors(log, wlInfo, resourceFlavors, &tc.clusterQueue, nil)
+			tc.clusterQueue.SamplePressure()
+			assign := AssignFlavors
+			if tc.preferBorrow {
+				assign = AssignFlavorsPreferBorrow
+			}
+			assignment := assign(log, wlInfo, resourceFlavors, &tc.clusterQueue, nil)
 			if repMode := assignment.RepresentativeMode(); repMode != tc.wantRepMode {
 				t.Errorf("e.assignFlavors(_).RepresentativeMode()=%s, want %s", repMode, tc.wantRepMode)
 			}
@@ -1467,3 +2304,286 @@ func TestAssignFlavors(t *testing.T) {
 		})
 	}
 }
+
+func TestAssignFlavorsAtWorkloadsLimit(t *testing.T) {
+	ctx := context.Background()
+	cqCache := cache.New(utiltesting.NewFakeClient())
+	resourceFlavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"spot":      utiltesting.MakeResourceFlavor("spot").Obj(),
+		"on-demand": utiltesting.MakeResourceFlavor("on-demand").Obj(),
+	}
+	for _, rf := range resourceFlavors {
+		cqCache.AddOrUpdateResourceFlavor(rf)
+	}
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("spot").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("on-demand").Resource(corev1.ResourceCPU, "10").Obj(),
+		).
+		Obj()
+	if err := cqCache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	admitted := utiltesting.MakeWorkload("admitted", "").
+		Admit(utiltesting.MakeAdmission("cq").Assignment(corev1.ResourceCPU, "spot", "1").Obj()).
+		Obj()
+	if !cqCache.AddOrUpdateWorkload(admitted) {
+		t.Fatalf("Failed adding the admitted workload")
+	}
+	snapshot := cqCache.Snapshot()
+	cqSnapshot := snapshot.ClusterQueues["cq"]
+	maxWorkloads := 1
+	cqSnapshot.ResourceGroups[0].Flavors[0].MaxWorkloads = &maxWorkloads
+
+	log := testr.NewWithOptions(t, testr.Options{Verbosity: 2})
+	wlInfo := workload.NewInfo(utiltesting.MakeWorkload("pending", "").
+		PodSets(*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "1").Obj()).
+		Obj())
+	assignment := AssignFlavors(log, wlInfo, resourceFlavors, cqSnapshot, nil)
+	wantAssignment := Assignment{
+		PodSets: []PodSetAssignment{{
+			Name: "main",
+			Flavors: ResourceAssignment{
+				corev1.ResourceCPU: {Name: "on-demand", Mode: Fit},
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("1000m"),
+			},
+			Count: 1,
+		}},
+	}
+	if diff := cmp.Diff(wantAssignment, assignment, cmpopts.IgnoreUnexported(Assignment{}, FlavorAssignment{})); diff != "" {
+		t.Errorf("Unexpected assignment (-want,+got):\n%s", diff)
+	}
+}
+
+// tightestFitAssigner chooses the flavor that fits the requests with the least
+// remaining nominal quota.
+type tightestFitAssigner struct{}
+
+func (tightestFitAssigner) Assign(rg *cache.ResourceGroup, requests workload.Requests, usage cache.FlavorResourceQuantities) cache.FlavorResourceQuantities {
+	var best *cache.FlavorQuotas
+	var bestRemaining int64
+	for i := range rg.Flavors {
+		flvQuotas := &rg.Flavors[i]
+		if !cache.FlavorFits(flvQuotas, requests, usage) {
+			continue
+		}
+		var remaining int64
+		for rName, v := range requests {
+			remaining += flvQuotas.Resources[rName].Nominal - usage[flvQuotas.Name][rName] - v
+		}
+		if best == nil || remaining < bestRemaining {
+			best, bestRemaining = flvQuotas, remaining
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return cache.AssignedQuantities(best, requests)
+}
+
+func TestAssignFlavorsWithFlavorAssigner(t *testing.T) {
+	ctx := context.Background()
+	cqCache := cache.New(utiltesting.NewFakeClient())
+	resourceFlavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"big":   utiltesting.MakeResourceFlavor("big").Obj(),
+		"small": utiltesting.MakeResourceFlavor("small").Obj(),
+	}
+	for _, rf := range resourceFlavors {
+		cqCache.AddOrUpdateResourceFlavor(rf)
+	}
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(
+			*utiltesting.MakeFlavorQuotas("big").Resource(corev1.ResourceCPU, "10").Obj(),
+			*utiltesting.MakeFlavorQuotas("small").Resource(corev1.ResourceCPU, "3").Obj(),
+		).
+		Obj()
+	if err := cqCache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	log := testr.NewWithOptions(t, testr.Options{Verbosity: 2})
+
+	cases := map[string]struct {
+		assigner   cache.FlavorAssigner
+		podSets    []kueue.PodSet
+		wantFlavor []kueue.ResourceFlavorReference
+	}{
+		"first fit without an assigner": {
+			podSets:    []kueue.PodSet{*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "2").Obj()},
+			wantFlavor: []kueue.ResourceFlavorReference{"big"},
+		},
+		"tightest fit": {
+			assigner:   tightestFitAssigner{},
+			podSets:    []kueue.PodSet{*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "2").Obj()},
+			wantFlavor: []kueue.ResourceFlavorReference{"small"},
+		},
+		"tightest fit considers the previous pod sets": {
+			assigner: tightestFitAssigner{},
+			podSets: []kueue.PodSet{
+				*utiltesting.MakePodSet("driver", 1).Request(corev1.ResourceCPU, "2").Obj(),
+				*utiltesting.MakePodSet("workers", 1).Request(corev1.ResourceCPU, "2").Obj(),
+			},
+			wantFlavor: []kueue.ResourceFlavorReference{"small", "big"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			snapshot := cqCache.Snapshot()
+			cqSnapshot := snapshot.ClusterQueues["cq"]
+			cqSnapshot.FlavorAssigner = tc.assigner
+			wlInfo := workload.NewInfo(utiltesting.MakeWorkload("wl", "").PodSets(tc.podSets...).Obj())
+			assignment := AssignFlavors(log, wlInfo, resourceFlavors, cqSnapshot, nil)
+			if repMode := assignment.RepresentativeMode(); repMode != Fit {
+				t.Fatalf("Got mode %s, want %s", repMode, Fit)
+			}
+			var gotFlavor []kueue.ResourceFlavorReference
+			for _, psa := range assignment.PodSets {
+				gotFlavor = append(gotFlavor, psa.Flavors[corev1.ResourceCPU].Name)
+			}
+			if diff := cmp.Diff(tc.wantFlavor, gotFlavor); diff != "" {
+				t.Errorf("Unexpected flavors (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAssignFlavorsResourceGroupPriority(t *testing.T) {
+	ctx := context.Background()
+	resourceFlavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"x86":  utiltesting.MakeResourceFlavor("x86").Obj(),
+		"a100": utiltesting.MakeResourceFlavor("a100").Obj(),
+	}
+	cases := map[string]struct {
+		settings    string
+		wantMessage string
+	}{
+		"groups in the order of the spec": {
+			wantMessage: "couldn't assign flavors to pod set main: insufficient quota for cpu in flavor x86 in ClusterQueue",
+		},
+		"higher priority group evaluated first": {
+			settings:    `{"resourceGroups":[{"coveredResources":["example.com/gpu"],"priority":10}]}`,
+			wantMessage: "couldn't assign flavors to pod set main: insufficient quota for example.com/gpu in flavor a100 in ClusterQueue",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cqCache := cache.New(utiltesting.NewFakeClient())
+			for _, rf := range resourceFlavors {
+				cqCache.AddOrUpdateResourceFlavor(rf)
+			}
+			cq := utiltesting.MakeClusterQueue("cq").
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("x86").Resource(corev1.ResourceCPU, "1").Obj()).
+				ResourceGroup(*utiltesting.MakeFlavorQuotas("a100").Resource("example.com/gpu", "1").Obj())
+			if tc.settings != "" {
+				cq.Annotation(cache.ResourceGroupSettingsAnnotation, tc.settings)
+			}
+			if err := cqCache.AddClusterQueue(ctx, cq.Obj()); err != nil {
+				t.Fatalf("Failed adding ClusterQueue: %v", err)
+			}
+			log := testr.NewWithOptions(t, testr.Options{Verbosity: 2})
+			wlInfo := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+				PodSets(*utiltesting.MakePodSet("main", 1).
+					Request(corev1.ResourceCPU, "2").
+					Request("example.com/gpu", "2").
+					Obj()).
+				Obj())
+			snapshot := cqCache.Snapshot()
+			assignment := AssignFlavors(log, wlInfo, resourceFlavors, snapshot.ClusterQueues["cq"], nil)
+			// Only the first group that doesn't fit is evaluated.
+			if diff := cmp.Diff(tc.wantMessage, assignment.Message()); diff != "" {
+				t.Errorf("Unexpected message (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAssignFlavorsSafetyMargin(t *testing.T) {
+	ctx := context.Background()
+	cqCache := cache.New(utiltesting.NewFakeClient(), cache.WithSafetyMargin(0.1))
+	resourceFlavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"default": utiltesting.MakeResourceFlavor("default").Obj(),
+	}
+	cqCache.AddOrUpdateResourceFlavor(resourceFlavors["default"])
+	cq := utiltesting.MakeClusterQueue("cq").
+		ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "10").Obj()).
+		Obj()
+	if err := cqCache.AddClusterQueue(ctx, cq); err != nil {
+		t.Fatalf("Failed adding ClusterQueue: %v", err)
+	}
+	log := testr.NewWithOptions(t, testr.Options{Verbosity: 2})
+	snapshot := cqCache.Snapshot()
+
+	cases := map[string]struct {
+		podSets  []kueue.PodSet
+		wantMode FlavorAssignmentMode
+	}{
+		"request equal to the nominal quota": {
+			podSets:  []kueue.PodSet{*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "10").Obj()},
+			wantMode: NoFit,
+		},
+		"request within the nominal quota once inflated": {
+			podSets:  []kueue.PodSet{*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "9").Obj()},
+			wantMode: Fit,
+		},
+		"pod sets exceeding the nominal quota once inflated": {
+			podSets: []kueue.PodSet{
+				*utiltesting.MakePodSet("driver", 1).Request(corev1.ResourceCPU, "5").Obj(),
+				*utiltesting.MakePodSet("workers", 1).Request(corev1.ResourceCPU, "5").Obj(),
+			},
+			wantMode: NoFit,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			wlInfo := workload.NewInfo(utiltesting.MakeWorkload("wl", "").PodSets(tc.podSets...).Obj())
+			assignment := AssignFlavors(log, wlInfo, resourceFlavors, snapshot.ClusterQueues["cq"], nil)
+			if repMode := assignment.RepresentativeMode(); repMode != tc.wantMode {
+				t.Errorf("Got mode %s, want %s", repMode, tc.wantMode)
+			}
+		})
+	}
+}
+
+func TestAssignFlavorsConservativeWarmup(t *testing.T) {
+	ctx := context.Background()
+	cqCache := cache.New(utiltesting.NewFakeClient(), cache.WithConservativeWarmup(true))
+	resourceFlavors := map[kueue.ResourceFlavorReference]*kueue.ResourceFlavor{
+		"default": utiltesting.MakeResourceFlavor("default").Obj(),
+	}
+	cqCache.AddOrUpdateResourceFlavor(resourceFlavors["default"])
+	for _, cq := range []*kueue.ClusterQueue{
+		utiltesting.MakeClusterQueue("a").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+			Cohort("one").
+			Obj(),
+		utiltesting.MakeClusterQueue("b").
+			ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+			Cohort("one").
+			Obj(),
+	} {
+		if err := cqCache.AddClusterQueue(ctx, cq); err != nil {
+			t.Fatalf("Failed adding ClusterQueue %q: %v", cq.Name, err)
+		}
+	}
+	log := testr.NewWithOptions(t, testr.Options{Verbosity: 2})
+	wlInfo := workload.NewInfo(utiltesting.MakeWorkload("wl", "").
+		PodSets(*utiltesting.MakePodSet("main", 1).Request(corev1.ResourceCPU, "3").Obj()).
+		Obj())
+
+	snapshot := cqCache.Snapshot()
+	assignment := AssignFlavors(log, wlInfo, resourceFlavors, snapshot.ClusterQueues["a"], nil)
+	if repMode := assignment.RepresentativeMode(); repMode != NoFit {
+		t.Errorf("Got mode %s before the warmup, want %s", repMode, NoFit)
+	}
+
+	cqCache.MarkWarm()
+	snapshot = cqCache.Snapshot()
+	assignment = AssignFlavors(log, wlInfo, resourceFlavors, snapshot.ClusterQueues["a"], nil)
+	if repMode := assignment.RepresentativeMode(); repMode != Fit {
+		t.Errorf("Got mode %s after the warmup, want %s", repMode, Fit)
+	}
+	if !assignment.Borrows() {
+		t.Errorf("The assignment doesn't borrow after the warmup")
+	}
+}
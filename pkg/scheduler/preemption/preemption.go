@@ -78,11 +78,18 @@ func (p *Preemptor) GetTargets(wl workload.Info, assignment flavorassigner.Assig
 	resPerFlv := resourcesRequiringPreemption(assignment)
 	cq := snapshot.ClusterQueues[wl.ClusterQueue]
 
-	candidates := findCandidates(wl.Obj, cq, resPerFlv)
+	now := time.Now()
+	candidates := findCandidates(wl.Obj, cq, resPerFlv, now)
 	if len(candidates) == 0 {
 		return nil
 	}
-	sort.Slice(candidates, candidatesOrdering(candidates, cq.Name, time.Now()))
+	scores := make(map[*workload.Info]float64, len(candidates))
+	for _, candidate := range candidates {
+		if candidateCQ := snapshot.ClusterQueues[candidate.ClusterQueue]; candidateCQ != nil {
+			scores[candidate] = candidateCQ.PreemptionScore(candidate)
+		}
+	}
+	sort.Slice(candidates, candidatesOrdering(candidates, cq.Name, now, scores))
 
 	sameQueueCandidates := candidatesOnlyFromQueue(candidates, wl.ClusterQueue)
 	var targets []*workload.Info
@@ -113,7 +120,7 @@ func (p *Preemptor) GetTargets(wl workload.Info, assignment flavorassigner.Assig
 }
 
 // IssuePreemptions marks the target workloads as evicted.
-func (p *Preemptor) IssuePreemptions(ctx context.Context, targets []*workload.Info, cq *cache.ClusterQueue) (int, error) {
+func (p *Preemptor) IssuePreemptions(ctx context.Context, targets []*workload.Info, cq cache.ClusterQueueView) (int, error) {
 	log := ctrl.LoggerFrom(ctx)
 	errCh := routine.NewErrorChannel()
 	ctx, cancel := context.WithCancel(ctx)
@@ -129,7 +136,7 @@ func (p *Preemptor) IssuePreemptions(ctx context.Context, targets []*workload.In
 			}
 
 			origin := "ClusterQueue"
-			if cq.Name != target.ClusterQueue {
+			if cq.GetName() != target.ClusterQueue {
 				origin = "cohort"
 			}
 			log.V(3).Info("Preempted", "targetWorkload", klog.KObj(target.Obj))
@@ -222,52 +229,29 @@ func resourcesRequiringPreemption(assignment flavorassigner.Assignment) resource
 // findCandidates obtains candidates for preemption within the ClusterQueue and
 // cohort that respect the preemption policy and are using a resource that the
 // preempting workload needs.
-func findCandidates(wl *kueue.Workload, cq *cache.ClusterQueue, resPerFlv resourcesPerFlavor) []*workload.Info {
+func findCandidates(wl *kueue.Workload, cq *cache.ClusterQueue, resPerFlv resourcesPerFlavor, now time.Time) []*workload.Info {
 	var candidates []*workload.Info
-	wlPriority := priority.Priority(wl)
-
-	if cq.Preemption.WithinClusterQueue != kueue.PreemptionPolicyNever {
-		considerSamePrio := (cq.Preemption.WithinClusterQueue == kueue.PreemptionPolicyLowerOrNewerEqualPriority)
-		preemptorTS := workload.GetQueueOrderTimestamp(wl)
-
-		for _, candidateWl := range cq.Workloads {
-			candidatePriority := priority.Priority(candidateWl.Obj)
-			if candidatePriority > wlPriority {
-				continue
-			}
 
-			if candidatePriority == wlPriority && !(considerSamePrio && preemptorTS.Before(workload.GetQueueOrderTimestamp(candidateWl.Obj))) {
-				continue
-			}
-
-			if !workloadUsesResources(candidateWl, resPerFlv) {
-				continue
-			}
-			candidates = append(candidates, candidateWl)
+	for _, candidateWl := range cq.PreemptionCandidates(wl, now) {
+		if !workloadUsesResources(candidateWl, resPerFlv) {
+			continue
 		}
+		candidates = append(candidates, candidateWl)
 	}
 
-	if cq.Cohort != nil && cq.Preemption.ReclaimWithinCohort != kueue.PreemptionPolicyNever {
-		cqs := cq.Cohort.Members
-		cqs.Delete(cq)
-		for cohortCQ := range cqs {
-			if !cqIsBorrowing(cohortCQ, resPerFlv) {
-				// Can't reclaim quota from ClusterQueues that are not borrowing.
-				continue
+	if cq.Cohort != nil {
+		// Can't reclaim quota from ClusterQueues that are not borrowing.
+		borrowing := sets.New[string]()
+		for cohortCQ := range cq.Cohort.Members {
+			if cohortCQ != cq && cqIsBorrowing(cohortCQ, resPerFlv) {
+				borrowing.Insert(cohortCQ.Name)
 			}
-			onlyLowerPrio := true
-			if cq.Preemption.ReclaimWithinCohort == kueue.PreemptionPolicyAny {
-				onlyLowerPrio = false
-			}
-			for _, candidateWl := range cohortCQ.Workloads {
-				if onlyLowerPrio && priority.Priority(candidateWl.Obj) >= priority.Priority(wl) {
-					continue
-				}
-				if !workloadUsesResources(candidateWl, resPerFlv) {
-					continue
-				}
-				candidates = append(candidates, candidateWl)
+		}
+		for _, candidateWl := range cq.Cohort.ReclaimCandidates(wl, cq, now) {
+			if !borrowing.Has(candidateWl.ClusterQueue) || !workloadUsesResources(candidateWl, resPerFlv) {
+				continue
 			}
+			candidates = append(candidates, candidateWl)
 		}
 	}
 	return candidates
@@ -336,8 +320,8 @@ func workloadFits(wlReq cache.FlavorResourceQuantities, cq *cache.ClusterQueue,
 			}
 			for rName, rReq := range flvReq {
 				limit := flvQuotas.Resources[rName].Nominal
-				if flvQuotas.Resources[rName].BorrowingLimit != nil && allowBorrowing {
-					limit += *flvQuotas.Resources[rName].BorrowingLimit
+				if borrowingLimit := cq.BorrowingLimit(flvQuotas.Resources[rName]); borrowingLimit != nil && allowBorrowing {
+					limit += *borrowingLimit
 				}
 				if cqResUsage[rName]+rReq > limit {
 					return false
@@ -355,8 +339,9 @@ func workloadFits(wlReq cache.FlavorResourceQuantities, cq *cache.ClusterQueue,
 // 1. Workloads from other ClusterQueues in the cohort before the ones in the
 // same ClusterQueue as the preemptor.
 // 2. Workloads with lower priority first.
-// 3. Workloads admited more recently first.
-func candidatesOrdering(candidates []*workload.Info, cq string, now time.Time) func(int, int) bool {
+// 3. Workloads with a higher PreemptionScore, in their ClusterQueue, first.
+// 4. Workloads admited more recently first.
+func candidatesOrdering(candidates []*workload.Info, cq string, now time.Time, scores map[*workload.Info]float64) func(int, int) bool {
 	return func(i, j int) bool {
 		a := candidates[i]
 		b := candidates[j]
@@ -370,6 +355,9 @@ func candidatesOrdering(candidates []*workload.Info, cq string, now time.Time) f
 		if pa != pb {
 			return pa < pb
 		}
+		if sa, sb := scores[a], scores[b]; sa != sb {
+			return sa > sb
+		}
 		return admisionTime(b.Obj, now).Before(admisionTime(a.Obj, now))
 	}
 }
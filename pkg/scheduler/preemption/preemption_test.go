@@ -35,6 +35,7 @@ import (
 	"sigs.k8s.io/kueue/pkg/cache"
 	"sigs.k8s.io/kueue/pkg/constants"
 	"sigs.k8s.io/kueue/pkg/scheduler/flavorassigner"
+	"sigs.k8s.io/kueue/pkg/util/pointer"
 	utiltesting "sigs.k8s.io/kueue/pkg/util/testing"
 	"sigs.k8s.io/kueue/pkg/workload"
 )
@@ -115,6 +116,9 @@ func TestPreemption(t *testing.T) {
 		targetCQ      string
 		assignment    flavorassigner.Assignment
 		wantPreempted sets.Set[string]
+		// thresholds are the PreemptionPriorityThreshold of the resource
+		// groups, by ClusterQueue.
+		thresholds map[string]int32
 	}{
 		"preempt lowest priority": {
 			admitted: []kueue.Workload{
@@ -349,6 +353,96 @@ func TestPreemption(t *testing.T) {
 			}),
 			wantPreempted: sets.New("/c2-mid"),
 		},
+		"workloads above the preemption priority threshold are protected": {
+			admitted: []kueue.Workload{
+				*utiltesting.MakeWorkload("low", "").
+					Priority(-1).
+					Request(corev1.ResourceCPU, "2").
+					Admit(utiltesting.MakeAdmission("standalone").Assignment(corev1.ResourceCPU, "default", "2000m").Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("mid", "").
+					Request(corev1.ResourceCPU, "2").
+					Admit(utiltesting.MakeAdmission("standalone").Assignment(corev1.ResourceCPU, "default", "2000m").Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("high", "").
+					Priority(1).
+					Request(corev1.ResourceCPU, "2").
+					Admit(utiltesting.MakeAdmission("standalone").Assignment(corev1.ResourceCPU, "default", "2000m").Obj()).
+					Obj(),
+			},
+			incoming: utiltesting.MakeWorkload("in", "").
+				Priority(1).
+				Request(corev1.ResourceCPU, "2").
+				Obj(),
+			targetCQ: "standalone",
+			assignment: singlePodSetAssignment(flavorassigner.ResourceAssignment{
+				corev1.ResourceCPU: &flavorassigner.FlavorAssignment{
+					Name: "default",
+					Mode: flavorassigner.Preempt,
+				},
+			}),
+			thresholds: map[string]int32{"standalone": -2},
+		},
+		"borrowing workloads above the preemption priority threshold are protected": {
+			admitted: []kueue.Workload{
+				*utiltesting.MakeWorkload("c1-low", "").
+					Priority(-1).
+					Request(corev1.ResourceCPU, "3").
+					Admit(utiltesting.MakeAdmission("c1").Assignment(corev1.ResourceCPU, "default", "3000m").Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("c2-mid", "").
+					Request(corev1.ResourceCPU, "3").
+					Admit(utiltesting.MakeAdmission("c2").Assignment(corev1.ResourceCPU, "default", "3000m").Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("c2-high", "").
+					Priority(1).
+					Request(corev1.ResourceCPU, "6").
+					Admit(utiltesting.MakeAdmission("c2").Assignment(corev1.ResourceCPU, "default", "6000m").Obj()).
+					Obj(),
+			},
+			incoming: utiltesting.MakeWorkload("in", "").
+				Priority(1).
+				Request(corev1.ResourceCPU, "3").
+				Obj(),
+			targetCQ: "c1",
+			assignment: singlePodSetAssignment(flavorassigner.ResourceAssignment{
+				corev1.ResourceCPU: &flavorassigner.FlavorAssignment{
+					Name: "default",
+					Mode: flavorassigner.Preempt,
+				},
+			}),
+			thresholds:    map[string]int32{"c2": -1},
+			wantPreempted: sets.New("/c1-low"),
+		},
+		"preempt the workload with the highest preemption score": {
+			admitted: []kueue.Workload{
+				*utiltesting.MakeWorkload("big", "").
+					Request(corev1.ResourceCPU, "4").
+					Admit(utiltesting.MakeAdmission("standalone").Assignment(corev1.ResourceCPU, "default", "4000m").Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("small", "").
+					Request(corev1.ResourceCPU, "1").
+					Admit(utiltesting.MakeAdmission("standalone").Assignment(corev1.ResourceCPU, "default", "1000m").Obj()).
+					SetOrReplaceCondition(metav1.Condition{
+						Type:               kueue.WorkloadAdmitted,
+						Status:             metav1.ConditionTrue,
+						LastTransitionTime: metav1.NewTime(time.Now().Add(time.Second)),
+					}).
+					Obj(),
+			},
+			incoming: utiltesting.MakeWorkload("in", "").
+				Priority(1).
+				Request(corev1.ResourceCPU, "2").
+				Obj(),
+			targetCQ: "standalone",
+			assignment: singlePodSetAssignment(flavorassigner.ResourceAssignment{
+				corev1.ResourceCPU: &flavorassigner.FlavorAssignment{
+					Name: "default",
+					Mode: flavorassigner.Preempt,
+				},
+			}),
+			wantPreempted: sets.New("/big"),
+		},
 		"no workloads borrowing": {
 			admitted: []kueue.Workload{
 				*utiltesting.MakeWorkload("c1-high", "").
@@ -772,6 +866,12 @@ func TestPreemption(t *testing.T) {
 			}
 
 			snapshot := cqCache.Snapshot()
+			for cqName, threshold := range tc.thresholds {
+				cq := snapshot.ClusterQueues[cqName]
+				for i := range cq.ResourceGroups {
+					cq.ResourceGroups[i].PreemptionPriorityThreshold = pointer.Int32(threshold)
+				}
+			}
 			wlInfo := workload.NewInfo(tc.incoming)
 			wlInfo.ClusterQueue = tc.targetCQ
 			targets := preemptor.GetTargets(*wlInfo, tc.assignment, &snapshot)
@@ -817,7 +917,7 @@ func TestCandidatesOrdering(t *testing.T) {
 			}).
 			Obj()),
 	}
-	sort.Slice(candidates, candidatesOrdering(candidates, "self", now))
+	sort.Slice(candidates, candidatesOrdering(candidates, "self", now, nil))
 	gotNames := make([]string, len(candidates))
 	for i, c := range candidates {
 		gotNames[i] = workload.Key(c.Obj)
@@ -239,6 +239,7 @@ type entry struct {
 func (s *Scheduler) nominate(ctx context.Context, workloads []workload.Info, snap cache.Snapshot) []entry {
 	log := ctrl.LoggerFrom(ctx)
 	entries := make([]entry, 0, len(workloads))
+	now := time.Now()
 	for _, w := range workloads {
 		log := log.WithValues("workload", klog.KObj(w.Obj), "clusterQueue", klog.KRef("", w.ClusterQueue))
 		cq := snap.ClusterQueues[w.ClusterQueue]
@@ -256,10 +257,17 @@ func (s *Scheduler) nominate(ctx context.Context, workloads []workload.Info, sna
 		} else if !cq.NamespaceSelector.Matches(labels.Set(ns.Labels)) {
 			e.inadmissibleMsg = "Workload namespace doesn't match ClusterQueue selector"
 			e.requeueReason = queue.RequeueReasonNamespaceMismatch
+		} else if err := cq.CheckNamespaceForResourceGroups(&w, ns.Labels); err != nil {
+			e.inadmissibleMsg = err.Error()
+			e.requeueReason = queue.RequeueReasonNamespaceMismatch
 		} else if err := s.validateResources(&w); err != nil {
 			e.inadmissibleMsg = err.Error()
 		} else if err := s.validateLimitRange(ctx, &w); err != nil {
 			e.inadmissibleMsg = err.Error()
+		} else if err := cache.CheckAdmissionDeadline(&w, now); err != nil {
+			e.inadmissibleMsg = err.Error()
+		} else if err := cq.RunAdmissionGates(&w); err != nil {
+			e.inadmissibleMsg = fmt.Sprintf("Workload rejected by an admission gate: %v", err)
 		} else {
 			e.assignment, e.preemptionTargets = s.getAssignments(log, &e.Info, &snap)
 			e.inadmissibleMsg = e.assignment.Message()
@@ -286,6 +294,12 @@ func (s *Scheduler) getAssignments(log logr.Logger, wl *workload.Info, snap *cac
 
 	if arm == flavorassigner.Preempt {
 		fullAssignmentTargets = s.preemptor.GetTargets(*wl, fullAssignment, snap)
+		if len(fullAssignmentTargets) == 0 && cq.BorrowVsPreemptPolicy == cache.BorrowVsPreemptPreferPreempt {
+			// There is nothing to preempt, fall back to borrowing.
+			if assignment := flavorassigner.AssignFlavorsPreferBorrow(log, wl, snap.ResourceFlavors, cq, nil); assignment.RepresentativeMode() == flavorassigner.Fit {
+				return assignment, nil
+			}
+		}
 	}
 
 	// if the feature gate is not enabled or we can preempt
@@ -194,6 +194,13 @@ func TestSchedule(t *testing.T) {
 
 		// enable partial admission
 		enablePartialAdmission bool
+
+		// cacheOptions are the options of the cache.
+		cacheOptions []cache.Option
+
+		// reservations are the pending workloads, by ClusterQueue, whose
+		// requests are reserved in the cache.
+		reservations map[string][]*kueue.Workload
 	}{
 		"workload fits in single clusterQueue": {
 			workloads: []kueue.Workload{
@@ -286,6 +293,123 @@ func TestSchedule(t *testing.T) {
 				"eng-alpha": sets.New("sales/new"),
 			},
 		},
+		"workload past its admission deadline": {
+			workloads: []kueue.Workload{
+				*utiltesting.MakeWorkload("late", "sales").
+					Queue("main").
+					Annotation(cache.AdmissionDeadlineAnnotation, time.Now().Add(-time.Hour).Format(time.RFC3339)).
+					PodSets(*utiltesting.MakePodSet("one", 1).
+						Request(corev1.ResourceCPU, "1").
+						Obj()).
+					Obj(),
+			},
+			wantLeft: map[string]sets.Set[string]{
+				"sales": sets.New("sales/late"),
+			},
+		},
+		"workload rejected by an admission gate": {
+			workloads: []kueue.Workload{
+				*utiltesting.MakeWorkload("unlabeled", "sales").
+					Queue("main").
+					PodSets(*utiltesting.MakePodSet("one", 1).
+						Request(corev1.ResourceCPU, "1").
+						Obj()).
+					Obj(),
+				*utiltesting.MakeWorkload("labeled", "eng-alpha").
+					Queue("main").
+					Label("team", "ml").
+					PodSets(*utiltesting.MakePodSet("one", 1).
+						Request(corev1.ResourceCPU, "1").
+						Obj()).
+					Obj(),
+			},
+			cacheOptions: []cache.Option{cache.WithAdmissionGates(
+				func(wi *workload.Info, _ cache.ClusterQueueView) error {
+					if _, ok := wi.Obj.Labels["team"]; !ok {
+						return errors.New("missing team label")
+					}
+					return nil
+				},
+			)},
+			wantAssignments: map[string]kueue.Admission{
+				"eng-alpha/labeled": {
+					ClusterQueue: "eng-alpha",
+					PodSetAssignments: []kueue.PodSetAssignment{
+						{
+							Name: "one",
+							Flavors: map[corev1.ResourceName]kueue.ResourceFlavorReference{
+								corev1.ResourceCPU: "on-demand",
+							},
+							ResourceUsage: corev1.ResourceList{
+								corev1.ResourceCPU: resource.MustParse("1000m"),
+							},
+							Count: pointer.Int32(1),
+						},
+					},
+				},
+			},
+			wantScheduled: []string{"eng-alpha/labeled"},
+			wantLeft: map[string]sets.Set[string]{
+				"sales": sets.New("sales/unlabeled"),
+			},
+		},
+		"quota reserved for a pending workload with a higher priority": {
+			workloads: []kueue.Workload{
+				*utiltesting.MakeWorkload("low", "sales").
+					Queue("main").
+					PodSets(*utiltesting.MakePodSet("one", 1).
+						Request(corev1.ResourceCPU, "20").
+						Obj()).
+					Obj(),
+			},
+			reservations: map[string][]*kueue.Workload{
+				"sales": {
+					utiltesting.MakeWorkload("high", "sales").
+						Priority(100).
+						Admit(utiltesting.MakeAdmission("sales").Assignment(corev1.ResourceCPU, "default", "40").Obj()).
+						Obj(),
+				},
+			},
+			wantLeft: map[string]sets.Set[string]{
+				"sales": sets.New("sales/low"),
+			},
+		},
+		"quota reserved for a pending workload with a lower priority": {
+			workloads: []kueue.Workload{
+				*utiltesting.MakeWorkload("high", "sales").
+					Queue("main").
+					Priority(100).
+					PodSets(*utiltesting.MakePodSet("one", 1).
+						Request(corev1.ResourceCPU, "20").
+						Obj()).
+					Obj(),
+			},
+			reservations: map[string][]*kueue.Workload{
+				"sales": {
+					utiltesting.MakeWorkload("low", "sales").
+						Admit(utiltesting.MakeAdmission("sales").Assignment(corev1.ResourceCPU, "default", "40").Obj()).
+						Obj(),
+				},
+			},
+			wantAssignments: map[string]kueue.Admission{
+				"sales/high": {
+					ClusterQueue: "sales",
+					PodSetAssignments: []kueue.PodSetAssignment{
+						{
+							Name: "one",
+							Flavors: map[corev1.ResourceName]kueue.ResourceFlavorReference{
+								corev1.ResourceCPU: "default",
+							},
+							ResourceUsage: corev1.ResourceList{
+								corev1.ResourceCPU: resource.MustParse("20000m"),
+							},
+							Count: pointer.Int32(1),
+						},
+					},
+				},
+			},
+			wantScheduled: []string{"sales/high"},
+		},
 		"admit in different cohorts": {
 			workloads: []kueue.Workload{
 				*utiltesting.MakeWorkload("new", "sales").
@@ -872,7 +996,7 @@ func TestSchedule(t *testing.T) {
 			broadcaster := record.NewBroadcaster()
 			recorder := broadcaster.NewRecorder(scheme,
 				corev1.EventSource{Component: constants.AdmissionName})
-			cqCache := cache.New(cl)
+			cqCache := cache.New(cl, tc.cacheOptions...)
 			qManager := queue.NewManager(cl, cqCache)
 			// Workloads are loaded into queues or clusterQueues as we add them.
 			for _, q := range allQueues {
@@ -891,6 +1015,15 @@ func TestSchedule(t *testing.T) {
 					t.Fatalf("Inserting clusterQueue %s in manager: %v", cq.Name, err)
 				}
 			}
+			for cqName, wls := range tc.reservations {
+				wis := make([]*workload.Info, len(wls))
+				for i, wl := range wls {
+					wis[i] = workload.NewInfo(wl)
+				}
+				if err := cqCache.ReserveForPending(cqName, wis); err != nil {
+					t.Fatalf("Reserving quota in clusterQueue %s: %v", cqName, err)
+				}
+			}
 			scheduler := New(qManager, cqCache, cl, recorder)
 			gotScheduled := make(map[string]kueue.Admission)
 			var mu sync.Mutex
@@ -968,6 +1101,76 @@ func TestSchedule(t *testing.T) {
 	}
 }
 
+func TestGetAssignmentsPreferPreempt(t *testing.T) {
+	cases := map[string]struct {
+		incomingPriority int32
+		wantMode         flavorassigner.FlavorAssignmentMode
+		wantTargets      []string
+	}{
+		"borrows when there is nothing to preempt": {
+			wantMode: flavorassigner.Fit,
+		},
+		"preempts instead of borrowing": {
+			incomingPriority: 1,
+			wantMode:         flavorassigner.Preempt,
+			wantTargets:      []string{"/running"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, log := utiltesting.ContextWithLog(t)
+			cl := utiltesting.NewClientBuilder().
+				WithLists(&kueue.WorkloadList{Items: []kueue.Workload{
+					*utiltesting.MakeWorkload("running", "").
+						Request(corev1.ResourceCPU, "1").
+						Admit(utiltesting.MakeAdmission("a").Assignment(corev1.ResourceCPU, "default", "1").Obj()).
+						Obj(),
+				}}).
+				Build()
+			cqCache := cache.New(cl)
+			cqCache.AddOrUpdateResourceFlavor(utiltesting.MakeResourceFlavor("default").Obj())
+			for _, cq := range []*kueue.ClusterQueue{
+				utiltesting.MakeClusterQueue("a").
+					Cohort("one").
+					Preemption(kueue.ClusterQueuePreemption{
+						WithinClusterQueue: kueue.PreemptionPolicyLowerPriority,
+					}).
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "2").Obj()).
+					Obj(),
+				utiltesting.MakeClusterQueue("b").
+					Cohort("one").
+					ResourceGroup(*utiltesting.MakeFlavorQuotas("default").Resource(corev1.ResourceCPU, "4").Obj()).
+					Obj(),
+			} {
+				if err := cqCache.AddClusterQueue(ctx, cq); err != nil {
+					t.Fatalf("Inserting clusterQueue %s in cache: %v", cq.Name, err)
+				}
+			}
+			recorder := record.NewBroadcaster().NewRecorder(runtime.NewScheme(), corev1.EventSource{Component: constants.AdmissionName})
+			scheduler := New(queue.NewManager(cl, cqCache), cqCache, cl, recorder)
+			snapshot := cqCache.Snapshot()
+			snapshot.ClusterQueues["a"].BorrowVsPreemptPolicy = cache.BorrowVsPreemptPreferPreempt
+
+			wi := workload.NewInfo(utiltesting.MakeWorkload("incoming", "").
+				Priority(tc.incomingPriority).
+				Request(corev1.ResourceCPU, "2").
+				Obj())
+			wi.ClusterQueue = "a"
+			assignment, targets := scheduler.getAssignments(log, wi, &snapshot)
+			if mode := assignment.RepresentativeMode(); mode != tc.wantMode {
+				t.Errorf("Got mode %s, want %s", mode, tc.wantMode)
+			}
+			gotTargets := make([]string, len(targets))
+			for i, target := range targets {
+				gotTargets[i] = workload.Key(target.Obj)
+			}
+			if diff := cmp.Diff(tc.wantTargets, gotTargets, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Unexpected preemption targets (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestEntryOrdering(t *testing.T) {
 	now := time.Now()
 	input := []entry{
@@ -26,6 +26,7 @@ func Quantity(q resource.Quantity) *resource.Quantity {
 }
 
 var (
+	Int    = pointer.Int
 	Int32  = pointer.Int32
 	Int64  = pointer.Int64
 	Bool   = pointer.Bool
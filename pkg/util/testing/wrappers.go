@@ -109,6 +109,24 @@ func (w *WorkloadWrapper) Admit(a *kueue.Admission) *WorkloadWrapper {
 	return w
 }
 
+// Label sets a label of the workload.
+func (w *WorkloadWrapper) Label(k, v string) *WorkloadWrapper {
+	if w.Labels == nil {
+		w.Labels = make(map[string]string)
+	}
+	w.Labels[k] = v
+	return w
+}
+
+// Annotation sets an annotation of the workload.
+func (w *WorkloadWrapper) Annotation(k, v string) *WorkloadWrapper {
+	if w.Annotations == nil {
+		w.Annotations = make(map[string]string)
+	}
+	w.Annotations[k] = v
+	return w
+}
+
 func (w *WorkloadWrapper) Creation(t time.Time) *WorkloadWrapper {
 	w.CreationTimestamp = metav1.NewTime(t)
 	return w
@@ -217,6 +235,11 @@ func (p *PodSetWrapper) InitContainers(containers ...corev1.Container) *PodSetWr
 	return p
 }
 
+func (p *PodSetWrapper) Overhead(resources corev1.ResourceList) *PodSetWrapper {
+	p.Template.Spec.Overhead = resources
+	return p
+}
+
 func (p *PodSetWrapper) NodeSelector(kv map[string]string) *PodSetWrapper {
 	p.Template.Spec.NodeSelector = kv
 	return p
@@ -377,6 +400,15 @@ func (c *ClusterQueueWrapper) Preemption(p kueue.ClusterQueuePreemption) *Cluste
 	return c
 }
 
+// Annotation sets an annotation of the ClusterQueue.
+func (c *ClusterQueueWrapper) Annotation(k, v string) *ClusterQueueWrapper {
+	if c.Annotations == nil {
+		c.Annotations = make(map[string]string)
+	}
+	c.Annotations[k] = v
+	return c
+}
+
 // FlavorQuotasWrapper wraps a FlavorQuotas object.
 type FlavorQuotasWrapper struct{ kueue.FlavorQuotas }
 
@@ -84,6 +84,60 @@ func TestNewInfo(t *testing.T) {
 				},
 			},
 		},
+		"pending with init containers and overhead": {
+			workload: *utiltesting.MakeWorkload("", "").
+				PodSets(
+					*utiltesting.MakePodSet("main", 2).
+						Containers(
+							corev1.Container{
+								Name: "c1",
+								Resources: corev1.ResourceRequirements{
+									Requests: corev1.ResourceList{
+										corev1.ResourceCPU:    resource.MustParse("1"),
+										corev1.ResourceMemory: resource.MustParse("1Gi"),
+									},
+								},
+							},
+							corev1.Container{
+								Name: "c2",
+								Resources: corev1.ResourceRequirements{
+									Requests: corev1.ResourceList{
+										corev1.ResourceCPU: resource.MustParse("1"),
+									},
+								},
+							},
+						).
+						InitContainers(
+							corev1.Container{
+								Name: "init",
+								Resources: corev1.ResourceRequirements{
+									Requests: corev1.ResourceList{
+										corev1.ResourceCPU:    resource.MustParse("4"),
+										corev1.ResourceMemory: resource.MustParse("512Mi"),
+									},
+								},
+							},
+						).
+						Overhead(corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("100m"),
+							corev1.ResourceMemory: resource.MustParse("64Mi"),
+						}).
+						Obj(),
+				).
+				Obj(),
+			wantInfo: Info{
+				TotalRequests: []PodSetResources{
+					{
+						Name: "main",
+						Requests: Requests{
+							corev1.ResourceCPU:    2 * 4_100,
+							corev1.ResourceMemory: 2 * (1024 + 64) * 1024 * 1024,
+						},
+						Count: 2,
+					},
+				},
+			},
+		},
 		"admitted": {
 			workload: *utiltesting.MakeWorkload("", "").
 				PodSets(
@@ -245,7 +245,7 @@ func ExpectPendingWorkloadsMetric(cq *kueue.ClusterQueue, active, inadmissible i
 }
 
 func ExpectAdmittedActiveWorkloadsMetric(cq *kueue.ClusterQueue, v int) {
-	metric := metrics.AdmittedActiveWorkloads.WithLabelValues(cq.Name)
+	metric := metrics.AdmittedActiveWorkloads.WithLabelValues(metrics.ClusterQueueLabelValues(cq.Labels, cq.Name)...)
 	gomega.EventuallyWithOffset(1, func() int {
 		v, err := testutil.GetGaugeMetricValue(metric)
 		gomega.Expect(err).ToNot(gomega.HaveOccurred())
@@ -268,7 +268,7 @@ func ExpectClusterQueueStatusMetric(cq *kueue.ClusterQueue, status metrics.Clust
 		if metrics.CQStatuses[i] == status {
 			wantV = 1
 		}
-		metric := metrics.ClusterQueueByStatus.WithLabelValues(cq.Name, string(s))
+		metric := metrics.ClusterQueueByStatus.WithLabelValues(metrics.ClusterQueueLabelValues(cq.Labels, cq.Name, string(s))...)
 		gomega.EventuallyWithOffset(1, func() float64 {
 			v, err := testutil.GetGaugeMetricValue(metric)
 			gomega.Expect(err).ToNot(gomega.HaveOccurred())